@@ -10,6 +10,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/yourname/raw-cacher-go/internal/cache"
 	"github.com/yourname/raw-cacher-go/internal/config"
 	"github.com/yourname/raw-cacher-go/internal/server"
 	"github.com/yourname/raw-cacher-go/internal/storage"
@@ -21,16 +22,112 @@ func main() {
 		log.Fatalf("config error: %v", err)
 	}
 
-	ctx := context.Background()
-	store, err := storage.NewStore(ctx, cfg.MinioEndpoint, cfg.MinioAccess, cfg.MinioSecret, cfg.MinioBucket)
+	cache.MaxKeyLength = cfg.MaxKeyLength
+
+	ctx, cancelBg := context.WithCancel(context.Background())
+	defer cancelBg()
+	store, err := storage.Connect(ctx, cfg.MinioEndpoint, cfg.MinioAccess, cfg.MinioSecret, cfg.MinioBucket,
+		cfg.StorageConnectAttempts, time.Duration(cfg.StorageConnectBackoffMS)*time.Millisecond)
 	if err != nil {
 		log.Fatalf("minio error: %v", err)
 	}
+	store.MetaMaxBytes = cfg.MetaMaxBytes
+	store.QuarantineMeta = cfg.QuarantineMeta
+	store.RecreateBucket = cfg.RecreateBucket
+	store.SlowDownRetries = cfg.StorageSlowDownRetries
+	store.SlowDownBackoff = time.Duration(cfg.StorageSlowDownBackoffMS) * time.Millisecond
+	if cfg.VerifyWrites {
+		enableWriteVerification(ctx, cfg.MinioEndpoint, store)
+	}
+
+	var backend storage.Backend = store
+	if len(cfg.MinioReplicas) > 0 {
+		var replicas []storage.Backend
+		for _, ep := range cfg.MinioReplicas {
+			rs, err := storage.Connect(ctx, ep, cfg.MinioAccess, cfg.MinioSecret, cfg.MinioBucket,
+				cfg.StorageConnectAttempts, time.Duration(cfg.StorageConnectBackoffMS)*time.Millisecond)
+			if err != nil {
+				log.Fatalf("minio replica %s error: %v", ep, err)
+			}
+			rs.MetaMaxBytes = cfg.MetaMaxBytes
+			rs.SlowDownRetries = store.SlowDownRetries
+			rs.SlowDownBackoff = store.SlowDownBackoff
+			if cfg.VerifyWrites {
+				enableWriteVerification(ctx, ep, rs)
+			}
+			replicas = append(replicas, rs)
+		}
+		rep := storage.NewReplicatedStore(store, replicas...)
+		rep.RoundRobin = cfg.ReplicaRoundRobin
+		backend = rep
+	}
+	if cfg.DiskCacheDir != "" {
+		disk, err := storage.NewFSStore(cfg.DiskCacheDir)
+		if err != nil {
+			log.Fatalf("disk_cache_dir: %v", err)
+		}
+		disk.MetaMaxBytes = cfg.MetaMaxBytes
+		tiered, err := storage.NewTieredStore(ctx, backend, disk, cfg.DiskCacheBytes)
+		if err != nil {
+			log.Fatalf("disk_cache_dir: %v", err)
+		}
+		backend = tiered
+	}
+	if cfg.CompressAtRest != "" {
+		comp, err := storage.NewCompressor(cfg.CompressAtRest, cfg.CompressAtRestLevel)
+		if err != nil {
+			log.Fatalf("compress_at_rest: %v", err)
+		}
+		if cfg.CompressAtRestDict != "" {
+			dict, err := os.ReadFile(cfg.CompressAtRestDict)
+			if err != nil {
+				log.Fatalf("compress_at_rest_dict: %v", err)
+			}
+			if comp, err = storage.NewZstdDictCompressor(dict, cfg.CompressAtRestLevel); err != nil {
+				log.Fatalf("compress_at_rest_dict: %v", err)
+			}
+		}
+		cs := storage.NewCompressStore(backend, comp)
+		cs.MaxDecompressed = cfg.MaxDecompressedBytes
+		if err := cs.StoreDict(ctx); err != nil {
+			log.Fatalf("compress_at_rest_dict: %v", err)
+		}
+		backend = cs
+	}
+	if cfg.Dedup {
+		backend = storage.NewDedupStore(backend)
+	}
+	var hot *storage.HotStore
+	if cfg.HotCacheBytes > 0 {
+		hot = storage.NewHotStore(backend, cfg.HotCacheBytes, cfg.HotCacheMaxObject)
+		backend = hot
+		if cfg.HotCacheWarm {
+			go func() {
+				n, err := hot.Warm(ctx)
+				if err != nil {
+					log.Printf("hot cache: warm-up stopped after %d objects: %v", n, err)
+					return
+				}
+				log.Printf("hot cache: warmed %d objects", n)
+			}()
+		}
+	}
 
 	mux := http.NewServeMux()
 
-	srv := server.NewServer(store, cfg.TTLDefault, cfg.TTL404, cfg.ServeIf)
-	mux.Handle("/", srv)
+	srv := server.NewServer(backend, cfg)
+	srv.Loader = config.Load
+	if p, ok := storage.PresignerOf(backend); ok {
+		srv.Presigner = p
+	} else if cfg.PresignRedirectMinBytes > 0 {
+		log.Printf("presign_redirect_min_bytes: compress_at_rest and dedup change stored bodies, redirects are off")
+	}
+	if cfg.MetricsMaxDomains > 0 {
+		srv.Stats = metrics.NewDomainStats(cfg.MetricsMaxDomains)
+		mux.Handle("/metrics", srv.Stats.Handler())
+	}
+	mux.Handle("/", srv.AccessLog(srv.LimitClients(srv)))
+	mux.Handle("/admin/", srv.AdminHandler())
 
 	httpSrv := &http.Server{
 		Addr:         cfg.ListenAddr,
@@ -42,6 +139,25 @@ func main() {
 	health := &metrics.HealthHandler{Store: store}
 	mux.Handle("/healthz", health.HealthCheckHandler())
 
+	if cfg.ReconcileInterval > 0 {
+		go srv.RunReconciler(ctx, time.Duration(cfg.ReconcileInterval)*time.Second)
+	}
+
+	if cfg.ScrubInterval > 0 {
+		go srv.RunScrubber(ctx, time.Duration(cfg.ScrubInterval)*time.Second, cfg.ScrubRate)
+	}
+	srv.StartRevalidator(ctx, cfg.RevalidateWorkers, cfg.RevalidateQueue)
+	if cfg.MaxObjectsPerDomain > 0 {
+		go func() {
+			n, err := srv.BuildQuotaIndex(ctx)
+			if err != nil {
+				log.Printf("quota: index incomplete after %d entries: %v", n, err)
+				return
+			}
+			log.Printf("quota: indexed %d entries", n)
+		}()
+	}
+
 	go func() {
 		log.Printf("raw-cacher-go listening on %s", cfg.ListenAddr)
 		if err := httpSrv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
@@ -52,9 +168,32 @@ func main() {
 	stop := make(chan os.Signal, 1)
 	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
 	<-stop
+	cancelBg()
 
 	ctxShutdown, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 	defer cancel()
 	_ = httpSrv.Shutdown(ctxShutdown)
+	srv.Drain()
+	if hot != nil && cfg.HotCacheWarm {
+		ctxSave, cancelSave := context.WithTimeout(context.Background(), 10*time.Second)
+		if n, err := hot.SaveIndex(ctxSave); err != nil {
+			log.Printf("hot cache: saving index: %v", err)
+		} else {
+			log.Printf("hot cache: saved %d keys", n)
+		}
+		cancelSave()
+	}
 	log.Println("server stopped")
 }
+
+// enableWriteVerification turns on verify_writes for one store, or logs why
+// it stays off.
+func enableWriteVerification(ctx context.Context, endpoint string, st *storage.Store) {
+	on, err := st.EnableWriteVerification(ctx)
+	switch {
+	case err != nil:
+		log.Printf("verify_writes: probing %s failed, not verifying writes: %v", endpoint, err)
+	case !on:
+		log.Printf("verify_writes: %s ETags aren't body MD5s (encrypted bucket?), not verifying writes", endpoint)
+	}
+}
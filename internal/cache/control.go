@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// CacheControl holds the response directives relevant to a shared cache.
+// Numeric fields are -1 when the directive is absent.
+type CacheControl struct {
+	MaxAge  int
+	SMaxAge int
+	Private bool
+	NoStore bool
+	NoCache bool
+	// StaleWhileRevalidate/StaleIfError are the RFC 5861 windows, in seconds.
+	StaleWhileRevalidate int
+	StaleIfError         int
+}
+
+// ParseCacheControl parses a Cache-Control header value. Unknown directives
+// are ignored and malformed numbers are treated as absent.
+func ParseCacheControl(v string) CacheControl {
+	cc := CacheControl{MaxAge: -1, SMaxAge: -1, StaleWhileRevalidate: -1, StaleIfError: -1}
+	for _, part := range strings.Split(v, ",") {
+		name, arg, _ := strings.Cut(strings.TrimSpace(part), "=")
+		name = strings.ToLower(strings.TrimSpace(name))
+		arg = strings.Trim(strings.TrimSpace(arg), `"`)
+		switch name {
+		case "max-age":
+			cc.MaxAge = parseDelta(arg)
+		case "s-maxage":
+			cc.SMaxAge = parseDelta(arg)
+		case "stale-while-revalidate":
+			cc.StaleWhileRevalidate = parseDelta(arg)
+		case "stale-if-error":
+			cc.StaleIfError = parseDelta(arg)
+		case "private":
+			cc.Private = true
+		case "no-store":
+			cc.NoStore = true
+		case "no-cache":
+			cc.NoCache = true
+		}
+	}
+	return cc
+}
+
+func parseDelta(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// SharedStorable reports whether a shared cache may store the response.
+// Shared caches must not store private responses (RFC 7234 §3).
+func (cc CacheControl) SharedStorable() bool {
+	return !cc.Private && !cc.NoStore
+}
+
+// Lifetime returns the remaining freshness in seconds a shared cache should
+// assign to a response: zero under no-cache, which may be stored but must be
+// revalidated before every use, else s-maxage, then max-age, then Expires
+// minus Date, less the Age already accumulated in upstream caches. ok is
+// false when the response carries no explicit freshness information.
+func Lifetime(h http.Header, now time.Time) (ttl int, ok bool) {
+	ttl, ok = lifetime(h, now)
+	return lessAge(h, ttl, ok)
+}
+
+// ExpiresLifetime is Lifetime from Expires alone, ignoring Cache-Control.
+func ExpiresLifetime(h http.Header, now time.Time) (ttl int, ok bool) {
+	ttl, ok = expiresLifetime(h, now)
+	return lessAge(h, ttl, ok)
+}
+
+func lessAge(h http.Header, ttl int, ok bool) (int, bool) {
+	if !ok {
+		return 0, false
+	}
+	if age := parseDelta(strings.TrimSpace(h.Get("Age"))); age > 0 {
+		ttl -= age
+	}
+	if ttl < 0 {
+		ttl = 0
+	}
+	return ttl, true
+}
+
+func lifetime(h http.Header, now time.Time) (int, bool) {
+	cc := ParseCacheControl(strings.Join(h.Values("Cache-Control"), ","))
+	if cc.NoCache {
+		return 0, true
+	}
+	if cc.SMaxAge >= 0 {
+		return cc.SMaxAge, true
+	}
+	if cc.MaxAge >= 0 {
+		return cc.MaxAge, true
+	}
+	return expiresLifetime(h, now)
+}
+
+func expiresLifetime(h http.Header, now time.Time) (int, bool) {
+	if v := h.Get("Expires"); v != "" {
+		exp, err := http.ParseTime(v)
+		if err != nil {
+			// An invalid Expires means "already expired".
+			return 0, true
+		}
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		return int(exp.Sub(date) / time.Second), true
+	}
+	return 0, false
+}
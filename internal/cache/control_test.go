@@ -0,0 +1,67 @@
+package cache
+
+import (
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestLifetime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name     string
+		header   http.Header
+		want     int
+		wantOK   bool
+		storable bool
+	}{
+		{"s-maxage wins", http.Header{"Cache-Control": {"max-age=60, s-maxage=600"}}, 600, true, true},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=60"}}, 60, true, true},
+		{"across headers", http.Header{"Cache-Control": {"max-age=60", "s-maxage=30"}}, 30, true, true},
+		{"expires", http.Header{"Expires": {"Mon, 01 Jan 2024 13:00:00 GMT"}, "Date": {"Mon, 01 Jan 2024 12:00:00 GMT"}}, 3600, true, true},
+		{"max-age over expires", http.Header{"Cache-Control": {"max-age=5"}, "Expires": {"Mon, 01 Jan 2024 13:00:00 GMT"}}, 5, true, true},
+		{"less age", http.Header{"Cache-Control": {"s-maxage=600"}, "Age": {"100"}}, 500, true, true},
+		{"none", http.Header{}, 0, false, true},
+		{"private", http.Header{"Cache-Control": {"private, max-age=60"}}, 60, true, false},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, 0, false, false},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache, max-age=600"}}, 0, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Lifetime(tt.header, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Lifetime = %d, %v; want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+			cc := ParseCacheControl(tt.header.Get("Cache-Control"))
+			if cc.SharedStorable() != tt.storable {
+				t.Errorf("SharedStorable = %v, want %v", cc.SharedStorable(), tt.storable)
+			}
+		})
+	}
+}
+
+func TestExpiresLifetime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		want   int
+		wantOK bool
+	}{
+		{"future", http.Header{"Expires": {"Mon, 01 Jan 2024 13:00:00 GMT"}, "Date": {"Mon, 01 Jan 2024 12:00:00 GMT"}}, 3600, true},
+		{"past", http.Header{"Expires": {"Mon, 01 Jan 2024 11:00:00 GMT"}, "Date": {"Mon, 01 Jan 2024 12:00:00 GMT"}}, 0, true},
+		{"max-age ignored", http.Header{"Cache-Control": {"max-age=5"}, "Expires": {"Mon, 01 Jan 2024 13:00:00 GMT"}, "Date": {"Mon, 01 Jan 2024 12:00:00 GMT"}}, 3600, true},
+		{"less age", http.Header{"Expires": {"Mon, 01 Jan 2024 13:00:00 GMT"}, "Date": {"Mon, 01 Jan 2024 12:00:00 GMT"}, "Age": {"600"}}, 3000, true},
+		{"invalid is expired", http.Header{"Expires": {"0"}}, 0, true},
+		{"max-age only", http.Header{"Cache-Control": {"max-age=5"}}, 0, false},
+		{"none", http.Header{}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := ExpiresLifetime(tt.header, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("ExpiresLifetime = %d, %v; want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
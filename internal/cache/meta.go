@@ -1,6 +1,17 @@
 package cache
 
-import "time"
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"hash"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// DefaultMetaMaxBytes is the default cap on the size of a stored meta
+// object (meta_max_bytes); backends treat anything larger as corrupt.
+const DefaultMetaMaxBytes = 64 << 10
 
 type Meta struct {
 	ETag         string `json:"etag,omitempty"`
@@ -9,18 +20,97 @@ type Meta struct {
 	TTL          int    `json:"ttl_sec,omitempty"`
 	Size         int64  `json:"size,omitempty"`
 	Neg          bool   `json:"neg,omitempty"`
+	// Status is the upstream status behind a negative entry; zero means 404.
+	Status int `json:"status,omitempty"`
+	// Headers is a filtered snapshot of upstream response headers replayed
+	// on cache hits (store_headers).
+	Headers map[string][]string `json:"headers,omitempty"`
+	// NegBody/NegContentType hold the upstream 404 payload of a negative
+	// entry so hits can replay it (negative_body_max_bytes).
+	NegBody        []byte `json:"neg_body,omitempty"`
+	NegContentType string `json:"neg_content_type,omitempty"`
+	// StaleWhileRevalidate/StaleIfError are upstream-declared stale windows
+	// in seconds; zero means use the configured defaults.
+	StaleWhileRevalidate int `json:"swr_sec,omitempty"`
+	StaleIfError         int `json:"sie_sec,omitempty"`
+	// BodyCached is false for entries populated by a HEAD, which have no
+	// object behind them. Nil (entries from before HEAD caching) means true.
+	BodyCached *bool `json:"body_cached,omitempty"`
+	// Segments lists the byte ranges of a partially cached object stored
+	// under SegmentKey (range_caching); such entries have BodyCached false
+	// and Size set to the full length.
+	Segments []Segment `json:"segments,omitempty"`
+	// Checksum is "sha256:<hex>" of the body as stored, checked by the scrub.
+	Checksum string `json:"checksum,omitempty"`
+	// StoreETag is the storage backend's ETag for the object at write time,
+	// distinct from the upstream ETag (verify_store_etag).
+	StoreETag string `json:"store_etag,omitempty"`
+	// ContentType is recorded for HEAD entries, which have no object to
+	// carry it.
+	ContentType string `json:"content_type,omitempty"`
+	// Revalidate marks an entry stored with a zero freshness lifetime
+	// (e.g. max-age=0): it is never fresh, so every use revalidates.
+	Revalidate bool `json:"revalidate,omitempty"`
+	// URL is the upstream URL of an entry whose key had to be truncated,
+	// since the route can't be recovered from the key.
+	URL string `json:"url,omitempty"`
+	// ContentLanguage is the upstream Content-Language, replayed on hits.
+	ContentLanguage string `json:"content_language,omitempty"`
+	// NotModifiedRun counts consecutive revalidations answered 304 since
+	// the body was last fetched (adaptive_ttl_max).
+	NotModifiedRun int `json:"not_modified_run,omitempty"`
 }
 
-func NowISO() string { return time.Now().UTC().Format(time.RFC3339Nano) }
+// Segment is an inclusive byte range of a partially cached object.
+type Segment struct {
+	Start int64 `json:"start"`
+	End   int64 `json:"end"`
+}
 
-func IsFresh(m Meta, defaultTTL int) bool {
-	if m.Neg {
-		return false
+// HasBody reports whether the entry's object was stored.
+func (m Meta) HasBody() bool { return m.BodyCached == nil || *m.BodyCached }
+
+// Checksum returns the Meta.Checksum of body.
+func Checksum(body []byte) string {
+	sum := sha256.Sum256(body)
+	return "sha256:" + hex.EncodeToString(sum[:])
+}
+
+// Checksummer computes a Meta.Checksum over everything written to it, so a
+// body can be hashed as it streams in (e.g. through an io.TeeReader).
+type Checksummer struct{ h hash.Hash }
+
+func NewChecksummer() *Checksummer { return &Checksummer{h: sha256.New()} }
+
+func (c *Checksummer) Write(p []byte) (int, error) { return c.h.Write(p) }
+
+// Sum returns the checksum of the bytes written so far.
+func (c *Checksummer) Sum() string { return "sha256:" + hex.EncodeToString(c.h.Sum(nil)) }
+
+// Renew restarts m's freshness after the upstream confirmed it with a 304.
+// With a positive maxTTL the TTL also doubles, capped at maxTTL, since an
+// entry that keeps revalidating unchanged is unlikely to change soon. A TTL
+// already above maxTTL is kept rather than cut back.
+func (m *Meta) Renew(defaultTTL, maxTTL int) {
+	m.CachedAt = NowISO()
+	m.NotModifiedRun++
+	if maxTTL <= 0 {
+		return
 	}
 	ttl := m.TTL
 	if ttl <= 0 {
 		ttl = defaultTTL
 	}
+	m.TTL = max(ttl, min(ttl*2, maxTTL))
+}
+
+func NowISO() string { return time.Now().UTC().Format(time.RFC3339Nano) }
+
+func IsFresh(m Meta, defaultTTL int) bool {
+	if m.Neg {
+		return false
+	}
+	ttl := effectiveTTL(m, defaultTTL)
 	if m.CachedAt == "" {
 		return false
 	}
@@ -31,6 +121,45 @@ func IsFresh(m Meta, defaultTTL int) bool {
 	return time.Since(t) < time.Duration(ttl)*time.Second
 }
 
+// Remaining returns the seconds until a positive entry expires, or 0 if it
+// already has; ok is false for entries without a valid CachedAt.
+func Remaining(m Meta, defaultTTL int, now time.Time) (secs int, ok bool) {
+	if m.Neg || m.CachedAt == "" {
+		return 0, false
+	}
+	t, err := time.Parse(time.RFC3339Nano, m.CachedAt)
+	if err != nil {
+		return 0, false
+	}
+	left := t.Add(time.Duration(effectiveTTL(m, defaultTTL)) * time.Second).Sub(now)
+	return max(int(left/time.Second), 0), true
+}
+
+// effectiveTTL is m's freshness lifetime in seconds.
+func effectiveTTL(m Meta, defaultTTL int) int {
+	switch {
+	case m.Revalidate:
+		return 0
+	case m.TTL > 0:
+		return m.TTL
+	}
+	return defaultTTL
+}
+
+// IsStaleWithin reports whether a positive entry has expired by less than
+// window seconds, i.e. may still be served stale.
+func IsStaleWithin(m Meta, defaultTTL, window int) bool {
+	if m.Neg || m.CachedAt == "" || window <= 0 {
+		return false
+	}
+	ttl := effectiveTTL(m, defaultTTL)
+	t, err := time.Parse(time.RFC3339Nano, m.CachedAt)
+	if err != nil {
+		return false
+	}
+	return time.Since(t) < time.Duration(ttl+window)*time.Second
+}
+
 func IsNegativeFresh(m Meta, ttl404 int) bool {
 	if !m.Neg || m.CachedAt == "" {
 		return false
@@ -46,16 +175,103 @@ func IsNegativeFresh(m Meta, ttl404 int) bool {
 	return time.Since(t) < time.Duration(ttl)*time.Second
 }
 
-func ObjectKey(domain, route string) string {
-	for len(route) > 0 && route[0] == '/' {
-		route = route[1:]
+// Version returns the key segment for a global and per-domain cache version,
+// or "" when both are zero so unversioned deployments keep their old keys.
+// The leading underscore keeps it from colliding with a real hostname.
+func Version(global, domain int) string {
+	if global == 0 && domain == 0 {
+		return ""
 	}
-	return "objects/" + domain + "/" + route
+	return "_v" + strconv.Itoa(global) + "." + strconv.Itoa(domain)
+}
+
+// ObjectKey returns the storage key for a cached body. A non-empty version
+// (see Version) namespaces the key so bumping it invalidates every entry.
+// variant, built with Variant, separates entries of one route (per
+// language, tenant, ...). The route is escaped by sanitizeRoute and
+// shortened to fit MaxKeyLength.
+func ObjectKey(version, domain, route, variant string) string {
+	prefix := versionPrefix(version) + domain + "/"
+	return "objects/" + prefix + boundRoute(prefix, sanitizeRoute(trimSlashes(route), variant))
 }
 
-func MetaKey(domain, route string) string {
+// MetaKey returns the storage key for the metadata of a cached body.
+func MetaKey(version, domain, route, variant string) string {
+	prefix := versionPrefix(version) + domain + "/"
+	return "meta/" + prefix + boundRoute(prefix, sanitizeRoute(trimSlashes(route), variant)) + ".json"
+}
+
+func trimSlashes(route string) string {
 	for len(route) > 0 && route[0] == '/' {
 		route = route[1:]
 	}
-	return "meta/" + domain + "/" + route + ".json"
+	return route
+}
+
+// ObjectKeyForMeta maps a key produced by MetaKey back to its ObjectKey.
+func ObjectKeyForMeta(metaKey string) (string, bool) {
+	if !strings.HasPrefix(metaKey, "meta/") || !strings.HasSuffix(metaKey, ".json") {
+		return "", false
+	}
+	return "objects/" + strings.TrimSuffix(strings.TrimPrefix(metaKey, "meta/"), ".json"), true
+}
+
+// MetaKeyForObject maps a key produced by ObjectKey to its MetaKey.
+func MetaKeyForObject(objKey string) string {
+	return "meta/" + strings.TrimPrefix(objKey, "objects/") + ".json"
+}
+
+// SegmentKey returns the storage key of bytes start-end of the object at
+// objKey.
+func SegmentKey(objKey string, start, end int64) string {
+	return SegmentPrefix(objKey) + strconv.FormatInt(start, 10) + "-" + strconv.FormatInt(end, 10)
+}
+
+// SegmentPrefix returns the prefix of the segment keys of the object at
+// objKey. Segments of routes nested below it share the prefix; see
+// ParseSegmentKey.
+func SegmentPrefix(objKey string) string {
+	return "segments/" + strings.TrimPrefix(objKey, "objects/") + "/"
+}
+
+// ParseSegmentKey returns the range of a key listed under prefix (from
+// SegmentPrefix), or false if the key belongs to another object.
+func ParseSegmentKey(prefix, key string) (Segment, bool) {
+	a, b, ok := strings.Cut(strings.TrimPrefix(key, prefix), "-")
+	if !ok || !strings.HasPrefix(key, prefix) {
+		return Segment{}, false
+	}
+	start, err1 := strconv.ParseInt(a, 10, 64)
+	end, err2 := strconv.ParseInt(b, 10, 64)
+	if err1 != nil || err2 != nil {
+		return Segment{}, false
+	}
+	return Segment{Start: start, End: end}, true
+}
+
+// ParseMetaKey splits a key produced by MetaKey into its version, domain and
+// route.
+func ParseMetaKey(metaKey string) (version, domain, route string, ok bool) {
+	if !strings.HasPrefix(metaKey, "meta/") || !strings.HasSuffix(metaKey, ".json") {
+		return "", "", "", false
+	}
+	rest := strings.TrimSuffix(strings.TrimPrefix(metaKey, "meta/"), ".json")
+	if strings.HasPrefix(rest, "_") {
+		version, rest, _ = strings.Cut(rest, "/")
+	}
+	domain, route, ok = strings.Cut(rest, "/")
+	return version, domain, route, ok
+}
+
+// VariantKey returns the storage key of an encoded (e.g. "br") variant of
+// the object stored at objKey.
+func VariantKey(objKey, encoding string) string {
+	return "variants/" + encoding + "/" + strings.TrimPrefix(objKey, "objects/")
+}
+
+func versionPrefix(version string) string {
+	if version == "" {
+		return ""
+	}
+	return version + "/"
 }
@@ -0,0 +1,145 @@
+package cache
+
+import (
+	"testing"
+	"time"
+)
+
+func TestVersionedKeys(t *testing.T) {
+	tests := []struct {
+		name         string
+		a, b         [2]int // global, domain
+		wantSameKeys bool
+	}{
+		{"unversioned", [2]int{0, 0}, [2]int{0, 0}, true},
+		{"same version", [2]int{2, 1}, [2]int{2, 1}, true},
+		{"global bump", [2]int{0, 0}, [2]int{1, 0}, false},
+		{"domain bump", [2]int{0, 0}, [2]int{0, 1}, false},
+		{"versions don't add up", [2]int{1, 0}, [2]int{0, 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			va, vb := Version(tt.a[0], tt.a[1]), Version(tt.b[0], tt.b[1])
+			objA, objB := ObjectKey(va, "example.com", "a/b.txt", ""), ObjectKey(vb, "example.com", "a/b.txt", "")
+			metaA, metaB := MetaKey(va, "example.com", "a/b.txt", ""), MetaKey(vb, "example.com", "a/b.txt", "")
+			if (objA == objB) != tt.wantSameKeys || (metaA == metaB) != tt.wantSameKeys {
+				t.Errorf("keys %q/%q and %q/%q: same = %v, want %v", objA, metaA, objB, metaB, objA == objB, tt.wantSameKeys)
+			}
+			if got, ok := ObjectKeyForMeta(metaB); !ok || got != objB {
+				t.Errorf("ObjectKeyForMeta(%q) = %q, %v; want %q", metaB, got, ok, objB)
+			}
+		})
+	}
+}
+
+func TestRenew(t *testing.T) {
+	tests := []struct {
+		name       string
+		ttl        int
+		defaultTTL int
+		maxTTL     int
+		renewals   int
+		wantTTL    int
+	}{
+		{"fixed", 60, 3600, 0, 3, 60},
+		{"doubles", 60, 3600, 86400, 3, 480},
+		{"capped", 60, 3600, 300, 5, 300},
+		{"from the default", 0, 100, 1000, 2, 400},
+		{"already above the cap", 5000, 3600, 1000, 2, 5000},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			m := Meta{TTL: tt.ttl, CachedAt: "2006-01-02T15:04:05Z"}
+			for i := 0; i < tt.renewals; i++ {
+				m.Renew(tt.defaultTTL, tt.maxTTL)
+			}
+			if m.TTL != tt.wantTTL || m.NotModifiedRun != tt.renewals {
+				t.Errorf("after %d renewals TTL = %d, run = %d; want %d, %d", tt.renewals, m.TTL, m.NotModifiedRun, tt.wantTTL, tt.renewals)
+			}
+			if !IsFresh(m, tt.defaultTTL) {
+				t.Error("renewed entry not fresh")
+			}
+		})
+	}
+}
+
+func TestIsFreshRevalidate(t *testing.T) {
+	tests := []struct {
+		name      string
+		meta      Meta
+		wantFresh bool
+	}{
+		{"fresh", Meta{TTL: 60}, true},
+		{"default TTL", Meta{}, true},
+		{"revalidate", Meta{TTL: 60, Revalidate: true}, false},
+		{"revalidate, no TTL", Meta{Revalidate: true}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.meta.CachedAt = time.Now().Add(-time.Second).UTC().Format(time.RFC3339Nano)
+			if got := IsFresh(tt.meta, 3600); got != tt.wantFresh {
+				t.Errorf("IsFresh = %v, want %v", got, tt.wantFresh)
+			}
+			// Still servable as stale while it revalidates.
+			if !IsStaleWithin(tt.meta, 3600, 60) {
+				t.Error("not within the stale window")
+			}
+		})
+	}
+}
+
+func TestRemaining(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(ago time.Duration) string { return now.Add(-ago).Format(time.RFC3339Nano) }
+	tests := []struct {
+		name   string
+		meta   Meta
+		want   int
+		wantOK bool
+	}{
+		{"fresh", Meta{CachedAt: at(10 * time.Second), TTL: 60}, 50, true},
+		{"default TTL", Meta{CachedAt: at(100 * time.Second)}, 200, true},
+		{"just expired", Meta{CachedAt: at(60 * time.Second), TTL: 60}, 0, true},
+		{"long expired", Meta{CachedAt: at(time.Hour), TTL: 60}, 0, true},
+		{"always revalidated", Meta{CachedAt: at(0), TTL: 60, Revalidate: true}, 0, true},
+		{"partial second rounds down", Meta{CachedAt: at(1500 * time.Millisecond), TTL: 60}, 58, true},
+		{"negative entry", Meta{CachedAt: at(0), TTL: 60, Neg: true}, 0, false},
+		{"no CachedAt", Meta{TTL: 60}, 0, false},
+		{"bad CachedAt", Meta{CachedAt: "yesterday", TTL: 60}, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := Remaining(tt.meta, 300, now)
+			if got != tt.want || ok != tt.wantOK {
+				t.Errorf("Remaining = %d, %v; want %d, %v", got, ok, tt.want, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestChecksummer(t *testing.T) {
+	tests := []struct {
+		name   string
+		writes []string
+	}{
+		{"empty", nil},
+		{"one write", []string{"hello world"}},
+		{"split", []string{"hel", "lo", " ", "world"}},
+		{"empty writes between", []string{"hello", "", " world", ""}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := NewChecksummer()
+			var whole []byte
+			for _, w := range tt.writes {
+				if n, err := c.Write([]byte(w)); n != len(w) || err != nil {
+					t.Fatalf("Write(%q) = %d, %v", w, n, err)
+				}
+				whole = append(whole, w...)
+			}
+			if got, want := c.Sum(), Checksum(whole); got != want {
+				t.Errorf("Sum = %s, want %s", got, want)
+			}
+		})
+	}
+}
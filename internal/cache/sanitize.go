@@ -0,0 +1,125 @@
+package cache
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"strings"
+	"unicode/utf8"
+)
+
+// ErrInvalidRoute is returned for routes that can't be mapped to a key.
+var ErrInvalidRoute = errors.New("route contains NUL or control characters")
+
+// maxKeySegment is the longest path segment kept verbatim in a key; MinIO
+// rejects object names with longer segments.
+const maxKeySegment = 255
+
+// MaxKeyLength bounds the object key a route maps to (S3 allows 1024
+// bytes). Longer routes keep a readable prefix and end in a hash of the
+// whole route, leaving room for the prefixes and suffixes of derived keys.
+// Set once at startup; zero disables the limit.
+var MaxKeyLength = 1024
+
+// keyOverhead is reserved below MaxKeyLength for what derived keys (meta,
+// variants, segments) add on top of the object key.
+const keyOverhead = 64
+
+// hashSuffixLen is the length of "~" plus a 16-hex-digit hash.
+const hashSuffixLen = 17
+
+// ValidateRoute rejects routes containing NUL or other control characters,
+// which storage backends either refuse or handle inconsistently.
+func ValidateRoute(route string) error {
+	for i := 0; i < len(route); i++ {
+		if c := route[i]; c < 0x20 || c == 0x7f {
+			return ErrInvalidRoute
+		}
+	}
+	return nil
+}
+
+// keyEscaper percent-escapes the characters a route may not carry verbatim
+// in a key. '@' is reserved for variants, so no route can pose as one.
+var keyEscaper = strings.NewReplacer("%", "%25", `\`, "%5C", "@", "%40")
+
+// Variant returns the key suffix for one variant of a route, e.g.
+// Variant("lang", "en"). The value is escaped, '/' included, so it can
+// neither add path segments nor spell out another variant.
+func Variant(kind, value string) string {
+	return "@" + kind + "/" + strings.ReplaceAll(keyEscaper.Replace(value), "/", "%2F")
+}
+
+// sanitizeRoute maps a route and its variant to a storage-safe key suffix.
+// '%', '\' and '@' in the route are percent-escaped, which UnescapeRoute
+// reverses. Segments longer than maxKeySegment are truncated and suffixed
+// with a hash of the original; that part is not reversible.
+func sanitizeRoute(route, variant string) string {
+	if strings.ContainsAny(route, `%\@`) {
+		route = keyEscaper.Replace(route)
+	}
+	route += variant
+	if len(route) <= maxKeySegment {
+		return route
+	}
+	segs := strings.Split(route, "/")
+	for i, seg := range segs {
+		if len(seg) > maxKeySegment {
+			segs[i] = seg[:maxKeySegment-hashSuffixLen] + hashMarker(seg)
+		}
+	}
+	return strings.Join(segs, "/")
+}
+
+// boundRoute truncates an already sanitized route so a key made of prefix
+// and route fits within MaxKeyLength.
+func boundRoute(prefix, route string) string {
+	if MaxKeyLength <= 0 {
+		return route
+	}
+	budget := MaxKeyLength - keyOverhead - len(prefix)
+	if len(route) <= budget {
+		return route
+	}
+	cut := max(budget-hashSuffixLen, 0)
+	for cut > 0 && !utf8.RuneStart(route[cut]) {
+		cut--
+	}
+	return route[:cut] + hashMarker(route)
+}
+
+func hashMarker(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return "~" + hex.EncodeToString(sum[:8])
+}
+
+// LossyRoute reports whether a route taken from a key may have been
+// shortened by truncation, so it no longer identifies the original.
+func LossyRoute(route string) bool {
+	for _, seg := range strings.Split(route, "/") {
+		if i := len(seg) - hashSuffixLen; i >= 0 && seg[i] == '~' {
+			if _, err := hex.DecodeString(seg[i+1:]); err == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// SplitVariant separates a route taken from a key from the variant built by
+// Variant, if any. Routes have their own '@' escaped, so the first one left
+// starts the variant.
+func SplitVariant(route string) (string, string) {
+	if i := strings.IndexByte(route, '@'); i >= 0 {
+		return route[:i], route[i:]
+	}
+	return route, ""
+}
+
+// UnescapeRoute reverses the escaping applied to routes in keys.
+func UnescapeRoute(route string) string {
+	if !strings.Contains(route, "%") {
+		return route
+	}
+	return strings.NewReplacer("%25", "%", "%5C", `\`, "%40", "@", "%2F", "/").Replace(route)
+}
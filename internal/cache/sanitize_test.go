@@ -0,0 +1,122 @@
+package cache
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestValidateRoute(t *testing.T) {
+	tests := []struct {
+		route   string
+		wantErr bool
+	}{
+		{"a/b.txt", false},
+		{`a\b.txt`, false},
+		{"päth/ünïcode", false},
+		{"a\x00b", true},
+		{"a\nb", true},
+		{"a\tb", true},
+		{"a\x7fb", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.route, func(t *testing.T) {
+			if err := ValidateRoute(tt.route); (err != nil) != tt.wantErr {
+				t.Errorf("ValidateRoute(%q) = %v, want error %v", tt.route, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestSanitizeRoute(t *testing.T) {
+	long := strings.Repeat("x", 300)
+	tests := []struct {
+		name       string
+		route      string
+		want       string // object key route; empty to skip the check
+		reversible bool
+	}{
+		{"plain", "a/b.txt", "a/b.txt", true},
+		{"backslash", `a\b\c.txt`, "a%5Cb%5Cc.txt", true},
+		{"percent", "a%2Fb", "a%252Fb", true},
+		{"at sign", "pkg@1.0/x", "pkg%401.0/x", true},
+		{"long segment", "dir/" + long + "/f", "", false},
+		{"long segment, escaped", `dir\` + long, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			objKey := ObjectKey("", "example.com", tt.route, "")
+			route := strings.TrimPrefix(objKey, "objects/example.com/")
+			if tt.want != "" && route != tt.want {
+				t.Errorf("key route = %q, want %q", route, tt.want)
+			}
+			for _, seg := range strings.Split(route, "/") {
+				if len(seg) > maxKeySegment {
+					t.Errorf("segment of %d bytes kept", len(seg))
+				}
+			}
+			if got := LossyRoute(route); got == tt.reversible {
+				t.Errorf("LossyRoute = %v, want %v", got, !tt.reversible)
+			}
+			if tt.reversible {
+				if got := UnescapeRoute(route); got != tt.route {
+					t.Errorf("UnescapeRoute = %q, want %q", got, tt.route)
+				}
+			}
+			// Meta keys escape the same way, and distinct routes stay distinct.
+			if got, _ := ObjectKeyForMeta(MetaKey("", "example.com", tt.route, "")); got != objKey {
+				t.Errorf("meta key maps to %q, want %q", got, objKey)
+			}
+			if ObjectKey("", "example.com", tt.route+"2", "") == objKey {
+				t.Error("distinct routes share a key")
+			}
+		})
+	}
+}
+
+func TestBoundKeys(t *testing.T) {
+	defer func(n int) { MaxKeyLength = n }(MaxKeyLength)
+	tests := []struct {
+		name      string
+		limit     int
+		route     string
+		wantLossy bool
+	}{
+		{"short", 1024, "a/b.txt", false},
+		{"over the limit", 1024, strings.Repeat("dir/", 400) + "f", true},
+		{"multibyte at the cut", 1024, strings.Repeat("é/", 600), true},
+		{"custom limit", 200, strings.Repeat("d/", 100), true},
+		{"disabled", 0, strings.Repeat("dir/", 400) + "f", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			MaxKeyLength = tt.limit
+			objKey := ObjectKey(Version(3, 1), "example.com", tt.route, Variant("lang", "en"))
+			metaKey := MetaKey(Version(3, 1), "example.com", tt.route, Variant("lang", "en"))
+			if tt.limit > 0 {
+				for _, k := range []string{objKey, metaKey} {
+					if len(k) > tt.limit {
+						t.Errorf("key of %d bytes, limit %d", len(k), tt.limit)
+					}
+				}
+			}
+			if !utf8.ValidString(objKey) {
+				t.Error("key cut mid-rune")
+			}
+			if got, _ := ObjectKeyForMeta(metaKey); got != objKey {
+				t.Errorf("meta key maps to %q, want %q", got, objKey)
+			}
+			_, _, route, _ := ParseMetaKey(metaKey)
+			if got := LossyRoute(route); got != tt.wantLossy {
+				t.Errorf("LossyRoute = %v, want %v", got, tt.wantLossy)
+			}
+			// The readable prefix is kept, and the hash keeps routes apart.
+			if tt.wantLossy && !strings.Contains(objKey, tt.route[:40]) {
+				t.Errorf("prefix of the route lost: %q", objKey)
+			}
+			if ObjectKey(Version(3, 1), "example.com", tt.route+"x", Variant("lang", "en")) == objKey {
+				t.Error("distinct routes share a key")
+			}
+		})
+	}
+}
@@ -2,26 +2,541 @@ package config
 
 import (
 	"errors"
+	"fmt"
 	"os"
+	"regexp"
 	"strconv"
 	"strings"
 
 	"gopkg.in/yaml.v3"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
 )
 
+// DomainConfig overrides global settings for a single upstream domain.
+// Zero values mean "use the global setting".
+type DomainConfig struct {
+	UpstreamTimeout int `yaml:"upstream_timeout"`
+	CacheVersion    int `yaml:"cache_version"`
+	// DisableHTTP2 forces HTTP/1.1 to this origin.
+	DisableHTTP2 bool `yaml:"disable_http2"`
+	// Headers are sent on every upstream request to this origin, e.g. a
+	// service API key. They are never stored or returned to clients.
+	Headers map[string]string `yaml:"headers"`
+	// UpstreamMethod forces the upstream request method ("GET" or "HEAD")
+	// regardless of the client's. Bodies fetched with HEAD are never stored.
+	UpstreamMethod string `yaml:"upstream_method"`
+	// TLSServerName is the SNI and certificate name expected from this
+	// origin, for when it's reached under a different host than the one its
+	// certificate is issued for. Empty uses the domain itself.
+	TLSServerName string `yaml:"tls_server_name"`
+	// StripHeaders are removed from every upstream request to this origin,
+	// including ones forwarded from the client, e.g. Cookie or Referer.
+	// Stripping User-Agent sends none instead of Go's default.
+	StripHeaders []string `yaml:"strip_headers"`
+	// TLSMinVersion/TLSMaxVersion ("1.0" to "1.3") bound the TLS versions
+	// offered to this origin. With TLSDowngrade a failed handshake is
+	// retried once offering one version less.
+	TLSMinVersion string `yaml:"tls_min_version"`
+	TLSMaxVersion string `yaml:"tls_max_version"`
+	TLSDowngrade  bool   `yaml:"tls_downgrade"`
+	// Immutable marks everything from this origin as never changing; see
+	// Config.ImmutableRoutes.
+	Immutable bool `yaml:"immutable"`
+	// IdleConnTimeout/KeepAlive override the global upstream connection
+	// settings (seconds) for this origin.
+	IdleConnTimeout int `yaml:"idle_conn_timeout"`
+	KeepAlive       int `yaml:"keepalive"`
+	// VaryAccept keys entries on the client's Accept header, for APIs that
+	// negotiate JSON vs XML and the like. The header is reduced to a single
+	// media type: the first of AcceptTypes it accepts, or without
+	// AcceptTypes its preferred type. Anything else shares the plain entry.
+	VaryAccept  bool     `yaml:"vary_accept"`
+	AcceptTypes []string `yaml:"accept_types"`
+	// MaxObjectBytes overrides the global max_object_bytes for this origin.
+	MaxObjectBytes int64 `yaml:"max_object_bytes"`
+	// FoldCase lowercases routes in cache keys for origins that treat paths
+	// case-insensitively; the upstream still sees the path as requested,
+	// and route rules (ttl_rules, immutable_routes, content_type_rules)
+	// still match it.
+	FoldCase bool `yaml:"fold_case"`
+}
+
+// TTLRule sets the TTL of entries whose "<domain>/<route>" matches Match.
+type TTLRule struct {
+	Match string  `yaml:"match"`
+	TTL   Seconds `yaml:"ttl"`
+
+	re *regexp.Regexp
+}
+
+// ContentTypeRule requires successful responses for "<domain>/<route>"
+// matching Match to have a Content-Type among Types (prefixes, or patterns
+// like "image/*"). Anything else, such as an HTML error page served with a
+// 200, is answered with 502 and not cached.
+type ContentTypeRule struct {
+	Match string   `yaml:"match"`
+	Types []string `yaml:"types"`
+
+	re *regexp.Regexp
+}
+
+// Placeholder is served instead of an error page when a request for a route
+// matching Match (a regex over "<domain>/<route>", e.g. '\.(png|jpe?g)$')
+// can't be fetched and nothing is cached: the contents of File with
+// ContentType and Status (200 if zero).
+type Placeholder struct {
+	Match       string `yaml:"match"`
+	File        string `yaml:"file"`
+	ContentType string `yaml:"content_type"`
+	Status      int    `yaml:"status"`
+
+	re   *regexp.Regexp
+	body []byte
+}
+
+// Body returns the placeholder's contents, read when the config was loaded.
+func (p *Placeholder) Body() []byte { return p.body }
+
+// CORSConfig controls cross-origin headers on proxied responses. An origin
+// of "*" allows any origin; otherwise the request Origin is reflected when it
+// appears in AllowOrigins.
+type CORSConfig struct {
+	AllowOrigins  []string `yaml:"allow_origins"`
+	AllowMethods  []string `yaml:"allow_methods"`
+	AllowHeaders  []string `yaml:"allow_headers"`
+	ExposeHeaders []string `yaml:"expose_headers"`
+	MaxAge        int      `yaml:"max_age"`
+}
+
 type Config struct {
 	MinioEndpoint string `yaml:"minio_endpoint"`
 	MinioAccess   string `yaml:"minio_access_key"`
 	MinioSecret   string `yaml:"minio_secret_key"`
 	MinioBucket   string `yaml:"minio_bucket"`
+	// MinioReplicas are read-only endpoints sharing the primary's
+	// credentials and bucket. Reads try them first and fall back to the
+	// primary; writes only go to the primary.
+	MinioReplicas []string `yaml:"minio_replicas"`
+	// ReplicaRoundRobin rotates the first replica tried per read.
+	ReplicaRoundRobin bool `yaml:"replica_round_robin"`
 
-	TTLDefault int  `yaml:"ttl_default"`
-	TTL404     int  `yaml:"ttl_404"`
-	ServeIf    bool `yaml:"serve_if_present"`
+	// TTLDefault and the other TTLs accept seconds or durations ("24h",
+	// "7d").
+	TTLDefault Seconds `yaml:"ttl_default"`
+	// MaxObjectsPerDomain caps the entries cached per domain, evicting the
+	// least recently used beyond it (0 = unlimited). Existing entries are
+	// indexed at startup, which reads all meta.
+	MaxObjectsPerDomain int `yaml:"max_objects_per_domain"`
+	// MaxKeyLength bounds storage key length; longer routes are truncated
+	// and suffixed with a hash (S3 allows 1024 bytes).
+	MaxKeyLength int `yaml:"max_key_length"`
+	// TTLRules override TTLDefault for matching routes; the first match
+	// wins. Upstream Cache-Control still takes precedence when honored.
+	TTLRules []TTLRule `yaml:"ttl_rules"`
+	// ContentTypeRules assert the content type of matching routes; the
+	// first match applies.
+	ContentTypeRules []ContentTypeRule `yaml:"content_type_rules"`
+	// Placeholders replace error responses on failed misses; the first
+	// matching entry applies.
+	Placeholders []Placeholder `yaml:"placeholders"`
+	// ImmutableRoutes are regexes over "<domain>/<route>" for content that
+	// never changes (content-addressed or versioned URLs). Successful
+	// responses for them carry "Cache-Control: public,
+	// max-age=<ImmutableMaxAge>, immutable" so clients never revalidate.
+	ImmutableRoutes []string `yaml:"immutable_routes"`
+	ImmutableMaxAge int      `yaml:"immutable_max_age"`
+	immutableRes    []*regexp.Regexp
+	TTL404          Seconds `yaml:"ttl_404"`
+	// NegativeTTLs negatively caches the listed upstream statuses for the
+	// given seconds, e.g. {503: 5, 410: 3600}. A 404 entry overrides TTL404.
+	NegativeTTLs map[int]int `yaml:"negative_ttls"`
+	// StatusMap rewrites upstream error statuses before they reach clients,
+	// e.g. {403: 404} to hide which private objects exist. Caching and
+	// metrics still see the upstream status.
+	StatusMap map[int]int `yaml:"status_map"`
+	// TTLNoValidators is a TTL floor for objects with neither ETag nor
+	// Last-Modified, which can only be refreshed by a full re-download.
+	TTLNoValidators Seconds `yaml:"ttl_no_validators"`
+	ServeIf         bool    `yaml:"serve_if_present"`
+	// ConditionalOnMiss answers 304 when a freshly fetched object matches
+	// the client's validators, not just on pre-existing cache hits.
+	ConditionalOnMiss bool `yaml:"conditional_on_miss"`
+	// ConditionalOnHit answers 304 to a cache hit matching the client's
+	// If-None-Match/If-Modified-Since instead of sending the body.
+	ConditionalOnHit bool `yaml:"conditional_on_hit"`
+	// NoCacheHeaders marks upstream responses uncacheable when they carry
+	// one of these headers, given as "Name" or "Name: value".
+	NoCacheHeaders []string `yaml:"no_cache_headers"`
+	// HonorCacheControl derives TTLs from upstream s-maxage, max-age or
+	// Expires (in that order) and refuses to store private/no-store
+	// responses, as a shared cache should.
+	HonorCacheControl bool `yaml:"honor_cache_control"`
+	// HonorExpires takes the TTL from Expires minus Date without honoring
+	// Cache-Control, for older origins; a past Expires counts as a zero
+	// lifetime (see ZeroLifetime). Implied by HonorCacheControl.
+	HonorExpires bool `yaml:"honor_expires"`
+	// RequireExplicitFreshness doesn't store responses that carry no
+	// freshness signal at all (no max-age, s-maxage or Expires, and no
+	// ETag or Last-Modified) instead of giving them ttl_default.
+	RequireExplicitFreshness bool `yaml:"require_explicit_freshness"`
+	// UpstreamTTLMin/UpstreamTTLMax bound TTLs taken from upstream headers
+	// (0 = unbounded). Expired responses stay expired.
+	UpstreamTTLMin Seconds `yaml:"upstream_ttl_min"`
+	UpstreamTTLMax Seconds `yaml:"upstream_ttl_max"`
+	// ZeroLifetime handles responses whose lifetime is zero or less (e.g.
+	// max-age=0) under honor_cache_control: "skip" (default) doesn't store
+	// them, "revalidate" stores them stale so each use revalidates, which
+	// pays off for origins that answer 304s cheaply.
+	ZeroLifetime string `yaml:"zero_lifetime"`
+	// StaleWhileRevalidate serves an expired object for up to this many
+	// seconds while it is refreshed in the background; StaleIfError serves
+	// it when the upstream fails. Upstream stale-while-revalidate and
+	// stale-if-error directives take precedence with honor_cache_control.
+	StaleWhileRevalidate int `yaml:"stale_while_revalidate"`
+	StaleIfError         int `yaml:"stale_if_error"`
+	// FetchPatienceMS serves the stale copy, when there is one, to a client
+	// whose refresh fetch is still running after this many milliseconds;
+	// the fetch completes in the background. Zero always waits.
+	FetchPatienceMS int `yaml:"fetch_patience_ms"`
+	// FetchCooldownMS serves the cached copy instead of fetching a key
+	// again within this many milliseconds of its last fetch, smoothing
+	// bursts on entries that expire immediately. Zero disables it.
+	FetchCooldownMS int `yaml:"fetch_cooldown_ms"`
+	// BreakerFailures opens a domain's circuit breaker after this many
+	// consecutive failed fetches (errors or 5xx): misses then get a 503
+	// with Retry-After, or a stale copy under stale_if_error, for
+	// BreakerCooldown seconds. Zero disables it.
+	BreakerFailures int `yaml:"breaker_failures"`
+	BreakerCooldown int `yaml:"breaker_cooldown"`
+	// AdaptiveTTLMax doubles an entry's TTL on each revalidation answered
+	// 304, up to this many seconds; a 200 starts over. Zero keeps TTLs
+	// fixed.
+	AdaptiveTTLMax int `yaml:"adaptive_ttl_max"`
+	// SameBodyNotModified treats a 200 whose body hashes the same as the
+	// stored one like a 304: the entry is renewed and takes the new
+	// validators, but the object isn't rewritten. For origins that rotate
+	// ETags on unchanged content.
+	SameBodyNotModified bool `yaml:"same_body_not_modified"`
 
 	ListenAddr string `yaml:"listen_addr"`
+
+	// EmptyBody* treat an empty 200 whose content type matches one of
+	// EmptyBodyTypes (a prefix, or a pattern like "image/*"), or whose route
+	// ends with one of EmptyBodyExts, as a soft failure: 502 to the client,
+	// optionally negatively cached for EmptyBodyNegTTL seconds. Types
+	// matching EmptyBodyAllowTypes are always accepted empty, whatever the
+	// route's extension says.
+	EmptyBodyTypes      []string `yaml:"empty_body_types"`
+	EmptyBodyAllowTypes []string `yaml:"empty_body_allow_types"`
+	EmptyBodyExts       []string `yaml:"empty_body_extensions"`
+	EmptyBodyNegTTL     int      `yaml:"empty_body_neg_ttl"`
+
+	// NegativeBodyMaxBytes keeps upstream 404 bodies up to this size in the
+	// negative meta and replays them on negative hits. Zero disables it.
+	// Base64-encoded plus metaOverhead, it must fit MetaMaxBytes.
+	NegativeBodyMaxBytes int `yaml:"negative_body_max_bytes"`
+
+	CORS CORSConfig `yaml:"cors"`
+
+	// CacheVersion is folded into every storage key; bump it to invalidate
+	// all entries after an origin redeploys under the same URLs.
+	CacheVersion int `yaml:"cache_version"`
+	// AdminToken enables the /admin/ API; requests must send it as a bearer token.
+	AdminToken string `yaml:"admin_token"`
+	// BypassSecret enables X-Cache-Bypass for requests that also send it in
+	// X-Cache-Bypass-Secret, forcing a fresh upstream fetch.
+	BypassSecret string `yaml:"bypass_secret"`
+
+	// WriteConflict decides what a write does when another write of the same
+	// key is in progress (e.g. a foreground miss racing a background
+	// refresh): "wait" (default) runs them one after the other, "skip" drops
+	// the later one.
+	WriteConflict string `yaml:"write_conflict"`
+
+	// PartialResponse decides what happens when the upstream answers a
+	// non-range fetch with 206: "relay" (default) passes it to the client
+	// uncached, "error" answers 502. Partial bodies are never stored as
+	// complete objects either way.
+	PartialResponse string `yaml:"partial_response"`
+
+	// DuplicateContentType picks between repeated upstream Content-Type
+	// headers: "first" (default) or "last". Either way values that don't
+	// parse are passed over, and the type is sniffed from the body if none
+	// does.
+	DuplicateContentType string `yaml:"duplicate_content_type"`
+
+	// TraceHeaders are copied from the client request to the upstream one
+	// for end-to-end tracing. A missing traceparent or X-Request-Id is
+	// generated; other listed headers are only forwarded.
+	TraceHeaders []string `yaml:"trace_headers"`
+
+	// VaryLanguage keys entries on the client's Accept-Language, forwarding
+	// it upstream, for origins that negotiate content by language.
+	VaryLanguage bool `yaml:"vary_language"`
+
+	// Partition splits the cache per client group for origins whose content
+	// depends on who asks: "ip" keys entries on the client address masked
+	// to PartitionIPv4Prefix/PartitionIPv6Prefix bits (and forwards it as
+	// X-Forwarded-For), "header" on the value of PartitionHeader (forwarded
+	// as is). Empty shares entries between all clients.
+	Partition           string `yaml:"partition"`
+	PartitionHeader     string `yaml:"partition_header"`
+	PartitionIPv4Prefix int    `yaml:"partition_ipv4_prefix"`
+	PartitionIPv6Prefix int    `yaml:"partition_ipv6_prefix"`
+
+	// PostCache enables caching of POST requests whose content type is a
+	// key here, keyed by the body after the named canonicalizer ("raw",
+	// "json" or "graphql") so equivalent bodies share an entry. Other POSTs
+	// are rejected.
+	PostCache map[string]string `yaml:"post_cache"`
+
+	// RangeCaching fetches single byte ranges of uncached objects upstream
+	// with Range and caches them as segments, stitching the full object
+	// together once every byte has been fetched.
+	RangeCaching bool `yaml:"range_caching"`
+
+	// CacheHead answers HEAD requests from meta and fetches them upstream
+	// with HEAD, storing body-less entries that a later GET fills in.
+	CacheHead bool `yaml:"cache_head"`
+
+	// ProxyUpgrades tunnels WebSocket/Upgrade requests instead of rejecting them.
+	ProxyUpgrades bool `yaml:"proxy_upgrades"`
+
+	// StorageWriteRetries/StorageWriteBackoffMS control retries of failed
+	// cache writes; ServeOnWriteFailure serves the fetched body regardless.
+	// Writes are detached from the request and bounded by StorageWriteTimeout
+	// seconds instead.
+	StorageWriteTimeout   int  `yaml:"storage_write_timeout"`
+	StorageWriteRetries   int  `yaml:"storage_write_retries"`
+	StorageWriteBackoffMS int  `yaml:"storage_write_backoff_ms"`
+	ServeOnWriteFailure   bool `yaml:"serve_on_write_failure"`
+
+	// AccessLog logs one line per request. LogSampleEvery > 0 keeps every
+	// Nth successful request, otherwise LogSampleRate (0-1) keeps that
+	// fraction; 5xx responses and those slower than LogSlowMS always log.
+	AccessLog      bool    `yaml:"access_log"`
+	LogSampleEvery int     `yaml:"log_sample_every"`
+	LogSampleRate  float64 `yaml:"log_sample_rate"`
+	LogSlowMS      int     `yaml:"log_slow_ms"`
+
+	// MetricsMaxDomains caps the distinct domain labels on /metrics; further
+	// domains are counted under "other". Zero disables per-domain metrics.
+	MetricsMaxDomains int `yaml:"metrics_max_domains"`
+
+	// ReadOnly puts the proxy in maintenance mode: only existing entries are
+	// served and nothing is fetched or written. Misses get ReadOnlyStatus,
+	// or the stored object regardless of age when ReadOnlyServeStale is set.
+	ReadOnly           bool `yaml:"read_only"`
+	ReadOnlyStatus     int  `yaml:"read_only_status"`
+	ReadOnlyServeStale bool `yaml:"read_only_serve_stale"`
+
+	// AdmitAfter stores an object only once it has missed this many times
+	// within AdmitWindow seconds; earlier misses are passed through
+	// uncached. 0 or 1 stores on the first miss.
+	AdmitAfter  int `yaml:"admit_after"`
+	AdmitWindow int `yaml:"admit_window"`
+
+	// DiskCacheDir enables a local disk tier in front of MinIO holding up to
+	// DiskCacheBytes of object bodies: reads try disk first and promote
+	// MinIO hits to it, writes go to both. Meta always stays in MinIO.
+	DiskCacheDir   string `yaml:"disk_cache_dir"`
+	DiskCacheBytes int64  `yaml:"disk_cache_bytes"`
+
+	// HotCacheBytes keeps up to this many bytes of recently served bodies no
+	// larger than HotCacheMaxObject in memory (0 disables). With
+	// HotCacheWarm the resident keys are saved on shutdown and reloaded on
+	// startup, so a restart doesn't start cold.
+	HotCacheBytes     int64 `yaml:"hot_cache_bytes"`
+	HotCacheMaxObject int64 `yaml:"hot_cache_max_object"`
+	HotCacheWarm      bool  `yaml:"hot_cache_warm"`
+
+	// MaxUpstreamFetches caps upstream fetches in flight; within it, no
+	// domain may hold more than MaxFetchesPerDomain, so one slow origin
+	// can't starve the rest. Zero is unlimited.
+	MaxUpstreamFetches  int `yaml:"max_upstream_fetches"`
+	MaxFetchesPerDomain int `yaml:"max_fetches_per_domain"`
+
+	// MetaReadConcurrency caps meta reads in flight across bulk operations
+	// (manifest, reconcile, scrub) so they can't starve request serving of
+	// storage capacity.
+	MetaReadConcurrency int `yaml:"meta_read_concurrency"`
+
+	// DebugHeaders adds X-Cache-Decision and similar diagnostic headers.
+	// Leave off for public deployments.
+	DebugHeaders bool `yaml:"debug_headers"`
+
+	// TrustProxyHeaders honors X-Forwarded-Proto/X-Forwarded-Host. Enable
+	// only behind a proxy that overwrites them.
+	TrustProxyHeaders bool `yaml:"trust_proxy_headers"`
+
+	// MaxRequestsPerClient caps the requests one client address may have
+	// in flight; further ones get 429 (0 = unlimited).
+	MaxRequestsPerClient int `yaml:"max_requests_per_client"`
+
+	// CompressVariants stores pre-encoded ("br", "gzip") variants of
+	// compressible objects and serves them to clients that accept them.
+	CompressVariants []string `yaml:"compress_variants"`
+	CompressTypes    []string `yaml:"compress_types"`
+	CompressMinBytes int      `yaml:"compress_min_bytes"`
+
+	// SlashMode collapses duplicate slashes in routes: "key" (cache keys
+	// only, the default), "all" (keys and upstream URL) or "off".
+	SlashMode string `yaml:"slash_mode"`
+
+	// TrailingSlash canonicalizes routes to "strip" or "append" a trailing
+	// slash ("" leaves them alone). By default only cache keys are
+	// normalized; TrailingSlashRedirect instead 301s clients to the
+	// canonical URL.
+	TrailingSlash         string `yaml:"trailing_slash"`
+	TrailingSlashRedirect bool   `yaml:"trailing_slash_redirect"`
+
+	// ReconcileInterval, in seconds, runs a background pass pruning meta
+	// whose object was deleted out-of-band. Zero disables it.
+	ReconcileInterval int `yaml:"reconcile_interval"`
+	// ReconcileRate bounds the objects a reconcile pass checks per second;
+	// zero is unlimited.
+	ReconcileRate int `yaml:"reconcile_rate"`
+	// SweepMaxLatencyMS makes reconcile and scrub passes back off, with a
+	// growing pause, while a storage read takes longer than this, so they
+	// yield to serving traffic. Zero disables it.
+	SweepMaxLatencyMS int `yaml:"sweep_max_latency_ms"`
+
+	// ScrubInterval, in seconds, runs a background pass re-checking cached
+	// bodies against their stored checksum at up to ScrubRate objects per
+	// second, removing corrupt entries (copied under quarantine/ first with
+	// ScrubQuarantine). Zero disables it.
+	ScrubInterval   int  `yaml:"scrub_interval"`
+	ScrubRate       int  `yaml:"scrub_rate"`
+	ScrubQuarantine bool `yaml:"scrub_quarantine"`
+
+	// StoreHeaders snapshots upstream response headers (minus hop-by-hop,
+	// credential and StoredHeadersDeny headers, up to StoredHeadersMaxBytes)
+	// into meta and replays them on hits. With StoreHeaders the bound is
+	// required and, like negative bodies, must fit MetaMaxBytes.
+	StoreHeaders          bool     `yaml:"store_headers"`
+	StoredHeadersDeny     []string `yaml:"stored_headers_deny"`
+	StoredHeadersMaxBytes int      `yaml:"stored_headers_max_bytes"`
+
+	// PresignRedirectMinBytes redirects cache hits at least this large to a
+	// presigned MinIO URL (valid PresignExpiry seconds) with a 302, or 307
+	// when PresignRedirectStatus is 307. Zero serves everything inline.
+	PresignRedirectMinBytes int64 `yaml:"presign_redirect_min_bytes"`
+	PresignRedirectStatus   int   `yaml:"presign_redirect_status"`
+	PresignExpiry           int   `yaml:"presign_expiry"`
+
+	// CopyBufferSize is the buffer used to stream cached bodies to clients.
+	CopyBufferSize int `yaml:"copy_buffer_size"`
+
+	// Dedup stores bodies content-addressed so identical content fetched
+	// from different URLs shares one blob.
+	Dedup bool `yaml:"dedup"`
+
+	// RequestTimeout bounds a whole client request in seconds (0 = none).
+	RequestTimeout int `yaml:"request_timeout"`
+	// DisableHTTP2 forces HTTP/1.1 for all upstream connections.
+	DisableHTTP2 bool `yaml:"disable_http2"`
+	// UpstreamTimeout is the per-request upstream deadline in seconds; zero
+	// falls back to 60 rather than no deadline.
+	UpstreamTimeout int `yaml:"upstream_timeout"`
+	// UpstreamBodyIdleTimeout aborts an upstream body that sends nothing for
+	// this many seconds (0 = only UpstreamTimeout applies).
+	UpstreamBodyIdleTimeout int `yaml:"upstream_body_idle_timeout"`
+	// UpstreamIdleConnTimeout closes pooled upstream connections idle this
+	// many seconds; UpstreamKeepAlive is the TCP keep-alive period. Zero
+	// keeps the defaults (90s and 60s). A reused connection the origin has
+	// reset is retried once either way.
+	UpstreamIdleConnTimeout int `yaml:"upstream_idle_conn_timeout"`
+	UpstreamKeepAlive       int `yaml:"upstream_keepalive"`
+	// UpstreamCertWarnDays logs a warning when an origin's TLS certificate
+	// chain expires within this many days, and exports its expiry on
+	// /metrics. Zero disables the check.
+	UpstreamCertWarnDays int `yaml:"upstream_cert_warn_days"`
+
+	// Aliases maps a short first path segment to a "<domain>[/<prefix>]"
+	// target, e.g. npm: registry.npmjs.org serves /npm/<pkg> from
+	// https://registry.npmjs.org/<pkg> under the same cache keys.
+	Aliases map[string]string `yaml:"aliases"`
+	// KeyDomains maps a domain to the canonical domain it is cached under,
+	// for mirrors serving identical content: an entry fetched through any
+	// of them serves them all. Fetches still go to the requested domain.
+	KeyDomains map[string]string `yaml:"key_domains"`
+
+	// AllowedDomains restricts which origins may be proxied; entries are
+	// exact hosts or "*.example.com" wildcards. Empty allows any origin.
+	AllowedDomains []string `yaml:"allowed_domains"`
+	// AllowlistFailMode decides what a reload with an invalid allowlist
+	// does: "open" keeps the last good config, "closed" rejects every
+	// proxied request until a valid reload.
+	AllowlistFailMode string `yaml:"allowlist_fail_mode"`
+
+	// Domains holds per-origin overrides keyed by the domain as it appears
+	// in the request path.
+	Domains map[string]DomainConfig `yaml:"domains"`
+
+	// StorageConnectAttempts/StorageConnectBackoffMS retry the initial
+	// storage connection at startup with jittered, doubling backoff.
+	StorageConnectAttempts  int `yaml:"storage_connect_attempts"`
+	StorageConnectBackoffMS int `yaml:"storage_connect_backoff_ms"`
+
+	// CompressAtRest stores object bodies compressed with "gzip" or "zstd"
+	// ("" disables it) at CompressAtRestLevel (0 = algorithm default).
+	CompressAtRest      string `yaml:"compress_at_rest"`
+	CompressAtRestLevel int    `yaml:"compress_at_rest_level"`
+	// CompressAtRestDict is a zstd dictionary file (e.g. from "zstd
+	// --train") used for new objects. Each dictionary is kept in the bucket
+	// under its content hash, so replacing the file leaves older objects
+	// readable.
+	CompressAtRestDict string `yaml:"compress_at_rest_dict"`
+	// MaxDecompressedBytes bounds any body we inflate (gzip from upstreams,
+	// compress_at_rest reads); larger ones are rejected, never cached.
+	MaxDecompressedBytes int64 `yaml:"max_decompressed_bytes"`
+	// MaxObjectBytes is the largest body stored; bigger ones are streamed
+	// through to the client uncached, never held in memory whole (the
+	// fetch that finds one too large is abandoned and each client gets a
+	// request of its own). Zero is unlimited; domains can override it.
+	MaxObjectBytes int64 `yaml:"max_object_bytes"`
+
+	// VerifyStoreETag records the storage ETag of each object in its meta
+	// and treats entries whose object was since replaced as misses.
+	VerifyStoreETag bool `yaml:"verify_store_etag"`
+	// VerifyOnRead checks each hit's body against the size and checksum in
+	// its meta before serving it (buffering bodies up to 8 MiB), and applies
+	// IntegrityMismatch when they disagree: "refetch" (default) evicts the
+	// entry and fetches it again, "serve" logs and serves it anyway, "fail"
+	// answers 502. Larger bodies are hashed as they stream; one that turns
+	// out not to match is evicted afterwards unless the mode is "serve".
+	VerifyOnRead      bool   `yaml:"verify_on_read"`
+	IntegrityMismatch string `yaml:"integrity_mismatch"`
+	// VerifyWrites compares the ETag storage returns for each upload with
+	// the MD5 of the bytes sent, deleting and retrying the write on a
+	// mismatch. Multipart ETags aren't checked, and it stays off (logged at
+	// startup) where ETags aren't body MD5s, e.g. encrypted buckets.
+	VerifyWrites bool `yaml:"verify_writes"`
+
+	MetaMaxBytes   int64 `yaml:"meta_max_bytes"`
+	QuarantineMeta bool  `yaml:"quarantine_corrupt_meta"`
+	// RecreateBucket makes the bucket again if it is deleted while running;
+	// otherwise storage operations fail with a bucket-missing error and
+	// /healthz reports down until it is restored.
+	RecreateBucket bool `yaml:"recreate_bucket"`
+	// StorageSlowDownRetries/StorageSlowDownBackoffMS retry storage calls
+	// throttled with SlowDown or 503, doubling the backoff each time, before
+	// the error reaches the write retries or the request.
+	StorageSlowDownRetries   int `yaml:"storage_slowdown_retries"`
+	StorageSlowDownBackoffMS int `yaml:"storage_slowdown_backoff_ms"`
+
+	// RevalidateWorkers/RevalidateQueue size the background pool that
+	// refreshes stale objects served by serve_if_present. Excess jobs are
+	// dropped; zero workers disables background revalidation.
+	RevalidateWorkers int `yaml:"revalidate_workers"`
+	RevalidateQueue   int `yaml:"revalidate_queue"`
 }
 
+// metaOverhead is the room a meta needs besides its negative body or stored
+// headers: the other fields, the content type and JSON framing.
+const metaOverhead = 1 << 10
+
 func Load() (Config, error) {
 	cfg := Config{
 		TTLDefault:  3600,
@@ -29,13 +544,70 @@ func Load() (Config, error) {
 		ServeIf:     false,
 		ListenAddr:  ":8080",
 		MinioBucket: "proxy-cache",
+
+		MetaMaxBytes: cache.DefaultMetaMaxBytes,
+
+		StorageConnectAttempts:  5,
+		StorageConnectBackoffMS: 1000,
+
+		UpstreamTimeout: 60,
+
+		StorageWriteTimeout:   30,
+		StorageWriteRetries:   2,
+		StorageWriteBackoffMS: 100,
+
+		StorageSlowDownRetries:   3,
+		StorageSlowDownBackoffMS: 200,
+		ServeOnWriteFailure:      true,
+
+		LogSampleRate: 1,
+
+		MetricsMaxDomains: 100,
+
+		MetaReadConcurrency: 8,
+
+		MaxKeyLength: 1024,
+
+		ImmutableMaxAge: 31536000,
+
+		HotCacheMaxObject: 1 << 20,
+
+		DiskCacheBytes: 10 << 30,
+
+		AdmitWindow: 3600,
+
+		BreakerCooldown: 30,
+
+		PartitionIPv4Prefix: 24,
+		PartitionIPv6Prefix: 48,
+
+		ReadOnlyStatus:     503,
+		ReadOnlyServeStale: true,
+
+		ScrubRate: 10,
+
+		MaxDecompressedBytes: 1 << 30,
+
+		PresignRedirectStatus: 302,
+		PresignExpiry:         300,
+
+		RevalidateWorkers: 4,
+		RevalidateQueue:   256,
+
+		CopyBufferSize: 32 << 10,
+
+		StoredHeadersMaxBytes: 8 << 10,
+		CompressMinBytes:      256,
+		SlashMode:             "key",
 	}
 	path := os.Getenv("RAW_CACHER_CONFIG")
 	if path == "" {
 		path = "config.yaml"
 	}
 	if b, err := os.ReadFile(path); err == nil {
-		_ = yaml.Unmarshal(b, &cfg)
+		if err := yaml.Unmarshal(b, &cfg); err != nil {
+			return cfg, fmt.Errorf("%s: %w", path, err)
+		}
 	}
 	if v := os.Getenv("MINIO_ENDPOINT"); v != "" {
 		cfg.MinioEndpoint = v
@@ -49,24 +621,885 @@ func Load() (Config, error) {
 	if v := os.Getenv("MINIO_BUCKET"); v != "" {
 		cfg.MinioBucket = v
 	}
+	if v := os.Getenv("MINIO_REPLICAS"); v != "" {
+		cfg.MinioReplicas = splitList(v)
+	}
+	if v := os.Getenv("REPLICA_ROUND_ROBIN"); v != "" {
+		cfg.ReplicaRoundRobin = strings.EqualFold(v, "true") || v == "1"
+	}
 	if v := os.Getenv("TTL_DEFAULT"); v != "" {
-		if n, err := strconv.Atoi(v); err == nil {
-			cfg.TTLDefault = n
+		if n, err := ParseSeconds(v); err == nil {
+			cfg.TTLDefault = Seconds(n)
 		}
 	}
 	if v := os.Getenv("TTL_404"); v != "" {
+		if n, err := ParseSeconds(v); err == nil {
+			cfg.TTL404 = Seconds(n)
+		}
+	}
+	if v := os.Getenv("NEGATIVE_TTLS"); v != "" {
+		ttls, err := parseStatusMap(v)
+		if err != nil {
+			return cfg, fmt.Errorf("NEGATIVE_TTLS: %w", err)
+		}
+		cfg.NegativeTTLs = ttls
+	}
+	if v := os.Getenv("STATUS_MAP"); v != "" {
+		m, err := parseStatusMap(v)
+		if err != nil {
+			return cfg, fmt.Errorf("STATUS_MAP: %w", err)
+		}
+		cfg.StatusMap = m
+	}
+	for from, to := range cfg.StatusMap {
+		if to < 100 || to > 599 {
+			return cfg, fmt.Errorf("status_map: %d maps to invalid status %d", from, to)
+		}
+	}
+	if v := os.Getenv("TTL_NO_VALIDATORS"); v != "" {
+		if n, err := ParseSeconds(v); err == nil {
+			cfg.TTLNoValidators = Seconds(n)
+		}
+	}
+	if v := os.Getenv("NO_CACHE_HEADERS"); v != "" {
+		cfg.NoCacheHeaders = splitList(v)
+	}
+	if v := os.Getenv("HONOR_CACHE_CONTROL"); v != "" {
+		cfg.HonorCacheControl = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("MAX_OBJECTS_PER_DOMAIN"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.MaxObjectsPerDomain = n
+		}
+	}
+	if v := os.Getenv("HONOR_EXPIRES"); v != "" {
+		cfg.HonorExpires = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("REQUIRE_EXPLICIT_FRESHNESS"); v != "" {
+		cfg.RequireExplicitFreshness = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("UPSTREAM_TTL_MIN"); v != "" {
+		if n, err := ParseSeconds(v); err == nil {
+			cfg.UpstreamTTLMin = Seconds(n)
+		}
+	}
+	if v := os.Getenv("UPSTREAM_TTL_MAX"); v != "" {
+		if n, err := ParseSeconds(v); err == nil {
+			cfg.UpstreamTTLMax = Seconds(n)
+		}
+	}
+	if v := os.Getenv("STALE_WHILE_REVALIDATE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.StaleWhileRevalidate = n
+		}
+	}
+	if v := os.Getenv("STALE_IF_ERROR"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.StaleIfError = n
+		}
+	}
+	if v := os.Getenv("ZERO_LIFETIME"); v != "" {
+		cfg.ZeroLifetime = v
+	}
+	switch cfg.ZeroLifetime {
+	case "", "skip", "revalidate":
+	default:
+		return cfg, fmt.Errorf("zero_lifetime: must be skip or revalidate, got %q", cfg.ZeroLifetime)
+	}
+	if v := os.Getenv("FETCH_PATIENCE_MS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.FetchPatienceMS = n
+		}
+	}
+	if v := os.Getenv("FETCH_COOLDOWN_MS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.FetchCooldownMS = n
+		}
+	}
+	if v := os.Getenv("BREAKER_FAILURES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.BreakerFailures = n
+		}
+	}
+	if v := os.Getenv("BREAKER_COOLDOWN"); v != "" {
 		if n, err := strconv.Atoi(v); err == nil {
-			cfg.TTL404 = n
+			cfg.BreakerCooldown = n
 		}
 	}
+	if v := os.Getenv("ADAPTIVE_TTL_MAX"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.AdaptiveTTLMax = n
+		}
+	}
+	if v := os.Getenv("SAME_BODY_NOT_MODIFIED"); v != "" {
+		cfg.SameBodyNotModified = strings.EqualFold(v, "true") || v == "1"
+	}
 	if v := os.Getenv("SERVE_IF_PRESENT"); v != "" {
 		cfg.ServeIf = strings.EqualFold(v, "true") || v == "1"
 	}
+	if v := os.Getenv("CONDITIONAL_ON_MISS"); v != "" {
+		cfg.ConditionalOnMiss = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("CONDITIONAL_ON_HIT"); v != "" {
+		cfg.ConditionalOnHit = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("REQUEST_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.RequestTimeout = n
+		}
+	}
+	if v := os.Getenv("UPSTREAM_IDLE_CONN_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.UpstreamIdleConnTimeout = n
+		}
+	}
+	if v := os.Getenv("UPSTREAM_KEEPALIVE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.UpstreamKeepAlive = n
+		}
+	}
+	if v := os.Getenv("UPSTREAM_CERT_WARN_DAYS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.UpstreamCertWarnDays = n
+		}
+	}
+	if v := os.Getenv("UPSTREAM_BODY_IDLE_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.UpstreamBodyIdleTimeout = n
+		}
+	}
+	if v := os.Getenv("UPSTREAM_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.UpstreamTimeout = n
+		}
+	}
 	if v := os.Getenv("LISTEN_ADDR"); v != "" {
 		cfg.ListenAddr = v
 	}
+	if v := os.Getenv("STORAGE_CONNECT_ATTEMPTS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.StorageConnectAttempts = n
+		}
+	}
+	if v := os.Getenv("STORAGE_CONNECT_BACKOFF_MS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.StorageConnectBackoffMS = n
+		}
+	}
+	if cfg.StorageConnectBackoffMS <= 0 {
+		return cfg, fmt.Errorf("storage_connect_backoff_ms: must be positive, got %d", cfg.StorageConnectBackoffMS)
+	}
+	if v := os.Getenv("META_MAX_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.MetaMaxBytes = n
+		}
+	}
+	if v := os.Getenv("QUARANTINE_CORRUPT_META"); v != "" {
+		cfg.QuarantineMeta = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("RECREATE_BUCKET"); v != "" {
+		cfg.RecreateBucket = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("STORAGE_SLOWDOWN_RETRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.StorageSlowDownRetries = n
+		}
+	}
+	if v := os.Getenv("STORAGE_SLOWDOWN_BACKOFF_MS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.StorageSlowDownBackoffMS = n
+		}
+	}
+	if v := os.Getenv("EMPTY_BODY_TYPES"); v != "" {
+		cfg.EmptyBodyTypes = splitList(v)
+	}
+	if v := os.Getenv("EMPTY_BODY_ALLOW_TYPES"); v != "" {
+		cfg.EmptyBodyAllowTypes = splitList(v)
+	}
+	if v := os.Getenv("EMPTY_BODY_EXTENSIONS"); v != "" {
+		cfg.EmptyBodyExts = splitList(v)
+	}
+	if v := os.Getenv("EMPTY_BODY_NEG_TTL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.EmptyBodyNegTTL = n
+		}
+	}
+	if v := os.Getenv("CORS_ALLOW_ORIGINS"); v != "" {
+		cfg.CORS.AllowOrigins = splitList(v)
+	}
+	if v := os.Getenv("CACHE_VERSION"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.CacheVersion = n
+		}
+	}
+	if v := os.Getenv("ADMIN_TOKEN"); v != "" {
+		cfg.AdminToken = v
+	}
+	if v := os.Getenv("BYPASS_SECRET"); v != "" {
+		cfg.BypassSecret = v
+	}
+	if v := os.Getenv("PROXY_UPGRADES"); v != "" {
+		cfg.ProxyUpgrades = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("STORAGE_WRITE_TIMEOUT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.StorageWriteTimeout = n
+		}
+	}
+	if v := os.Getenv("STORAGE_WRITE_RETRIES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.StorageWriteRetries = n
+		}
+	}
+	if v := os.Getenv("STORAGE_WRITE_BACKOFF_MS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.StorageWriteBackoffMS = n
+		}
+	}
+	if v := os.Getenv("SERVE_ON_WRITE_FAILURE"); v != "" {
+		cfg.ServeOnWriteFailure = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("DEBUG_HEADERS"); v != "" {
+		cfg.DebugHeaders = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("WRITE_CONFLICT"); v != "" {
+		cfg.WriteConflict = v
+	}
+	switch cfg.WriteConflict {
+	case "", "wait", "skip":
+	default:
+		return cfg, fmt.Errorf("write_conflict: must be wait or skip, got %q", cfg.WriteConflict)
+	}
+	if v := os.Getenv("PARTIAL_RESPONSE"); v != "" {
+		cfg.PartialResponse = v
+	}
+	switch cfg.PartialResponse {
+	case "", "relay", "error":
+	default:
+		return cfg, fmt.Errorf("partial_response: must be relay or error, got %q", cfg.PartialResponse)
+	}
+	if v := os.Getenv("DUPLICATE_CONTENT_TYPE"); v != "" {
+		cfg.DuplicateContentType = v
+	}
+	switch cfg.DuplicateContentType {
+	case "", "first", "last":
+	default:
+		return cfg, fmt.Errorf("duplicate_content_type: must be first or last, got %q", cfg.DuplicateContentType)
+	}
+	if v := os.Getenv("TRACE_HEADERS"); v != "" {
+		cfg.TraceHeaders = splitList(v)
+	}
+	if v := os.Getenv("VARY_LANGUAGE"); v != "" {
+		cfg.VaryLanguage = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("PARTITION"); v != "" {
+		cfg.Partition = v
+	}
+	if v := os.Getenv("PARTITION_HEADER"); v != "" {
+		cfg.PartitionHeader = v
+	}
+	if v := os.Getenv("PARTITION_IPV4_PREFIX"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.PartitionIPv4Prefix = n
+		}
+	}
+	if v := os.Getenv("PARTITION_IPV6_PREFIX"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.PartitionIPv6Prefix = n
+		}
+	}
+	switch cfg.Partition {
+	case "", "ip":
+	case "header":
+		if cfg.PartitionHeader == "" {
+			return cfg, fmt.Errorf("partition: header requires partition_header")
+		}
+	default:
+		return cfg, fmt.Errorf("partition: must be ip or header, got %q", cfg.Partition)
+	}
+	if cfg.PartitionIPv4Prefix < 0 || cfg.PartitionIPv4Prefix > 32 {
+		return cfg, fmt.Errorf("partition_ipv4_prefix: must be 0-32, got %d", cfg.PartitionIPv4Prefix)
+	}
+	if cfg.PartitionIPv6Prefix < 0 || cfg.PartitionIPv6Prefix > 128 {
+		return cfg, fmt.Errorf("partition_ipv6_prefix: must be 0-128, got %d", cfg.PartitionIPv6Prefix)
+	}
+	if v := os.Getenv("POST_CACHE"); v != "" {
+		cfg.PostCache = make(map[string]string)
+		for _, item := range splitList(v) {
+			ct, name, _ := strings.Cut(item, "=")
+			cfg.PostCache[strings.TrimSpace(ct)] = strings.TrimSpace(name)
+		}
+	}
+	for ct, name := range cfg.PostCache {
+		switch name {
+		case "raw", "json", "graphql":
+		default:
+			return cfg, fmt.Errorf("post_cache.%s: unknown canonicalizer %q", ct, name)
+		}
+	}
+	if v := os.Getenv("RANGE_CACHING"); v != "" {
+		cfg.RangeCaching = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("CACHE_HEAD"); v != "" {
+		cfg.CacheHead = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("METRICS_MAX_DOMAINS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.MetricsMaxDomains = n
+		}
+	}
+	if v := os.Getenv("READ_ONLY"); v != "" {
+		cfg.ReadOnly = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("READ_ONLY_STATUS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.ReadOnlyStatus = n
+		}
+	}
+	if v := os.Getenv("READ_ONLY_SERVE_STALE"); v != "" {
+		cfg.ReadOnlyServeStale = strings.EqualFold(v, "true") || v == "1"
+	}
+	if cfg.ReadOnlyStatus < 400 || cfg.ReadOnlyStatus > 599 {
+		return cfg, fmt.Errorf("read_only_status: must be a 4xx or 5xx status, got %d", cfg.ReadOnlyStatus)
+	}
+	if v := os.Getenv("MAX_KEY_LENGTH"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.MaxKeyLength = n
+		}
+	}
+	if v := os.Getenv("ADMIT_AFTER"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.AdmitAfter = n
+		}
+	}
+	if v := os.Getenv("ADMIT_WINDOW"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.AdmitWindow = n
+		}
+	}
+	if v := os.Getenv("DISK_CACHE_DIR"); v != "" {
+		cfg.DiskCacheDir = v
+	}
+	if v := os.Getenv("DISK_CACHE_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.DiskCacheBytes = n
+		}
+	}
+	if v := os.Getenv("HOT_CACHE_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.HotCacheBytes = n
+		}
+	}
+	if v := os.Getenv("HOT_CACHE_MAX_OBJECT"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.HotCacheMaxObject = n
+		}
+	}
+	if v := os.Getenv("HOT_CACHE_WARM"); v != "" {
+		cfg.HotCacheWarm = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("MAX_UPSTREAM_FETCHES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.MaxUpstreamFetches = n
+		}
+	}
+	if v := os.Getenv("MAX_FETCHES_PER_DOMAIN"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.MaxFetchesPerDomain = n
+		}
+	}
+	if v := os.Getenv("META_READ_CONCURRENCY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.MetaReadConcurrency = n
+		}
+	}
+	if cfg.MetaReadConcurrency < 1 {
+		cfg.MetaReadConcurrency = 1
+	}
+	if v := os.Getenv("ACCESS_LOG"); v != "" {
+		cfg.AccessLog = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("LOG_SAMPLE_EVERY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.LogSampleEvery = n
+		}
+	}
+	if v := os.Getenv("LOG_SAMPLE_RATE"); v != "" {
+		if f, err := strconv.ParseFloat(v, 64); err == nil {
+			cfg.LogSampleRate = f
+		}
+	}
+	if v := os.Getenv("LOG_SLOW_MS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.LogSlowMS = n
+		}
+	}
+	if v := os.Getenv("TRUST_PROXY_HEADERS"); v != "" {
+		cfg.TrustProxyHeaders = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("MAX_REQUESTS_PER_CLIENT"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.MaxRequestsPerClient = n
+		}
+	}
+	if v := os.Getenv("COMPRESS_VARIANTS"); v != "" {
+		cfg.CompressVariants = splitList(v)
+	}
+	if err := validateEncodings(cfg.CompressVariants); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("SLASH_MODE"); v != "" {
+		cfg.SlashMode = v
+	}
+	switch cfg.SlashMode {
+	case "key", "all", "off":
+	default:
+		return cfg, fmt.Errorf("slash_mode: must be key, all or off, got %q", cfg.SlashMode)
+	}
+	if v := os.Getenv("TRAILING_SLASH"); v != "" {
+		cfg.TrailingSlash = v
+	}
+	switch cfg.TrailingSlash {
+	case "", "strip", "append":
+	default:
+		return cfg, fmt.Errorf("trailing_slash: must be strip or append, got %q", cfg.TrailingSlash)
+	}
+	if v := os.Getenv("TRAILING_SLASH_REDIRECT"); v != "" {
+		cfg.TrailingSlashRedirect = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("RECONCILE_INTERVAL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.ReconcileInterval = n
+		}
+	}
+	if v := os.Getenv("RECONCILE_RATE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.ReconcileRate = n
+		}
+	}
+	if v := os.Getenv("SWEEP_MAX_LATENCY_MS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.SweepMaxLatencyMS = n
+		}
+	}
+	if v := os.Getenv("SCRUB_INTERVAL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.ScrubInterval = n
+		}
+	}
+	if v := os.Getenv("SCRUB_RATE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.ScrubRate = n
+		}
+	}
+	if v := os.Getenv("SCRUB_QUARANTINE"); v != "" {
+		cfg.ScrubQuarantine = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("DEDUP"); v != "" {
+		cfg.Dedup = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("DISABLE_HTTP2"); v != "" {
+		cfg.DisableHTTP2 = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("STORE_HEADERS"); v != "" {
+		cfg.StoreHeaders = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("PRESIGN_REDIRECT_MIN_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.PresignRedirectMinBytes = n
+		}
+	}
+	if v := os.Getenv("PRESIGN_REDIRECT_STATUS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.PresignRedirectStatus = n
+		}
+	}
+	if v := os.Getenv("PRESIGN_EXPIRY"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.PresignExpiry = n
+		}
+	}
+	if v := os.Getenv("COPY_BUFFER_SIZE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.CopyBufferSize = n
+		}
+	}
+	if v := os.Getenv("COMPRESS_AT_REST"); v != "" {
+		cfg.CompressAtRest = v
+	}
+	if v := os.Getenv("COMPRESS_AT_REST_LEVEL"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.CompressAtRestLevel = n
+		}
+	}
+	if v := os.Getenv("COMPRESS_AT_REST_DICT"); v != "" {
+		cfg.CompressAtRestDict = v
+	}
+	if v := os.Getenv("MAX_DECOMPRESSED_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.MaxDecompressedBytes = n
+		}
+	}
+	if v := os.Getenv("MAX_OBJECT_BYTES"); v != "" {
+		if n, err := strconv.ParseInt(v, 10, 64); err == nil {
+			cfg.MaxObjectBytes = n
+		}
+	}
+	switch cfg.CompressAtRest {
+	case "", "gzip", "zstd":
+	default:
+		return cfg, fmt.Errorf("compress_at_rest: must be gzip or zstd, got %q", cfg.CompressAtRest)
+	}
+	if cfg.CompressAtRestDict != "" && cfg.CompressAtRest != "zstd" {
+		return cfg, fmt.Errorf("compress_at_rest_dict: requires compress_at_rest zstd")
+	}
+	if v := os.Getenv("VERIFY_STORE_ETAG"); v != "" {
+		cfg.VerifyStoreETag = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("VERIFY_ON_READ"); v != "" {
+		cfg.VerifyOnRead = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("VERIFY_WRITES"); v != "" {
+		cfg.VerifyWrites = strings.EqualFold(v, "true") || v == "1"
+	}
+	if v := os.Getenv("INTEGRITY_MISMATCH"); v != "" {
+		cfg.IntegrityMismatch = v
+	}
+	switch cfg.IntegrityMismatch {
+	case "", "refetch", "serve", "fail":
+	default:
+		return cfg, fmt.Errorf("integrity_mismatch: must be refetch, serve or fail, got %q", cfg.IntegrityMismatch)
+	}
+	if v := os.Getenv("REVALIDATE_WORKERS"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.RevalidateWorkers = n
+		}
+	}
+	if v := os.Getenv("REVALIDATE_QUEUE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.RevalidateQueue = n
+		}
+	}
+	if v := os.Getenv("NEGATIVE_BODY_MAX_BYTES"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.NegativeBodyMaxBytes = n
+		}
+	}
+	// Negative bodies are kept base64-encoded in meta, which has to stay
+	// under meta_max_bytes or it is rejected on read.
+	if n := int64(cfg.NegativeBodyMaxBytes); n > 0 && cfg.MetaMaxBytes > 0 &&
+		(n+2)/3*4+metaOverhead > cfg.MetaMaxBytes {
+		return cfg, fmt.Errorf("negative_body_max_bytes: %d doesn't fit meta_max_bytes %d once encoded (at most %d)",
+			n, cfg.MetaMaxBytes, (cfg.MetaMaxBytes-metaOverhead)/4*3)
+	}
+	// Likewise the header snapshot, which zero would leave unbounded.
+	if cfg.StoreHeaders {
+		limit := cfg.MetaMaxBytes
+		if limit <= 0 {
+			limit = cache.DefaultMetaMaxBytes
+		}
+		if n := int64(cfg.StoredHeadersMaxBytes); n <= 0 || n+metaOverhead > limit {
+			return cfg, fmt.Errorf("stored_headers_max_bytes: %d must be positive and fit meta_max_bytes %d (at most %d)",
+				n, limit, limit-metaOverhead)
+		}
+	}
+	if v := os.Getenv("ALLOWED_DOMAINS"); v != "" {
+		cfg.AllowedDomains = splitList(v)
+	}
+	if v := os.Getenv("ALLOWLIST_FAIL_MODE"); v != "" {
+		cfg.AllowlistFailMode = v
+	}
+	switch cfg.AllowlistFailMode {
+	case "", "open", "closed":
+	default:
+		return cfg, fmt.Errorf("allowlist_fail_mode: must be open or closed, got %q", cfg.AllowlistFailMode)
+	}
+	if err := validateAllowlist(cfg.AllowedDomains); err != nil {
+		return cfg, err
+	}
+	if v := os.Getenv("IMMUTABLE_ROUTES"); v != "" {
+		cfg.ImmutableRoutes = splitList(v)
+	}
+	if v := os.Getenv("IMMUTABLE_MAX_AGE"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil {
+			cfg.ImmutableMaxAge = n
+		}
+	}
+	for i, expr := range cfg.ImmutableRoutes {
+		re, err := regexp.Compile(expr)
+		if err != nil {
+			return cfg, fmt.Errorf("immutable_routes[%d]: %w", i, err)
+		}
+		cfg.immutableRes = append(cfg.immutableRes, re)
+	}
+	for i := range cfg.TTLRules {
+		re, err := regexp.Compile(cfg.TTLRules[i].Match)
+		if err != nil {
+			return cfg, fmt.Errorf("ttl_rules[%d]: %w", i, err)
+		}
+		cfg.TTLRules[i].re = re
+	}
+	for i := range cfg.Placeholders {
+		p := &cfg.Placeholders[i]
+		re, err := regexp.Compile(p.Match)
+		if err != nil {
+			return cfg, fmt.Errorf("placeholders[%d]: %w", i, err)
+		}
+		p.re = re
+		if p.body, err = os.ReadFile(p.File); err != nil {
+			return cfg, fmt.Errorf("placeholders[%d]: %w", i, err)
+		}
+		if p.Status == 0 {
+			p.Status = 200
+		}
+		if p.Status < 200 || p.Status > 599 {
+			return cfg, fmt.Errorf("placeholders[%d]: invalid status %d", i, p.Status)
+		}
+	}
+	for i := range cfg.ContentTypeRules {
+		re, err := regexp.Compile(cfg.ContentTypeRules[i].Match)
+		if err != nil {
+			return cfg, fmt.Errorf("content_type_rules[%d]: %w", i, err)
+		}
+		cfg.ContentTypeRules[i].re = re
+	}
+	cfg.Domains = normalizeDomains(cfg.Domains)
+	if v := os.Getenv("KEY_DOMAINS"); v != "" {
+		cfg.KeyDomains = make(map[string]string)
+		for _, item := range splitList(v) {
+			from, to, _ := strings.Cut(item, "=")
+			cfg.KeyDomains[strings.TrimSpace(from)] = strings.TrimSpace(to)
+		}
+	}
+	keyDomains := make(map[string]string, len(cfg.KeyDomains))
+	for from, to := range cfg.KeyDomains {
+		keyDomains[strings.ToLower(from)] = strings.ToLower(to)
+	}
+	cfg.KeyDomains = keyDomains
+	for name, d := range cfg.Domains {
+		switch d.UpstreamMethod {
+		case "", "GET", "HEAD":
+		default:
+			return cfg, fmt.Errorf("domains.%s.upstream_method: must be GET or HEAD, got %q", name, d.UpstreamMethod)
+		}
+		for _, v := range []string{d.TLSMinVersion, d.TLSMaxVersion} {
+			switch v {
+			case "", "1.0", "1.1", "1.2", "1.3":
+			default:
+				return cfg, fmt.Errorf("domains.%s: TLS version must be 1.0 to 1.3, got %q", name, v)
+			}
+		}
+	}
 	if cfg.MinioEndpoint == "" || cfg.MinioAccess == "" || cfg.MinioSecret == "" || cfg.MinioBucket == "" {
 		return cfg, errors.New("minio config incomplete (endpoint/access/secret/bucket)")
 	}
 	return cfg, nil
 }
+
+// normalizeDomains lowercases domain keys so lookups are case-insensitive.
+func normalizeDomains(in map[string]DomainConfig) map[string]DomainConfig {
+	out := make(map[string]DomainConfig, len(in))
+	for k, v := range in {
+		out[strings.ToLower(k)] = v
+	}
+	return out
+}
+
+// splitList parses a comma-separated env value, dropping empty items.
+func splitList(v string) []string {
+	var out []string
+	for _, p := range strings.Split(v, ",") {
+		if p = strings.TrimSpace(p); p != "" {
+			out = append(out, p)
+		}
+	}
+	return out
+}
+
+// AllowlistError reports an invalid allowed_domains entry.
+type AllowlistError struct {
+	Entry string
+}
+
+func (e *AllowlistError) Error() string {
+	return fmt.Sprintf("allowed_domains: invalid entry %q", e.Entry)
+}
+
+// validateAllowlist checks that every entry is a host or "*." wildcard.
+func validateAllowlist(entries []string) error {
+	for _, e := range entries {
+		host := strings.TrimPrefix(e, "*.")
+		if host == "" || strings.ContainsAny(host, "/* ") {
+			return &AllowlistError{Entry: e}
+		}
+	}
+	return nil
+}
+
+// validateEncodings rejects content-codings we can't produce.
+func validateEncodings(encs []string) error {
+	for _, e := range encs {
+		if e != "br" && e != "gzip" {
+			return fmt.Errorf("compress_variants: unsupported encoding %q", e)
+		}
+	}
+	return nil
+}
+
+// NegativeTTL returns how long to negatively cache an upstream status, or 0
+// if it shouldn't be cached.
+func (c *Config) NegativeTTL(status int) int {
+	if ttl, ok := c.NegativeTTLs[status]; ok {
+		return ttl
+	}
+	if status == 404 {
+		return int(c.TTL404)
+	}
+	return 0
+}
+
+// ClientStatus returns the status to send clients for an upstream status,
+// after status_map.
+func (c *Config) ClientStatus(status int) int {
+	if to, ok := c.StatusMap[status]; ok {
+		return to
+	}
+	return status
+}
+
+// parseStatusMap parses status=value pairs such as "404=60,503=5".
+func parseStatusMap(v string) (map[int]int, error) {
+	out := make(map[int]int)
+	for _, item := range splitList(v) {
+		k, val, ok := strings.Cut(item, "=")
+		if !ok {
+			return nil, fmt.Errorf("%q: want status=value", item)
+		}
+		status, err := strconv.Atoi(strings.TrimSpace(k))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		ttl, err := strconv.Atoi(strings.TrimSpace(val))
+		if err != nil {
+			return nil, fmt.Errorf("%q: %w", item, err)
+		}
+		out[status] = ttl
+	}
+	return out, nil
+}
+
+// Placeholder returns the first placeholder matching domain/route, or nil.
+func (c *Config) Placeholder(domain, route string) *Placeholder {
+	path := strings.ToLower(domain) + "/" + route
+	for i := range c.Placeholders {
+		if p := &c.Placeholders[i]; p.re != nil && p.re.MatchString(path) {
+			return p
+		}
+	}
+	return nil
+}
+
+// ExpectedTypes returns the content types allowed for domain/route by the
+// first matching content_type_rules entry, or nil if none matches.
+func (c *Config) ExpectedTypes(domain, route string) []string {
+	path := strings.ToLower(domain) + "/" + route
+	for _, r := range c.ContentTypeRules {
+		if r.re != nil && r.re.MatchString(path) {
+			return r.Types
+		}
+	}
+	return nil
+}
+
+// RouteTTL returns the TTL of the first rule matching domain/route, or
+// TTLDefault.
+func (c *Config) RouteTTL(domain, route string) int {
+	if len(c.TTLRules) == 0 {
+		return int(c.TTLDefault)
+	}
+	path := strings.ToLower(domain) + "/" + route
+	for _, r := range c.TTLRules {
+		if r.re != nil && r.re.MatchString(path) {
+			return int(r.TTL)
+		}
+	}
+	return int(c.TTLDefault)
+}
+
+// Immutable reports whether responses for domain/route are marked
+// immutable, by the domain's setting or an immutable_routes match.
+func (c *Config) Immutable(domain, route string) bool {
+	if c.Domain(domain).Immutable {
+		return true
+	}
+	if len(c.immutableRes) == 0 {
+		return false
+	}
+	path := strings.ToLower(domain) + "/" + route
+	for _, re := range c.immutableRes {
+		if re.MatchString(path) {
+			return true
+		}
+	}
+	return false
+}
+
+// KeyDomain returns the domain entries for name are cached under.
+func (c *Config) KeyDomain(name string) string {
+	if to, ok := c.KeyDomains[strings.ToLower(name)]; ok && to != "" {
+		return to
+	}
+	return name
+}
+
+// Domain returns the overrides for name, or the zero value.
+func (c *Config) Domain(name string) DomainConfig {
+	return c.Domains[strings.ToLower(name)]
+}
+
+// RestartRequired lists the settings that differ between old and new but
+// are only read at startup, so a reload can't apply them.
+func RestartRequired(old, new Config) []string {
+	var out []string
+	check := func(name string, changed bool) {
+		if changed {
+			out = append(out, name)
+		}
+	}
+	check("listen_addr", old.ListenAddr != new.ListenAddr)
+	check("minio_endpoint", old.MinioEndpoint != new.MinioEndpoint)
+	check("minio_access_key", old.MinioAccess != new.MinioAccess)
+	check("minio_secret_key", old.MinioSecret != new.MinioSecret)
+	check("minio_bucket", old.MinioBucket != new.MinioBucket)
+	check("minio_replicas", strings.Join(old.MinioReplicas, ",") != strings.Join(new.MinioReplicas, ","))
+	check("replica_round_robin", old.ReplicaRoundRobin != new.ReplicaRoundRobin)
+	check("meta_max_bytes", old.MetaMaxBytes != new.MetaMaxBytes)
+	check("quarantine_corrupt_meta", old.QuarantineMeta != new.QuarantineMeta)
+	check("recreate_bucket", old.RecreateBucket != new.RecreateBucket)
+	check("verify_writes", old.VerifyWrites != new.VerifyWrites)
+	check("storage_slowdown_retries", old.StorageSlowDownRetries != new.StorageSlowDownRetries)
+	check("storage_slowdown_backoff_ms", old.StorageSlowDownBackoffMS != new.StorageSlowDownBackoffMS)
+	check("dedup", old.Dedup != new.Dedup)
+	check("compress_at_rest", old.CompressAtRest != new.CompressAtRest)
+	check("compress_at_rest_level", old.CompressAtRestLevel != new.CompressAtRestLevel)
+	check("compress_at_rest_dict", old.CompressAtRestDict != new.CompressAtRestDict)
+	check("max_objects_per_domain", (old.MaxObjectsPerDomain > 0) != (new.MaxObjectsPerDomain > 0))
+	check("storage_connect_attempts", old.StorageConnectAttempts != new.StorageConnectAttempts)
+	check("storage_connect_backoff_ms", old.StorageConnectBackoffMS != new.StorageConnectBackoffMS)
+	check("reconcile_interval", old.ReconcileInterval != new.ReconcileInterval)
+	check("scrub_interval", old.ScrubInterval != new.ScrubInterval)
+	check("scrub_rate", old.ScrubRate != new.ScrubRate)
+	check("metrics_max_domains", old.MetricsMaxDomains != new.MetricsMaxDomains)
+	check("max_key_length", old.MaxKeyLength != new.MaxKeyLength)
+	check("disk_cache_dir", old.DiskCacheDir != new.DiskCacheDir)
+	check("disk_cache_bytes", old.DiskCacheBytes != new.DiskCacheBytes)
+	check("hot_cache_bytes", old.HotCacheBytes != new.HotCacheBytes)
+	check("hot_cache_max_object", old.HotCacheMaxObject != new.HotCacheMaxObject)
+	check("hot_cache_warm", old.HotCacheWarm != new.HotCacheWarm)
+	check("max_upstream_fetches", old.MaxUpstreamFetches != new.MaxUpstreamFetches)
+	check("max_fetches_per_domain", old.MaxFetchesPerDomain != new.MaxFetchesPerDomain)
+	check("meta_read_concurrency", old.MetaReadConcurrency != new.MetaReadConcurrency)
+	check("revalidate_workers", old.RevalidateWorkers != new.RevalidateWorkers)
+	check("revalidate_queue", old.RevalidateQueue != new.RevalidateQueue)
+	return out
+}
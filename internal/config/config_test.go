@@ -0,0 +1,894 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// load runs Load over yaml with the required storage settings in the
+// environment.
+func load(t *testing.T, yaml string) (Config, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RAW_CACHER_CONFIG", path)
+	t.Setenv("MINIO_ENDPOINT", "localhost:9000")
+	t.Setenv("MINIO_ACCESS_KEY", "access")
+	t.Setenv("MINIO_SECRET_KEY", "secret")
+	return Load()
+}
+
+func TestNegativeBodyFitsMeta(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr bool
+	}{
+		{"largest that fits", "negative_body_max_bytes: 48384\n", false},
+		{"too large", "negative_body_max_bytes: 48385\n", true},
+		{"smaller meta", "meta_max_bytes: 4096\nnegative_body_max_bytes: 4096\n", true},
+		{"disabled", "meta_max_bytes: 4096\nnegative_body_max_bytes: 0\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := load(t, tt.yaml); (err != nil) != tt.wantErr {
+				t.Errorf("Load err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestStoredHeadersFitMeta(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr bool
+	}{
+		{"default", "store_headers: true\n", false},
+		{"largest that fits", "store_headers: true\nstored_headers_max_bytes: 64512\n", false},
+		{"too large", "store_headers: true\nstored_headers_max_bytes: 64513\n", true},
+		{"smaller meta", "store_headers: true\nmeta_max_bytes: 4096\n", true},
+		{"unbounded", "store_headers: true\nstored_headers_max_bytes: 0\n", true},
+		{"unbounded, not storing", "stored_headers_max_bytes: 0\n", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := load(t, tt.yaml); (err != nil) != tt.wantErr {
+				t.Errorf("Load err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpstreamMethod(t *testing.T) {
+	tests := []struct {
+		method  string
+		wantErr bool
+	}{
+		{"GET", false},
+		{"HEAD", false},
+		{"POST", true},
+		{"get", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method, func(t *testing.T) {
+			cfg, err := load(t, "domains:\n  example.com:\n    upstream_method: "+tt.method+"\n")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.Domain("example.com").UpstreamMethod != tt.method {
+				t.Errorf("UpstreamMethod = %q", cfg.Domain("example.com").UpstreamMethod)
+			}
+		})
+	}
+}
+
+func TestRouteTTL(t *testing.T) {
+	const yaml = `ttl_default: 3600
+ttl_rules:
+  - match: '^github\.com/.*/releases/latest$'
+    ttl: 300
+  - match: '/releases/'
+    ttl: 86400
+  - match: '/latest$'
+    ttl: 60
+`
+	tests := []struct {
+		domain, route string
+		want          int
+	}{
+		{"github.com", "acme/tool/releases/latest", 300},
+		{"GitHub.com", "acme/tool/releases/latest", 300},
+		{"example.com", "acme/tool/releases/latest", 86400},
+		{"example.com", "acme/tool/releases/v1.2.3/tool.tgz", 86400},
+		{"example.com", "acme/tool/latest", 60},
+		{"example.com", "acme/tool/latest/file", 3600},
+		{"example.com", "index.html", 3600},
+	}
+	cfg, err := load(t, yaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain+"/"+tt.route, func(t *testing.T) {
+			if got := cfg.RouteTTL(tt.domain, tt.route); got != tt.want {
+				t.Errorf("RouteTTL = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTTLRulesInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr bool
+	}{
+		{"valid", "ttl_rules:\n  - match: '\\.tgz$'\n    ttl: 1d\n", false},
+		{"bad regex", "ttl_rules:\n  - match: '(unclosed'\n    ttl: 60\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := load(t, tt.yaml); (err != nil) != tt.wantErr {
+				t.Errorf("Load err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestZeroLifetime(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"skip", false},
+		{"revalidate", false},
+		{"store", true},
+		{"Revalidate", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			cfg, err := load(t, "zero_lifetime: "+tt.value+"\n")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.ZeroLifetime != tt.value {
+				t.Errorf("ZeroLifetime = %q", cfg.ZeroLifetime)
+			}
+		})
+	}
+}
+
+func TestImmutable(t *testing.T) {
+	const yaml = `immutable_routes: ['^example\.com/assets/', '\.[0-9a-f]{8}\.js$']
+domains:
+  static.example.com:
+    immutable: true
+`
+	cfg, err := load(t, yaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain, route string
+		want          bool
+	}{
+		{"example.com", "assets/logo.png", true},
+		{"EXAMPLE.com", "assets/logo.png", true},
+		{"example.com", "app.0123abcd.js", true},
+		{"example.com", "app.js", false},
+		{"other.example.com", "assets/logo.png", false},
+		{"static.example.com", "anything", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain+"/"+tt.route, func(t *testing.T) {
+			if got := cfg.Immutable(tt.domain, tt.route); got != tt.want {
+				t.Errorf("Immutable = %v, want %v", got, tt.want)
+			}
+		})
+	}
+	if _, err := load(t, "immutable_routes: ['(']\n"); err == nil {
+		t.Error("invalid immutable_routes pattern accepted")
+	}
+}
+
+func TestWriteConflict(t *testing.T) {
+	tests := []struct {
+		value   string
+		wantErr bool
+	}{
+		{"wait", false},
+		{"skip", false},
+		{"drop", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.value, func(t *testing.T) {
+			if _, err := load(t, "write_conflict: "+tt.value+"\n"); (err != nil) != tt.wantErr {
+				t.Errorf("Load err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestKeyDomain(t *testing.T) {
+	tests := []struct {
+		name, yaml, env string
+		domain, want    string
+	}{
+		{"mapped", "key_domains:\n  cdn1.example.com: cdn.example.com\n", "", "cdn1.example.com", "cdn.example.com"},
+		{"case folded", "key_domains:\n  CDN1.example.com: CDN.example.com\n", "", "cdn1.EXAMPLE.com", "cdn.example.com"},
+		{"unmapped", "key_domains:\n  cdn1.example.com: cdn.example.com\n", "", "other.example.com", "other.example.com"},
+		{"empty target", "key_domains:\n  cdn1.example.com: ''\n", "", "cdn1.example.com", "cdn1.example.com"},
+		{"environment", "", "cdn1.example.com=cdn.example.com, cdn2.example.com = cdn.example.com", "cdn2.example.com", "cdn.example.com"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("KEY_DOMAINS", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cfg.KeyDomain(tt.domain); got != tt.want {
+				t.Errorf("KeyDomain(%q) = %q, want %q", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStatusMap(t *testing.T) {
+	tests := []struct {
+		name, yaml, env string
+		status, want    int
+		wantErr         bool
+	}{
+		{"mapped", "status_map: {403: 404}\n", "", 403, 404, false},
+		{"unmapped", "status_map: {403: 404}\n", "", 500, 500, false},
+		{"environment", "", "403=404,401=404", 401, 404, false},
+		{"invalid target", "status_map: {403: 4040}\n", "", 0, 0, true},
+		{"malformed environment", "", "403:404", 0, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("STATUS_MAP", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.ClientStatus(tt.status) != tt.want {
+				t.Errorf("ClientStatus(%d) = %d, want %d", tt.status, cfg.ClientStatus(tt.status), tt.want)
+			}
+		})
+	}
+}
+
+func TestPartition(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		wantErr bool
+	}{
+		{"ip", "partition: ip\n", false},
+		{"header", "partition: header\npartition_header: X-Tenant\n", false},
+		{"header without a name", "partition: header\n", true},
+		{"unknown", "partition: cookie\n", true},
+		{"ipv4 prefix too long", "partition: ip\npartition_ipv4_prefix: 33\n", true},
+		{"ipv6 prefix negative", "partition: ip\npartition_ipv6_prefix: -1\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := load(t, tt.yaml); (err != nil) != tt.wantErr {
+				t.Errorf("Load err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestUpstreamConnTuning(t *testing.T) {
+	const yaml = "upstream_idle_conn_timeout: 20\nupstream_keepalive: 10\ndomains:\n  example.com:\n    idle_conn_timeout: 5\n    keepalive: 3\n"
+	tests := []struct {
+		name                string
+		env                 map[string]string
+		wantIdle, wantAlive int
+	}{
+		{"yaml", nil, 20, 10},
+		{"env overrides", map[string]string{"UPSTREAM_IDLE_CONN_TIMEOUT": "30", "UPSTREAM_KEEPALIVE": "15"}, 30, 15},
+		{"bad env ignored", map[string]string{"UPSTREAM_IDLE_CONN_TIMEOUT": "soon"}, 20, 10},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := load(t, yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.UpstreamIdleConnTimeout != tt.wantIdle || cfg.UpstreamKeepAlive != tt.wantAlive {
+				t.Errorf("idle %d, keep-alive %d; want %d, %d", cfg.UpstreamIdleConnTimeout, cfg.UpstreamKeepAlive, tt.wantIdle, tt.wantAlive)
+			}
+			if d := cfg.Domain("example.com"); d.IdleConnTimeout != 5 || d.KeepAlive != 3 {
+				t.Errorf("domain override %d, %d", d.IdleConnTimeout, d.KeepAlive)
+			}
+		})
+	}
+}
+
+func TestConditionalOnHit(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		want bool
+	}{
+		{"default", "", "", false},
+		{"yaml", "conditional_on_hit: true\n", "", true},
+		{"env", "", "1", true},
+		{"env overrides yaml", "conditional_on_hit: true\n", "false", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("CONDITIONAL_ON_HIT", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ConditionalOnHit != tt.want {
+				t.Errorf("ConditionalOnHit = %v, want %v", cfg.ConditionalOnHit, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompressAtRestDict(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{"zstd", "compress_at_rest: zstd\ncompress_at_rest_dict: /etc/dict\n", "", "/etc/dict", false},
+		{"env", "compress_at_rest: zstd\n", "/etc/env-dict", "/etc/env-dict", false},
+		{"gzip", "compress_at_rest: gzip\ncompress_at_rest_dict: /etc/dict\n", "", "", true},
+		{"compression off", "compress_at_rest_dict: /etc/dict\n", "", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("COMPRESS_AT_REST_DICT", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.CompressAtRestDict != tt.want {
+				t.Errorf("CompressAtRestDict = %q, want %q", cfg.CompressAtRestDict, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxRequestsPerClient(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		want int
+	}{
+		{"default", "", "", 0},
+		{"yaml", "max_requests_per_client: 8\n", "", 8},
+		{"env", "max_requests_per_client: 8\n", "16", 16},
+		{"bad env ignored", "max_requests_per_client: 8\n", "many", 8},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("MAX_REQUESTS_PER_CLIENT", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.MaxRequestsPerClient != tt.want {
+				t.Errorf("MaxRequestsPerClient = %d, want %d", cfg.MaxRequestsPerClient, tt.want)
+			}
+		})
+	}
+}
+
+func TestExpectedTypes(t *testing.T) {
+	const yaml = `content_type_rules:
+  - match: '^api\.example\.com/v1/'
+    types: ["application/json"]
+  - match: '^api\.example\.com/'
+    types: ["application/json", "text/plain"]
+`
+	cfg, err := load(t, yaml)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		domain, route string
+		want          []string
+	}{
+		{"api.example.com", "v1/users", []string{"application/json"}},
+		{"API.example.com", "v1/users", []string{"application/json"}},
+		{"api.example.com", "v2/users", []string{"application/json", "text/plain"}},
+		{"example.com", "v1/users", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain+"/"+tt.route, func(t *testing.T) {
+			if got := cfg.ExpectedTypes(tt.domain, tt.route); strings.Join(got, ",") != strings.Join(tt.want, ",") {
+				t.Errorf("ExpectedTypes = %q, want %q", got, tt.want)
+			}
+		})
+	}
+	if _, err := load(t, "content_type_rules:\n  - match: '('\n    types: [\"a/b\"]\n"); err == nil {
+		t.Error("invalid match pattern accepted")
+	}
+}
+
+func TestUpstreamTTLBounds(t *testing.T) {
+	tests := []struct {
+		name             string
+		yaml             string
+		env              map[string]string
+		wantExpires      bool
+		wantMin, wantMax Seconds
+	}{
+		{"yaml", "honor_expires: true\nupstream_ttl_min: 1m\nupstream_ttl_max: 1d\n", nil, true, 60, 86400},
+		{"env", "", map[string]string{"HONOR_EXPIRES": "1", "UPSTREAM_TTL_MIN": "30", "UPSTREAM_TTL_MAX": "2h"}, true, 30, 7200},
+		{"bad env ignored", "upstream_ttl_max: 1h\n", map[string]string{"UPSTREAM_TTL_MAX": "forever"}, false, 0, 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.HonorExpires != tt.wantExpires || cfg.UpstreamTTLMin != tt.wantMin || cfg.UpstreamTTLMax != tt.wantMax {
+				t.Errorf("HonorExpires %v, bounds %d..%d; want %v, %d..%d", cfg.HonorExpires, cfg.UpstreamTTLMin, cfg.UpstreamTTLMax, tt.wantExpires, tt.wantMin, tt.wantMax)
+			}
+		})
+	}
+}
+
+func TestMaxObjectsPerDomain(t *testing.T) {
+	tests := []struct {
+		name        string
+		old, new    int
+		wantRestart bool
+	}{
+		{"enabled", 0, 100, true},
+		{"disabled", 100, 0, true},
+		{"resized", 100, 50, false},
+		{"off", 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, fmt.Sprintf("max_objects_per_domain: %d\n", tt.new))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.MaxObjectsPerDomain != tt.new {
+				t.Fatalf("MaxObjectsPerDomain = %d, want %d", cfg.MaxObjectsPerDomain, tt.new)
+			}
+			old := cfg
+			old.MaxObjectsPerDomain = tt.old
+			restart := strings.Contains(strings.Join(RestartRequired(old, cfg), ","), "max_objects_per_domain")
+			if restart != tt.wantRestart {
+				t.Errorf("restart required = %v, want %v", restart, tt.wantRestart)
+			}
+		})
+	}
+}
+
+func TestFetchCooldown(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		want int
+	}{
+		{"default", "", "", 0},
+		{"yaml", "fetch_cooldown_ms: 250\n", "", 250},
+		{"env", "fetch_cooldown_ms: 250\n", "500", 500},
+		{"bad env ignored", "fetch_cooldown_ms: 250\n", "soon", 250},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("FETCH_COOLDOWN_MS", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.FetchCooldownMS != tt.want {
+				t.Errorf("FetchCooldownMS = %d, want %d", cfg.FetchCooldownMS, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuplicateContentType(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		env     string
+		want    string
+		wantErr bool
+	}{
+		{"default", "", "", "", false},
+		{"first", "duplicate_content_type: first\n", "", "first", false},
+		{"last", "duplicate_content_type: last\n", "", "last", false},
+		{"env", "duplicate_content_type: first\n", "last", "last", false},
+		{"unknown", "duplicate_content_type: middle\n", "", "", true},
+		{"unknown env", "", "both", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("DUPLICATE_CONTENT_TYPE", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && cfg.DuplicateContentType != tt.want {
+				t.Errorf("DuplicateContentType = %q, want %q", cfg.DuplicateContentType, tt.want)
+			}
+		})
+	}
+}
+
+func TestVaryAccept(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		domain    string
+		wantVary  bool
+		wantTypes []string
+	}{
+		{"off", "", "api.example.com", false, nil},
+		{"on", "domains:\n  api.example.com:\n    vary_accept: true\n", "api.example.com", true, nil},
+		{"with types", "domains:\n  api.example.com:\n    vary_accept: true\n    accept_types: [application/json, application/xml]\n", "api.example.com", true, []string{"application/json", "application/xml"}},
+		{"other domain", "domains:\n  api.example.com:\n    vary_accept: true\n", "example.com", false, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			dc := cfg.Domain(tt.domain)
+			if dc.VaryAccept != tt.wantVary || fmt.Sprint(dc.AcceptTypes) != fmt.Sprint(tt.wantTypes) {
+				t.Errorf("VaryAccept = %v, AcceptTypes = %v; want %v, %v", dc.VaryAccept, dc.AcceptTypes, tt.wantVary, tt.wantTypes)
+			}
+		})
+	}
+}
+
+func TestRequireExplicitFreshness(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		want bool
+	}{
+		{"default", "", "", false},
+		{"yaml", "require_explicit_freshness: true\n", "", true},
+		{"env on", "", "1", true},
+		{"env off", "require_explicit_freshness: true\n", "false", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("REQUIRE_EXPLICIT_FRESHNESS", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.RequireExplicitFreshness != tt.want {
+				t.Errorf("RequireExplicitFreshness = %v, want %v", cfg.RequireExplicitFreshness, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaxObjectBytes(t *testing.T) {
+	const domains = "domains:\n  releases.example.com:\n    max_object_bytes: 1048576\n"
+	tests := []struct {
+		name       string
+		yaml       string
+		env        string
+		wantGlobal int64
+		wantDomain int64
+	}{
+		{"default", "", "", 0, 0},
+		{"yaml", "max_object_bytes: 1024\n" + domains, "", 1024, 1048576},
+		{"env", "max_object_bytes: 1024\n" + domains, "2048", 2048, 1048576},
+		{"bad env ignored", "max_object_bytes: 1024\n", "big", 1024, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("MAX_OBJECT_BYTES", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.MaxObjectBytes != tt.wantGlobal {
+				t.Errorf("MaxObjectBytes = %d, want %d", cfg.MaxObjectBytes, tt.wantGlobal)
+			}
+			if got := cfg.Domain("releases.example.com").MaxObjectBytes; got != tt.wantDomain {
+				t.Errorf("domain MaxObjectBytes = %d, want %d", got, tt.wantDomain)
+			}
+		})
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	tests := []struct {
+		name         string
+		yaml         string
+		env          [2]string // BREAKER_FAILURES, BREAKER_COOLDOWN
+		wantFailures int
+		wantCooldown int
+	}{
+		{"default", "", [2]string{}, 0, 30},
+		{"yaml", "breaker_failures: 5\nbreaker_cooldown: 10\n", [2]string{}, 5, 10},
+		{"env", "breaker_failures: 5\nbreaker_cooldown: 10\n", [2]string{"3", "60"}, 3, 60},
+		{"bad env ignored", "breaker_failures: 5\n", [2]string{"many", "long"}, 5, 30},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env[0] != "" {
+				t.Setenv("BREAKER_FAILURES", tt.env[0])
+				t.Setenv("BREAKER_COOLDOWN", tt.env[1])
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.BreakerFailures != tt.wantFailures || cfg.BreakerCooldown != tt.wantCooldown {
+				t.Errorf("BreakerFailures = %d, BreakerCooldown = %d; want %d, %d", cfg.BreakerFailures, cfg.BreakerCooldown, tt.wantFailures, tt.wantCooldown)
+			}
+		})
+	}
+}
+
+func TestUpstreamCertWarnDays(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		want int
+	}{
+		{"default", "", "", 0},
+		{"yaml", "upstream_cert_warn_days: 14\n", "", 14},
+		{"env", "upstream_cert_warn_days: 14\n", "30", 30},
+		{"bad env ignored", "upstream_cert_warn_days: 14\n", "soon", 14},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("UPSTREAM_CERT_WARN_DAYS", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.UpstreamCertWarnDays != tt.want {
+				t.Errorf("UpstreamCertWarnDays = %d, want %d", cfg.UpstreamCertWarnDays, tt.want)
+			}
+		})
+	}
+}
+
+func TestIntegrityMismatch(t *testing.T) {
+	tests := []struct {
+		name       string
+		yaml       string
+		env        string
+		wantVerify bool
+		want       string
+		wantErr    bool
+	}{
+		{"default", "", "", false, "", false},
+		{"refetch", "verify_on_read: true\nintegrity_mismatch: refetch\n", "", true, "refetch", false},
+		{"serve", "verify_on_read: true\nintegrity_mismatch: serve\n", "", true, "serve", false},
+		{"env", "verify_on_read: true\nintegrity_mismatch: serve\n", "fail", true, "fail", false},
+		{"unknown", "integrity_mismatch: ignore\n", "", false, "", true},
+		{"unknown env", "", "repair", false, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("INTEGRITY_MISMATCH", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("err = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err == nil && (cfg.VerifyOnRead != tt.wantVerify || cfg.IntegrityMismatch != tt.want) {
+				t.Errorf("VerifyOnRead = %v, IntegrityMismatch = %q; want %v, %q", cfg.VerifyOnRead, cfg.IntegrityMismatch, tt.wantVerify, tt.want)
+			}
+		})
+	}
+}
+
+func TestFoldCase(t *testing.T) {
+	const yaml = "domains:\n  ci.example.com:\n    fold_case: true\n"
+	tests := []struct {
+		name   string
+		yaml   string
+		domain string
+		want   bool
+	}{
+		{"off", "", "ci.example.com", false},
+		{"on", yaml, "ci.example.com", true},
+		{"case-insensitive domain lookup", yaml, "CI.example.com", true},
+		{"other domain", yaml, "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := cfg.Domain(tt.domain).FoldCase; got != tt.want {
+				t.Errorf("FoldCase = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestVerifyWrites(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		want bool
+	}{
+		{"default", "", "", false},
+		{"yaml", "verify_writes: true\n", "", true},
+		{"env on", "", "true", true},
+		{"env off", "verify_writes: true\n", "0", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("VERIFY_WRITES", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.VerifyWrites != tt.want {
+				t.Errorf("VerifyWrites = %v, want %v", cfg.VerifyWrites, tt.want)
+			}
+			// Stores are set up at startup, so a change needs a restart.
+			var old Config
+			restart := strings.Contains(strings.Join(RestartRequired(old, cfg), ","), "verify_writes")
+			if restart != tt.want {
+				t.Errorf("restart required %v, want %v", restart, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameBodyNotModified(t *testing.T) {
+	tests := []struct {
+		name string
+		yaml string
+		env  string
+		want bool
+	}{
+		{"default", "", "", false},
+		{"yaml", "same_body_not_modified: true\n", "", true},
+		{"env on", "", "1", true},
+		{"env off", "same_body_not_modified: true\n", "false", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("SAME_BODY_NOT_MODIFIED", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.SameBodyNotModified != tt.want {
+				t.Errorf("SameBodyNotModified = %v, want %v", cfg.SameBodyNotModified, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "placeholder.png")
+	if err := os.WriteFile(file, []byte("png"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	entry := func(match, status string) string {
+		return fmt.Sprintf("  - match: '%s'\n    file: %q\n    status: %s\n", match, file, status)
+	}
+	tests := []struct {
+		name       string
+		yaml       string
+		path       string // domain/route looked up
+		wantStatus int    // 0: no placeholder
+		wantErr    bool
+	}{
+		{"default status", "placeholders:\n" + entry(`\.png$`, "0"), "example.com/a.png", 200, false},
+		{"first match wins", "placeholders:\n" + entry(`^img\.`, "404") + entry(`\.png$`, "200"), "IMG.example.com/a.png", 404, false},
+		{"no match", "placeholders:\n" + entry(`\.png$`, "0"), "example.com/a.gif", 0, false},
+		{"invalid status", "placeholders:\n" + entry(`\.png$`, "700"), "", 0, true},
+		{"invalid pattern", "placeholders:\n" + entry(`(`, "0"), "", 0, true},
+		{"missing file", "placeholders:\n  - match: 'x'\n    file: /nonexistent/placeholder\n", "", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg, err := load(t, tt.yaml)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load err = %v, want error %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			domain, route, _ := strings.Cut(tt.path, "/")
+			p := cfg.Placeholder(domain, route)
+			if (p != nil) != (tt.wantStatus != 0) {
+				t.Fatalf("Placeholder = %v, want status %d", p, tt.wantStatus)
+			}
+			if p != nil && (p.Status != tt.wantStatus || string(p.Body()) != "png") {
+				t.Errorf("status %d, body %q", p.Status, p.Body())
+			}
+		})
+	}
+}
+
+func TestSweepPacing(t *testing.T) {
+	tests := []struct {
+		name                  string
+		yaml                  string
+		env                   map[string]string
+		wantRate, wantLatency int
+	}{
+		{"default", "", nil, 0, 0},
+		{"yaml", "reconcile_rate: 100\nsweep_max_latency_ms: 250\n", nil, 100, 250},
+		{"env", "reconcile_rate: 100\n", map[string]string{"RECONCILE_RATE": "20", "SWEEP_MAX_LATENCY_MS": "50"}, 20, 50},
+		{"bad env ignored", "reconcile_rate: 100\n", map[string]string{"RECONCILE_RATE": "fast"}, 100, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for k, v := range tt.env {
+				t.Setenv(k, v)
+			}
+			cfg, err := load(t, tt.yaml)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if cfg.ReconcileRate != tt.wantRate || cfg.SweepMaxLatencyMS != tt.wantLatency {
+				t.Errorf("rate %d, max latency %d; want %d, %d", cfg.ReconcileRate, cfg.SweepMaxLatencyMS, tt.wantRate, tt.wantLatency)
+			}
+		})
+	}
+}
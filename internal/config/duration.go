@@ -0,0 +1,51 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Seconds is a duration in whole seconds. In YAML it may be written as a
+// bare number of seconds or as a duration string; see ParseSeconds.
+type Seconds int
+
+func (s *Seconds) UnmarshalYAML(n *yaml.Node) error {
+	v, err := ParseSeconds(n.Value)
+	if err != nil {
+		return fmt.Errorf("line %d: %w", n.Line, err)
+	}
+	*s = Seconds(v)
+	return nil
+}
+
+// ParseSeconds parses a bare integer as seconds, or a Go duration string
+// ("90s", "24h") optionally led by a number of days ("7d", "1d12h").
+func ParseSeconds(v string) (int, error) {
+	v = strings.TrimSpace(v)
+	if n, err := strconv.Atoi(v); err == nil {
+		return n, nil
+	}
+	rest, days := v, 0
+	if i := strings.IndexByte(v, 'd'); i > 0 {
+		n, err := strconv.Atoi(v[:i])
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", v)
+		}
+		rest, days = v[i+1:], n
+	}
+	var d time.Duration
+	if rest != "" {
+		var err error
+		if d, err = time.ParseDuration(rest); err != nil {
+			return 0, fmt.Errorf("invalid duration %q", v)
+		}
+	}
+	if d%time.Second != 0 {
+		return 0, fmt.Errorf("duration %q is not a whole number of seconds", v)
+	}
+	return days*86400 + int(d/time.Second), nil
+}
@@ -0,0 +1,70 @@
+package config
+
+import "testing"
+
+func TestParseSeconds(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    int
+		wantErr bool
+	}{
+		{"3600", 3600, false},
+		{" 60 ", 60, false},
+		{"0", 0, false},
+		{"90s", 90, false},
+		{"24h", 86400, false},
+		{"1h30m", 5400, false},
+		{"7d", 604800, false},
+		{"1d12h", 129600, false},
+		{"1.5h", 5400, false},
+		{"500ms", 0, true},
+		{"d", 0, true},
+		{"xd", 0, true},
+		{"1w", 0, true},
+		{"", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := ParseSeconds(tt.in)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("ParseSeconds(%q) err = %v, want error %v", tt.in, err, tt.wantErr)
+			}
+			if got != tt.want {
+				t.Errorf("ParseSeconds(%q) = %d, want %d", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDurationSettings(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		env     string // TTL_DEFAULT
+		check   func(Config) int
+		want    int
+		wantErr bool
+	}{
+		{"bare seconds", "ttl_default: 120\n", "", func(c Config) int { return int(c.TTLDefault) }, 120, false},
+		{"duration", "ttl_default: 24h\n", "", func(c Config) int { return int(c.TTLDefault) }, 86400, false},
+		{"days", "ttl_404: 2d\n", "", func(c Config) int { return int(c.TTL404) }, 172800, false},
+		{"quoted", "ttl_no_validators: \"30m\"\n", "", func(c Config) int { return int(c.TTLNoValidators) }, 1800, false},
+		{"rule", "ttl_rules:\n  - match: 'x'\n    ttl: 7d\n", "", func(c Config) int { return int(c.TTLRules[0].TTL) }, 604800, false},
+		{"environment", "", "1d", func(c Config) int { return int(c.TTLDefault) }, 86400, false},
+		{"invalid", "ttl_default: soon\n", "", nil, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.env != "" {
+				t.Setenv("TTL_DEFAULT", tt.env)
+			}
+			cfg, err := load(t, tt.yaml)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Load err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && tt.check(cfg) != tt.want {
+				t.Errorf("got %d, want %d", tt.check(cfg), tt.want)
+			}
+		})
+	}
+}
@@ -1,25 +1,133 @@
 package httpx
 
 import (
+	"crypto/tls"
+	"errors"
+	"fmt"
 	"net"
 	"net/http"
+	"syscall"
 	"time"
 )
 
+const (
+	defaultKeepAlive       = 60 * time.Second
+	defaultIdleConnTimeout = 90 * time.Second
+)
+
 var defaultTransport = &http.Transport{
 	Proxy:                 http.ProxyFromEnvironment,
-	DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: 60 * time.Second}).DialContext,
+	DialContext:           (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: defaultKeepAlive}).DialContext,
 	ForceAttemptHTTP2:     true,
 	MaxIdleConns:          200,
 	MaxIdleConnsPerHost:   50,
-	IdleConnTimeout:       90 * time.Second,
+	IdleConnTimeout:       defaultIdleConnTimeout,
 	TLSHandshakeTimeout:   10 * time.Second,
 	ExpectContinueTimeout: 1 * time.Second,
 }
 
+// Options tweak the shared transport for origins that need it.
+type Options struct {
+	// DisableHTTP2 pins connections to HTTP/1.1 for origins that misbehave
+	// over HTTP/2.
+	DisableHTTP2 bool
+	// ServerName overrides the TLS SNI and the name the server certificate
+	// is verified against; empty uses the request's host.
+	ServerName string
+	// MinVersion/MaxVersion bound the TLS versions offered (tls.VersionTLS12
+	// etc.); zero keeps Go's defaults.
+	MinVersion, MaxVersion uint16
+	// IdleConnTimeout closes pooled connections idle this long, and
+	// KeepAlive sets the TCP keep-alive period; zero keeps 90s and 60s.
+	// Origins that drop idle connections sooner need a shorter timeout.
+	IdleConnTimeout, KeepAlive time.Duration
+}
+
+// TLSVersion maps "1.0" through "1.3" to the tls package constant; "" is 0.
+func TLSVersion(v string) (uint16, error) {
+	switch v {
+	case "":
+		return 0, nil
+	case "1.0":
+		return tls.VersionTLS10, nil
+	case "1.1":
+		return tls.VersionTLS11, nil
+	case "1.2":
+		return tls.VersionTLS12, nil
+	case "1.3":
+		return tls.VersionTLS13, nil
+	}
+	return 0, fmt.Errorf("unknown TLS version %q", v)
+}
+
+// Downgrade returns o with the highest TLS version lowered one step, for a
+// retry after a failed handshake; ok is false at TLS 1.0 or below MinVersion.
+func (o Options) Downgrade() (Options, bool) {
+	max := o.MaxVersion
+	if max == 0 {
+		max = tls.VersionTLS13
+	}
+	if max <= tls.VersionTLS10 || (o.MinVersion != 0 && max-1 < o.MinVersion) {
+		return o, false
+	}
+	o.MaxVersion = max - 1
+	return o, true
+}
+
+// IsHandshakeError reports whether err is a TLS negotiation failure that a
+// different protocol version might avoid. Alerts from the server arrive as
+// a *net.OpError with Op "remote error"; tls.AlertError only covers ones
+// raised locally.
+func IsHandshakeError(err error) bool {
+	var alert tls.AlertError
+	var rec tls.RecordHeaderError
+	var op *net.OpError
+	return errors.As(err, &alert) || errors.As(err, &rec) ||
+		(errors.As(err, &op) && op.Op == "remote error")
+}
+
+// IsConnReset reports whether err is the peer resetting the connection, as
+// an origin does when it closes a pooled connection we then reuse. A bare
+// EOF isn't counted: it may equally be a response cut short.
+func IsConnReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.EPIPE)
+}
+
+// DefaultTimeout is the deadline callers give an upstream request when no
+// upstream_timeout is configured, so none runs unbounded.
+const DefaultTimeout = 60 * time.Second
+
+// NewUpstreamClient returns the shared upstream client. It has no overall
+// Timeout of its own: callers bound each request with a context deadline
+// (DefaultTimeout at most, unless configured) so per-domain timeouts can be
+// longer than the default.
 func NewUpstreamClient() *http.Client {
 	return &http.Client{
-		Timeout:   60 * time.Second,
 		Transport: defaultTransport,
 	}
 }
+
+// NewClient returns an upstream client with its own transport configured by
+// o. Like NewUpstreamClient it relies on per-request deadlines.
+func NewClient(o Options) *http.Client {
+	t := defaultTransport.Clone()
+	if o.DisableHTTP2 {
+		t.ForceAttemptHTTP2 = false
+		// A non-nil empty map disables the transport's built-in HTTP/2.
+		t.TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+	}
+	if o.IdleConnTimeout > 0 {
+		t.IdleConnTimeout = o.IdleConnTimeout
+	}
+	if o.KeepAlive > 0 {
+		t.DialContext = (&net.Dialer{Timeout: 10 * time.Second, KeepAlive: o.KeepAlive}).DialContext
+	}
+	if o.ServerName != "" || o.MinVersion != 0 || o.MaxVersion != 0 {
+		t.TLSClientConfig = &tls.Config{
+			ServerName: o.ServerName,
+			MinVersion: o.MinVersion,
+			MaxVersion: o.MaxVersion,
+		}
+	}
+	return &http.Client{Transport: t}
+}
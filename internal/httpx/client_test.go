@@ -0,0 +1,261 @@
+package httpx
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestDisableHTTP2(t *testing.T) {
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Proto", r.Proto)
+	}))
+	ts.EnableHTTP2 = true
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	tests := []struct {
+		name    string
+		disable bool
+		want    string
+	}{
+		{"default", false, "HTTP/2.0"},
+		{"disabled", true, "HTTP/1.1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cl := NewClient(Options{DisableHTTP2: tt.disable})
+			cl.Transport.(*http.Transport).TLSClientConfig = &tls.Config{RootCAs: roots}
+			resp, err := cl.Get(ts.URL)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.Proto != tt.want || resp.Header.Get("X-Proto") != tt.want {
+				t.Errorf("negotiated %s (server saw %s), want %s", resp.Proto, resp.Header.Get("X-Proto"), tt.want)
+			}
+		})
+	}
+}
+
+func TestServerName(t *testing.T) {
+	var sni atomic.Value
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		sni.Store(hello.ServerName)
+		return nil, nil
+	}}
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	tests := []struct {
+		name       string
+		serverName string
+		wantSNI    string
+		wantErr    bool
+	}{
+		// No SNI is sent for an IP address; the certificate covers it.
+		{"request host", "", "", false},
+		{"override", "example.com", "example.com", false},
+		{"name the certificate doesn't cover", "other.test", "other.test", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sni.Store("unset")
+			cl := NewClient(Options{ServerName: tt.serverName, DisableHTTP2: true})
+			tr := cl.Transport.(*http.Transport)
+			if tr.TLSClientConfig == nil {
+				tr.TLSClientConfig = &tls.Config{}
+			}
+			tr.TLSClientConfig.RootCAs = roots
+			resp, err := cl.Get(ts.URL)
+			if err == nil {
+				resp.Body.Close()
+			}
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Get err = %v, want error %v", err, tt.wantErr)
+			}
+			if got := sni.Load().(string); got != tt.wantSNI {
+				t.Errorf("SNI %q, want %q", got, tt.wantSNI)
+			}
+		})
+	}
+}
+
+func TestDowngradeHandshake(t *testing.T) {
+	// An origin whose TLS 1.3 support is broken: it aborts any handshake
+	// offering 1.3.
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	ts.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, v := range hello.SupportedVersions {
+			if v == tls.VersionTLS13 {
+				return nil, errors.New("no TLS 1.3 here")
+			}
+		}
+		return nil, nil
+	}}
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(ts.Certificate())
+
+	tests := []struct {
+		name          string
+		opts          Options
+		downgrade     bool
+		wantHandshake bool // first attempt fails with a handshake error
+		wantErr       bool
+	}{
+		{"default fails", Options{}, false, true, true},
+		{"downgraded", Options{}, true, true, false},
+		{"pinned to 1.2", Options{MaxVersion: tls.VersionTLS12}, false, false, false},
+		{"1.3 required", Options{MinVersion: tls.VersionTLS13}, true, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			get := func(o Options) error {
+				cl := NewClient(o)
+				tr := cl.Transport.(*http.Transport)
+				if tr.TLSClientConfig == nil {
+					tr.TLSClientConfig = &tls.Config{}
+				}
+				tr.TLSClientConfig.RootCAs = roots
+				resp, err := cl.Get(ts.URL)
+				if err == nil {
+					resp.Body.Close()
+				}
+				return err
+			}
+			err := get(tt.opts)
+			if got := IsHandshakeError(err); got != tt.wantHandshake {
+				t.Fatalf("IsHandshakeError(%v) = %v, want %v", err, got, tt.wantHandshake)
+			}
+			if err != nil && tt.downgrade {
+				if o, ok := tt.opts.Downgrade(); ok {
+					err = get(o)
+				}
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("err = %v, want error %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestTLSVersion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    uint16
+		wantErr bool
+	}{
+		{"", 0, false},
+		{"1.0", tls.VersionTLS10, false},
+		{"1.2", tls.VersionTLS12, false},
+		{"1.3", tls.VersionTLS13, false},
+		{"1.4", 0, true},
+		{"TLS1.2", 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			got, err := TLSVersion(tt.in)
+			if got != tt.want || (err != nil) != tt.wantErr {
+				t.Errorf("TLSVersion(%q) = %x, %v; want %x, error %v", tt.in, got, err, tt.want, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestDowngrade(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    Options
+		wantMax uint16
+		wantOK  bool
+	}{
+		{"default", Options{}, tls.VersionTLS12, true},
+		{"from 1.2", Options{MaxVersion: tls.VersionTLS12}, tls.VersionTLS11, true},
+		{"at 1.0", Options{MaxVersion: tls.VersionTLS10}, 0, false},
+		{"at the minimum", Options{MinVersion: tls.VersionTLS12, MaxVersion: tls.VersionTLS12}, 0, false},
+		{"above the minimum", Options{MinVersion: tls.VersionTLS12}, tls.VersionTLS12, true},
+		{"keeps other options", Options{ServerName: "example.com", DisableHTTP2: true}, tls.VersionTLS12, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := tt.opts.Downgrade()
+			if ok != tt.wantOK {
+				t.Fatalf("Downgrade ok = %v, want %v", ok, tt.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if got.MaxVersion != tt.wantMax {
+				t.Errorf("MaxVersion = %x, want %x", got.MaxVersion, tt.wantMax)
+			}
+			if got.ServerName != tt.opts.ServerName || got.DisableHTTP2 != tt.opts.DisableHTTP2 || got.MinVersion != tt.opts.MinVersion {
+				t.Errorf("Downgrade changed other options: %+v", got)
+			}
+		})
+	}
+}
+
+func TestIsConnReset(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"reset", &net.OpError{Op: "read", Err: os.NewSyscallError("read", syscall.ECONNRESET)}, true},
+		{"broken pipe", &net.OpError{Op: "write", Err: os.NewSyscallError("write", syscall.EPIPE)}, true},
+		{"wrapped", fmt.Errorf("Get: %w", syscall.ECONNRESET), true},
+		{"EOF", io.EOF, false},
+		{"unexpected EOF", io.ErrUnexpectedEOF, false},
+		{"refused", &net.OpError{Op: "dial", Err: os.NewSyscallError("connect", syscall.ECONNREFUSED)}, false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := IsConnReset(tt.err); got != tt.want {
+				t.Errorf("IsConnReset(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestConnTuning(t *testing.T) {
+	tests := []struct {
+		name     string
+		o        Options
+		wantIdle time.Duration
+	}{
+		{"defaults", Options{}, defaultIdleConnTimeout},
+		{"idle timeout", Options{IdleConnTimeout: 5 * time.Second}, 5 * time.Second},
+		{"keep-alive only", Options{KeepAlive: 5 * time.Second}, defaultIdleConnTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewClient(tt.o).Transport.(*http.Transport)
+			if tr.IdleConnTimeout != tt.wantIdle {
+				t.Errorf("IdleConnTimeout = %v, want %v", tr.IdleConnTimeout, tt.wantIdle)
+			}
+			if tr == defaultTransport {
+				t.Error("tuned client shares the default transport")
+			}
+		})
+	}
+}
@@ -0,0 +1,139 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+)
+
+// OtherDomain is the label shared by domains beyond the cardinality cap.
+const OtherDomain = "other"
+
+// Counters are the per-domain cache outcome counts.
+type Counters struct {
+	Hits         atomic.Int64
+	Misses       atomic.Int64
+	NegativeHits atomic.Int64
+	// ScrubCorrupt counts entries the integrity scrub found corrupted.
+	ScrubCorrupt atomic.Int64
+	// BytesServed counts response body bytes written to clients.
+	BytesServed atomic.Int64
+	// InFlight is the number of upstream fetches currently running.
+	InFlight atomic.Int64
+	// CertExpiry is the Unix time the upstream's TLS certificate chain
+	// last seen expires, or zero (upstream_cert_warn_days).
+	CertExpiry atomic.Int64
+}
+
+// Snapshot is a point-in-time copy of Counters.
+type Snapshot struct {
+	Hits         int64 `json:"hits"`
+	Misses       int64 `json:"misses"`
+	NegativeHits int64 `json:"negative_hits"`
+	ScrubCorrupt int64 `json:"scrub_corrupt"`
+	BytesServed  int64 `json:"bytes_served"`
+	InFlight     int64 `json:"inflight_fetches"`
+	CertExpiry   int64 `json:"cert_expiry,omitempty"`
+}
+
+// Snapshot reads each counter once. Counters keep moving while it runs, so
+// fields may be a request apart, but none is torn.
+func (c *Counters) Snapshot() Snapshot {
+	return Snapshot{
+		Hits:         c.Hits.Load(),
+		Misses:       c.Misses.Load(),
+		NegativeHits: c.NegativeHits.Load(),
+		ScrubCorrupt: c.ScrubCorrupt.Load(),
+		BytesServed:  c.BytesServed.Load(),
+		InFlight:     c.InFlight.Load(),
+		CertExpiry:   c.CertExpiry.Load(),
+	}
+}
+
+// DomainStats holds Counters per domain label. At most max distinct labels
+// are tracked; later ones are folded into OtherDomain so a flood of origins
+// can't blow up metric cardinality.
+type DomainStats struct {
+	mu  sync.RWMutex
+	m   map[string]*Counters
+	max int
+}
+
+func NewDomainStats(max int) *DomainStats {
+	return &DomainStats{m: make(map[string]*Counters), max: max}
+}
+
+// For returns the counters for label, creating them if needed.
+func (d *DomainStats) For(label string) *Counters {
+	d.mu.RLock()
+	c, ok := d.m[label]
+	d.mu.RUnlock()
+	if ok {
+		return c
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if c, ok := d.m[label]; ok {
+		return c
+	}
+	if d.max > 0 && len(d.m) >= d.max && label != OtherDomain {
+		label = OtherDomain
+		if c, ok := d.m[label]; ok {
+			return c
+		}
+	}
+	c = &Counters{}
+	d.m[label] = c
+	return c
+}
+
+// Lookup returns the counters for label without creating them.
+func (d *DomainStats) Lookup(label string) (*Counters, bool) {
+	d.mu.RLock()
+	defer d.mu.RUnlock()
+	c, ok := d.m[label]
+	return c, ok
+}
+
+// WritePrometheus writes the counters in the Prometheus text format.
+func (d *DomainStats) WritePrometheus(w io.Writer) {
+	d.mu.RLock()
+	labels := make([]string, 0, len(d.m))
+	for l := range d.m {
+		labels = append(labels, l)
+	}
+	d.mu.RUnlock()
+	sort.Strings(labels)
+
+	series := []struct {
+		name, typ, help string
+		get             func(*Counters) int64
+	}{
+		{"rawcacher_cache_hits_total", "counter", "Requests served from cache.", func(c *Counters) int64 { return c.Hits.Load() }},
+		{"rawcacher_cache_misses_total", "counter", "Requests that went to the upstream.", func(c *Counters) int64 { return c.Misses.Load() }},
+		{"rawcacher_cache_negative_hits_total", "counter", "Requests answered from a negative entry.", func(c *Counters) int64 { return c.NegativeHits.Load() }},
+		{"rawcacher_scrub_corrupt_total", "counter", "Cached entries removed by the integrity scrub.", func(c *Counters) int64 { return c.ScrubCorrupt.Load() }},
+		{"rawcacher_bytes_served_total", "counter", "Response body bytes written to clients.", func(c *Counters) int64 { return c.BytesServed.Load() }},
+		{"rawcacher_upstream_inflight", "gauge", "Upstream fetches in progress.", func(c *Counters) int64 { return c.InFlight.Load() }},
+		{"rawcacher_upstream_cert_expiry_timestamp_seconds", "gauge", "Expiry of the upstream TLS certificate chain (0 = unknown).", func(c *Counters) int64 { return c.CertExpiry.Load() }},
+	}
+	for _, s := range series {
+		fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.typ)
+		for _, l := range labels {
+			c, _ := d.Lookup(l)
+			fmt.Fprintf(w, "%s{domain=%s} %d\n", s.name, strconv.Quote(l), s.get(c))
+		}
+	}
+}
+
+// Handler serves the counters for scraping.
+func (d *DomainStats) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		d.WritePrometheus(w)
+	})
+}
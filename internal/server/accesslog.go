@@ -0,0 +1,75 @@
+package server
+
+import (
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// accessRecorder captures the status and size of a response for logging.
+type accessRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int64
+}
+
+func (a *accessRecorder) WriteHeader(code int) {
+	if a.status == 0 {
+		a.status = code
+	}
+	a.ResponseWriter.WriteHeader(code)
+}
+
+func (a *accessRecorder) Write(b []byte) (int, error) {
+	if a.status == 0 {
+		a.status = http.StatusOK
+	}
+	n, err := a.ResponseWriter.Write(b)
+	a.bytes += int64(n)
+	return n, err
+}
+
+// Unwrap lets http.ResponseController reach Flush/Hijack on the real writer.
+func (a *accessRecorder) Unwrap() http.ResponseWriter { return a.ResponseWriter }
+
+var accessSeq atomic.Uint64
+
+// AccessLog wraps next with one log line per request when access_log is set.
+// Successful requests are sampled (log_sample_every, else log_sample_rate);
+// 5xx responses and ones slower than log_slow_ms are always logged.
+func (s *Server) AccessLog(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.conf().AccessLog {
+			next.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &accessRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		elapsed := time.Since(start)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if !s.sampleAccess(rec.status, elapsed) {
+			return
+		}
+		log.Printf("%s %s %d %dB %s", r.Method, r.URL.RequestURI(), rec.status, rec.bytes, elapsed.Round(time.Millisecond))
+	})
+}
+
+// sampleAccess decides whether a finished request is logged.
+func (s *Server) sampleAccess(status int, elapsed time.Duration) bool {
+	c := s.conf()
+	if status >= 500 {
+		return true
+	}
+	if c.LogSlowMS > 0 && elapsed >= time.Duration(c.LogSlowMS)*time.Millisecond {
+		return true
+	}
+	if c.LogSampleEvery > 0 {
+		return accessSeq.Add(1)%uint64(c.LogSampleEvery) == 0
+	}
+	return c.LogSampleRate >= 1 || rand.Float64() < c.LogSampleRate
+}
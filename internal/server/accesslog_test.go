@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"log"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAccessLogSampling(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		status   int
+		delay    time.Duration
+		requests int
+		min, max int
+	}{
+		{"10% of successes", "log_sample_rate: 0.1\n", http.StatusOK, 0, 2000, 120, 280},
+		{"every 10th success", "log_sample_every: 10\n", http.StatusOK, 0, 2000, 200, 200},
+		{"all errors", "log_sample_rate: 0.1\n", http.StatusBadGateway, 0, 200, 200, 200},
+		{"all slow requests", "log_sample_rate: 0.1\nlog_slow_ms: 1\n", http.StatusOK, 2 * time.Millisecond, 20, 20, 20},
+		{"client errors are sampled", "log_sample_every: 10\n", http.StatusNotFound, 0, 200, 20, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, "access_log: true\n"+tt.yaml), http.NotFoundHandler())
+			var buf bytes.Buffer
+			prev := log.Writer()
+			log.SetOutput(&buf)
+			defer log.SetOutput(prev)
+			accessSeq.Store(0)
+
+			h := s.AccessLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(tt.delay)
+				w.WriteHeader(tt.status)
+			}))
+			for i := 0; i < tt.requests; i++ {
+				do(h, http.MethodGet, "/example.com/a.txt")
+			}
+			if n := strings.Count(buf.String(), "\n"); n < tt.min || n > tt.max {
+				t.Errorf("%d of %d requests logged, want %d-%d", n, tt.requests, tt.min, tt.max)
+			}
+		})
+	}
+}
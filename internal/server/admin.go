@@ -0,0 +1,133 @@
+package server
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+	"github.com/yourname/raw-cacher-go/internal/config"
+)
+
+// AdminHandler serves the /admin/ endpoints. Every request must carry the
+// configured token as "Authorization: Bearer <token>"; with no token set the
+// admin API is disabled.
+func (s *Server) AdminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/admin/version", s.handleBumpVersion)
+	mux.HandleFunc("/admin/reload", s.handleReload)
+	mux.HandleFunc("/admin/manifest", s.handleManifest)
+	mux.HandleFunc("/admin/readonly", s.handleReadOnly)
+	mux.HandleFunc("/admin/sweep", s.handleSweep)
+	mux.HandleFunc("/admin/purge", s.handlePurge)
+	mux.HandleFunc("/admin/stats/", s.handleDomainStats)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.adminAuthorized(r) {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		mux.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) adminAuthorized(r *http.Request) bool {
+	token := s.conf().AdminToken
+	if token == "" {
+		return false
+	}
+	got := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// bypassRequested reports whether r carries X-Cache-Bypass together with a
+// matching X-Cache-Bypass-Secret. Without a configured secret the header is
+// ignored, so clients can't force origin traffic on their own.
+func (s *Server) bypassRequested(r *http.Request) bool {
+	secret := s.conf().BypassSecret
+	if secret == "" || r.Header.Get("X-Cache-Bypass") == "" {
+		return false
+	}
+	got := r.Header.Get("X-Cache-Bypass-Secret")
+	return subtle.ConstantTimeCompare([]byte(got), []byte(secret)) == 1
+}
+
+// handleBumpVersion increments the cache version for ?domain=, or the global
+// version when no domain is given. Bumps are held in memory only; persist
+// them in config (cache_version / domains.*.cache_version) to survive restarts.
+func (s *Server) handleBumpVersion(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	domain := strings.ToLower(r.URL.Query().Get("domain"))
+
+	s.versionMu.Lock()
+	if domain == "" {
+		s.globalBump++
+	} else {
+		if s.versions == nil {
+			s.versions = make(map[string]int)
+		}
+		s.versions[domain]++
+	}
+	s.versionMu.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Domain  string `json:"domain,omitempty"`
+		Version string `json:"version"`
+	}{domain, s.cacheVersion(domain)})
+}
+
+// handleReload re-reads the configuration and swaps it in for subsequent
+// requests. Settings only read at startup are applied on next restart and
+// listed in the response.
+func (s *Server) handleReload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if s.Loader == nil {
+		http.Error(w, "reload not configured", http.StatusNotImplemented)
+		return
+	}
+	cfg, err := s.Loader()
+	if err != nil {
+		var ae *config.AllowlistError
+		if errors.As(err, &ae) && s.conf().AllowlistFailMode == "closed" {
+			s.denyAll.Store(true)
+			log.Printf("admin: RELOAD FAILED ON ALLOWLIST, REJECTING ALL PROXIED REQUESTS (allowlist_fail_mode=closed): %v", err)
+		} else {
+			log.Printf("admin: reload failed, keeping current config: %v", err)
+		}
+		http.Error(w, "reload failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	restart := config.RestartRequired(*s.conf(), cfg)
+	s.SetConfig(cfg)
+	s.denyAll.Store(false)
+	log.Printf("admin: config reloaded (restart required for: %v)", restart)
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Reloaded        bool     `json:"reloaded"`
+		RestartRequired []string `json:"restart_required,omitempty"`
+	}{true, restart})
+}
+
+// cacheVersion returns the key version segment currently in effect for
+// domain: the configured versions plus any runtime bumps.
+func (s *Server) cacheVersion(domain string) string {
+	c := s.conf()
+	s.versionMu.RLock()
+	defer s.versionMu.RUnlock()
+	return cache.Version(
+		c.CacheVersion+s.globalBump,
+		c.Domain(domain).CacheVersion+s.versions[strings.ToLower(domain)],
+	)
+}
@@ -0,0 +1,178 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yourname/raw-cacher-go/internal/config"
+)
+
+func TestBumpVersion(t *testing.T) {
+	tests := []struct {
+		name      string
+		bump      string // query of the POST /admin/version
+		wantFetch map[string]bool
+	}{
+		{"domain bump", "?domain=a.example.com", map[string]bool{"a.example.com": true, "b.example.com": false}},
+		{"domain bump, any case", "?domain=A.Example.com", map[string]bool{"a.example.com": true, "b.example.com": false}},
+		{"global bump", "", map[string]bool{"a.example.com": true, "b.example.com": true}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetches := map[string]*atomic.Int32{"a.example.com": {}, "b.example.com": {}}
+			cfg := loadConfig(t, "admin_token: secret\n")
+			s, _ := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches[r.Host].Add(1)
+				_, _ = io.WriteString(w, "v")
+			}))
+			admin := s.AdminHandler()
+			for d := range fetches {
+				do(s, http.MethodGet, "/"+d+"/f.txt")
+				do(s, http.MethodGet, "/"+d+"/f.txt")
+			}
+			if w := do(admin, http.MethodPost, "/admin/version"+tt.bump, "Authorization", "Bearer secret"); w.Code != http.StatusOK {
+				t.Fatalf("bump: %d %s", w.Code, w.Body)
+			}
+			for d, n := range fetches {
+				do(s, http.MethodGet, "/"+d+"/f.txt")
+				want := int32(1)
+				if tt.wantFetch[d] {
+					want = 2
+				}
+				if got := n.Load(); got != want {
+					t.Errorf("%s: %d upstream fetches, want %d", d, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestReload(t *testing.T) {
+	const base = "admin_token: secret\nttl_default: 3600\n"
+	tests := []struct {
+		name        string
+		yaml        string
+		want        int
+		wantTTL     int
+		wantRestart string
+	}{
+		{"ttl change", "admin_token: secret\nttl_default: 120\n", http.StatusOK, 120, ""},
+		{"startup setting", base + "listen_addr: \":9090\"\n", http.StatusOK, 3600, "listen_addr"},
+		{"invalid", base + "slash_mode: sideways\n", http.StatusInternalServerError, 3600, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, base), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "body")
+			}))
+			s.Loader = config.Load
+			do(s, http.MethodGet, "/example.com/before.txt")
+
+			if err := os.WriteFile(os.Getenv("RAW_CACHER_CONFIG"), []byte(tt.yaml), 0o644); err != nil {
+				t.Fatal(err)
+			}
+			w := do(s.AdminHandler(), http.MethodPost, "/admin/reload", "Authorization", "Bearer secret")
+			if w.Code != tt.want {
+				t.Fatalf("reload: %d %s", w.Code, w.Body)
+			}
+			if tt.wantRestart != "" && !strings.Contains(w.Body.String(), tt.wantRestart) {
+				t.Errorf("restart_required missing %s: %s", tt.wantRestart, w.Body)
+			}
+
+			// Entries written from now on use the reloaded settings, without
+			// a restart.
+			do(s, http.MethodGet, "/example.com/after.txt")
+			_, metaKey := entryKeys(s, "example.com", "after.txt")
+			meta, ok, _ := st.ReadMeta(context.Background(), metaKey)
+			if !ok || meta.TTL != tt.wantTTL {
+				t.Errorf("TTL after reload = %d (found %v), want %d", meta.TTL, ok, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestCacheBypass(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		secret   string
+		wantBody string
+	}{
+		{"matching secret", "bypass_secret: s3cret\n", "s3cret", "v2"},
+		{"matching secret, serve_if_present", "bypass_secret: s3cret\nserve_if_present: true\n", "s3cret", "v2"},
+		{"wrong secret", "bypass_secret: s3cret\n", "guess", "v1"},
+		{"not configured", "", "", "v1"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var version atomic.Int32
+			version.Store(1)
+			s, _ := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "v"+strconv.Itoa(int(version.Load())))
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			version.Store(2)
+
+			w := do(s, http.MethodGet, "/example.com/a.txt", "X-Cache-Bypass", "1", "X-Cache-Bypass-Secret", tt.secret)
+			if w.Body.String() != tt.wantBody {
+				t.Fatalf("bypass request got %q, want %q", w.Body, tt.wantBody)
+			}
+			// A bypass repopulates the cache for everyone else.
+			if got := do(s, http.MethodGet, "/example.com/a.txt").Body.String(); got != tt.wantBody {
+				t.Errorf("next request got %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestAllowlistReloadFailure(t *testing.T) {
+	const good = "admin_token: secret\nallowed_domains: [example.com]\n"
+	tests := []struct {
+		name string
+		mode string
+		want int
+	}{
+		{"fail open keeps the old list", "open", http.StatusOK},
+		{"fail closed rejects everything", "closed", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfgYAML := good + "allowlist_fail_mode: " + tt.mode + "\n"
+			s, _ := newTestServer(t, loadConfig(t, cfgYAML), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "body")
+			}))
+			s.Loader = config.Load
+			admin := s.AdminHandler()
+			reload := func(yaml string) int {
+				if err := os.WriteFile(os.Getenv("RAW_CACHER_CONFIG"), []byte(yaml), 0o644); err != nil {
+					t.Fatal(err)
+				}
+				return do(admin, http.MethodPost, "/admin/reload", "Authorization", "Bearer secret").Code
+			}
+
+			bad := "admin_token: secret\nallowed_domains: [\"bad/entry\"]\nallowlist_fail_mode: " + tt.mode + "\n"
+			if code := reload(bad); code != http.StatusInternalServerError {
+				t.Fatalf("bad reload: %d", code)
+			}
+			if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != tt.want {
+				t.Errorf("after bad reload: %d, want %d", w.Code, tt.want)
+			}
+			if w := do(s, http.MethodGet, "/other.com/a.txt"); w.Code != http.StatusForbidden {
+				t.Errorf("unlisted domain after bad reload: %d, want 403", w.Code)
+			}
+			// A good reload recovers either way.
+			if code := reload(cfgYAML); code != http.StatusOK {
+				t.Fatalf("good reload: %d", code)
+			}
+			if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != http.StatusOK {
+				t.Errorf("after good reload: %d, want 200", w.Code)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package server
+
+import (
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// admissionRows/admissionWidth size the count-min sketch behind the
+// admission filter: 4 rows of 64Ki one-byte counters, 256KiB in all.
+const (
+	admissionRows  = 4
+	admissionWidth = 1 << 16
+)
+
+// admission counts misses per key in a fixed-size count-min sketch so
+// objects are only stored once they have been asked for admit_after times,
+// keeping one-off requests out of storage. Counts are halved every window,
+// so only recent demand counts. Collisions can only over-count, which
+// admits early but never refuses a popular key.
+type admission struct {
+	mu     sync.Mutex
+	seeds  [admissionRows]maphash.Seed
+	counts [admissionRows][admissionWidth]uint8
+	reset  time.Time
+}
+
+func newAdmission() *admission {
+	a := &admission{reset: time.Now()}
+	for i := range a.seeds {
+		a.seeds[i] = maphash.MakeSeed()
+	}
+	return a
+}
+
+// record counts a miss for key and returns its estimated count within the
+// window, including this one.
+func (a *admission) record(key string, window time.Duration) int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if window > 0 && time.Since(a.reset) >= window {
+		for r := range a.counts {
+			for i := range a.counts[r] {
+				a.counts[r][i] >>= 1
+			}
+		}
+		a.reset = time.Now()
+	}
+	est := 255
+	for r := range a.counts {
+		i := maphash.String(a.seeds[r], key) % admissionWidth
+		if a.counts[r][i] < 255 {
+			a.counts[r][i]++
+		}
+		est = min(est, int(a.counts[r][i]))
+	}
+	return est
+}
+
+// admitted records a miss for key and reports whether its object may be
+// stored under admit_after.
+func (s *Server) admitted(key string) bool {
+	c := s.conf()
+	if c.AdmitAfter <= 1 {
+		return true
+	}
+	s.admitOnce.Do(func() { s.admit = newAdmission() })
+	return s.admit.record(key, seconds(c.AdmitWindow)) >= c.AdmitAfter
+}
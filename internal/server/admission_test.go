@@ -0,0 +1,90 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestAdmissionRecord(t *testing.T) {
+	tests := []struct {
+		name    string
+		records int // of "a" before the checked one
+		window  time.Duration
+		aged    bool // the window has passed since
+		want    int
+	}{
+		{"first", 0, time.Hour, false, 1},
+		{"third", 2, time.Hour, false, 3},
+		{"halved after the window", 4, time.Hour, true, 3},
+		{"no window", 4, 0, true, 5},
+		{"saturates", 300, time.Hour, false, 255},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newAdmission()
+			for i := 0; i < tt.records; i++ {
+				a.record("a", tt.window)
+			}
+			if tt.aged {
+				a.reset = time.Now().Add(-2 * time.Hour)
+			}
+			if got := a.record("a", tt.window); got != tt.want {
+				t.Errorf("record = %d, want %d", got, tt.want)
+			}
+			if got := a.record("b", tt.window); got != 1 {
+				t.Errorf("other key counted %d", got)
+			}
+		})
+	}
+}
+
+func TestAdmitAfter(t *testing.T) {
+	tests := []struct {
+		name       string
+		admitAfter int
+		requests   int
+		wantStored bool
+		wantFetch  int32
+	}{
+		{"requested once", 2, 1, false, 1},
+		{"requested twice", 2, 2, true, 2},
+		{"hit after admission", 2, 3, true, 2},
+		{"disabled", 0, 1, true, 1},
+		{"one", 1, 2, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			cfg := loadConfig(t, "")
+			cfg.AdmitAfter = tt.admitAfter
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				_, _ = io.WriteString(w, "body")
+			}))
+			for i := 0; i < tt.requests; i++ {
+				if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != http.StatusOK || w.Body.String() != "body" {
+					t.Fatalf("request %d: %d %q", i, w.Code, w.Body)
+				}
+			}
+			objKey, _ := entryKeys(s, "example.com", "a.txt")
+			if stored, _ := st.HasObject(context.Background(), objKey); stored != tt.wantStored {
+				t.Errorf("stored = %v, want %v", stored, tt.wantStored)
+			}
+			if n := fetches.Load(); n != tt.wantFetch {
+				t.Errorf("%d upstream fetches, want %d", n, tt.wantFetch)
+			}
+			// Requests for other objects don't count towards this one.
+			if tt.requests == 1 && tt.admitAfter > 1 {
+				do(s, http.MethodGet, "/example.com/b.txt")
+				do(s, http.MethodGet, "/example.com/a.txt")
+				if stored, _ := st.HasObject(context.Background(), objKey); !stored {
+					t.Error("not stored on its second request")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"strings"
+)
+
+// domainAllowed reports whether domain may be proxied under allowed_domains.
+// After a fail-closed reload nothing is allowed until a valid one succeeds.
+func (s *Server) domainAllowed(domain string) bool {
+	if s.denyAll.Load() {
+		return false
+	}
+	_, ok := s.allowlistMatch(domain)
+	return ok
+}
+
+// allowlistMatch returns the allowed_domains entry matching domain, or ""
+// with ok true when there is no allowlist.
+func (s *Server) allowlistMatch(domain string) (entry string, ok bool) {
+	list := s.conf().AllowedDomains
+	if len(list) == 0 {
+		return "", true
+	}
+	domain = strings.ToLower(domain)
+	for _, e := range list {
+		e = strings.ToLower(e)
+		if rest, ok := strings.CutPrefix(e, "*."); ok {
+			if strings.HasSuffix(domain, "."+rest) {
+				return e, true
+			}
+			continue
+		}
+		if domain == e {
+			return e, true
+		}
+	}
+	return "", false
+}
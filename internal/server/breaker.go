@@ -0,0 +1,102 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// breakerState tracks one origin's consecutive failed fetches.
+type breakerState struct {
+	failures  int
+	openUntil time.Time
+}
+
+// breakers is a per-domain circuit breaker (breaker_failures): after that
+// many consecutive failed fetches (see breakerFailure) a domain's misses fail fast
+// for breaker_cooldown. Fetches are then let through again: a success closes
+// the breaker, a failure re-opens it straight away.
+type breakers struct {
+	mu sync.Mutex
+	m  map[string]*breakerState
+}
+
+// remaining returns how long domain's breaker stays open, or zero if a fetch
+// may go ahead.
+func (b *breakers) remaining(domain string, now time.Time) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if st := b.m[domain]; st != nil && now.Before(st.openUntil) {
+		return st.openUntil.Sub(now)
+	}
+	return 0
+}
+
+// record notes the outcome of a fetch from domain, opening its breaker for
+// cooldown once failures reach threshold.
+func (b *breakers) record(domain string, failed bool, now time.Time, threshold int, cooldown time.Duration) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		delete(b.m, domain)
+		return
+	}
+	if b.m == nil {
+		b.m = make(map[string]*breakerState)
+	}
+	st := b.m[domain]
+	if st == nil {
+		st = &breakerState{}
+		b.m[domain] = st
+	}
+	st.failures++
+	if st.failures >= threshold {
+		st.openUntil = now.Add(cooldown)
+	}
+}
+
+// breakerFailure reports whether a fetch outcome counts against its origin:
+// transport errors, timeouts and 5xx do. A fetch its caller gave up on
+// (including while waiting for a fetch slot) or whose body was refused
+// locally says nothing about the origin.
+func breakerFailure(ctx context.Context, fr fetched, err error) bool {
+	switch {
+	case err == nil:
+		return fr.status >= 500
+	case ctx.Err() != nil, errors.Is(err, errInflatedTooLarge):
+		return false
+	}
+	return true
+}
+
+// breakerOpen returns how long domain's breaker stays open, or zero if a
+// fetch may go ahead (always, without breaker_failures).
+func (s *Server) breakerOpen(domain string) time.Duration {
+	if s.conf().BreakerFailures <= 0 {
+		return 0
+	}
+	return s.breakers.remaining(domain, time.Now())
+}
+
+// recordFetch feeds the outcome of a fetch from domain, made under ctx, to
+// its breaker.
+func (s *Server) recordFetch(ctx context.Context, domain string, fr fetched, err error) {
+	c := s.conf()
+	if c.BreakerFailures <= 0 {
+		return
+	}
+	s.breakers.record(domain, breakerFailure(ctx, fr, err), time.Now(),
+		c.BreakerFailures, time.Duration(c.BreakerCooldown)*time.Second)
+}
+
+// errBreakerOpen fails a miss fast while its origin's breaker is open.
+type errBreakerOpen struct {
+	domain     string
+	retryAfter time.Duration
+}
+
+func (e *errBreakerOpen) Error() string {
+	return fmt.Sprintf("circuit open for %s", e.domain)
+}
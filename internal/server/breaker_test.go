@@ -0,0 +1,143 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestBreakers(t *testing.T) {
+	const threshold, cooldown = 2, 30 * time.Second
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name string
+		ops  []string      // "f" failure, "s" success, recorded at now
+		at   time.Duration // after now, when remaining is checked
+		want time.Duration
+	}{
+		{"under the threshold", []string{"f"}, 0, 0},
+		{"opened", []string{"f", "f"}, 0, cooldown},
+		{"partly elapsed", []string{"f", "f"}, 10 * time.Second, 20 * time.Second},
+		{"cooldown over", []string{"f", "f"}, cooldown, 0},
+		{"success closes", []string{"f", "f", "s"}, 0, 0},
+		{"success resets the count", []string{"f", "s", "f"}, 0, 0},
+		{"failure after the cooldown reopens", []string{"f", "f", "f"}, 0, cooldown},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var b breakers
+			for _, op := range tt.ops {
+				b.record("example.com", op == "f", now, threshold, cooldown)
+			}
+			if got := b.remaining("example.com", now.Add(tt.at)); got != tt.want {
+				t.Errorf("remaining = %v, want %v", got, tt.want)
+			}
+			if got := b.remaining("other.example.com", now); got != 0 {
+				t.Errorf("other domain open for %v", got)
+			}
+		})
+	}
+}
+
+func TestBreakerFailure(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name   string
+		ctx    context.Context
+		status int
+		err    error
+		want   bool
+	}{
+		{"ok", context.Background(), http.StatusOK, nil, false},
+		{"not found", context.Background(), http.StatusNotFound, nil, false},
+		{"server error", context.Background(), http.StatusInternalServerError, nil, true},
+		{"unavailable", context.Background(), http.StatusServiceUnavailable, nil, true},
+		{"transport error", context.Background(), 0, errors.New("connection refused"), true},
+		{"timeout", context.Background(), 0, context.DeadlineExceeded, true},
+		{"caller gave up", canceled, 0, context.Canceled, false},
+		{"refused locally", context.Background(), 0, errInflatedTooLarge, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := breakerFailure(tt.ctx, fetched{status: tt.status}, tt.err); got != tt.want {
+				t.Errorf("breakerFailure = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBreakerRetryAfter(t *testing.T) {
+	tests := []struct {
+		name           string
+		failures       int           // failed fetches of other routes first
+		left           time.Duration // cooldown remaining, if set by hand
+		target         string
+		stale          bool // a stale copy of target is cached
+		wantStatus     int
+		wantRetryAfter string
+		wantFetch      bool
+	}{
+		{"full cooldown", 2, 0, "/example.com/a.txt", false, http.StatusServiceUnavailable, "30", false},
+		{"partly elapsed", 2, 4200 * time.Millisecond, "/example.com/a.txt", false, http.StatusServiceUnavailable, "5", false},
+		{"last moments", 2, 10 * time.Millisecond, "/example.com/a.txt", false, http.StatusServiceUnavailable, "1", false},
+		{"under the threshold", 1, 0, "/example.com/a.txt", false, http.StatusInternalServerError, "", true},
+		{"stale copy served", 2, 0, "/example.com/a.txt", true, http.StatusOK, "", false},
+		{"other domain", 2, 0, "/other.example.com/a.txt", false, http.StatusInternalServerError, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := loadConfig(t, "debug_headers: true\nbreaker_failures: 2\nbreaker_cooldown: 30\nstale_if_error: 86400\n")
+			var fetches atomic.Int32
+			var failing atomic.Bool
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				if failing.Load() {
+					w.WriteHeader(http.StatusInternalServerError)
+				}
+				_, _ = io.WriteString(w, "body")
+			}))
+			if tt.stale {
+				do(s, http.MethodGet, tt.target)
+				_, metaKey := entryKeys(s, "example.com", "a.txt")
+				m, _, _ := st.ReadMeta(ctx, metaKey)
+				m.CachedAt = time.Now().Add(-time.Duration(cfg.TTLDefault+60) * time.Second).UTC().Format(time.RFC3339Nano)
+				_ = st.WriteMeta(ctx, metaKey, m)
+			}
+			failing.Store(true)
+			for i := 0; i < tt.failures; i++ {
+				do(s, http.MethodGet, fmt.Sprint("/example.com/fail", i))
+			}
+			if tt.left > 0 {
+				s.breakers.mu.Lock()
+				s.breakers.m["example.com"].openUntil = time.Now().Add(tt.left)
+				s.breakers.mu.Unlock()
+			}
+
+			before := fetches.Load()
+			w := do(s, http.MethodGet, tt.target)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if got := w.Header().Get("Retry-After"); got != tt.wantRetryAfter {
+				t.Errorf("Retry-After %q, want %q", got, tt.wantRetryAfter)
+			}
+			if w.Code == http.StatusServiceUnavailable && !strings.Contains(w.Body.String(), "circuit open") {
+				t.Errorf("body %q, want the circuit named", w.Body)
+			}
+			if tt.stale && (w.Body.String() != "body" || w.Header().Get("X-Cache-Decision") != decisionStaleIfError) {
+				t.Errorf("body %q, decision %q; want the stale copy", w.Body, w.Header().Get("X-Cache-Decision"))
+			}
+			if fetched := fetches.Load() > before; fetched != tt.wantFetch {
+				t.Errorf("fetched %v, want %v", fetched, tt.wantFetch)
+			}
+		})
+	}
+}
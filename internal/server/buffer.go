@@ -0,0 +1,28 @@
+package server
+
+import (
+	"io"
+	"sync"
+)
+
+// copyBufPool holds *[]byte copy buffers. Buffers of a size other than the
+// configured one (e.g. after a reload) are dropped rather than reused.
+var copyBufPool sync.Pool
+
+// copyBody streams src to dst through a pooled buffer of copy_buffer_size
+// bytes. Larger buffers mean fewer syscalls when serving big objects.
+func (s *Server) copyBody(dst io.Writer, src io.Reader) (int64, error) {
+	size := s.conf().CopyBufferSize
+	if size <= 0 {
+		return io.Copy(dst, src)
+	}
+	bp, _ := copyBufPool.Get().(*[]byte)
+	if bp == nil || len(*bp) != size {
+		b := make([]byte, size)
+		bp = &b
+	}
+	defer copyBufPool.Put(bp)
+	// Hide ReaderFrom/WriterTo so io.CopyBuffer actually uses our buffer
+	// instead of delegating to the ResponseWriter's fixed-size one.
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *bp)
+}
@@ -0,0 +1,47 @@
+package server
+
+import (
+	"crypto/tls"
+	"log"
+	"time"
+)
+
+// certExpiry returns the earliest NotAfter in an upstream's certificate
+// chain, or false for plain-HTTP responses.
+func certExpiry(state *tls.ConnectionState) (time.Time, bool) {
+	if state == nil || len(state.PeerCertificates) == 0 {
+		return time.Time{}, false
+	}
+	earliest := state.PeerCertificates[0].NotAfter
+	for _, cert := range state.PeerCertificates[1:] {
+		if cert.NotAfter.Before(earliest) {
+			earliest = cert.NotAfter
+		}
+	}
+	return earliest, true
+}
+
+// certWatcher returns the fetchOpts.certSeen hook for domain under
+// upstream_cert_warn_days, or nil when it is off. The hook exports the
+// chain's expiry on /metrics and logs once per certificate when it falls
+// within the threshold.
+func (s *Server) certWatcher(domain string) func(time.Time) {
+	days := s.conf().UpstreamCertWarnDays
+	if days <= 0 {
+		return nil
+	}
+	return func(notAfter time.Time) {
+		if s.Stats != nil {
+			s.Stats.For(s.metricsLabel(domain)).CertExpiry.Store(notAfter.Unix())
+		}
+		left := time.Until(notAfter)
+		if left > time.Duration(days)*24*time.Hour {
+			return
+		}
+		if prev, loaded := s.certWarned.Swap(domain, notAfter); loaded && prev.(time.Time).Equal(notAfter) {
+			return
+		}
+		log.Printf("upstream %s: TLS certificate expires %s (in %v)",
+			domain, notAfter.UTC().Format(time.RFC3339), left.Round(time.Hour))
+	}
+}
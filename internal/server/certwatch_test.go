@@ -0,0 +1,187 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"io"
+	"log"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/metrics"
+)
+
+// selfSigned returns a certificate for example.com that expires at notAfter.
+func selfSigned(t *testing.T, notAfter time.Time) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "example.com"},
+		DNSNames:     []string{"example.com"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     notAfter,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestCertExpiry(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	chain := func(days ...int) *tls.ConnectionState {
+		st := &tls.ConnectionState{}
+		for _, d := range days {
+			st.PeerCertificates = append(st.PeerCertificates, &x509.Certificate{NotAfter: now.AddDate(0, 0, d)})
+		}
+		return st
+	}
+	tests := []struct {
+		name     string
+		state    *tls.ConnectionState
+		wantDays int
+		wantOK   bool
+	}{
+		{"plain HTTP", nil, 0, false},
+		{"no certificates", chain(), 0, false},
+		{"leaf only", chain(30), 30, true},
+		{"leaf first to expire", chain(30, 365, 3650), 30, true},
+		{"intermediate first to expire", chain(90, 10, 3650), 10, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := certExpiry(tt.state)
+			if ok != tt.wantOK || (ok && !got.Equal(now.AddDate(0, 0, tt.wantDays))) {
+				t.Errorf("certExpiry = %v, %v; want %d days, %v", got, ok, tt.wantDays, tt.wantOK)
+			}
+		})
+	}
+}
+
+func TestCertWatcher(t *testing.T) {
+	soon := time.Now().Add(3 * 24 * time.Hour).Truncate(time.Second)
+	later := time.Now().Add(90 * 24 * time.Hour).Truncate(time.Second)
+	tests := []struct {
+		name     string
+		warnDays int
+		seen     []time.Time // expiries reported, in order
+		wantLogs int
+	}{
+		{"off", 0, []time.Time{soon}, 0},
+		{"near expiry", 7, []time.Time{soon}, 1},
+		{"logged once per certificate", 7, []time.Time{soon, soon, soon}, 1},
+		{"renewed, still near", 7, []time.Time{soon, soon.Add(time.Hour)}, 2},
+		{"renewed", 7, []time.Time{soon, later}, 1},
+		{"far off", 7, []time.Time{later}, 0},
+		{"expired", 7, []time.Time{time.Now().Add(-time.Hour).Truncate(time.Second)}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			prev := log.Writer()
+			log.SetOutput(&logs)
+			defer log.SetOutput(prev)
+
+			cfg := loadConfig(t, fmt.Sprintf("upstream_cert_warn_days: %d\n", tt.warnDays))
+			s, _ := newTestServer(t, cfg, http.NotFoundHandler())
+			s.Stats = metrics.NewDomainStats(10)
+			hook := s.certWatcher("example.com")
+			if (hook == nil) != (tt.warnDays == 0) {
+				t.Fatalf("hook set %v with upstream_cert_warn_days %d", hook != nil, tt.warnDays)
+			}
+			for _, at := range tt.seen {
+				if hook != nil {
+					hook(at)
+				}
+			}
+			if n := strings.Count(logs.String(), "TLS certificate expires"); n != tt.wantLogs {
+				t.Errorf("%d warnings, want %d:\n%s", n, tt.wantLogs, logs.String())
+			}
+			var exported int64
+			if c, ok := s.Stats.Lookup("example.com"); ok {
+				exported = c.CertExpiry.Load()
+			}
+			if want := tt.seen[len(tt.seen)-1].Unix(); tt.warnDays > 0 && exported != want {
+				t.Errorf("exported expiry %d, want %d", exported, want)
+			} else if tt.warnDays == 0 && exported != 0 {
+				t.Errorf("exported expiry %d with the check off", exported)
+			}
+		})
+	}
+}
+
+func TestUpstreamCertWarning(t *testing.T) {
+	tests := []struct {
+		name     string
+		warnDays int
+		expires  time.Duration
+		wantLog  bool
+	}{
+		{"expires soon", 7, 3 * 24 * time.Hour, true},
+		{"expires later", 7, 30 * 24 * time.Hour, false},
+		{"check off", 0, 3 * 24 * time.Hour, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var logs bytes.Buffer
+			prev := log.Writer()
+			log.SetOutput(&logs)
+			defer log.SetOutput(prev)
+
+			notAfter := time.Now().Add(tt.expires).Truncate(time.Second)
+			up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "body")
+			}))
+			up.TLS = &tls.Config{Certificates: []tls.Certificate{selfSigned(t, notAfter)}}
+			up.StartTLS()
+			defer up.Close()
+
+			cfg := loadConfig(t, fmt.Sprintf("upstream_cert_warn_days: %d\n", tt.warnDays))
+			s, _ := newTestServer(t, cfg, http.NotFoundHandler())
+			s.Stats = metrics.NewDomainStats(10)
+			s.Client = &http.Client{Transport: &http.Transport{
+				TLSClientConfig: &tls.Config{InsecureSkipVerify: true},
+				DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+					return (&net.Dialer{}).DialContext(ctx, network, up.Listener.Addr().String())
+				},
+			}}
+			for _, route := range []string{"a.txt", "b.txt"} {
+				if w := do(s, http.MethodGet, "/example.com/"+route); w.Code != http.StatusOK {
+					t.Fatalf("%s: status %d", route, w.Code)
+				}
+			}
+			n := strings.Count(logs.String(), "upstream example.com: TLS certificate expires "+notAfter.UTC().Format(time.RFC3339))
+			if want := map[bool]int{true: 1, false: 0}[tt.wantLog]; n != want {
+				t.Errorf("%d warnings, want %d:\n%s", n, want, logs.String())
+			}
+			var exported int64
+			if c, ok := s.Stats.Lookup("example.com"); ok {
+				exported = c.CertExpiry.Load()
+			}
+			if got := exported == notAfter.Unix(); got != (tt.warnDays > 0) {
+				t.Errorf("exported expiry %d, want %d exported %v", exported, notAfter.Unix(), tt.warnDays > 0)
+			}
+			series := fmt.Sprintf("rawcacher_upstream_cert_expiry_timestamp_seconds{domain=\"example.com\"} %d\n", exported)
+			if body := do(s.Stats.Handler(), http.MethodGet, "/metrics").Body.String(); !strings.Contains(body, series) {
+				t.Errorf("/metrics lacks %q:\n%s", series, body)
+			}
+		})
+	}
+}
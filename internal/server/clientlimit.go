@@ -0,0 +1,60 @@
+package server
+
+import (
+	"net/http"
+	"net/netip"
+	"sync"
+)
+
+// clientCounts tracks in-flight requests per client address.
+type clientCounts struct {
+	mu sync.Mutex
+	m  map[netip.Addr]int
+}
+
+// acquire counts a request from a unless a already has limit in flight.
+func (c *clientCounts) acquire(a netip.Addr, limit int) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m[a] >= limit {
+		return false
+	}
+	if c.m == nil {
+		c.m = make(map[netip.Addr]int)
+	}
+	c.m[a]++
+	return true
+}
+
+func (c *clientCounts) release(a netip.Addr) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.m[a]--; c.m[a] <= 0 {
+		delete(c.m, a)
+	}
+}
+
+// LimitClients wraps next with max_requests_per_client: a client with that
+// many requests in flight gets 429 for further ones until one completes.
+// Clients are identified as in partitioning (see clientAddr).
+func (s *Server) LimitClients(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		limit := s.conf().MaxRequestsPerClient
+		if limit <= 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		a, ok := s.clientAddr(r)
+		if !ok {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.perClient.acquire(a, limit) {
+			w.Header().Set("Retry-After", "1")
+			http.Error(w, "too many concurrent requests", http.StatusTooManyRequests)
+			return
+		}
+		defer s.perClient.release(a)
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestClientCounts(t *testing.T) {
+	a, b := netip.MustParseAddr("192.0.2.1"), netip.MustParseAddr("192.0.2.2")
+	tests := []struct {
+		name  string
+		limit int
+		ops   []string // "+a" acquires for a, "-a" releases
+		want  []bool   // result of each acquire, in order
+	}{
+		{"under the limit", 2, []string{"+a", "+a"}, []bool{true, true}},
+		{"at the limit", 2, []string{"+a", "+a", "+a"}, []bool{true, true, false}},
+		{"released slot reused", 1, []string{"+a", "+a", "-a", "+a"}, []bool{true, false, true}},
+		{"clients counted apart", 1, []string{"+a", "+b", "+a", "+b"}, []bool{true, true, false, false}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var c clientCounts
+			addr := map[byte]netip.Addr{'a': a, 'b': b}
+			var got []bool
+			held := map[netip.Addr]int{}
+			for _, op := range tt.ops {
+				x := addr[op[1]]
+				if op[0] == '-' {
+					c.release(x)
+					held[x]--
+					continue
+				}
+				ok := c.acquire(x, tt.limit)
+				if ok {
+					held[x]++
+				}
+				got = append(got, ok)
+			}
+			if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("acquires = %v, want %v", got, tt.want)
+			}
+			for x, n := range held {
+				for ; n > 0; n-- {
+					c.release(x)
+				}
+			}
+			if len(c.m) != 0 {
+				t.Errorf("%d clients still tracked after release", len(c.m))
+			}
+		})
+	}
+}
+
+func TestLimitClients(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		sameIP   int    // concurrent requests from one client
+		xff      []bool // per request: vary X-Forwarded-For instead of sharing it
+		want429  int
+		wantBusy int // of them in the handler at once
+	}{
+		{"capped", "max_requests_per_client: 3\n", 10, nil, 7, 3},
+		{"unlimited", "", 10, nil, 0, 10},
+		{"forwarded clients apart", "max_requests_per_client: 1\ntrust_proxy_headers: true\n", 4, []bool{true, true, true, true}, 0, 4},
+		{"forwarded client capped", "max_requests_per_client: 1\ntrust_proxy_headers: true\n", 4, []bool{false, false, false, false}, 3, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, tt.yaml), http.NotFoundHandler())
+			unblock := make(chan struct{})
+			var busy, peak atomic.Int32
+			h := s.LimitClients(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.RemoteAddr == "198.51.100.9:1234" {
+					return
+				}
+				n := busy.Add(1)
+				for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+				}
+				<-unblock
+				busy.Add(-1)
+			}))
+			send := func(remote, xff string) int {
+				r := httptest.NewRequest(http.MethodGet, "/example.com/a.txt", nil)
+				r.RemoteAddr = remote
+				if xff != "" {
+					r.Header.Set("X-Forwarded-For", xff)
+				}
+				w := httptest.NewRecorder()
+				h.ServeHTTP(w, r)
+				return w.Code
+			}
+
+			codes := make(chan int, tt.sameIP)
+			var wg sync.WaitGroup
+			for i := 0; i < tt.sameIP; i++ {
+				xff := ""
+				if tt.xff != nil {
+					xff = "203.0.113.1"
+					if tt.xff[i] {
+						xff = fmt.Sprintf("203.0.113.%d", 10+i)
+					}
+				}
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					codes <- send("192.0.2.1:1234", xff)
+				}()
+			}
+			// Wait until the admitted requests are in the handler and the
+			// rest have been turned away.
+			deadline := time.Now().Add(2 * time.Second)
+			for int(busy.Load())+len(codes) < tt.sameIP && time.Now().Before(deadline) {
+				time.Sleep(time.Millisecond)
+			}
+			if code := send("198.51.100.9:1234", ""); code != http.StatusOK {
+				t.Errorf("another client got %d meanwhile", code)
+			}
+			close(unblock)
+			wg.Wait()
+			close(codes)
+
+			var rejected int
+			for code := range codes {
+				if code == http.StatusTooManyRequests {
+					rejected++
+				}
+			}
+			if rejected != tt.want429 {
+				t.Errorf("%d requests got 429, want %d", rejected, tt.want429)
+			}
+			if p := int(peak.Load()); p != tt.wantBusy {
+				t.Errorf("%d requests in the handler at once, want %d", p, tt.wantBusy)
+			}
+			if len(s.perClient.m) != 0 {
+				t.Errorf("%d clients still tracked after completion", len(s.perClient.m))
+			}
+		})
+	}
+}
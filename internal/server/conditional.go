@@ -0,0 +1,76 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"time"
+)
+
+// notModified reports whether the client's validators match the given ETag or
+// Last-Modified, per RFC 7232: If-None-Match takes precedence and
+// If-Modified-Since is only consulted when it is absent.
+func notModified(r *http.Request, etag, lastModified string) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		return etagListMatch(inm, etag)
+	}
+	ims := r.Header.Get("If-Modified-Since")
+	if ims == "" || lastModified == "" {
+		return false
+	}
+	since, err := http.ParseTime(ims)
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return !lm.Truncate(time.Second).After(since)
+}
+
+// unmodifiedSinceFailed reports whether an If-Unmodified-Since precondition
+// fails, i.e. lastModified is newer than the client's date. It is ignored
+// when If-Match is present, the date is malformed or lastModified unknown.
+func unmodifiedSinceFailed(r *http.Request, lastModified string) bool {
+	ius := r.Header.Get("If-Unmodified-Since")
+	if ius == "" || lastModified == "" || r.Header.Get("If-Match") != "" {
+		return false
+	}
+	since, err := http.ParseTime(ius)
+	if err != nil {
+		return false
+	}
+	lm, err := http.ParseTime(lastModified)
+	if err != nil {
+		return false
+	}
+	return lm.Truncate(time.Second).After(since)
+}
+
+// etagListMatch performs the weak comparison used by If-None-Match.
+func etagListMatch(list, etag string) bool {
+	if etag == "" {
+		return false
+	}
+	if strings.TrimSpace(list) == "*" {
+		return true
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, c := range strings.Split(list, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(c), "W/") == want {
+			return true
+		}
+	}
+	return false
+}
+
+// writeNotModified sends a 304 carrying the validators for the representation.
+func writeNotModified(w http.ResponseWriter, etag, lastModified string) {
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if lastModified != "" {
+		w.Header().Set("Last-Modified", lastModified)
+	}
+	w.WriteHeader(http.StatusNotModified)
+}
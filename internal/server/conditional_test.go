@@ -0,0 +1,38 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestIfUnmodifiedSince(t *testing.T) {
+	const lastModified = "Wed, 10 Jan 2024 12:00:00 GMT"
+	tests := []struct {
+		name   string
+		header []string
+		want   int
+	}{
+		{"unmodified since later date", []string{"If-Unmodified-Since", "Thu, 11 Jan 2024 12:00:00 GMT"}, http.StatusOK},
+		{"same date", []string{"If-Unmodified-Since", lastModified}, http.StatusOK},
+		{"modified since", []string{"If-Unmodified-Since", "Tue, 09 Jan 2024 12:00:00 GMT"}, http.StatusPreconditionFailed},
+		{"malformed date", []string{"If-Unmodified-Since", "yesterday"}, http.StatusOK},
+		{"If-Match takes over", []string{"If-Unmodified-Since", "Tue, 09 Jan 2024 12:00:00 GMT", "If-Match", "*"}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, ""), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Last-Modified", lastModified)
+				_, _ = io.WriteString(w, "body")
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			w := do(s, http.MethodGet, "/example.com/a.txt", tt.header...)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && w.Body.String() != "body" {
+				t.Errorf("body = %q", w.Body)
+			}
+		})
+	}
+}
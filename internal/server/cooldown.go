@@ -0,0 +1,45 @@
+package server
+
+import (
+	"sync"
+	"time"
+)
+
+// maxCooldownKeys bounds the keys remembered for fetch_cooldown_ms; when
+// full, expired ones are pruned and, failing that, new fetches go
+// unrecorded.
+const maxCooldownKeys = 10000
+
+// fetchCooldown remembers when each key was last fetched upstream.
+type fetchCooldown struct {
+	mu   sync.Mutex
+	last map[string]time.Time
+}
+
+// record notes a completed fetch of key.
+func (f *fetchCooldown) record(key string, now time.Time, window time.Duration) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.last == nil {
+		f.last = make(map[string]time.Time)
+	}
+	if _, ok := f.last[key]; !ok && len(f.last) >= maxCooldownKeys {
+		for k, t := range f.last {
+			if now.Sub(t) >= window {
+				delete(f.last, k)
+			}
+		}
+		if len(f.last) >= maxCooldownKeys {
+			return
+		}
+	}
+	f.last[key] = now
+}
+
+// active reports whether key was fetched less than window ago.
+func (f *fetchCooldown) active(key string, now time.Time, window time.Duration) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	t, ok := f.last[key]
+	return ok && now.Sub(t) < window
+}
@@ -0,0 +1,94 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestFetchCooldownWindow(t *testing.T) {
+	now := time.Date(2024, 1, 1, 12, 0, 0, 0, time.UTC)
+	const window = time.Second
+	tests := []struct {
+		name   string
+		filled int           // other keys recorded first, at now
+		age    time.Duration // of those, and of key's own record
+		record bool
+		at     time.Duration // after now, when key is checked
+		want   bool
+	}{
+		{"within the window", 0, 0, true, 500 * time.Millisecond, true},
+		{"window over", 0, 0, true, window, false},
+		{"never fetched", 0, 0, false, 0, false},
+		{"full of expired keys", maxCooldownKeys, 2 * window, true, 0, true},
+		{"full of active keys", maxCooldownKeys, 0, true, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var f fetchCooldown
+			for i := 0; i < tt.filled; i++ {
+				f.record(fmt.Sprint("objects/other/", i), now.Add(-tt.age), window)
+			}
+			if tt.record {
+				f.record("objects/key", now, window)
+			}
+			if got := f.active("objects/key", now.Add(tt.at), window); got != tt.want {
+				t.Errorf("active = %v, want %v", got, tt.want)
+			}
+			if n := len(f.last); n > maxCooldownKeys {
+				t.Errorf("%d keys remembered, over the bound of %d", n, maxCooldownKeys)
+			}
+		})
+	}
+}
+
+func TestFetchCooldown(t *testing.T) {
+	tests := []struct {
+		name        string
+		cooldownMS  int
+		pause       time.Duration // after the first request
+		then        int           // upstream status after the first request
+		requests    int
+		wantFetches int32
+	}{
+		{"burst served from the fresh copy", 1000, 0, http.StatusOK, 5, 1},
+		{"off", 0, 0, http.StatusOK, 5, 5},
+		{"window elapsed", 20, 40 * time.Millisecond, http.StatusOK, 3, 2},
+		{"failed refresh starts no window", 20, 40 * time.Millisecond, http.StatusInternalServerError, 3, 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// max-age=0 entries are stored stale, so every request would
+			// otherwise go upstream again.
+			cfg := loadConfig(t, fmt.Sprintf("honor_cache_control: true\nzero_lifetime: revalidate\ndebug_headers: true\nfetch_cooldown_ms: %d\n", tt.cooldownMS))
+			var fetches atomic.Int32
+			var status atomic.Int32
+			status.Store(http.StatusOK)
+			s, _ := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				w.Header().Set("Cache-Control", "max-age=0")
+				w.WriteHeader(int(status.Load()))
+				_, _ = io.WriteString(w, "body")
+			}))
+			for i := 0; i < tt.requests; i++ {
+				w := do(s, http.MethodGet, "/example.com/a.txt")
+				if (i == 0 || tt.then == http.StatusOK) && w.Body.String() != "body" {
+					t.Fatalf("request %d: %d %q", i, w.Code, w.Body)
+				}
+				if d := w.Header().Get("X-Cache-Decision"); i > 0 && tt.wantFetches == 1 && d != decisionCooldown {
+					t.Errorf("request %d: decision %q, want %q", i, d, decisionCooldown)
+				}
+				if i == 0 {
+					time.Sleep(tt.pause)
+					status.Store(int32(tt.then))
+				}
+			}
+			if n := fetches.Load(); n != tt.wantFetches {
+				t.Errorf("%d upstream fetches, want %d", n, tt.wantFetches)
+			}
+		})
+	}
+}
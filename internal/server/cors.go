@@ -0,0 +1,82 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// handleCORS sets CORS response headers for cross-origin requests and answers
+// preflight requests, and any other OPTIONS request, which is never fetched
+// upstream. It returns true when the request has been fully handled.
+func (s *Server) handleCORS(w http.ResponseWriter, r *http.Request) bool {
+	c := s.conf().CORS
+	origin := r.Header.Get("Origin")
+	if len(c.AllowOrigins) == 0 || origin == "" {
+		return s.answerOptions(w, r)
+	}
+
+	allow := ""
+	for _, o := range c.AllowOrigins {
+		if o == "*" {
+			allow = "*"
+			break
+		}
+		if strings.EqualFold(o, origin) {
+			allow = origin
+			break
+		}
+	}
+	if allow != "*" {
+		w.Header().Add("Vary", "Origin")
+	}
+
+	preflight := r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != ""
+	if allow == "" {
+		if preflight {
+			w.WriteHeader(http.StatusForbidden)
+			return true
+		}
+		return s.answerOptions(w, r)
+	}
+
+	h := w.Header()
+	h.Set("Access-Control-Allow-Origin", allow)
+	if !preflight {
+		if len(c.ExposeHeaders) > 0 {
+			h.Set("Access-Control-Expose-Headers", strings.Join(c.ExposeHeaders, ", "))
+		}
+		return s.answerOptions(w, r)
+	}
+
+	methods := c.AllowMethods
+	if len(methods) == 0 {
+		methods = []string{http.MethodGet, http.MethodHead, http.MethodOptions}
+	}
+	h.Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+	if len(c.AllowHeaders) > 0 {
+		h.Set("Access-Control-Allow-Headers", strings.Join(c.AllowHeaders, ", "))
+	} else if req := r.Header.Get("Access-Control-Request-Headers"); req != "" {
+		h.Set("Access-Control-Allow-Headers", req)
+	}
+	if c.MaxAge > 0 {
+		h.Set("Access-Control-Max-Age", strconv.Itoa(c.MaxAge))
+	}
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
+
+// answerOptions answers a non-preflight OPTIONS request with 204 and the
+// methods the proxy serves, rather than letting it through as a fetch.
+func (s *Server) answerOptions(w http.ResponseWriter, r *http.Request) bool {
+	if r.Method != http.MethodOptions {
+		return false
+	}
+	allow := "GET, HEAD, OPTIONS"
+	if len(s.conf().PostCache) > 0 {
+		allow = "GET, HEAD, POST, OPTIONS"
+	}
+	w.Header().Set("Allow", allow)
+	w.WriteHeader(http.StatusNoContent)
+	return true
+}
@@ -0,0 +1,131 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"testing"
+)
+
+const corsYAML = `
+cors:
+  allow_origins: [https://app.example.org]
+  allow_methods: [GET, HEAD]
+  expose_headers: [X-Cache]
+  max_age: 600
+`
+
+func TestCORSPreflight(t *testing.T) {
+	tests := []struct {
+		name        string
+		yaml        string
+		origin      string
+		reqHeaders  string
+		wantStatus  int
+		wantOrigin  string
+		wantMethods string
+		wantHeaders string
+	}{
+		{"allowed origin", corsYAML, "https://app.example.org", "", http.StatusNoContent, "https://app.example.org", "GET, HEAD", ""},
+		{"request headers echoed", corsYAML, "https://app.example.org", "X-Token", http.StatusNoContent, "https://app.example.org", "GET, HEAD", "X-Token"},
+		{"any origin", "cors:\n  allow_origins: ['*']\n", "https://other.example", "", http.StatusNoContent, "*", "GET, HEAD, OPTIONS", ""},
+		{"disallowed origin", corsYAML, "https://evil.example", "", http.StatusForbidden, "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, tt.yaml), http.NotFoundHandler())
+			h := []string{"Origin", tt.origin, "Access-Control-Request-Method", "GET"}
+			if tt.reqHeaders != "" {
+				h = append(h, "Access-Control-Request-Headers", tt.reqHeaders)
+			}
+			w := do(s, http.MethodOptions, "/example.com/a.js", h...)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			for name, want := range map[string]string{
+				"Access-Control-Allow-Origin":  tt.wantOrigin,
+				"Access-Control-Allow-Methods": tt.wantMethods,
+				"Access-Control-Allow-Headers": tt.wantHeaders,
+			} {
+				if got := w.Header().Get(name); got != want {
+					t.Errorf("%s = %q, want %q", name, got, want)
+				}
+			}
+		})
+	}
+}
+
+func TestCORSGet(t *testing.T) {
+	tests := []struct {
+		name       string
+		origin     string
+		wantOrigin string
+		wantExpose string
+	}{
+		{"allowed origin", "https://app.example.org", "https://app.example.org", "X-Cache"},
+		{"disallowed origin", "https://evil.example", "", ""},
+		{"same origin", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, corsYAML), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				// An origin's own CORS headers don't override the proxy's.
+				w.Header().Set("Access-Control-Allow-Origin", "https://origin.example")
+				w.Header().Set("Content-Type", "application/javascript")
+				_, _ = io.WriteString(w, "x()")
+			}))
+			// The miss, then the hit served from cache.
+			for _, pass := range []string{"miss", "hit"} {
+				w := do(s, http.MethodGet, "/example.com/a.js", "Origin", tt.origin)
+				if w.Code != http.StatusOK || w.Body.String() != "x()" {
+					t.Fatalf("%s: %d %q", pass, w.Code, w.Body)
+				}
+				if tt.origin != "" {
+					if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantOrigin {
+						t.Errorf("%s: Access-Control-Allow-Origin = %q, want %q", pass, got, tt.wantOrigin)
+					}
+				}
+				if got := w.Header().Get("Access-Control-Expose-Headers"); got != tt.wantExpose {
+					t.Errorf("%s: Access-Control-Expose-Headers = %q, want %q", pass, got, tt.wantExpose)
+				}
+			}
+		})
+	}
+}
+
+func TestOptionsNotFetched(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		origin    string
+		wantAllow string
+		wantACAO  string
+	}{
+		{"no cors", "", "", "GET, HEAD, OPTIONS", ""},
+		{"cors, same origin", corsYAML, "", "GET, HEAD, OPTIONS", ""},
+		{"cors, allowed origin", corsYAML, "https://app.example.org", "GET, HEAD, OPTIONS", "https://app.example.org"},
+		{"cors, disallowed origin", corsYAML, "https://evil.example", "GET, HEAD, OPTIONS", ""},
+		{"post caching", "post_cache:\n  application/json: json\n", "", "GET, HEAD, POST, OPTIONS", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetches := 0
+			s, st := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches++
+				_, _ = io.WriteString(w, "x()")
+			}))
+			w := do(s, http.MethodOptions, "/example.com/a.js", "Origin", tt.origin)
+			if w.Code != http.StatusNoContent {
+				t.Fatalf("status = %d, want %d", w.Code, http.StatusNoContent)
+			}
+			if got := w.Header().Get("Allow"); got != tt.wantAllow {
+				t.Errorf("Allow = %q, want %q", got, tt.wantAllow)
+			}
+			if got := w.Header().Get("Access-Control-Allow-Origin"); got != tt.wantACAO {
+				t.Errorf("Access-Control-Allow-Origin = %q, want %q", got, tt.wantACAO)
+			}
+			if fetches != 0 || len(st.puts) != 0 {
+				t.Errorf("OPTIONS fetched %d times and stored %d objects; want neither", fetches, len(st.puts))
+			}
+		})
+	}
+}
@@ -0,0 +1,59 @@
+package server
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// Cache decisions reported in X-Cache-Decision when DebugHeaders is set.
+const (
+	decisionServeIfPresent  = "serve-if-present"
+	decisionFreshHit        = "fresh-hit"
+	decisionNegativeHit     = "negative-hit"
+	decisionRevalidated     = "stale-revalidated"
+	decisionStaleRevalidate = "stale-while-revalidate"
+	decisionStaleIfError    = "stale-if-error"
+	decisionStalePatience   = "stale-patience"
+	decisionCooldown        = "fetch-cooldown"
+	decisionMissFetched     = "miss-fetched"
+	decisionMissNotFound    = "miss-not-found"
+	decisionMissError       = "miss-error"
+	decisionPassThrough     = "pass-through"
+	decisionBypass          = "bypass"
+	decisionReadOnlyStale   = "read-only-stale"
+	decisionReadOnlyMiss    = "read-only-miss"
+)
+
+// fetchDecision labels a successful upstream fetch.
+func fetchDecision(bypass bool) string {
+	if bypass {
+		return decisionBypass
+	}
+	return decisionMissFetched
+}
+
+// setTTLRemaining reports in X-Cache-TTL-Remaining how many seconds the
+// entry served has left before it expires, when DebugHeaders is set.
+func (s *Server) setTTLRemaining(w http.ResponseWriter, m *cache.Meta) {
+	c := s.conf()
+	if !c.DebugHeaders || m == nil {
+		return
+	}
+	if left, ok := cache.Remaining(*m, int(c.TTLDefault), time.Now()); ok {
+		w.Header().Set("X-Cache-TTL-Remaining", strconv.Itoa(left))
+	}
+}
+
+// setDecision records why the response took its path. It must be called
+// before the status line is written.
+func (s *Server) setDecision(w http.ResponseWriter, decision string) {
+	if dw, ok := w.(*decisionWriter); ok {
+		dw.decision = decision
+	}
+	if s.conf().DebugHeaders && decision != "" {
+		w.Header().Set("X-Cache-Decision", decision)
+	}
+}
@@ -0,0 +1,130 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestCacheDecisionHeader(t *testing.T) {
+	const etag = `"v1"`
+	// expire backdates the cached entry so the next request revalidates it.
+	expire := func(t *testing.T, s *Server, st *memStore) {
+		_, metaKey := entryKeys(s, "example.com", "a.txt")
+		m, ok, _ := st.ReadMeta(context.Background(), metaKey)
+		if !ok {
+			t.Fatal("no meta to expire")
+		}
+		m.CachedAt = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339Nano)
+		m.TTL = 60
+		if err := st.WriteMeta(context.Background(), metaKey, m); err != nil {
+			t.Fatal(err)
+		}
+	}
+	tests := []struct {
+		name   string
+		yaml   string
+		status int
+		primed bool
+		prep   func(t *testing.T, s *Server, st *memStore)
+		want   string
+	}{
+		{"miss", "debug_headers: true\n", http.StatusOK, false, nil, decisionMissFetched},
+		{"fresh hit", "debug_headers: true\n", http.StatusOK, true, nil, decisionFreshHit},
+		{"stale, revalidated", "debug_headers: true\n", http.StatusOK, true, expire, decisionRevalidated},
+		{"upstream 404", "debug_headers: true\n", http.StatusNotFound, false, nil, decisionMissNotFound},
+		{"negative hit", "debug_headers: true\n", http.StatusNotFound, true, nil, decisionNegativeHit},
+		{"serve if present", "debug_headers: true\nserve_if_present: true\n", http.StatusOK, true, nil, decisionServeIfPresent},
+		{"disabled", "", http.StatusOK, true, nil, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status != http.StatusOK {
+					http.Error(w, "nope", tt.status)
+					return
+				}
+				if r.Header.Get("If-None-Match") == etag {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				w.Header().Set("ETag", etag)
+				_, _ = io.WriteString(w, "body")
+			}))
+			if tt.primed {
+				do(s, http.MethodGet, "/example.com/a.txt")
+			}
+			if tt.prep != nil {
+				tt.prep(t, s, st)
+			}
+			w := do(s, http.MethodGet, "/example.com/a.txt")
+			if w.Code != tt.status {
+				t.Fatalf("status = %d, want %d", w.Code, tt.status)
+			}
+			if got := w.Header().Get("X-Cache-Decision"); got != tt.want {
+				t.Errorf("X-Cache-Decision = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTTLRemainingHeader(t *testing.T) {
+	tests := []struct {
+		name    string
+		yaml    string
+		method  string
+		elapsed time.Duration // backdated between the two hits
+		want    bool
+	}{
+		{"hit", "debug_headers: true\nttl_default: 600\n", http.MethodGet, 100 * time.Second, true},
+		{"serve if present", "debug_headers: true\nserve_if_present: true\nttl_default: 600\n", http.MethodGet, 100 * time.Second, true},
+		{"HEAD from meta", "debug_headers: true\ncache_head: true\nttl_default: 600\n", http.MethodHead, 100 * time.Second, true},
+		{"expired entry served", "debug_headers: true\nserve_if_present: true\nttl_default: 600\n", http.MethodGet, time.Hour, true},
+		{"disabled", "ttl_default: 600\n", http.MethodGet, 100 * time.Second, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, st := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "body")
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			remaining := func() (int, bool) {
+				w := do(s, tt.method, "/example.com/a.txt")
+				v := w.Header().Get("X-Cache-TTL-Remaining")
+				if v == "" {
+					return 0, false
+				}
+				n, err := strconv.Atoi(v)
+				if err != nil {
+					t.Fatalf("X-Cache-TTL-Remaining = %q", v)
+				}
+				return n, true
+			}
+			first, ok := remaining()
+			if ok != tt.want {
+				t.Fatalf("header present %v, want %v", ok, tt.want)
+			}
+			if !ok {
+				return
+			}
+			if first < 598 || first > 600 {
+				t.Errorf("first hit: %d seconds left, want about 600", first)
+			}
+			_, metaKey := entryKeys(s, "example.com", "a.txt")
+			m, _, _ := st.ReadMeta(ctx, metaKey)
+			at, _ := time.Parse(time.RFC3339Nano, m.CachedAt)
+			m.CachedAt = at.Add(-tt.elapsed).Format(time.RFC3339Nano)
+			_ = st.WriteMeta(ctx, metaKey, m)
+
+			second, _ := remaining()
+			want := max(first-int(tt.elapsed/time.Second), 0)
+			if second > want || second < want-2 {
+				t.Errorf("after %v: %d seconds left, want about %d", tt.elapsed, second, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,105 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+)
+
+// defaultCompressTypes are content-type prefixes worth storing encoded variants for.
+var defaultCompressTypes = []string{
+	"text/",
+	"application/json",
+	"application/javascript",
+	"application/xml",
+	"image/svg+xml",
+}
+
+// compressible reports whether encoded variants should exist for contentType.
+func (s *Server) compressible(contentType string, size int) bool {
+	c := s.conf()
+	if len(c.CompressVariants) == 0 || size < c.CompressMinBytes {
+		return false
+	}
+	types := c.CompressTypes
+	if len(types) == 0 {
+		types = defaultCompressTypes
+	}
+	ct := strings.ToLower(contentType)
+	for _, t := range types {
+		if strings.HasPrefix(ct, t) {
+			return true
+		}
+	}
+	return false
+}
+
+// encodeVariant compresses body with the named content-coding.
+func encodeVariant(enc string, body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	switch enc {
+	case "br":
+		bw := brotli.NewWriterLevel(&buf, brotli.DefaultCompression)
+		if _, err := bw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := bw.Close(); err != nil {
+			return nil, err
+		}
+	case "gzip":
+		gw := gzip.NewWriter(&buf)
+		if _, err := gw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := gw.Close(); err != nil {
+			return nil, err
+		}
+	default:
+		return nil, fmt.Errorf("unsupported encoding %q", enc)
+	}
+	return buf.Bytes(), nil
+}
+
+// acceptedEncodings returns the configured variant encodings the client
+// accepts, in server preference order.
+func (s *Server) acceptedEncodings(r *http.Request) []string {
+	ae := r.Header.Get("Accept-Encoding")
+	if ae == "" {
+		return nil
+	}
+	var out []string
+	for _, enc := range s.conf().CompressVariants {
+		if acceptsEncoding(ae, enc) {
+			out = append(out, enc)
+		}
+	}
+	return out
+}
+
+// acceptsEncoding reports whether an Accept-Encoding value allows enc,
+// honoring q=0 exclusions and the "*" wildcard.
+func acceptsEncoding(header, enc string) bool {
+	wildcard := false
+	for _, part := range strings.Split(header, ",") {
+		name, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		name = strings.ToLower(strings.TrimSpace(name))
+		q := 1.0
+		if k, v, ok := strings.Cut(strings.TrimSpace(params), "="); ok && strings.TrimSpace(k) == "q" {
+			if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+				q = f
+			}
+		}
+		switch name {
+		case enc:
+			return q > 0
+		case "*":
+			wildcard = q > 0
+		}
+	}
+	return wildcard
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+)
+
+func TestCompressedVariants(t *testing.T) {
+	asset := `{"items":[` + strings.Repeat(`{"name":"widget","tags":["a","b"]},`, 40) + `{}]}`
+	tests := []struct {
+		name     string
+		variants string
+		accept   string
+		want     string
+	}{
+		{"brotli", `["br", "gzip"]`, "gzip, deflate, br", "br"},
+		{"gzip only accepted", `["br", "gzip"]`, "gzip", "gzip"},
+		{"brotli refused", `["br", "gzip"]`, "br;q=0, *", "gzip"},
+		{"no brotli variant", `["gzip"]`, "br", ""},
+		{"identity", `["br", "gzip"]`, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, "compress_variants: "+tt.variants+"\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "application/json")
+				_, _ = io.WriteString(w, asset)
+			}))
+			do(s, http.MethodGet, "/example.com/data.json")
+			w := do(s, http.MethodGet, "/example.com/data.json", "Accept-Encoding", tt.accept)
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			if got := w.Header().Get("Content-Encoding"); got != tt.want {
+				t.Fatalf("Content-Encoding = %q, want %q", got, tt.want)
+			}
+			var body io.Reader = w.Body
+			switch tt.want {
+			case "br":
+				body = brotli.NewReader(body)
+			case "gzip":
+				zr, err := gzip.NewReader(body)
+				if err != nil {
+					t.Fatal(err)
+				}
+				body = zr
+			}
+			got, err := io.ReadAll(body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, []byte(asset)) {
+				t.Errorf("decoded body differs: %.60q", got)
+			}
+			if tt.want != "" && !strings.Contains(w.Header().Get("Vary"), "Accept-Encoding") {
+				t.Errorf("Vary = %q, want Accept-Encoding", w.Header().Get("Vary"))
+			}
+		})
+	}
+}
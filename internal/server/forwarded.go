@@ -0,0 +1,67 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"net/netip"
+	"strings"
+)
+
+// requestScheme returns the scheme the client used to reach us. Behind a
+// TLS-terminating proxy that is only knowable from X-Forwarded-Proto, which
+// is honored only when TrustProxyHeaders is set.
+func (s *Server) requestScheme(r *http.Request) string {
+	if s.conf().TrustProxyHeaders {
+		if v := firstForwarded(r.Header.Get("X-Forwarded-Proto")); v == "http" || v == "https" {
+			return v
+		}
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// requestHost returns the host the client addressed, preferring a trusted
+// X-Forwarded-Host over the Host header.
+func (s *Server) requestHost(r *http.Request) string {
+	if s.conf().TrustProxyHeaders {
+		if v := firstForwarded(r.Header.Get("X-Forwarded-Host")); v != "" {
+			return v
+		}
+	}
+	return r.Host
+}
+
+// clientAddr returns the client's IP address, taken from a trusted
+// X-Forwarded-For or else the connection's remote address.
+func (s *Server) clientAddr(r *http.Request) (netip.Addr, bool) {
+	if s.conf().TrustProxyHeaders {
+		if a, err := netip.ParseAddr(firstForwarded(r.Header.Get("X-Forwarded-For"))); err == nil {
+			return a.Unmap(), true
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	a, err := netip.ParseAddr(host)
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	return a.Unmap(), true
+}
+
+// absoluteURL builds a client-facing absolute URL for path on this proxy.
+func (s *Server) absoluteURL(r *http.Request, path string) string {
+	return s.requestScheme(r) + "://" + s.requestHost(r) + path
+}
+
+// firstForwarded returns the left-most (client-side) entry of a
+// comma-separated forwarding header, lowercased for scheme comparisons.
+func firstForwarded(v string) string {
+	if i := strings.IndexByte(v, ','); i >= 0 {
+		v = v[:i]
+	}
+	return strings.ToLower(strings.TrimSpace(v))
+}
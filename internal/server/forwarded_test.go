@@ -0,0 +1,42 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestForwardedHeaders(t *testing.T) {
+	tests := []struct {
+		name    string
+		trust   bool
+		tls     bool
+		headers map[string]string
+		want    string
+	}{
+		{"untrusted", false, false, map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "cdn.example.com"}, "http://proxy.local/a"},
+		{"untrusted, tls", false, true, map[string]string{"X-Forwarded-Proto": "http"}, "https://proxy.local/a"},
+		{"trusted", true, false, map[string]string{"X-Forwarded-Proto": "https", "X-Forwarded-Host": "cdn.example.com"}, "https://cdn.example.com/a"},
+		{"trusted, chained", true, false, map[string]string{"X-Forwarded-Proto": "HTTPS, http", "X-Forwarded-Host": "cdn.example.com, lb.internal"}, "https://cdn.example.com/a"},
+		{"trusted, bogus scheme", true, false, map[string]string{"X-Forwarded-Proto": "gopher"}, "http://proxy.local/a"},
+		{"trusted, no headers", true, true, nil, "https://proxy.local/a"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "")
+			cfg.TrustProxyHeaders = tt.trust
+			s, _ := newTestServer(t, cfg, http.NotFoundHandler())
+			r := httptest.NewRequest(http.MethodGet, "http://proxy.local/a", nil)
+			if tt.tls {
+				r.TLS = &tls.ConnectionState{}
+			}
+			for k, v := range tt.headers {
+				r.Header.Set(k, v)
+			}
+			if got := s.absoluteURL(r, "/a"); got != tt.want {
+				t.Errorf("absoluteURL = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,112 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// readBodyMeta reads meta for the GET path. Entries populated by a HEAD have
+// no object behind them, and with verify_store_etag entries whose object was
+// replaced out-of-band no longer describe it; both are reported as absent
+// so the body is fetched in full.
+func (s *Server) readBodyMeta(ctx context.Context, objKey, metaKey string) (cache.Meta, bool) {
+	m, ok, _ := s.Store.ReadMeta(ctx, metaKey)
+	if !ok || !m.HasBody() {
+		return cache.Meta{}, false
+	}
+	if s.conf().VerifyStoreETag && !m.Neg && m.StoreETag != "" {
+		etag, found, err := s.Store.ObjectETag(ctx, objKey)
+		if err == nil && found && etag != m.StoreETag {
+			log.Printf("object %s replaced out-of-band (etag %s, meta has %s); refetching", objKey, etag, m.StoreETag)
+			return cache.Meta{}, false
+		}
+	}
+	return m, true
+}
+
+// serveHead answers a HEAD from meta alone when cache_head is set, issuing an
+// upstream HEAD (not GET) on a miss and storing the result as a body-less
+// entry. o carries the request's upstream headers (language, tenant, ...).
+// It returns false to leave the request to the regular path, which is also
+// used when a full entry exists or the upstream HEAD fails.
+func (s *Server) serveHead(ctx context.Context, w http.ResponseWriter, r *http.Request, domain, upstreamURL, metaKey string, o fetchOpts) bool {
+	c := s.conf()
+	meta, ok, _ := s.Store.ReadMeta(ctx, metaKey)
+	if ok && (meta.Neg || meta.HasBody()) {
+		return false
+	}
+	if ok && cache.IsFresh(meta, int(c.TTLDefault)) {
+		s.setDecision(w, decisionFreshHit)
+		s.writeHead(w, r, meta)
+		return true
+	}
+
+	if s.breakerOpen(domain) > 0 {
+		return false
+	}
+	fr, err := fetchUpstream(ctx, s.clientFor(domain), http.MethodHead, upstreamURL, cache.Meta{}, o)
+	s.recordFetch(ctx, domain, fr, err)
+	if err != nil || fr.status != http.StatusOK {
+		return false
+	}
+	bodyCached := false
+	ttl, revalidate := s.entryTTL(metaKey, fr)
+	meta = cache.Meta{
+		ETag:            fr.etag,
+		LastModified:    fr.lastModified,
+		CachedAt:        cache.NowISO(),
+		TTL:             ttl,
+		Revalidate:      revalidate,
+		ContentType:     fr.contentType,
+		ContentLanguage: fr.header.Get("Content-Language"),
+		Headers:         s.snapshotHeaders(fr.header),
+		BodyCached:      &bodyCached,
+	}
+	if n, err := strconv.ParseInt(fr.header.Get("Content-Length"), 10, 64); err == nil {
+		meta.Size = n
+	}
+	decision := decisionPassThrough
+	// storable sees no body, so the declared size is checked separately.
+	if s.storable(fr) && !s.overSizeLimit(domain, meta.Size) {
+		wctx, cancel := s.writeContext(ctx)
+		if s.Store.WriteMeta(wctx, metaKey, meta) == nil {
+			decision = decisionMissFetched
+		}
+		cancel()
+	}
+	s.setDecision(w, decision)
+	s.writeHead(w, r, meta)
+	return true
+}
+
+// writeHead writes the response headers recorded in a body-less entry.
+func (s *Server) writeHead(w http.ResponseWriter, r *http.Request, m cache.Meta) {
+	if notModified(r, m.ETag, m.LastModified) {
+		writeNotModified(w, m.ETag, m.LastModified)
+		return
+	}
+	s.setTTLRemaining(w, &m)
+	replayHeaders(w, m.Headers)
+	ct := m.ContentType
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ct)
+	if m.ETag != "" {
+		w.Header().Set("ETag", m.ETag)
+	}
+	if m.LastModified != "" {
+		w.Header().Set("Last-Modified", m.LastModified)
+	}
+	if m.ContentLanguage != "" {
+		w.Header().Set("Content-Language", m.ContentLanguage)
+	}
+	if m.Size > 0 {
+		w.Header().Set("Content-Length", strconv.FormatInt(m.Size, 10))
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,107 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestHeadThenGet(t *testing.T) {
+	tests := []struct {
+		name         string
+		requests     []string
+		wantUpstream []string
+	}{
+		{"head populates meta only", []string{"HEAD", "HEAD", "GET", "GET", "HEAD"}, []string{"HEAD", "GET"}},
+		{"get satisfies later heads", []string{"GET", "HEAD", "HEAD"}, []string{"GET"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var upstream []string
+			s, _ := newTestServer(t, loadConfig(t, "cache_head: true\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				upstream = append(upstream, r.Method)
+				mu.Unlock()
+				w.Header().Set("Content-Type", "text/plain")
+				w.Header().Set("Content-Length", "4")
+				_, _ = w.Write([]byte("body"))
+			}))
+			for i, method := range tt.requests {
+				w := do(s, method, "/example.com/a.txt")
+				if w.Code != http.StatusOK {
+					t.Fatalf("request %d (%s): status %d", i, method, w.Code)
+				}
+				// A recorder keeps what a HEAD writes, so only GET bodies
+				// are checked.
+				if method == http.MethodGet && w.Body.String() != "body" {
+					t.Errorf("request %d (GET): body %q", i, w.Body)
+				}
+				if got := w.Header().Get("Content-Length"); got != "4" {
+					t.Errorf("request %d (%s): Content-Length %q", i, method, got)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if strings.Join(upstream, ",") != strings.Join(tt.wantUpstream, ",") {
+				t.Errorf("upstream requests %v, want %v", upstream, tt.wantUpstream)
+			}
+		})
+	}
+}
+
+func TestUpstreamMethod(t *testing.T) {
+	tests := []struct {
+		name         string
+		override     string
+		cacheHead    bool
+		client       string
+		wantUpstream string
+		wantBody     string // of a client GET
+		wantStored   bool
+	}{
+		{"no override", "", false, http.MethodGet, http.MethodGet, "body", true},
+		{"GET for a client HEAD", "GET", false, http.MethodHead, http.MethodGet, "", true},
+		{"GET for a cached HEAD", "GET", true, http.MethodHead, http.MethodGet, "", false},
+		{"HEAD for a client GET", "HEAD", false, http.MethodGet, http.MethodHead, "", false},
+		{"no override, client HEAD", "", true, http.MethodHead, http.MethodHead, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yaml := ""
+			if tt.cacheHead {
+				yaml += "cache_head: true\n"
+			}
+			if tt.override != "" {
+				yaml += "domains:\n  example.com:\n    upstream_method: " + tt.override + "\n"
+			}
+			var mu sync.Mutex
+			var upstream []string
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				upstream = append(upstream, r.Method)
+				mu.Unlock()
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = w.Write([]byte("body"))
+			}))
+			w := do(s, tt.client, "/example.com/a.txt")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			if tt.client == http.MethodGet && w.Body.String() != tt.wantBody {
+				t.Errorf("body %q, want %q", w.Body, tt.wantBody)
+			}
+			mu.Lock()
+			got := strings.Join(upstream, ",")
+			mu.Unlock()
+			if got != tt.wantUpstream {
+				t.Errorf("upstream requests %s, want %s", got, tt.wantUpstream)
+			}
+			objKey, _ := entryKeys(s, "example.com", "a.txt")
+			if _, stored := st.objects[objKey]; stored != tt.wantStored {
+				t.Errorf("body stored %v, want %v", stored, tt.wantStored)
+			}
+		})
+	}
+}
@@ -0,0 +1,196 @@
+package server
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// unstoredHeaders are never captured in a header snapshot: hop-by-hop
+// headers, credentials, and headers we derive from the stored body itself or
+// keep in dedicated meta fields.
+var unstoredHeaders = map[string]bool{
+	"Connection":          true,
+	"Keep-Alive":          true,
+	"Proxy-Authenticate":  true,
+	"Proxy-Authorization": true,
+	"Proxy-Connection":    true,
+	"Te":                  true,
+	"Trailer":             true,
+	"Transfer-Encoding":   true,
+	"Upgrade":             true,
+	"Set-Cookie":          true,
+	"Authorization":       true,
+	"Www-Authenticate":    true,
+	"Content-Length":      true,
+	"Content-Encoding":    true,
+	"Content-Type":        true,
+	"Content-Language":    true,
+	"Etag":                true,
+	"Last-Modified":       true,
+	"Date":                true,
+	"Age":                 true,
+}
+
+// snapshotHeaders returns the upstream headers worth replaying on cache hits,
+// minus unstoredHeaders and the configured denylist. Headers are added in
+// name order until stored_headers_max_bytes is reached, counting their JSON
+// framing in meta so the bound config validates against meta_max_bytes holds.
+func (s *Server) snapshotHeaders(h http.Header) map[string][]string {
+	c := s.conf()
+	if !c.StoreHeaders || len(h) == 0 {
+		return nil
+	}
+	deny := make(map[string]bool, len(c.StoredHeadersDeny))
+	for _, d := range c.StoredHeadersDeny {
+		deny[http.CanonicalHeaderKey(d)] = true
+	}
+	names := make([]string, 0, len(h))
+	for k := range h {
+		k = http.CanonicalHeaderKey(k)
+		if !unstoredHeaders[k] && !deny[k] && !connectionListed(h, k) {
+			names = append(names, k)
+		}
+	}
+	sort.Strings(names)
+
+	out := make(map[string][]string, len(names))
+	budget, limited := c.StoredHeadersMaxBytes, c.StoredHeadersMaxBytes > 0
+	for _, k := range names {
+		vs := h.Values(k)
+		n := len(k) + len(`"":[],`)
+		for _, v := range vs {
+			n += len(v) + len(`"",`)
+		}
+		if limited && n > budget {
+			continue
+		}
+		budget -= n
+		out[k] = append([]string(nil), vs...)
+	}
+	return out
+}
+
+// connectionListed reports whether name is declared hop-by-hop through the
+// Connection header.
+func connectionListed(h http.Header, name string) bool {
+	for _, v := range h.Values("Connection") {
+		for _, t := range strings.Split(v, ",") {
+			if http.CanonicalHeaderKey(strings.TrimSpace(t)) == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// languageKeySuffix returns the cache key suffix for the client's
+// Accept-Language under vary_language: the header lowercased with spaces
+// removed, so trivially different spellings share an entry. Requests without
+// one keep the plain key.
+func languageKeySuffix(acceptLanguage string) string {
+	v := strings.ToLower(strings.Join(strings.Fields(acceptLanguage), ""))
+	if v == "" {
+		return ""
+	}
+	return cache.Variant("lang", v)
+}
+
+// acceptKeySuffix returns the cache key suffix for the client's Accept under
+// a domain's vary_accept, and the media type it stands for, which is what
+// goes upstream as Accept. The header is reduced to one type so the number
+// of entries per route stays bounded: the first of types (in q order) the
+// client accepts, or without types the one it prefers most. Requests with no
+// such type, including "*/*", keep the plain key.
+func acceptKeySuffix(accept string, types []string) (suffix, mediaType string) {
+	for _, want := range acceptedTypes(accept) {
+		if len(types) == 0 {
+			if strings.HasSuffix(want, "/*") {
+				return "", ""
+			}
+			return cache.Variant("accept", want), want
+		}
+		if want == "*/*" {
+			continue
+		}
+		for _, t := range types {
+			t = strings.ToLower(strings.TrimSpace(t))
+			if t == want || strings.HasSuffix(want, "/*") && strings.HasPrefix(t, strings.TrimSuffix(want, "*")) {
+				return cache.Variant("accept", t), t
+			}
+		}
+	}
+	return "", ""
+}
+
+// acceptedTypes returns the media types in an Accept header, lowercased and
+// without parameters, most preferred first. Types with q=0 are left out.
+func acceptedTypes(accept string) []string {
+	type entry struct {
+		typ string
+		q   float64
+	}
+	var entries []entry
+	for _, part := range strings.Split(accept, ",") {
+		typ, params, _ := strings.Cut(part, ";")
+		typ = strings.ToLower(strings.TrimSpace(typ))
+		if !strings.Contains(typ, "/") {
+			continue
+		}
+		q := 1.0
+		for _, p := range strings.Split(params, ";") {
+			k, v, _ := strings.Cut(p, "=")
+			if strings.EqualFold(strings.TrimSpace(k), "q") {
+				if f, err := strconv.ParseFloat(strings.TrimSpace(v), 64); err == nil {
+					q = f
+				}
+			}
+		}
+		if q > 0 {
+			entries = append(entries, entry{typ, q})
+		}
+	}
+	sort.SliceStable(entries, func(i, j int) bool { return entries[i].q > entries[j].q })
+	out := make([]string, len(entries))
+	for i, e := range entries {
+		out[i] = e.typ
+	}
+	return out
+}
+
+// replayHeaders sets a stored header snapshot on the response. Headers the
+// proxy has already set (CORS, ...) win; Vary is merged so both the
+// origin's and our own dimensions are listed.
+func replayHeaders(w http.ResponseWriter, snap map[string][]string) {
+	h := w.Header()
+	for k, vs := range snap {
+		switch {
+		case k == "Vary":
+			for _, v := range vs {
+				for _, t := range strings.Split(v, ",") {
+					if t = strings.TrimSpace(t); t != "" && !hasToken(h.Values("Vary"), t) {
+						h.Add("Vary", t)
+					}
+				}
+			}
+		case len(h.Values(k)) == 0:
+			h[k] = append([]string(nil), vs...)
+		}
+	}
+}
+
+// hasToken reports whether a comma-separated header, given as its values,
+// lists token (case-insensitively).
+func hasToken(values []string, token string) bool {
+	for _, v := range values {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
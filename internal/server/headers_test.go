@@ -0,0 +1,301 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestStoredHeaders(t *testing.T) {
+	const yaml = "store_headers: true\nstored_headers_deny: [x-internal-trace]\n"
+	tests := []struct {
+		name   string
+		yaml   string
+		header string
+		value  string
+		want   bool
+	}{
+		{"custom header", yaml, "X-Custom", "kept", true},
+		{"denylisted", yaml, "X-Internal-Trace", "abc", false},
+		{"credential", yaml, "Set-Cookie", "id=1", false},
+		{"hop-by-hop via Connection", yaml, "X-Hop", "1", false},
+		{"over the size bound", yaml + "stored_headers_max_bytes: 8\n", "X-Custom", "too long to keep", false},
+		{"framing counts toward the bound", yaml + "stored_headers_max_bytes: 20\n", "X-Custom", "kept", false},
+		{"exactly at the bound", yaml + "stored_headers_max_bytes: 21\n", "X-Custom", "kept", true},
+		{"disabled", "", "X-Custom", "kept", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set(tt.header, tt.value)
+				w.Header().Set("Connection", "X-Hop")
+				_, _ = w.Write([]byte("body"))
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			w := do(s, http.MethodGet, "/example.com/a.txt")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			if got := w.Header().Get(tt.header) == tt.value; got != tt.want {
+				t.Errorf("%s replayed on hit = %v, want %v (%q)", tt.header, got, tt.want, w.Header().Get(tt.header))
+			}
+		})
+	}
+}
+
+func TestContentLanguage(t *testing.T) {
+	type req struct {
+		acceptLanguage string
+		wantLang       string
+		wantFetch      bool
+	}
+	tests := []struct {
+		name     string
+		vary     bool
+		requests []req
+	}{
+		{"keyed on language", true, []req{
+			{"de", "de", true},
+			{"fr-CH, fr;q=0.9", "fr", true},
+			{"de", "de", false},
+			{"fr-ch,fr;q=0.9", "fr", false},
+			{"", "en", true},
+			{"", "en", false},
+		}},
+		// Accept-Language isn't forwarded either, so the origin's default
+		// is what everyone gets.
+		{"shared entry", false, []req{
+			{"de", "en", true},
+			{"fr", "en", false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "")
+			cfg.VaryLanguage = tt.vary
+			var fetches atomic.Int32
+			s, _ := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				lang := "en"
+				if al := r.Header.Get("Accept-Language"); al != "" {
+					lang, _, _ = strings.Cut(strings.ToLower(al), "-")
+					lang, _, _ = strings.Cut(lang, ",")
+				}
+				w.Header().Set("Content-Language", lang)
+				_, _ = io.WriteString(w, "hello-"+lang)
+			}))
+			for i, rq := range tt.requests {
+				before := fetches.Load()
+				w := do(s, http.MethodGet, "/example.com/page", "Accept-Language", rq.acceptLanguage)
+				if got := w.Header().Get("Content-Language"); got != rq.wantLang || w.Body.String() != "hello-"+rq.wantLang {
+					t.Errorf("request %d (%q): Content-Language %q, body %q; want %q", i, rq.acceptLanguage, got, w.Body, rq.wantLang)
+				}
+				fetched := fetches.Load() > before
+				if fetched != rq.wantFetch {
+					t.Errorf("request %d (%q): fetched %v, want %v", i, rq.acceptLanguage, fetched, rq.wantFetch)
+				}
+				if hasToken(w.Header().Values("Vary"), "Accept-Language") != tt.vary {
+					t.Errorf("request %d: Vary %q, want Accept-Language %v", i, w.Header().Values("Vary"), tt.vary)
+				}
+			}
+		})
+	}
+}
+
+func TestLanguageKeySuffix(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		wantSame bool
+	}{
+		{"en-US", "en-us", true},
+		{"en, de;q=0.5", "en,de;q=0.5", true},
+		{"en", "de", false},
+		{"en", "en, de", false},
+	}
+	for _, tt := range tests {
+		if got := languageKeySuffix(tt.a) == languageKeySuffix(tt.b); got != tt.wantSame {
+			t.Errorf("languageKeySuffix(%q) vs (%q): same = %v, want %v", tt.a, tt.b, got, tt.wantSame)
+		}
+	}
+	if languageKeySuffix("  ") != "" {
+		t.Error("blank Accept-Language should keep the plain key")
+	}
+}
+
+func TestAcceptKeySuffix(t *testing.T) {
+	api := []string{"application/json", "application/xml"}
+	tests := []struct {
+		name   string
+		accept string
+		types  []string
+		want   string // media type keyed on, "" for the plain key
+	}{
+		{"json", "application/json", nil, "application/json"},
+		{"case and params", "Application/JSON; charset=utf-8", nil, "application/json"},
+		{"preferred by q", "application/xml;q=0.5, application/json", nil, "application/json"},
+		{"q=0 left out", "application/json;q=0, application/xml", nil, "application/xml"},
+		{"wildcard", "*/*", nil, ""},
+		{"subtype wildcard", "text/*", nil, ""},
+		{"empty", "", nil, ""},
+		{"garbage", "json", nil, ""},
+		{"listed", "application/xml", api, "application/xml"},
+		{"first listed the client accepts", "text/html, application/xml;q=0.9, application/json;q=0.8", api, "application/xml"},
+		{"subtype wildcard matches a listed type", "application/*", api, "application/json"},
+		{"wildcard skipped for a listed type", "*/*, application/xml;q=0.1", api, "application/xml"},
+		{"nothing listed", "text/html", api, ""},
+		{"only wildcard", "*/*", api, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			suffix, mediaType := acceptKeySuffix(tt.accept, tt.types)
+			if mediaType != tt.want || (suffix == "") != (tt.want == "") {
+				t.Errorf("acceptKeySuffix(%q) = %q, %q; want %q", tt.accept, suffix, mediaType, tt.want)
+			}
+		})
+	}
+	same := func(a, b string) bool {
+		x, _ := acceptKeySuffix(a, nil)
+		y, _ := acceptKeySuffix(b, nil)
+		return x == y
+	}
+	if same("application/json", "application/xml") {
+		t.Error("json and xml share a key suffix")
+	}
+	if !same("application/json", "application/json;q=1, text/plain;q=0.2") {
+		t.Error("the same preferred type got different key suffixes")
+	}
+}
+
+func TestVaryAccept(t *testing.T) {
+	type req struct {
+		domain    string
+		accept    string
+		wantBody  string
+		wantFetch bool
+	}
+	const yaml = `domains:
+  api.example.com:
+    vary_accept: true
+  typed.example.com:
+    vary_accept: true
+    accept_types: [application/json, application/xml]
+`
+	tests := []struct {
+		name     string
+		requests []req
+	}{
+		{"json and xml apart", []req{
+			{"api.example.com", "application/json", "json", true},
+			{"api.example.com", "application/xml", "xml", true},
+			{"api.example.com", "application/json", "json", false},
+			{"api.example.com", "application/xml", "xml", false},
+		}},
+		{"normalized", []req{
+			{"api.example.com", "application/json", "json", true},
+			{"api.example.com", "Application/JSON, text/plain;q=0.1", "json", false},
+		}},
+		{"wildcard shares the plain entry", []req{
+			{"api.example.com", "*/*", "default", true},
+			{"api.example.com", "", "default", false},
+			{"api.example.com", "application/json", "json", true},
+		}},
+		{"listed types only", []req{
+			{"typed.example.com", "text/html, application/xml;q=0.5", "xml", true},
+			{"typed.example.com", "application/xml", "xml", false},
+			{"typed.example.com", "text/html", "default", true},
+			{"typed.example.com", "text/csv", "default", false},
+		}},
+		{"other domain ignores Accept", []req{
+			{"example.com", "application/json", "default", true},
+			{"example.com", "application/xml", "default", false},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			s, _ := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				switch r.Header.Get("Accept") {
+				case "application/json":
+					_, _ = io.WriteString(w, "json")
+				case "application/xml":
+					_, _ = io.WriteString(w, "xml")
+				default:
+					_, _ = io.WriteString(w, "default")
+				}
+			}))
+			for i, rq := range tt.requests {
+				before := fetches.Load()
+				w := do(s, http.MethodGet, "/"+rq.domain+"/items", "Accept", rq.accept)
+				if w.Body.String() != rq.wantBody {
+					t.Errorf("request %d (%q): body %q, want %q", i, rq.accept, w.Body, rq.wantBody)
+				}
+				if fetched := fetches.Load() > before; fetched != rq.wantFetch {
+					t.Errorf("request %d (%q): fetched %v, want %v", i, rq.accept, fetched, rq.wantFetch)
+				}
+				if got := hasToken(w.Header().Values("Vary"), "Accept"); got != (rq.domain != "example.com") {
+					t.Errorf("request %d: Vary %q", i, w.Header().Values("Vary"))
+				}
+			}
+		})
+	}
+}
+
+func TestImmutableCacheControl(t *testing.T) {
+	const yaml = `immutable_routes: ['^example\.com/assets/[0-9a-f]{8}\.']
+domains:
+  static.example.com:
+    immutable: true
+`
+	const immutable = "public, max-age=31536000, immutable"
+	tests := []struct {
+		name     string
+		target   string
+		status   int
+		cc       string // upstream Cache-Control
+		hit      bool   // request it twice and check the hit
+		maxAge   int
+		wantCC   string
+		wantKept bool // upstream Cache-Control left alone
+	}{
+		{"matching route, miss", "/example.com/assets/0123abcd.js", 200, "max-age=60", false, 0, immutable, false},
+		{"matching route, hit", "/example.com/assets/0123abcd.js", 200, "max-age=60", true, 0, immutable, false},
+		{"immutable domain", "/static.example.com/x.css", 200, "", false, 0, immutable, false},
+		{"custom max-age", "/example.com/assets/0123abcd.js", 200, "", false, 600, "public, max-age=600, immutable", false},
+		{"other route", "/example.com/index.html", 200, "max-age=60", false, 0, "", true},
+		{"not found", "/example.com/assets/0123abcd.js", 404, "max-age=60", false, 0, "", true},
+		{"no-store upstream", "/example.com/assets/0123abcd.js", 200, "no-store", false, 0, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, yaml+"honor_cache_control: true\n")
+			if tt.maxAge > 0 {
+				cfg.ImmutableMaxAge = tt.maxAge
+			}
+			s, _ := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.cc != "" {
+					w.Header().Set("Cache-Control", tt.cc)
+				}
+				w.WriteHeader(tt.status)
+				_, _ = io.WriteString(w, "body")
+			}))
+			w := do(s, http.MethodGet, tt.target)
+			if tt.hit {
+				w = do(s, http.MethodGet, tt.target)
+			}
+			if w.Code != tt.status {
+				t.Fatalf("status %d, want %d", w.Code, tt.status)
+			}
+			got := w.Header().Get("Cache-Control")
+			if tt.wantKept {
+				if got == immutable {
+					t.Errorf("Cache-Control replaced with %q", got)
+				}
+			} else if got != tt.wantCC {
+				t.Errorf("Cache-Control = %q, want %q", got, tt.wantCC)
+			}
+		})
+	}
+}
@@ -0,0 +1,28 @@
+package server
+
+import (
+	"io"
+	"time"
+)
+
+// idleReader calls onIdle when no bytes arrive for the idle window, so a
+// trickling upstream can't hold a fetch for the whole request timeout.
+type idleReader struct {
+	r     io.Reader
+	idle  time.Duration
+	timer *time.Timer
+}
+
+func newIdleReader(r io.Reader, idle time.Duration, onIdle func()) *idleReader {
+	return &idleReader{r: r, idle: idle, timer: time.AfterFunc(idle, onIdle)}
+}
+
+func (ir *idleReader) Read(p []byte) (int, error) {
+	n, err := ir.r.Read(p)
+	if n > 0 {
+		ir.timer.Reset(ir.idle)
+	}
+	return n, err
+}
+
+func (ir *idleReader) stop() { ir.timer.Stop() }
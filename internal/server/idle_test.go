@@ -0,0 +1,93 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+func TestBodyIdleTimeout(t *testing.T) {
+	tests := []struct {
+		name     string
+		idle     time.Duration
+		gap      time.Duration // pause between body chunks
+		wantErr  bool
+		wantBody string
+	}{
+		{"stalls mid-body", 50 * time.Millisecond, 2 * time.Second, true, ""},
+		{"trickles within the window", 200 * time.Millisecond, 20 * time.Millisecond, false, "abcd"},
+		{"no idle timeout", 0, 100 * time.Millisecond, false, "abcd"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, ""), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for i, b := range "abcd" {
+					if i > 0 {
+						select {
+						case <-time.After(tt.gap):
+						case <-r.Context().Done():
+							return
+						}
+					}
+					_, _ = io.WriteString(w, string(b))
+					w.(http.Flusher).Flush()
+				}
+			}))
+			o := s.fetchOpts("example.com")
+			o.bodyIdle = tt.idle
+			start := time.Now()
+			fr, err := download(context.Background(), s.Client, "https://example.com/a", cache.Meta{}, o)
+			if tt.wantErr {
+				if !errors.Is(err, errBodyIdle) {
+					t.Fatalf("err = %v, want %v", err, errBodyIdle)
+				}
+				if d := time.Since(start); d > time.Second {
+					t.Errorf("took %v to abort", d)
+				}
+				return
+			}
+			if err != nil || string(fr.body) != tt.wantBody {
+				t.Fatalf("download = %q, %v", fr.body, err)
+			}
+		})
+	}
+}
+
+func TestIdleReader(t *testing.T) {
+	tests := []struct {
+		name     string
+		stop     bool
+		wantIdle bool
+	}{
+		{"left waiting", false, true},
+		{"stopped", true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			idle := make(chan struct{}, 1)
+			ir := newIdleReader(strings.NewReader("body"), 20*time.Millisecond, func() { idle <- struct{}{} })
+			if b, err := io.ReadAll(ir); err != nil || string(b) != "body" {
+				t.Fatalf("ReadAll = %q, %v", b, err)
+			}
+			if tt.stop {
+				ir.stop()
+			}
+			select {
+			case <-idle:
+				if !tt.wantIdle {
+					t.Error("onIdle called after stop")
+				}
+			case <-time.After(100 * time.Millisecond):
+				if tt.wantIdle {
+					t.Error("onIdle not called")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,113 @@
+package server
+
+import "sync"
+
+// keyActivity coordinates request-path fetches and background revalidation
+// with maintenance that deletes entries (reconcile, scrub), keyed by object
+// key. Maintenance skips keys with a fetch in flight, since the fetch is
+// about to write a fresh entry; revalidation skips keys being deleted rather
+// than bring them back.
+type keyActivity struct {
+	mu       sync.Mutex
+	fetching map[string]int
+	evicting map[string]bool
+}
+
+// beginFetch registers a fetch of key and reports whether the key is being
+// evicted. endFetch must be called either way.
+func (a *keyActivity) beginFetch(key string) (evicting bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fetching == nil {
+		a.fetching = make(map[string]int)
+	}
+	a.fetching[key]++
+	return a.evicting[key]
+}
+
+func (a *keyActivity) endFetch(key string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fetching[key]--; a.fetching[key] <= 0 {
+		delete(a.fetching, key)
+	}
+}
+
+// beginEvict claims key for deletion. It returns false, claiming nothing,
+// when a fetch is in flight or another eviction holds it.
+func (a *keyActivity) beginEvict(key string) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if a.fetching[key] > 0 || a.evicting[key] {
+		return false
+	}
+	if a.evicting == nil {
+		a.evicting = make(map[string]bool)
+	}
+	a.evicting[key] = true
+	return true
+}
+
+func (a *keyActivity) endEvict(key string) {
+	a.mu.Lock()
+	delete(a.evicting, key)
+	a.mu.Unlock()
+}
+
+// keyedMutex serializes work per key. Entries are reference counted and
+// dropped when unused, so memory tracks only keys currently contended.
+type keyedMutex struct {
+	mu    sync.Mutex
+	locks map[string]*keyLock
+}
+
+type keyLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+func (k *keyedMutex) ref(key string) *keyLock {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.locks == nil {
+		k.locks = make(map[string]*keyLock)
+	}
+	l := k.locks[key]
+	if l == nil {
+		l = &keyLock{}
+		k.locks[key] = l
+	}
+	l.refs++
+	return l
+}
+
+func (k *keyedMutex) unref(key string, l *keyLock) {
+	k.mu.Lock()
+	if l.refs--; l.refs == 0 {
+		delete(k.locks, key)
+	}
+	k.mu.Unlock()
+}
+
+// Lock blocks until key is free and returns its unlock func.
+func (k *keyedMutex) Lock(key string) func() {
+	l := k.ref(key)
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		k.unref(key, l)
+	}
+}
+
+// TryLock is Lock without waiting; ok is false if key is held.
+func (k *keyedMutex) TryLock(key string) (unlock func(), ok bool) {
+	l := k.ref(key)
+	if !l.mu.TryLock() {
+		k.unref(key, l)
+		return nil, false
+	}
+	return func() {
+		l.mu.Unlock()
+		k.unref(key, l)
+	}, true
+}
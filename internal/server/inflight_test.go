@@ -0,0 +1,301 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+func TestKeyActivity(t *testing.T) {
+	tests := []struct {
+		name         string
+		fetches      int  // in flight on the key
+		evicting     bool // already claimed by another eviction
+		wantEvict    bool
+		wantEvicting bool // what a fetch starting now is told
+	}{
+		{"idle", 0, false, true, true},
+		{"fetch in flight", 1, false, false, false},
+		{"two fetches", 2, false, false, false},
+		{"already evicting", 0, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var a keyActivity
+			for i := 0; i < tt.fetches; i++ {
+				a.beginFetch("k")
+			}
+			if tt.evicting {
+				a.beginEvict("k")
+			}
+			if got := a.beginEvict("k"); got != tt.wantEvict {
+				t.Errorf("beginEvict = %v, want %v", got, tt.wantEvict)
+			}
+			if got := a.beginFetch("k"); got != tt.wantEvicting {
+				t.Errorf("beginFetch reported evicting = %v, want %v", got, tt.wantEvicting)
+			}
+			a.endFetch("k")
+			if a.beginEvict("other") != true {
+				t.Error("claim on one key blocked another")
+			}
+			a.endEvict("other")
+			for i := 0; i < tt.fetches; i++ {
+				a.endFetch("k")
+			}
+			a.endEvict("k")
+			if !a.beginEvict("k") {
+				t.Error("key still held after everything ended")
+			}
+			a.endEvict("k")
+			if len(a.fetching) != 0 || len(a.evicting) != 0 {
+				t.Errorf("left behind: fetching %v, evicting %v", a.fetching, a.evicting)
+			}
+		})
+	}
+}
+
+func TestEvictionDuringFetch(t *testing.T) {
+	tests := []struct {
+		name       string
+		blockFetch bool // a request refetches the dropped object during reconcile
+		wantPruned int
+		wantEntry  bool
+	}{
+		{"fetch in flight", true, 0, true},
+		{"idle", false, 1, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var block atomic.Bool
+			started := make(chan struct{}, 1)
+			unblock := make(chan struct{})
+			s, st := newTestServer(t, loadConfig(t, ""), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if block.Load() {
+					started <- struct{}{}
+					<-unblock
+				}
+				_, _ = io.WriteString(w, "body")
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			objKey, metaKey := entryKeys(s, "example.com", "a.txt")
+			_ = st.DeleteObject(ctx, objKey)
+
+			var wg sync.WaitGroup
+			if tt.blockFetch {
+				block.Store(true)
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					do(s, http.MethodGet, "/example.com/a.txt")
+				}()
+				<-started
+			}
+			_, pruned, err := s.ReconcileOnce(ctx)
+			close(unblock)
+			wg.Wait()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if pruned != tt.wantPruned {
+				t.Errorf("pruned %d, want %d", pruned, tt.wantPruned)
+			}
+			_, hasMeta, _ := st.ReadMeta(ctx, metaKey)
+			hasObj, _ := st.HasObject(ctx, objKey)
+			if hasMeta != tt.wantEntry || hasObj != tt.wantEntry {
+				t.Errorf("meta %v, object %v; want both %v", hasMeta, hasObj, tt.wantEntry)
+			}
+		})
+	}
+}
+
+func TestRevalidationDuringEviction(t *testing.T) {
+	tests := []struct {
+		name      string
+		evicting  bool
+		wantFetch bool
+		wantBody  string
+	}{
+		{"key being evicted", true, false, "v1"},
+		{"key idle", false, true, "v2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var fetches atomic.Int32
+			var body atomic.Value
+			body.Store("v1")
+			s, st := newTestServer(t, loadConfig(t, ""), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				_, _ = io.WriteString(w, body.Load().(string))
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			objKey, metaKey := entryKeys(s, "example.com", "a.txt")
+			m, _, _ := st.ReadMeta(ctx, metaKey)
+			m.CachedAt = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339Nano)
+			_ = st.WriteMeta(ctx, metaKey, m)
+			body.Store("v2")
+			fetches.Store(0)
+
+			if tt.evicting {
+				s.activity.beginEvict(objKey)
+			}
+			s.revalidate(ctx, "example.com", "https://example.com/a.txt", objKey, metaKey, fetchOpts{timeout: 5 * time.Second})
+			s.activity.endEvict(objKey)
+			if got := fetches.Load() > 0; got != tt.wantFetch {
+				t.Errorf("fetched %v, want %v", got, tt.wantFetch)
+			}
+			st.mu.Lock()
+			got := string(st.objects[objKey].data)
+			st.mu.Unlock()
+			if got != tt.wantBody {
+				t.Errorf("stored body %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+// TestEvictRevalidateRace runs reconcile and revalidation on one key at once;
+// whichever wins, meta and object must end up together or gone together.
+func TestEvictRevalidateRace(t *testing.T) {
+	for i := 0; i < 20; i++ {
+		ctx := context.Background()
+		s, st := newTestServer(t, loadConfig(t, ""), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, "body")
+		}))
+		do(s, http.MethodGet, "/example.com/a.txt")
+		objKey, metaKey := entryKeys(s, "example.com", "a.txt")
+		_ = st.DeleteObject(ctx, objKey)
+
+		var wg sync.WaitGroup
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, _, _ = s.ReconcileOnce(ctx)
+		}()
+		go func() {
+			defer wg.Done()
+			s.revalidate(ctx, "example.com", "https://example.com/a.txt", objKey, metaKey, fetchOpts{timeout: 5 * time.Second})
+		}()
+		wg.Wait()
+		_, hasMeta, _ := st.ReadMeta(ctx, metaKey)
+		hasObj, _ := st.HasObject(ctx, objKey)
+		if hasMeta != hasObj {
+			t.Fatalf("run %d: meta %v, object %v", i, hasMeta, hasObj)
+		}
+	}
+}
+
+func TestKeyedMutex(t *testing.T) {
+	tests := []struct {
+		name   string
+		held   string // key locked first
+		try    string
+		wantOK bool
+	}{
+		{"same key", "a", "a", false},
+		{"other key", "a", "b", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var k keyedMutex
+			unlock := k.Lock(tt.held)
+			u, ok := k.TryLock(tt.try)
+			if ok != tt.wantOK {
+				t.Fatalf("TryLock = %v, want %v", ok, tt.wantOK)
+			}
+			if ok {
+				u()
+			}
+			unlock()
+			if u, ok := k.TryLock(tt.try); !ok {
+				t.Error("TryLock failed after unlock")
+			} else {
+				u()
+			}
+			if len(k.locks) != 0 {
+				t.Errorf("%d locks left", len(k.locks))
+			}
+		})
+	}
+}
+
+// overlapStore records how many PutObject calls for one key overlap.
+type overlapStore struct {
+	*memStore
+	mu         sync.Mutex
+	active     int
+	maxActive  int
+	objectPuts int
+}
+
+func (s *overlapStore) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	s.mu.Lock()
+	s.active++
+	s.objectPuts++
+	s.maxActive = max(s.maxActive, s.active)
+	s.mu.Unlock()
+	time.Sleep(20 * time.Millisecond)
+	defer func() {
+		s.mu.Lock()
+		s.active--
+		s.mu.Unlock()
+	}()
+	return s.memStore.PutObject(ctx, key, data, contentType)
+}
+
+func TestConcurrentPersist(t *testing.T) {
+	tests := []struct {
+		name     string
+		conflict string
+		wantPuts int
+	}{
+		{"wait", "", 2},
+		{"skip", "skip", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := loadConfig(t, "")
+			cfg.WriteConflict = tt.conflict
+			s, mem := newTestServer(t, cfg, http.NotFoundHandler())
+			st := &overlapStore{memStore: mem}
+			s.Store = st
+			objKey, metaKey := entryKeys(s, "example.com", "a.txt")
+
+			var wg sync.WaitGroup
+			for _, body := range []string{"first", "second"} {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					fr := fetched{status: http.StatusOK, header: http.Header{}, body: []byte(body), contentType: "text/plain", etag: `"` + body + `"`}
+					if err := s.persist(ctx, objKey, metaKey, fr); err != nil {
+						t.Errorf("persist %s: %v", body, err)
+					}
+				}()
+			}
+			wg.Wait()
+
+			if st.maxActive != 1 {
+				t.Errorf("%d writes of one key overlapped", st.maxActive)
+			}
+			if st.objectPuts != tt.wantPuts {
+				t.Errorf("%d object writes, want %d", st.objectPuts, tt.wantPuts)
+			}
+			// Object and meta come from the same response.
+			mem.mu.Lock()
+			body := string(mem.objects[objKey].data)
+			mem.mu.Unlock()
+			m, _, _ := mem.ReadMeta(ctx, metaKey)
+			if m.ETag != `"`+body+`"` || m.Checksum != cache.Checksum([]byte(body)) {
+				t.Errorf("object %q stored with meta %+v", body, m)
+			}
+		})
+	}
+}
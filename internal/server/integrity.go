@@ -0,0 +1,87 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// Values of integrity_mismatch besides the default "refetch".
+const (
+	IntegrityMismatchServe = "serve"
+	IntegrityMismatchFail  = "fail"
+)
+
+// errIntegrity reports a cached body that disagrees with its meta.
+var errIntegrity = errors.New("cached body does not match its meta")
+
+// verifyBufferMax bounds the bodies verify_on_read reads in full before
+// serving them.
+const verifyBufferMax = 8 << 20
+
+// verifyCached checks a cached body against the size and checksum recorded
+// in m (verify_on_read). It returns a reader over the body, which is usable
+// even when the check fails; rc is consumed. Bodies over verifyBufferMax are
+// instead hashed as the returned reader is read to the end, and mismatch is
+// called if they turn out not to match.
+func verifyCached(rc io.ReadCloser, size int64, m cache.Meta, mismatch func()) (io.ReadCloser, error) {
+	if m.Size > 0 && size != m.Size {
+		return rc, errIntegrity
+	}
+	if m.Checksum == "" {
+		return rc, nil
+	}
+	if size > verifyBufferMax {
+		return &verifyingReader{rc: rc, sum: cache.NewChecksummer(), want: m.Checksum, mismatch: mismatch}, nil
+	}
+	body, err := io.ReadAll(io.LimitReader(rc, verifyBufferMax+1))
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+	out := io.NopCloser(bytes.NewReader(body))
+	if int64(len(body)) != size || cache.Checksum(body) != m.Checksum {
+		return out, errIntegrity
+	}
+	return out, nil
+}
+
+// verifyingReader hashes a body as it is read and calls mismatch at EOF if
+// the checksum isn't want.
+type verifyingReader struct {
+	rc       io.ReadCloser
+	sum      *cache.Checksummer
+	want     string
+	mismatch func()
+	done     bool
+}
+
+func (v *verifyingReader) Read(p []byte) (int, error) {
+	n, err := v.rc.Read(p)
+	v.sum.Write(p[:n])
+	if err == io.EOF && !v.done {
+		v.done = true
+		if v.sum.Sum() != v.want {
+			v.mismatch()
+		}
+	}
+	return n, err
+}
+
+func (v *verifyingReader) Close() error { return v.rc.Close() }
+
+// dropCorrupt evicts the entry behind objKey after a failed read check so
+// the next request refetches it.
+func (s *Server) dropCorrupt(ctx context.Context, objKey string) {
+	if !s.activity.beginEvict(objKey) {
+		return
+	}
+	defer s.activity.endEvict(objKey)
+	metaKey := cache.MetaKeyForObject(objKey)
+	_ = s.Store.DeleteObject(ctx, metaKey)
+	_ = s.removeBody(ctx, objKey)
+	s.noteRemoved(metaKey)
+}
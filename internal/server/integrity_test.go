@@ -0,0 +1,128 @@
+package server
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"sync/atomic"
+	"testing"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+func TestVerifyCached(t *testing.T) {
+	small := []byte("cached body")
+	large := bytes.Repeat([]byte{'x'}, verifyBufferMax+16)
+	altered := func(b []byte) []byte {
+		out := bytes.Clone(b)
+		out[len(out)-1] ^= 1
+		return out
+	}
+	tests := []struct {
+		name         string
+		stored       []byte
+		meta         cache.Meta
+		wantErr      bool
+		wantMismatch bool // reported at EOF, for streamed checks
+	}{
+		{"match", small, cache.Meta{Size: int64(len(small)), Checksum: cache.Checksum(small)}, false, false},
+		{"size differs", append(bytes.Clone(small), '!'), cache.Meta{Size: int64(len(small)), Checksum: cache.Checksum(small)}, true, false},
+		{"checksum differs", altered(small), cache.Meta{Size: int64(len(small)), Checksum: cache.Checksum(small)}, true, false},
+		{"no checksum recorded", altered(small), cache.Meta{Size: int64(len(small))}, false, false},
+		{"nothing recorded", small, cache.Meta{}, false, false},
+		{"large, match", large, cache.Meta{Size: int64(len(large)), Checksum: cache.Checksum(large)}, false, false},
+		{"large, checksum differs", altered(large), cache.Meta{Size: int64(len(large)), Checksum: cache.Checksum(large)}, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mismatched bool
+			rc, err := verifyCached(io.NopCloser(bytes.NewReader(tt.stored)), int64(len(tt.stored)), tt.meta, func() { mismatched = true })
+			if errors.Is(err, errIntegrity) != tt.wantErr {
+				t.Fatalf("err = %v, want integrity error %v", err, tt.wantErr)
+			}
+			// The body is readable either way.
+			got, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(got, tt.stored) {
+				t.Fatalf("read %d bytes, %v; want the stored %d", len(got), err, len(tt.stored))
+			}
+			if mismatched != tt.wantMismatch {
+				t.Errorf("mismatch reported %v, want %v", mismatched, tt.wantMismatch)
+			}
+		})
+	}
+}
+
+func TestIntegrityMismatch(t *testing.T) {
+	small := []byte("the original body")
+	large := bytes.Repeat([]byte("0123456789abcdef"), verifyBufferMax/16+1)
+	tests := []struct {
+		name        string
+		yaml        string
+		body        []byte
+		grow        bool // corrupt by appending rather than altering a byte
+		wantStatus  int
+		wantServed  string // "good" or "corrupt"
+		wantKept    bool   // the corrupt entry is still stored afterwards
+		wantFetches int32
+	}{
+		{"refetch, checksum", "", small, false, http.StatusOK, "good", false, 2},
+		{"refetch, size", "", small, true, http.StatusOK, "good", false, 2},
+		{"serve, checksum", "integrity_mismatch: serve\n", small, false, http.StatusOK, "corrupt", true, 1},
+		{"serve, size", "integrity_mismatch: serve\n", small, true, http.StatusOK, "corrupt", true, 1},
+		{"fail, checksum", "integrity_mismatch: fail\n", small, false, http.StatusBadGateway, "", true, 1},
+		{"fail, size", "integrity_mismatch: fail\n", small, true, http.StatusBadGateway, "", true, 1},
+		// Too large to check before serving: it goes out as stored, and
+		// is evicted once the check fails.
+		{"refetch, large", "", large, false, http.StatusOK, "corrupt", false, 1},
+		{"serve, large", "integrity_mismatch: serve\n", large, false, http.StatusOK, "corrupt", true, 1},
+		{"refetch, large, size", "", large, true, http.StatusOK, "good", false, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			s, st := newTestServer(t, loadConfig(t, "verify_on_read: true\n"+tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				_, _ = w.Write(tt.body)
+			}))
+			do(s, http.MethodGet, "/example.com/a.bin")
+			objKey, _ := entryKeys(s, "example.com", "a.bin")
+			st.mu.Lock()
+			o := st.objects[objKey]
+			if tt.grow {
+				o.data = append(bytes.Clone(o.data), "!"...)
+			} else {
+				o.data = bytes.Clone(o.data)
+				o.data[0] ^= 1
+			}
+			corrupt := o.data
+			st.objects[objKey] = o
+			st.mu.Unlock()
+
+			w := do(s, http.MethodGet, "/example.com/a.bin")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+			switch tt.wantServed {
+			case "good":
+				if !bytes.Equal(w.Body.Bytes(), tt.body) {
+					t.Errorf("served %d bytes, want the original body", w.Body.Len())
+				}
+			case "corrupt":
+				if !bytes.Equal(w.Body.Bytes(), corrupt) {
+					t.Errorf("served %d bytes, want the stored ones", w.Body.Len())
+				}
+			}
+			st.mu.Lock()
+			stored, ok := st.objects[objKey]
+			st.mu.Unlock()
+			if kept := ok && bytes.Equal(stored.data, corrupt); kept != tt.wantKept {
+				t.Errorf("corrupt entry kept %v, want %v", kept, tt.wantKept)
+			}
+			if n := fetches.Load(); n != tt.wantFetches {
+				t.Errorf("%d upstream fetches, want %d", n, tt.wantFetches)
+			}
+		})
+	}
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"context"
+	"sync"
+)
+
+// fetchLimiter bounds concurrent upstream fetches: at most global in total
+// and at most perDomain for any one domain, so a slow origin can't hold every
+// slot while requests for fast ones queue behind it. A domain waits for its
+// own slot before taking a global one. Zero limits are unlimited.
+type fetchLimiter struct {
+	global    chan struct{}
+	perDomain int
+
+	mu      sync.Mutex
+	domains map[string]*domainSlots
+}
+
+type domainSlots struct {
+	ch    chan struct{}
+	users int // holders and waiters; the entry is dropped at zero
+}
+
+func newFetchLimiter(global, perDomain int) *fetchLimiter {
+	l := &fetchLimiter{perDomain: perDomain, domains: make(map[string]*domainSlots)}
+	if global > 0 {
+		l.global = make(chan struct{}, global)
+	}
+	return l
+}
+
+// acquire blocks until domain may start a fetch or ctx is done. The returned
+// func releases the slots and must be called exactly once.
+func (l *fetchLimiter) acquire(ctx context.Context, domain string) (func(), error) {
+	var ds *domainSlots
+	if l.perDomain > 0 {
+		l.mu.Lock()
+		ds = l.domains[domain]
+		if ds == nil {
+			ds = &domainSlots{ch: make(chan struct{}, l.perDomain)}
+			l.domains[domain] = ds
+		}
+		ds.users++
+		l.mu.Unlock()
+
+		select {
+		case ds.ch <- struct{}{}:
+		case <-ctx.Done():
+			l.leave(domain, ds, false)
+			return nil, ctx.Err()
+		}
+	}
+	if l.global != nil {
+		select {
+		case l.global <- struct{}{}:
+		case <-ctx.Done():
+			if ds != nil {
+				l.leave(domain, ds, true)
+			}
+			return nil, ctx.Err()
+		}
+	}
+	return func() {
+		if l.global != nil {
+			<-l.global
+		}
+		if ds != nil {
+			l.leave(domain, ds, true)
+		}
+	}, nil
+}
+
+func (l *fetchLimiter) leave(domain string, ds *domainSlots, held bool) {
+	if held {
+		<-ds.ch
+	}
+	l.mu.Lock()
+	if ds.users--; ds.users == 0 {
+		delete(l.domains, domain)
+	}
+	l.mu.Unlock()
+}
@@ -0,0 +1,123 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFetchLimiter(t *testing.T) {
+	tests := []struct {
+		name          string
+		global        int
+		perDomain     int
+		slowHeld      int  // slots slow.example.com holds
+		wantSlowMore  bool // slow.example.com can start another fetch
+		wantFastStart bool // fast.example.com can start one
+	}{
+		{"per-domain cap leaves room", 4, 2, 2, false, true},
+		{"global only starves", 2, 0, 2, false, false},
+		{"per-domain only", 0, 1, 1, false, true},
+		{"under both caps", 4, 3, 2, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := newFetchLimiter(tt.global, tt.perDomain)
+			var releases []func()
+			for i := 0; i < tt.slowHeld; i++ {
+				release, err := l.acquire(context.Background(), "slow.example.com")
+				if err != nil {
+					t.Fatalf("slot %d: %v", i, err)
+				}
+				releases = append(releases, release)
+			}
+			try := func(domain string) bool {
+				ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+				defer cancel()
+				release, err := l.acquire(ctx, domain)
+				if err != nil {
+					return false
+				}
+				release()
+				return true
+			}
+			if got := try("slow.example.com"); got != tt.wantSlowMore {
+				t.Errorf("slow domain got another slot: %v, want %v", got, tt.wantSlowMore)
+			}
+			if got := try("fast.example.com"); got != tt.wantFastStart {
+				t.Errorf("fast domain got a slot: %v, want %v", got, tt.wantFastStart)
+			}
+			for _, release := range releases {
+				release()
+			}
+			if !try("fast.example.com") {
+				t.Error("no slot after everything was released")
+			}
+			l.mu.Lock()
+			defer l.mu.Unlock()
+			if len(l.domains) != 0 {
+				t.Errorf("%d domains still tracked after release", len(l.domains))
+			}
+		})
+	}
+}
+
+func TestFetchFairness(t *testing.T) {
+	tests := []struct {
+		name       string
+		yaml       string
+		wantStarve bool
+	}{
+		{"per-domain limit", "max_upstream_fetches: 4\nmax_fetches_per_domain: 2\n", false},
+		{"global limit only", "max_upstream_fetches: 4\n", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unblock := make(chan struct{})
+			s, _ := newTestServer(t, loadConfig(t, tt.yaml+"upstream_timeout: 5\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.Host, "slow.") {
+					select {
+					case <-unblock:
+					case <-r.Context().Done():
+					}
+				}
+				_, _ = io.WriteString(w, r.Host)
+			}))
+			var wg sync.WaitGroup
+			for i := 0; i < 6; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					do(s, http.MethodGet, fmt.Sprintf("/slow.example.com/%d", i))
+				}()
+			}
+			defer wg.Wait()
+			defer close(unblock)
+			time.Sleep(50 * time.Millisecond) // let the slow fetches take their slots
+
+			done := make(chan int, 1)
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				done <- do(s, http.MethodGet, "/fast.example.com/a").Code
+			}()
+			select {
+			case code := <-done:
+				if tt.wantStarve {
+					t.Errorf("fast domain answered %d while every slot was held", code)
+				} else if code != http.StatusOK {
+					t.Errorf("fast domain status %d", code)
+				}
+			case <-time.After(500 * time.Millisecond):
+				if !tt.wantStarve {
+					t.Error("fast domain starved by the slow one")
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,106 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+type manifestEntry struct {
+	Domain   string `json:"domain"`
+	Route    string `json:"route"`
+	Version  string `json:"version,omitempty"`
+	Size     int64  `json:"size"`
+	ETag     string `json:"etag,omitempty"`
+	CachedAt string `json:"cached_at,omitempty"`
+	Neg      bool   `json:"neg,omitempty"`
+	URL      string `json:"url,omitempty"`
+}
+
+// handleManifest streams one JSON line per cached entry. Keys are listed and
+// their meta read as the response is written, so memory use doesn't grow
+// with the size of the cache; lines come out in no particular order.
+func (s *Server) handleManifest(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	keys := make(chan string)
+	var listErr error
+	go func() {
+		defer close(keys)
+		listErr = s.Store.ListKeys(ctx, "meta/", func(key string) error {
+			select {
+			case keys <- key:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+
+	entries := make(chan manifestEntry)
+	var wg sync.WaitGroup
+	for i := 0; i < cap(s.metaSem); i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for key := range keys {
+				e, ok := s.manifestEntry(ctx, key)
+				if !ok {
+					continue
+				}
+				select {
+				case entries <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(entries)
+	}()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	enc := json.NewEncoder(w)
+	for e := range entries {
+		if err := enc.Encode(e); err != nil {
+			// Client went away; stop the producers and let them drain.
+			cancel()
+		}
+	}
+	if listErr != nil && ctx.Err() == nil {
+		log.Printf("admin: manifest listing failed: %v", listErr)
+	}
+}
+
+func (s *Server) manifestEntry(ctx context.Context, metaKey string) (manifestEntry, bool) {
+	version, domain, route, ok := cache.ParseMetaKey(metaKey)
+	if !ok {
+		return manifestEntry{}, false
+	}
+	m, found, err := s.readMetaBulk(ctx, metaKey)
+	if err != nil || !found {
+		return manifestEntry{}, false
+	}
+	return manifestEntry{
+		Domain:   domain,
+		Route:    cache.UnescapeRoute(route),
+		Version:  version,
+		Size:     m.Size,
+		ETag:     m.ETag,
+		CachedAt: m.CachedAt,
+		Neg:      m.Neg,
+		URL:      m.URL,
+	}, true
+}
@@ -0,0 +1,146 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+func TestManifest(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries int
+		missing int
+	}{
+		{"empty", 0, 0},
+		{"one", 1, 0},
+		{"many, with negative entries", 60, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, "admin_token: secret\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/missing") {
+					http.NotFound(w, r)
+					return
+				}
+				_, _ = io.WriteString(w, r.URL.Path)
+			}))
+			want := map[string]bool{}
+			for i := 0; i < tt.entries; i++ {
+				domain := fmt.Sprintf("d%d.example.com", i%3)
+				route := fmt.Sprintf("file-%d.txt", i)
+				do(s, http.MethodGet, "/"+domain+"/"+route)
+				want[domain+"/"+route] = false
+			}
+			for i := 0; i < tt.missing; i++ {
+				route := fmt.Sprintf("missing-%d", i)
+				do(s, http.MethodGet, "/example.com/"+route)
+				want["example.com/"+route] = true
+			}
+
+			w := do(s.AdminHandler(), http.MethodGet, "/admin/manifest", "Authorization", "Bearer secret")
+			if w.Code != http.StatusOK {
+				t.Fatalf("manifest: %d %s", w.Code, w.Body)
+			}
+			got := map[string]bool{}
+			sc := bufio.NewScanner(w.Body)
+			for sc.Scan() {
+				var e manifestEntry
+				if err := json.Unmarshal(sc.Bytes(), &e); err != nil {
+					t.Fatalf("bad line %q: %v", sc.Text(), err)
+				}
+				got[e.Domain+"/"+e.Route] = e.Neg
+			}
+			if fmt.Sprint(manifestLines(got)) != fmt.Sprint(manifestLines(want)) {
+				t.Errorf("manifest has %v, want %v", manifestLines(got), manifestLines(want))
+			}
+		})
+	}
+}
+
+// manifestLines renders entries (route -> negative) for comparison.
+func manifestLines(m map[string]bool) []string {
+	out := make([]string, 0, len(m))
+	for k, neg := range m {
+		out = append(out, fmt.Sprintf("%s neg=%v", k, neg))
+	}
+	sort.Strings(out)
+	return out
+}
+
+// peakMetaStore records the most ReadMeta calls it has seen in flight, each
+// held for delay.
+type peakMetaStore struct {
+	*memStore
+	delay     time.Duration
+	cur, peak atomic.Int32
+}
+
+func (p *peakMetaStore) ReadMeta(ctx context.Context, key string) (cache.Meta, bool, error) {
+	n := p.cur.Add(1)
+	defer p.cur.Add(-1)
+	for {
+		old := p.peak.Load()
+		if n <= old || p.peak.CompareAndSwap(old, n) {
+			break
+		}
+	}
+	time.Sleep(p.delay)
+	return p.memStore.ReadMeta(ctx, key)
+}
+
+func TestMetaReadConcurrency(t *testing.T) {
+	tests := []struct {
+		name      string
+		limit     int
+		reconcile bool // walk with ReconcileOnce alongside the manifest
+	}{
+		{"serial", 1, false},
+		{"four", 4, false},
+		{"shared with reconcile", 3, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			yaml := fmt.Sprintf("admin_token: secret\nmeta_read_concurrency: %d\n", tt.limit)
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, r.URL.Path)
+			}))
+			const entries = 40
+			for i := 0; i < entries; i++ {
+				do(s, http.MethodGet, fmt.Sprintf("/example.com/file-%d.txt", i))
+			}
+			ps := &peakMetaStore{memStore: st, delay: 2 * time.Millisecond}
+			s.Store = ps
+
+			var wg sync.WaitGroup
+			if tt.reconcile {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					if _, _, err := s.ReconcileOnce(context.Background()); err != nil {
+						t.Errorf("ReconcileOnce: %v", err)
+					}
+				}()
+			}
+			w := do(s.AdminHandler(), http.MethodGet, "/admin/manifest", "Authorization", "Bearer secret")
+			wg.Wait()
+			if w.Code != http.StatusOK || strings.Count(w.Body.String(), "\n") != entries {
+				t.Fatalf("manifest: %d, %d lines", w.Code, strings.Count(w.Body.String(), "\n"))
+			}
+			if peak := int(ps.peak.Load()); peak > tt.limit || (tt.limit > 1 && peak < 2) {
+				t.Errorf("peak of %d meta reads in flight, limit %d", peak, tt.limit)
+			}
+		})
+	}
+}
@@ -0,0 +1,38 @@
+package server
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// partitionKey returns the cache key suffix of the client's partition, plus
+// the header to forward upstream so the origin sees the same partition.
+// Requests without a usable partition keep the plain key.
+func (s *Server) partitionKey(r *http.Request) (suffix, header, value string) {
+	c := s.conf()
+	switch c.Partition {
+	case "ip":
+		a, ok := s.clientAddr(r)
+		if !ok {
+			return "", "", ""
+		}
+		bits := c.PartitionIPv6Prefix
+		if a.Is4() {
+			bits = c.PartitionIPv4Prefix
+		}
+		p, err := a.Prefix(bits)
+		if err != nil {
+			return "", "", ""
+		}
+		return cache.Variant("part", p.String()), "X-Forwarded-For", a.String()
+	case "header":
+		v := strings.TrimSpace(r.Header.Get(c.PartitionHeader))
+		if v == "" {
+			return "", "", ""
+		}
+		return cache.Variant("part", v), c.PartitionHeader, v
+	}
+	return "", "", ""
+}
@@ -0,0 +1,92 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestPartitionKey(t *testing.T) {
+	tests := []struct {
+		name     string
+		yaml     string
+		a, b     [2]string // remote address, X-Tenant / X-Forwarded-For value
+		wantSame bool
+		wantNone bool // a has no partition
+	}{
+		{"same /24", "partition: ip\n", [2]string{"10.0.0.1:1", ""}, [2]string{"10.0.0.200:2", ""}, true, false},
+		{"other /24", "partition: ip\n", [2]string{"10.0.0.1:1", ""}, [2]string{"10.0.1.1:1", ""}, false, false},
+		{"narrower prefix", "partition: ip\npartition_ipv4_prefix: 32\n", [2]string{"10.0.0.1:1", ""}, [2]string{"10.0.0.2:1", ""}, false, false},
+		{"same /48", "partition: ip\n", [2]string{"[2001:db8:1:2::1]:1", ""}, [2]string{"[2001:db8:1:ffff::9]:1", ""}, true, false},
+		{"other /48", "partition: ip\n", [2]string{"[2001:db8:1::1]:1", ""}, [2]string{"[2001:db8:2::1]:1", ""}, false, false},
+		{"mapped v4", "partition: ip\n", [2]string{"[::ffff:10.0.0.1]:1", ""}, [2]string{"10.0.0.9:1", ""}, true, false},
+		{"trusted forwarded for", "partition: ip\ntrust_proxy_headers: true\n", [2]string{"10.0.0.1:1", "192.0.2.1"}, [2]string{"10.0.0.1:1", "198.51.100.1"}, false, false},
+		{"untrusted forwarded for", "partition: ip\n", [2]string{"10.0.0.1:1", "192.0.2.1"}, [2]string{"10.0.0.1:1", "198.51.100.1"}, true, false},
+		{"same header", "partition: header\npartition_header: X-Tenant\n", [2]string{"10.0.0.1:1", "acme"}, [2]string{"10.9.9.9:1", "acme"}, true, false},
+		{"other header", "partition: header\npartition_header: X-Tenant\n", [2]string{"10.0.0.1:1", "acme"}, [2]string{"10.0.0.1:1", "globex"}, false, false},
+		{"no header", "partition: header\npartition_header: X-Tenant\n", [2]string{"10.0.0.1:1", ""}, [2]string{"10.0.0.1:1", ""}, true, true},
+		{"off", "", [2]string{"10.0.0.1:1", "acme"}, [2]string{"10.0.1.1:1", "globex"}, true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, tt.yaml), http.NotFoundHandler())
+			key := func(c [2]string) string {
+				r := httptest.NewRequest(http.MethodGet, "/example.com/a.txt", nil)
+				r.RemoteAddr = c[0]
+				if c[1] != "" {
+					r.Header.Set("X-Tenant", c[1])
+					r.Header.Set("X-Forwarded-For", c[1])
+				}
+				suffix, _, _ := s.partitionKey(r)
+				return suffix
+			}
+			ka, kb := key(tt.a), key(tt.b)
+			if (ka == kb) != tt.wantSame {
+				t.Errorf("partitions %q and %q: same = %v, want %v", ka, kb, ka == kb, tt.wantSame)
+			}
+			if (ka == "") != tt.wantNone {
+				t.Errorf("partition %q, want none %v", ka, tt.wantNone)
+			}
+		})
+	}
+}
+
+func TestPartitionedCache(t *testing.T) {
+	const yaml = "partition: header\npartition_header: X-Tenant\n"
+	tests := []struct {
+		name        string
+		tenants     []string
+		wantFetches int32
+	}{
+		{"one tenant", []string{"acme", "acme"}, 1},
+		{"two tenants", []string{"acme", "globex"}, 2},
+		{"path-like value", []string{"a/../b", "b"}, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				_, _ = io.WriteString(w, "for "+r.Header.Get("X-Tenant"))
+			}))
+			for _, tenant := range tt.tenants {
+				w := do(s, http.MethodGet, "/example.com/a.txt", "X-Tenant", tenant)
+				if w.Code != http.StatusOK || w.Body.String() != "for "+tenant {
+					t.Errorf("%s: got %d %q", tenant, w.Code, w.Body)
+				}
+			}
+			if n := fetches.Load(); n != tt.wantFetches {
+				t.Errorf("%d upstream fetches, want %d", n, tt.wantFetches)
+			}
+			// Partitions add no path segments beyond their own.
+			for _, k := range st.keys("objects/") {
+				if !strings.HasPrefix(k, "objects/example.com/a.txt@part/") || strings.Count(k, "/") != 3 {
+					t.Errorf("unexpected key %q", k)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,277 @@
+package server
+
+import (
+	"context"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// softEmpty reports whether an empty 200 for route with the given content
+// type should be treated as a not-yet-propagated asset rather than a
+// legitimately empty file.
+func (s *Server) softEmpty(route, contentType string) bool {
+	c := s.conf()
+	ct := strings.ToLower(contentType)
+	if matchesType(ct, c.EmptyBodyAllowTypes) {
+		return false
+	}
+	if matchesType(ct, c.EmptyBodyTypes) {
+		return true
+	}
+	lr := strings.ToLower(route)
+	for _, e := range c.EmptyBodyExts {
+		if e != "" && strings.HasSuffix(lr, strings.ToLower(e)) {
+			return true
+		}
+	}
+	return false
+}
+
+// ZeroLifetimeRevalidate stores responses that arrive with no freshness
+// lifetime as always-stale entries instead of skipping them (zero_lifetime).
+const ZeroLifetimeRevalidate = "revalidate"
+
+// ruleRoute returns the domain and route that per-route rules match for fr,
+// stored at metaKey: the route as requested (before fold_case lowercased it
+// for the key) when fr carries it, else the one in the key.
+func ruleRoute(metaKey string, fr fetched) (domain, route string, ok bool) {
+	_, domain, route, ok = cache.ParseMetaKey(metaKey)
+	if !ok {
+		return "", "", false
+	}
+	if fr.route != "" {
+		return domain, fr.route, true
+	}
+	route, _ = cache.SplitVariant(route)
+	return domain, cache.UnescapeRoute(route), true
+}
+
+// routeTTL returns the configured TTL for fr stored at metaKey, applying
+// ttl_rules.
+func (s *Server) routeTTL(metaKey string, fr fetched) int {
+	c := s.conf()
+	domain, route, ok := ruleRoute(metaKey, fr)
+	if !ok {
+		return int(c.TTLDefault)
+	}
+	return c.RouteTTL(domain, route)
+}
+
+// unexpectedType reports whether fr's content type violates the
+// content_type_rules entry matching it, stored at metaKey.
+func (s *Server) unexpectedType(metaKey string, fr fetched) bool {
+	domain, route, ok := ruleRoute(metaKey, fr)
+	if !ok {
+		return false
+	}
+	want := s.conf().ExpectedTypes(domain, route)
+	return want != nil && !matchesType(strings.ToLower(fr.contentType), want)
+}
+
+// servePlaceholder answers a failed miss with the configured placeholder for
+// the route, if any. Downstream caches are told not to keep it.
+func (s *Server) servePlaceholder(w http.ResponseWriter, domain, route string) bool {
+	p := s.conf().Placeholder(domain, route)
+	if p == nil {
+		return false
+	}
+	ct := p.ContentType
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ct)
+	w.Header().Set("Content-Length", strconv.Itoa(len(p.Body())))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(p.Status)
+	_, _ = w.Write(p.Body())
+	return true
+}
+
+// matchesType reports whether the lowercased content type ct matches one of
+// patterns: a pattern with '*' is matched against the media type alone
+// (e.g. "image/*"), anything else as a prefix.
+func matchesType(ct string, patterns []string) bool {
+	mt, _, _ := strings.Cut(ct, ";")
+	mt = strings.TrimSpace(mt)
+	for _, t := range patterns {
+		t = strings.ToLower(t)
+		switch {
+		case t == "":
+		case strings.Contains(t, "*"):
+			if ok, _ := path.Match(t, mt); ok {
+				return true
+			}
+		case strings.HasPrefix(ct, t):
+			return true
+		}
+	}
+	return false
+}
+
+// lifetime returns the upstream-declared freshness lifetime in seconds when
+// honor_cache_control (or, for Expires only, honor_expires) is set and the
+// response carries one. Positive lifetimes are clamped to
+// upstream_ttl_min/upstream_ttl_max.
+func (s *Server) lifetime(fr fetched) (int, bool) {
+	c := s.conf()
+	var lt int
+	var ok bool
+	switch {
+	case c.HonorCacheControl:
+		lt, ok = cache.Lifetime(fr.header, time.Now())
+	case c.HonorExpires:
+		lt, ok = cache.ExpiresLifetime(fr.header, time.Now())
+	}
+	if !ok || lt <= 0 {
+		return lt, ok
+	}
+	if m := int(c.UpstreamTTLMin); m > 0 && lt < m {
+		lt = m
+	}
+	if m := int(c.UpstreamTTLMax); m > 0 && lt > m {
+		lt = m
+	}
+	return lt, true
+}
+
+// staleWindows returns the stale-while-revalidate and stale-if-error windows
+// for m: the upstream's when recorded, else the configured defaults.
+func (s *Server) staleWindows(m cache.Meta) (swr, sie int) {
+	c := s.conf()
+	swr, sie = c.StaleWhileRevalidate, c.StaleIfError
+	if m.StaleWhileRevalidate > 0 {
+		swr = m.StaleWhileRevalidate
+	}
+	if m.StaleIfError > 0 {
+		sie = m.StaleIfError
+	}
+	return swr, sie
+}
+
+// canServeStaleOnError reports whether objKey may be served in place of an
+// upstream failure under stale-if-error.
+func (s *Server) canServeStaleOnError(ctx context.Context, objKey string, m cache.Meta, hasMeta bool) bool {
+	if !hasMeta {
+		return false
+	}
+	_, sie := s.staleWindows(m)
+	if !cache.IsStaleWithin(m, int(s.conf().TTLDefault), sie) {
+		return false
+	}
+	ok, _ := s.Store.HasObject(ctx, objKey)
+	return ok
+}
+
+// storable reports whether a successful response may be cached. Responses
+// carrying a configured no_cache_headers marker, with honor_cache_control
+// private/no-store responses, and, unless zero_lifetime is "revalidate",
+// ones already expired on arrival (see lifetime) are passed through to the
+// client without being stored; no-cache ones are stored regardless, as
+// entries every hit revalidates. So are, under require_explicit_freshness,
+// responses with neither a lifetime nor a validator, and bodies over the
+// domain's max_object_bytes.
+func (s *Server) storable(fr fetched) bool {
+	c := s.conf()
+	if hasNoCacheMarker(fr.header, c.NoCacheHeaders) || s.overSizeLimit(fr.domain, int64(len(fr.body))) {
+		return false
+	}
+	if c.RequireExplicitFreshness && fr.etag == "" && fr.lastModified == "" {
+		if _, ok := cache.Lifetime(fr.header, time.Now()); !ok {
+			return false
+		}
+	}
+	if c.HonorCacheControl {
+		cc := cache.ParseCacheControl(strings.Join(fr.header.Values("Cache-Control"), ","))
+		if !cc.SharedStorable() {
+			return false
+		}
+		if cc.NoCache {
+			return true
+		}
+	}
+	if lt, ok := s.lifetime(fr); ok && lt <= 0 && c.ZeroLifetime != ZeroLifetimeRevalidate {
+		return false
+	}
+	return true
+}
+
+// unchangedBody reports whether a 200 carries exactly the body already
+// stored for the entry, so it can be treated as a 304 under
+// same_body_not_modified: origins that rotate ETags on identical content
+// would otherwise be re-stored on every revalidation.
+func (s *Server) unchangedBody(meta cache.Meta, hasMeta bool, fr fetched) bool {
+	if !s.conf().SameBodyNotModified || !hasMeta || meta.Neg || !meta.HasBody() ||
+		meta.Checksum == "" || fr.status != http.StatusOK {
+		return false
+	}
+	sum := fr.checksum
+	if sum == "" {
+		sum = cache.Checksum(fr.body)
+	}
+	return sum == meta.Checksum
+}
+
+// renewUnchanged renews an entry whose body came back unchanged, adopting
+// the response's new validators so later revalidations send them, and the
+// TTL it would be stored under now (see entryTTL).
+func (s *Server) renewUnchanged(ctx context.Context, metaKey string, meta cache.Meta, fr fetched) {
+	c := s.conf()
+	meta.TTL, meta.Revalidate = s.entryTTL(metaKey, fr)
+	meta.Renew(int(c.TTLDefault), c.AdaptiveTTLMax)
+	meta.ETag, meta.LastModified = fr.etag, fr.lastModified
+	_ = s.Store.WriteMeta(ctx, metaKey, meta)
+}
+
+// hasNoCacheMarker reports whether h matches any "Name" or "Name: value"
+// rule. Names match case-insensitively; values match exactly after trimming.
+func hasNoCacheMarker(h http.Header, rules []string) bool {
+	for _, rule := range rules {
+		name, want, hasValue := strings.Cut(rule, ":")
+		vs := h.Values(strings.TrimSpace(name))
+		if len(vs) == 0 {
+			continue
+		}
+		if !hasValue {
+			return true
+		}
+		want = strings.TrimSpace(want)
+		for _, v := range vs {
+			if strings.TrimSpace(v) == want {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// DuplicateContentTypeLast prefers the last of several Content-Type headers.
+const DuplicateContentTypeLast = "last"
+
+// pickContentType chooses the Content-Type to store from the upstream's
+// values. Values that don't parse as a media type are skipped, trying them in
+// order, or from the end under duplicate_content_type "last"; when none
+// parses the type is sniffed from the body. No header at all stays "".
+func pickContentType(values []string, body []byte, pick string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	for i := range values {
+		v := values[i]
+		if pick == DuplicateContentTypeLast {
+			v = values[len(values)-1-i]
+		}
+		if _, _, err := mime.ParseMediaType(v); err == nil {
+			return v
+		}
+	}
+	if len(body) == 0 {
+		return ""
+	}
+	return http.DetectContentType(body)
+}
@@ -0,0 +1,831 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+func TestEmptyBody(t *testing.T) {
+	const yaml = `
+empty_body_types: [application/octet-stream, "image/*"]
+empty_body_allow_types: [text/plain]
+empty_body_extensions: [.wasm]
+`
+	tests := []struct {
+		name        string
+		route       string
+		contentType string
+		body        string
+		negTTL      int
+		wantStatus  int
+		wantStored  bool
+		wantNeg     bool
+	}{
+		{"empty binary", "app.bin", "application/octet-stream", "", 0, http.StatusBadGateway, false, false},
+		{"empty image pattern", "logo.png", "image/png", "", 0, http.StatusBadGateway, false, false},
+		{"empty by extension", "mod.wasm", "text/html", "", 0, http.StatusBadGateway, false, false},
+		{"empty binary, negatively cached", "app.bin", "application/octet-stream", "", 30, http.StatusBadGateway, false, true},
+		{"empty but valid text", "robots.txt", "text/plain", "", 0, http.StatusOK, true, false},
+		{"allow type wins over extension", "notes.wasm", "text/plain", "", 0, http.StatusOK, true, false},
+		{"non-empty binary", "app.bin", "application/octet-stream", "\x00\x01", 0, http.StatusOK, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, yaml)
+			cfg.EmptyBodyNegTTL = tt.negTTL
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				_, _ = w.Write([]byte(tt.body))
+			}))
+			w := do(s, http.MethodGet, "/example.com/"+tt.route)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			objKey, metaKey := entryKeys(s, "example.com", tt.route)
+			if stored, _ := st.HasObject(context.Background(), objKey); stored != tt.wantStored {
+				t.Errorf("stored = %v, want %v", stored, tt.wantStored)
+			}
+			m, ok, _ := st.ReadMeta(context.Background(), metaKey)
+			if neg := ok && m.Neg; neg != tt.wantNeg {
+				t.Errorf("negative entry = %v, want %v", neg, tt.wantNeg)
+			}
+		})
+	}
+}
+
+func TestHonorCacheControl(t *testing.T) {
+	tests := []struct {
+		name           string
+		cc             string
+		wantStored     bool
+		wantTTL        int
+		wantRevalidate bool
+		wantFetches    int // over two requests
+	}{
+		{"s-maxage over max-age", "max-age=60, s-maxage=600", true, 600, false, 1},
+		{"max-age", "max-age=60", true, 60, false, 1},
+		{"private", "private, max-age=600", false, 0, false, 2},
+		{"no-store", "no-store", false, 0, false, 2},
+		{"no-cache", "no-cache", true, 0, true, 2},
+		{"no-cache over max-age", "no-cache, max-age=600", true, 0, true, 2},
+		{"none", "", true, 3600, false, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			fetches, notModified := 0, 0
+			s, st := newTestServer(t, loadConfig(t, "honor_cache_control: true\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches++
+				if tt.cc != "" {
+					w.Header().Set("Cache-Control", tt.cc)
+				}
+				w.Header().Set("ETag", `"v1"`)
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					notModified++
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				_, _ = w.Write([]byte("body"))
+			}))
+			if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != http.StatusOK || w.Body.String() != "body" {
+				t.Fatalf("status = %d, body %q", w.Code, w.Body)
+			}
+			objKey, metaKey := entryKeys(s, "example.com", "a.txt")
+			if stored, _ := st.HasObject(context.Background(), objKey); stored != tt.wantStored {
+				t.Errorf("stored = %v, want %v", stored, tt.wantStored)
+			}
+			if m, ok, _ := st.ReadMeta(context.Background(), metaKey); ok && (m.TTL != tt.wantTTL || m.Revalidate != tt.wantRevalidate) {
+				t.Errorf("TTL = %d, revalidate %v; want %d, %v", m.TTL, m.Revalidate, tt.wantTTL, tt.wantRevalidate)
+			}
+			if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != http.StatusOK || w.Body.String() != "body" {
+				t.Fatalf("second request: status = %d, body %q", w.Code, w.Body)
+			}
+			if fetches != tt.wantFetches {
+				t.Errorf("upstream fetches = %d, want %d", fetches, tt.wantFetches)
+			}
+			// A stored no-cache entry is reused only after a conditional check.
+			if tt.wantRevalidate && notModified != 1 {
+				t.Errorf("conditional revalidations = %d, want 1", notModified)
+			}
+		})
+	}
+}
+
+func TestNoCacheHeaders(t *testing.T) {
+	const yaml = "no_cache_headers: [\"X-No-Cache: 1\", x-private-object]\n"
+	tests := []struct {
+		name       string
+		header     []string
+		wantStored bool
+	}{
+		{"matching value", []string{"X-No-Cache", "1"}, false},
+		{"other value", []string{"X-No-Cache", "0"}, true},
+		{"name only rule, any case", []string{"X-Private-Object", "anything"}, false},
+		{"no marker", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i+1 < len(tt.header); i += 2 {
+					w.Header().Set(tt.header[i], tt.header[i+1])
+				}
+				_, _ = w.Write([]byte("body"))
+			}))
+			if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != http.StatusOK || w.Body.String() != "body" {
+				t.Fatalf("status = %d, body %q", w.Code, w.Body)
+			}
+			objKey, _ := entryKeys(s, "example.com", "a.txt")
+			if stored, _ := st.HasObject(context.Background(), objKey); stored != tt.wantStored {
+				t.Errorf("stored = %v, want %v", stored, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestUpstreamAge(t *testing.T) {
+	tests := []struct {
+		name    string
+		cc      string
+		age     string
+		wantTTL int
+		wantSWR int
+		wantSIE int
+	}{
+		{"age subtracted", "max-age=60", "30", 30, 0, 0},
+		{"older than max-age", "max-age=60", "90", 0, 0, 0},
+		{"no age", "max-age=60", "", 60, 0, 0},
+		{"stale windows adopted", "max-age=60, stale-while-revalidate=120, stale-if-error=600", "30", 30, 120, 600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "honor_cache_control: true\nzero_lifetime: revalidate\ndebug_headers: true\n")
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Cache-Control", tt.cc)
+				if tt.age != "" {
+					w.Header().Set("Age", tt.age)
+				}
+				_, _ = w.Write([]byte("body"))
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			_, metaKey := entryKeys(s, "example.com", "a.txt")
+			m, ok, _ := st.ReadMeta(context.Background(), metaKey)
+			if !ok {
+				t.Fatal("not stored")
+			}
+			if m.TTL != tt.wantTTL || m.StaleWhileRevalidate != tt.wantSWR || m.StaleIfError != tt.wantSIE {
+				t.Errorf("meta TTL/swr/sie = %d/%d/%d, want %d/%d/%d",
+					m.TTL, m.StaleWhileRevalidate, m.StaleIfError, tt.wantTTL, tt.wantSWR, tt.wantSIE)
+			}
+			if tt.wantTTL > 0 {
+				w := do(s, http.MethodGet, "/example.com/a.txt")
+				if left := w.Header().Get("X-Cache-TTL-Remaining"); left != strconv.Itoa(tt.wantTTL) && left != strconv.Itoa(tt.wantTTL-1) {
+					t.Errorf("X-Cache-TTL-Remaining = %q, want %d", left, tt.wantTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestAdaptiveTTL(t *testing.T) {
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	tests := []struct {
+		name    string
+		maxTTL  int
+		answers []int // upstream status for each revalidation
+		wantTTL []int // meta TTL after each
+	}{
+		{"grows on 304s", 1000, []int{304, 304, 304}, []int{200, 400, 800}},
+		{"capped", 500, []int{304, 304, 304, 304}, []int{200, 400, 500, 500}},
+		{"reset by a 200", 1000, []int{304, 304, 200, 304}, []int{200, 400, 100, 200}},
+		{"disabled", 0, []int{304, 304}, []int{100, 100}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := loadConfig(t, "ttl_default: 100\n")
+			cfg.AdaptiveTTLMax = tt.maxTTL
+			status := http.StatusOK
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Last-Modified", lastModified)
+				if status == http.StatusNotModified && r.Header.Get("If-Modified-Since") == lastModified {
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				_, _ = w.Write([]byte("body"))
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			_, metaKey := entryKeys(s, "example.com", "a.txt")
+			for i, answer := range tt.answers {
+				// Expire the entry so the next request revalidates.
+				m, _, _ := st.ReadMeta(ctx, metaKey)
+				m.CachedAt = time.Now().Add(-time.Duration(m.TTL+1) * time.Second).UTC().Format(time.RFC3339Nano)
+				_ = st.WriteMeta(ctx, metaKey, m)
+
+				status = answer
+				if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != http.StatusOK || w.Body.String() != "body" {
+					t.Fatalf("revalidation %d: %d %q", i, w.Code, w.Body)
+				}
+				m, _, _ = st.ReadMeta(ctx, metaKey)
+				wantRun := 0
+				for j := i; j >= 0 && tt.answers[j] == http.StatusNotModified; j-- {
+					wantRun++
+				}
+				if m.TTL != tt.wantTTL[i] || m.NotModifiedRun != wantRun {
+					t.Errorf("after revalidation %d (%d): TTL %d, run %d; want %d, %d", i, answer, m.TTL, m.NotModifiedRun, tt.wantTTL[i], wantRun)
+				}
+			}
+		})
+	}
+}
+
+func TestRuleRoute(t *testing.T) {
+	tests := []struct {
+		name       string
+		route      string // in the key
+		variant    string
+		requested  string // fetched.route
+		wantDomain string
+		wantRoute  string
+		wantOK     bool
+	}{
+		{"from the key", "docs/guide.html", "", "", "example.com", "docs/guide.html", true},
+		{"variant stripped", "docs/guide.html", cache.Variant("accept", "application/json"), "", "example.com", "docs/guide.html", true},
+		{"escaped route", "a b/c?d=1", "", "", "example.com", "a b/c?d=1", true},
+		{"as requested", "docs/guide.html", "", "Docs/Guide.html", "example.com", "Docs/Guide.html", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			metaKey := cache.MetaKey("", "example.com", tt.route, tt.variant)
+			domain, route, ok := ruleRoute(metaKey, fetched{route: tt.requested})
+			if domain != tt.wantDomain || route != tt.wantRoute || ok != tt.wantOK {
+				t.Errorf("ruleRoute(%q) = %q, %q, %v; want %q, %q, %v", metaKey, domain, route, ok, tt.wantDomain, tt.wantRoute, tt.wantOK)
+			}
+		})
+	}
+	if _, _, ok := ruleRoute("not a meta key", fetched{}); ok {
+		t.Error("ruleRoute accepted a malformed key")
+	}
+}
+
+func TestTTLRules(t *testing.T) {
+	const yaml = `ttl_default: 3600
+ttl_rules:
+  - match: '/releases/latest$'
+    ttl: 300
+  - match: '/releases/'
+    ttl: 86400
+  - match: '@'
+    ttl: 120
+`
+	tests := []struct {
+		path string
+		want int
+	}{
+		{"/example.com/acme/releases/latest", 300},
+		{"/example.com/acme/releases/v1/tool.tgz", 86400},
+		{"/example.com/pkg@1.0.0/index.js", 120},
+		{"/example.com/index.html", 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = w.Write([]byte("body"))
+			}))
+			do(s, http.MethodGet, tt.path)
+			domain, route, _ := strings.Cut(strings.TrimPrefix(tt.path, "/"), "/")
+			_, metaKey := entryKeys(s, domain, route)
+			m, ok, _ := st.ReadMeta(context.Background(), metaKey)
+			if !ok || m.TTL != tt.want {
+				t.Errorf("stored TTL = %d (found %v), want %d", m.TTL, ok, tt.want)
+			}
+		})
+	}
+}
+
+func TestHonorExpires(t *testing.T) {
+	future := func() string { return time.Now().Add(2 * time.Hour).UTC().Format(http.TimeFormat) }
+	past := func() string { return time.Now().Add(-2 * time.Hour).UTC().Format(http.TimeFormat) }
+	tests := []struct {
+		name       string
+		yaml       string
+		header     []string // "future"/"past" stand for Expires dates
+		wantStored bool
+		wantTTL    int // within a few seconds
+	}{
+		{"future Expires", "honor_expires: true\n", []string{"Expires", "future"}, true, 7200},
+		{"past Expires", "honor_expires: true\n", []string{"Expires", "past"}, false, 0},
+		{"max-age not honored", "honor_expires: true\n", []string{"Cache-Control", "max-age=60"}, true, 3600},
+		{"no-store not honored", "honor_expires: true\n", []string{"Cache-Control", "no-store", "Expires", "future"}, true, 7200},
+		{"clamped to the minimum", "honor_expires: true\nupstream_ttl_min: 3h\n", []string{"Expires", "future"}, true, 10800},
+		{"clamped to the maximum", "honor_expires: true\nupstream_ttl_max: 1h\n", []string{"Expires", "future"}, true, 3600},
+		{"past not raised to the minimum", "honor_expires: true\nupstream_ttl_min: 1h\n", []string{"Expires", "past"}, false, 0},
+		{"max-age clamped", "honor_cache_control: true\nupstream_ttl_max: 30\n", []string{"Cache-Control", "max-age=600"}, true, 30},
+		{"off", "", []string{"Expires", "past"}, true, 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, "ttl_default: 3600\n"+tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i+1 < len(tt.header); i += 2 {
+					v := tt.header[i+1]
+					switch v {
+					case "future":
+						v = future()
+					case "past":
+						v = past()
+					}
+					w.Header().Set(tt.header[i], v)
+				}
+				_, _ = w.Write([]byte("body"))
+			}))
+			if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != http.StatusOK || w.Body.String() != "body" {
+				t.Fatalf("status = %d, body %q", w.Code, w.Body)
+			}
+			objKey, metaKey := entryKeys(s, "example.com", "a.txt")
+			if stored, _ := st.HasObject(context.Background(), objKey); stored != tt.wantStored {
+				t.Errorf("stored = %v, want %v", stored, tt.wantStored)
+			}
+			if m, ok, _ := st.ReadMeta(context.Background(), metaKey); ok && (m.TTL > tt.wantTTL || m.TTL < tt.wantTTL-5) {
+				t.Errorf("TTL = %d, want %d", m.TTL, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestZeroLifetime(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        string
+		header      []string
+		wantStored  bool
+		wantFetches int32 // full responses over two requests
+		wantChecks  int32 // conditional requests answered 304
+	}{
+		{"skipped", "", []string{"Cache-Control", "max-age=0"}, false, 2, 0},
+		{"stored, always revalidated", "revalidate", []string{"Cache-Control", "max-age=0"}, true, 1, 1},
+		{"expired by Age", "revalidate", []string{"Cache-Control", "max-age=10", "Age", "20"}, true, 1, 1},
+		{"past Expires", "revalidate", []string{"Expires", "Thu, 01 Jan 2015 00:00:00 GMT"}, true, 1, 1},
+		{"positive lifetime", "revalidate", []string{"Cache-Control", "max-age=60"}, true, 1, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches, checks atomic.Int32
+			cfg := loadConfig(t, "honor_cache_control: true\n")
+			cfg.ZeroLifetime = tt.mode
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i+1 < len(tt.header); i += 2 {
+					w.Header().Set(tt.header[i], tt.header[i+1])
+				}
+				w.Header().Set("ETag", `"v1"`)
+				if r.Header.Get("If-None-Match") == `"v1"` {
+					checks.Add(1)
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				fetches.Add(1)
+				_, _ = w.Write([]byte("body"))
+			}))
+			for i := 0; i < 2; i++ {
+				if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != http.StatusOK || w.Body.String() != "body" {
+					t.Fatalf("request %d: status = %d, body %q", i, w.Code, w.Body)
+				}
+			}
+			objKey, metaKey := entryKeys(s, "example.com", "a.txt")
+			if stored, _ := st.HasObject(context.Background(), objKey); stored != tt.wantStored {
+				t.Errorf("stored = %v, want %v", stored, tt.wantStored)
+			}
+			if m, ok, _ := st.ReadMeta(context.Background(), metaKey); ok && m.Revalidate != (tt.wantChecks > 0) {
+				t.Errorf("meta Revalidate = %v", m.Revalidate)
+			}
+			if n := fetches.Load(); n != tt.wantFetches {
+				t.Errorf("%d full fetches, want %d", n, tt.wantFetches)
+			}
+			if n := checks.Load(); n != tt.wantChecks {
+				t.Errorf("%d revalidations, want %d", n, tt.wantChecks)
+			}
+		})
+	}
+}
+
+func TestMatchesType(t *testing.T) {
+	tests := []struct {
+		ct       string
+		patterns []string
+		want     bool
+	}{
+		{"image/png", []string{"image/*"}, true},
+		{"image/svg+xml; charset=utf-8", []string{"image/*"}, true},
+		{"IMAGE/PNG", []string{"image/*"}, true},
+		{"application/octet-stream", []string{"image/*"}, false},
+		{"text/plain; charset=utf-8", []string{"text/plain"}, true},
+		{"text/plain", []string{"Text/Plain"}, true},
+		{"application/json", []string{"application/"}, true},
+		{"text/html", []string{"*/html"}, true},
+		{"text/html", []string{""}, false},
+		{"", []string{"image/*"}, false},
+		{"image/png", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ct+" "+strings.Join(tt.patterns, ","), func(t *testing.T) {
+			if got := matchesType(strings.ToLower(tt.ct), tt.patterns); got != tt.want {
+				t.Errorf("matchesType(%q, %q) = %v, want %v", tt.ct, tt.patterns, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestContentTypeRules(t *testing.T) {
+	const yaml = `content_type_rules:
+  - match: '^api\.example\.com/v1/'
+    types: ["application/json"]
+  - match: '^cdn\.example\.com/img/'
+    types: ["image/*"]
+`
+	tests := []struct {
+		name        string
+		path        string
+		contentType string
+		status      int
+		wantStatus  int
+		wantStored  bool
+	}{
+		{"json on a json route", "api.example.com/v1/users", "application/json; charset=utf-8", http.StatusOK, http.StatusOK, true},
+		{"html on a json route", "api.example.com/v1/users", "text/html; charset=utf-8", http.StatusOK, http.StatusBadGateway, false},
+		{"missing type on a json route", "api.example.com/v1/users", "", http.StatusOK, http.StatusBadGateway, false},
+		{"domain matched case-insensitively", "API.example.com/v1/users", "text/html", http.StatusOK, http.StatusBadGateway, false},
+		{"pattern", "cdn.example.com/img/a.png", "image/png", http.StatusOK, http.StatusOK, true},
+		{"pattern mismatch", "cdn.example.com/img/a.png", "text/html", http.StatusOK, http.StatusBadGateway, false},
+		{"route without a rule", "api.example.com/v2/users", "text/html", http.StatusOK, http.StatusOK, true},
+		{"error status left alone", "api.example.com/v1/users", "text/html", http.StatusNotFound, http.StatusNotFound, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", tt.contentType)
+				w.WriteHeader(tt.status)
+				_, _ = io.WriteString(w, "<html>error</html>")
+			}))
+			w := do(s, http.MethodGet, "/"+tt.path)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			domain, route, _ := strings.Cut(tt.path, "/")
+			objKey, _ := entryKeys(s, strings.ToLower(domain), route)
+			if ok, _ := st.HasObject(context.Background(), objKey); ok != tt.wantStored {
+				t.Errorf("stored %v, want %v", ok, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestContentTypeRulesRevalidate(t *testing.T) {
+	const yaml = "content_type_rules:\n  - match: '^example\\.com/'\n    types: [\"application/json\"]\n"
+	tests := []struct {
+		name        string
+		contentType string
+		wantBody    string
+	}{
+		{"expected type replaces the copy", "application/json", `{"v":2}`},
+		{"unexpected type keeps the copy", "text/html", `{"v":1}`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var ct, body atomic.Value
+			ct.Store("application/json")
+			body.Store(`{"v":1}`)
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", ct.Load().(string))
+				_, _ = io.WriteString(w, body.Load().(string))
+			}))
+			do(s, http.MethodGet, "/example.com/a.json")
+			objKey, metaKey := entryKeys(s, "example.com", "a.json")
+			m, _, _ := st.ReadMeta(ctx, metaKey)
+			m.CachedAt = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339Nano)
+			_ = st.WriteMeta(ctx, metaKey, m)
+			ct.Store(tt.contentType)
+			body.Store(`{"v":2}`)
+			s.revalidate(ctx, "example.com", "https://example.com/a.json", objKey, metaKey, fetchOpts{timeout: 5 * time.Second})
+			st.mu.Lock()
+			got := string(st.objects[objKey].data)
+			st.mu.Unlock()
+			if got != tt.wantBody {
+				t.Errorf("stored body %q, want %q", got, tt.wantBody)
+			}
+		})
+	}
+}
+
+func TestPlaceholder(t *testing.T) {
+	dir := t.TempDir()
+	png := filepath.Join(dir, "missing.png")
+	if err := os.WriteFile(png, []byte("PNG placeholder"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	yaml := fmt.Sprintf(`placeholders:
+  - match: '^img\.example\.com/.*\.png$'
+    file: %q
+    content_type: image/png
+  - match: '^img\.example\.com/'
+    file: %q
+    status: 404
+`, png, png)
+	tests := []struct {
+		name       string
+		route      string
+		upstream   int // 0: the connection fails
+		repeat     bool
+		wantStatus int
+		wantCT     string // "" expects the usual error instead
+	}{
+		{"upstream error", "img.example.com/a.png", http.StatusInternalServerError, false, http.StatusOK, "image/png"},
+		{"upstream 404", "img.example.com/a.png", http.StatusNotFound, false, http.StatusOK, "image/png"},
+		{"negative cached 404", "img.example.com/a.png", http.StatusNotFound, true, http.StatusOK, "image/png"},
+		{"connection failed", "img.example.com/a.png", 0, false, http.StatusOK, "image/png"},
+		{"status and default type", "img.example.com/a.gif", http.StatusBadGateway, false, http.StatusNotFound, "application/octet-stream"},
+		{"no matching placeholder", "example.com/a.png", http.StatusInternalServerError, false, http.StatusInternalServerError, ""},
+		{"fetched normally", "img.example.com/a.png", http.StatusOK, false, http.StatusOK, "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.upstream == 0 {
+					panic(http.ErrAbortHandler)
+				}
+				w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+				w.WriteHeader(tt.upstream)
+				_, _ = io.WriteString(w, "origin")
+			}))
+			w := do(s, http.MethodGet, "/"+tt.route)
+			if tt.repeat {
+				w = do(s, http.MethodGet, "/"+tt.route)
+			}
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantCT == "" {
+				return
+			}
+			if ct := w.Header().Get("Content-Type"); ct != tt.wantCT {
+				t.Errorf("Content-Type = %q, want %q", ct, tt.wantCT)
+			}
+			if tt.upstream == http.StatusOK {
+				if w.Body.String() != "origin" {
+					t.Errorf("body = %q", w.Body)
+				}
+				return
+			}
+			if w.Body.String() != "PNG placeholder" || w.Header().Get("Cache-Control") != "no-store" {
+				t.Errorf("body %q, Cache-Control %q", w.Body, w.Header().Get("Cache-Control"))
+			}
+			for _, k := range st.keys("objects/") {
+				t.Errorf("placeholder stored as %s", k)
+			}
+		})
+	}
+}
+
+func TestPickContentType(t *testing.T) {
+	html := []byte("<!DOCTYPE html><html></html>")
+	tests := []struct {
+		name   string
+		values []string
+		body   []byte
+		pick   string
+		want   string
+	}{
+		{"single", []string{"application/json"}, nil, "", "application/json"},
+		{"first of duplicates", []string{"text/plain", "application/json"}, nil, "", "text/plain"},
+		{"last of duplicates", []string{"text/plain", "application/json"}, nil, DuplicateContentTypeLast, "application/json"},
+		{"malformed first skipped", []string{"text/", "application/json"}, nil, "", "application/json"},
+		{"malformed last skipped", []string{"text/plain", "json;;"}, nil, DuplicateContentTypeLast, "text/plain"},
+		{"params kept", []string{"text/html; charset=utf-8"}, nil, "", "text/html; charset=utf-8"},
+		{"all malformed, sniffed", []string{"text/", "/"}, html, "", "text/html; charset=utf-8"},
+		{"all malformed, no body", []string{"text/"}, nil, "", ""},
+		{"no header", nil, html, "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := pickContentType(tt.values, tt.body, tt.pick); got != tt.want {
+				t.Errorf("pickContentType(%q) = %q, want %q", tt.values, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDuplicateContentType(t *testing.T) {
+	tests := []struct {
+		name   string
+		yaml   string
+		values []string
+		want   string
+	}{
+		{"first", "", []string{"image/png", "text/plain"}, "image/png"},
+		{"last", "duplicate_content_type: last\n", []string{"image/png", "text/plain"}, "text/plain"},
+		{"malformed passed over", "", []string{"image/", "image/png"}, "image/png"},
+		{"sniffed", "", []string{"image/"}, "image/png"},
+		{"streamed, last", "duplicate_content_type: last\nmax_object_bytes: 8\n", []string{"image/png", "text/plain"}, "text/plain"},
+		{"streamed, none parses", "max_object_bytes: 8\n", []string{"image/"}, "application/octet-stream"},
+	}
+	png := []byte("\x89PNG\r\n\x1a\nrest of the image")
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for _, v := range tt.values {
+					w.Header().Add("Content-Type", v)
+				}
+				_, _ = w.Write(png)
+			}))
+			for i, label := range []string{"miss", "hit"} {
+				w := do(s, http.MethodGet, "/example.com/a")
+				if ct := w.Header().Get("Content-Type"); ct != tt.want {
+					t.Errorf("%s: Content-Type %q, want %q", label, ct, tt.want)
+				}
+				if n := len(w.Header().Values("Content-Type")); n != 1 {
+					t.Errorf("%s: %d Content-Type headers", label, n)
+				}
+				if i == 0 && !strings.Contains(tt.yaml, "max_object_bytes") {
+					objKey, _ := entryKeys(s, "example.com", "a")
+					st.mu.Lock()
+					stored := st.objects[objKey].contentType
+					st.mu.Unlock()
+					if stored != tt.want {
+						t.Errorf("stored Content-Type %q, want %q", stored, tt.want)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRequireExplicitFreshness(t *testing.T) {
+	tests := []struct {
+		name     string
+		strict   bool
+		header   map[string]string
+		wantKept bool
+	}{
+		{"bare, default mode", false, nil, true},
+		{"bare", true, nil, false},
+		{"no lifetime in Cache-Control", true, map[string]string{"Cache-Control": "public"}, false},
+		{"max-age", true, map[string]string{"Cache-Control": "max-age=60"}, true},
+		{"s-maxage", true, map[string]string{"Cache-Control": "s-maxage=60"}, true},
+		{"Expires", true, map[string]string{"Expires": time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)}, true},
+		{"ETag", true, map[string]string{"ETag": `"v1"`}, true},
+		{"Last-Modified", true, map[string]string{"Last-Modified": "Mon, 01 Jan 2024 00:00:00 GMT"}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "")
+			cfg.RequireExplicitFreshness = tt.strict
+			var fetches atomic.Int32
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				for k, v := range tt.header {
+					w.Header().Set(k, v)
+				}
+				_, _ = io.WriteString(w, "body")
+			}))
+			for i := 0; i < 2; i++ {
+				if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != http.StatusOK || w.Body.String() != "body" {
+					t.Fatalf("request %d: %d %q", i, w.Code, w.Body)
+				}
+			}
+			objKey, _ := entryKeys(s, "example.com", "a.txt")
+			if kept, _ := st.HasObject(context.Background(), objKey); kept != tt.wantKept {
+				t.Errorf("stored %v, want %v", kept, tt.wantKept)
+			}
+			wantFetches := int32(1)
+			if !tt.wantKept {
+				wantFetches = 2
+			}
+			if n := fetches.Load(); n != wantFetches {
+				t.Errorf("%d upstream fetches, want %d", n, wantFetches)
+			}
+		})
+	}
+}
+
+func TestUnchangedBody(t *testing.T) {
+	body := []byte("body")
+	stored := cache.Meta{Checksum: cache.Checksum(body)}
+	tests := []struct {
+		name    string
+		off     bool
+		meta    cache.Meta
+		hasMeta bool
+		fr      fetched
+		want    bool
+	}{
+		{"same body", false, stored, true, fetched{status: http.StatusOK, body: body}, true},
+		{"same body, hashed on read", false, stored, true, fetched{status: http.StatusOK, checksum: cache.Checksum(body)}, true},
+		{"changed body", false, stored, true, fetched{status: http.StatusOK, body: []byte("new body")}, false},
+		{"off", true, stored, true, fetched{status: http.StatusOK, body: body}, false},
+		{"no entry", false, cache.Meta{}, false, fetched{status: http.StatusOK, body: body}, false},
+		{"no checksum stored", false, cache.Meta{}, true, fetched{status: http.StatusOK, body: body}, false},
+		{"negative entry", false, cache.Meta{Neg: true, Checksum: stored.Checksum}, true, fetched{status: http.StatusOK, body: body}, false},
+		{"not a 200", false, stored, true, fetched{status: http.StatusPartialContent, body: body}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "")
+			cfg.SameBodyNotModified = !tt.off
+			s, _ := newTestServer(t, cfg, http.NotFoundHandler())
+			if got := s.unchangedBody(tt.meta, tt.hasMeta, tt.fr); got != tt.want {
+				t.Errorf("unchangedBody = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSameBodyNotModified(t *testing.T) {
+	const on = "same_body_not_modified: true\n"
+	tests := []struct {
+		name       string
+		yaml       string
+		background bool     // refreshed by the revalidator, not a request
+		next       string   // body of the refetch
+		header     []string // on the refetch
+		dropSum    bool     // the entry predates checksums
+		wantPuts   int
+		wantETag   string // in the meta afterwards
+		wantTTL    int
+	}{
+		{"rotated ETag, same body", on, false, "body", nil, false, 1, `"v2"`, 3600},
+		{"rotated ETag, same body, background", on, true, "body", nil, false, 1, `"v2"`, 3600},
+		{"changed body", on, false, "new body", nil, false, 2, `"v2"`, 3600},
+		{"changed body, background", on, true, "new body", nil, false, 2, `"v2"`, 3600},
+		{"off", "", false, "body", nil, false, 2, `"v2"`, 3600},
+		{"no checksum stored", on, false, "body", nil, true, 2, `"v2"`, 3600},
+		{"TTL recomputed", on + "honor_cache_control: true\n", false, "body", []string{"Cache-Control", "max-age=600"}, false, 1, `"v2"`, 600},
+		{"not storable", on + "no_cache_headers: [X-No-Cache]\n", false, "body", []string{"X-No-Cache", "1"}, false, 1, `"v1"`, 3600},
+		{"not storable, background", on + "no_cache_headers: [X-No-Cache]\n", true, "body", []string{"X-No-Cache", "1"}, false, 1, `"v1"`, 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var fetches atomic.Int32
+			s, st := newTestServer(t, loadConfig(t, "ttl_default: 3600\ndebug_headers: true\n"+tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				n := fetches.Add(1)
+				w.Header().Set("ETag", fmt.Sprintf(`"v%d"`, n))
+				if n == 1 {
+					_, _ = io.WriteString(w, "body")
+					return
+				}
+				for i := 0; i+1 < len(tt.header); i += 2 {
+					w.Header().Set(tt.header[i], tt.header[i+1])
+				}
+				_, _ = io.WriteString(w, tt.next)
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			objKey, metaKey := entryKeys(s, "example.com", "a.txt")
+			m, _, _ := st.ReadMeta(ctx, metaKey)
+			m.CachedAt = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339Nano)
+			if tt.dropSum {
+				m.Checksum = ""
+			}
+			_ = st.WriteMeta(ctx, metaKey, m)
+
+			if tt.background {
+				s.revalidate(ctx, "example.com", "https://example.com/a.txt", objKey, metaKey, fetchOpts{timeout: 5 * time.Second})
+			} else {
+				w := do(s, http.MethodGet, "/example.com/a.txt")
+				if w.Code != http.StatusOK || w.Body.String() != tt.next {
+					t.Fatalf("refetch: %d %q, want %q", w.Code, w.Body, tt.next)
+				}
+				if d := w.Header().Get("X-Cache-Decision"); tt.wantPuts == 1 && tt.wantETag == `"v2"` && d != decisionRevalidated {
+					t.Errorf("decision %q, want %q", d, decisionRevalidated)
+				}
+			}
+			if n := fetches.Load(); n != 2 {
+				t.Fatalf("%d upstream fetches, want 2", n)
+			}
+			st.mu.Lock()
+			puts, data := st.puts[objKey], string(st.objects[objKey].data)
+			st.mu.Unlock()
+			if puts != tt.wantPuts {
+				t.Errorf("object stored %d times, want %d", puts, tt.wantPuts)
+			}
+			if want := map[bool]string{true: "body", false: tt.next}[tt.wantPuts == 1]; data != want {
+				t.Errorf("stored body %q, want %q", data, want)
+			}
+			m, _, _ = st.ReadMeta(ctx, metaKey)
+			if m.ETag != tt.wantETag || m.TTL != tt.wantTTL {
+				t.Errorf("meta ETag %s, TTL %d; want %s, %d", m.ETag, m.TTL, tt.wantETag, tt.wantTTL)
+			}
+			renewed := cache.IsFresh(m, 3600)
+			if want := tt.wantETag == `"v2"`; renewed != want {
+				t.Errorf("entry fresh again %v, want %v", renewed, want)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// maxPostBody bounds request bodies read for POST caching.
+const maxPostBody = 1 << 20
+
+// BodyCanonicalizer rewrites a request body so that semantically equal
+// bodies produce identical bytes, and so identical cache keys.
+type BodyCanonicalizer func(body []byte) ([]byte, error)
+
+// canonicalizers are selectable by name in post_cache.
+var canonicalizers = map[string]BodyCanonicalizer{
+	"raw":     func(b []byte) ([]byte, error) { return b, nil },
+	"json":    canonicalJSON,
+	"graphql": canonicalGraphQL,
+}
+
+// canonicalJSON re-encodes JSON with sorted object keys and no insignificant
+// whitespace.
+func canonicalJSON(body []byte) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return nil, err
+	}
+	return json.Marshal(v)
+}
+
+// canonicalGraphQL normalizes a {"query", "variables", "operationName"}
+// request: whitespace and commas in the query outside string literals are
+// collapsed, and the whole document is canonical JSON.
+func canonicalGraphQL(body []byte) ([]byte, error) {
+	var req map[string]any
+	dec := json.NewDecoder(bytes.NewReader(body))
+	dec.UseNumber()
+	if err := dec.Decode(&req); err != nil {
+		return nil, err
+	}
+	if q, ok := req["query"].(string); ok {
+		req["query"] = normalizeGraphQL(q)
+	}
+	return json.Marshal(req)
+}
+
+func normalizeGraphQL(q string) string {
+	var b strings.Builder
+	inString, space := false, false
+	for i := 0; i < len(q); i++ {
+		ch := q[i]
+		if inString {
+			b.WriteByte(ch)
+			if ch == '\\' && i+1 < len(q) {
+				i++
+				b.WriteByte(q[i])
+			} else if ch == '"' {
+				inString = false
+			}
+			continue
+		}
+		switch ch {
+		case ' ', '\t', '\n', '\r', ',':
+			space = true
+			continue
+		case '"':
+			inString = true
+		}
+		if space && b.Len() > 0 {
+			b.WriteByte(' ')
+		}
+		space = false
+		b.WriteByte(ch)
+	}
+	return b.String()
+}
+
+var errPostNotCached = errors.New("post not cacheable")
+
+// postCacheKey reads r's body and returns it along with the key suffix
+// derived from its canonical form, when post_cache configures a
+// canonicalizer for the request's content type. The body is needed again
+// for the upstream request.
+func (s *Server) postCacheKey(r *http.Request) (body []byte, suffix string, err error) {
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	name, ok := s.conf().PostCache[mt]
+	if !ok {
+		return nil, "", errPostNotCached
+	}
+	canon, ok := canonicalizers[name]
+	if !ok {
+		return nil, "", fmt.Errorf("unknown canonicalizer %q", name)
+	}
+	body, err = io.ReadAll(io.LimitReader(r.Body, maxPostBody+1))
+	if err != nil {
+		return nil, "", err
+	}
+	if len(body) > maxPostBody {
+		return nil, "", errPostNotCached
+	}
+	c, err := canon(body)
+	if err != nil {
+		return nil, "", err
+	}
+	sum := sha256.Sum256(append([]byte(mt+"\n"), c...))
+	return body, cache.Variant("post", hex.EncodeToString(sum[:16])), nil
+}
@@ -0,0 +1,108 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestPostCacheKey(t *testing.T) {
+	const yaml = "post_cache:\n  application/json: json\n  application/graphql+json: graphql\n  text/plain: raw\n"
+	tests := []struct {
+		name        string
+		contentType string
+		a, b        string
+		wantSame    bool
+	}{
+		{"json whitespace", "application/json", `{"a": 1, "b": [1, 2]}`, "{\n  \"a\":1,\"b\":[1,2]\n}", true},
+		{"json key order", "application/json", `{"a":1,"b":{"x":1,"y":2}}`, `{"b":{"y":2,"x":1},"a":1}`, true},
+		{"json big numbers kept", "application/json", `{"n":12345678901234567890}`, `{"n":12345678901234567891}`, false},
+		{"json different values", "application/json", `{"a":1}`, `{"a":2}`, false},
+		{"graphql query whitespace", "application/graphql+json",
+			`{"query":"query Q { user(id: 1) { name, email } }","variables":{"x":1}}`,
+			`{"variables":{"x":1},"query":"query Q {\n  user(id: 1) {\n    name\n    email\n  }\n}"}`, true},
+		{"graphql string literals kept", "application/graphql+json",
+			`{"query":"{ search(q: \"a  b\") }"}`, `{"query":"{ search(q: \"a b\") }"}`, false},
+		{"graphql variables differ", "application/graphql+json",
+			`{"query":"{ u }","variables":{"x":1}}`, `{"query":"{ u }","variables":{"x":2}}`, false},
+		{"raw is byte for byte", "text/plain", "a b", "a  b", false},
+		{"content type params ignored", "application/json; charset=utf-8", `{"a":1}`, `{ "a" : 1 }`, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, yaml), http.NotFoundHandler())
+			key := func(body string) string {
+				r := httptest.NewRequest(http.MethodPost, "/example.com/graphql", strings.NewReader(body))
+				r.Header.Set("Content-Type", tt.contentType)
+				got, suffix, err := s.postCacheKey(r)
+				if err != nil {
+					t.Fatalf("postCacheKey(%q): %v", body, err)
+				}
+				if string(got) != body {
+					t.Errorf("body returned as %q, want it unchanged", got)
+				}
+				return suffix
+			}
+			if ka, kb := key(tt.a), key(tt.b); (ka == kb) != tt.wantSame {
+				t.Errorf("keys %q and %q: same = %v, want %v", ka, kb, ka == kb, tt.wantSame)
+			}
+		})
+	}
+}
+
+func TestPostCache(t *testing.T) {
+	tests := []struct {
+		name        string
+		contentType string
+		bodies      []string
+		wantStatus  int
+		wantFetches int
+	}{
+		{"equivalent bodies share an entry", "application/json", []string{`{"q": "x", "n": 1}`, `{"n":1,"q":"x"}`}, http.StatusOK, 1},
+		{"distinct bodies", "application/json", []string{`{"q":"x"}`, `{"q":"y"}`}, http.StatusOK, 2},
+		{"invalid json", "application/json", []string{`{"q":`}, http.StatusMethodNotAllowed, 0},
+		{"unconfigured content type", "application/xml", []string{`<q/>`}, http.StatusMethodNotAllowed, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var received []string
+			s, _ := newTestServer(t, loadConfig(t, "post_cache:\n  application/json: json\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				b, _ := io.ReadAll(r.Body)
+				mu.Lock()
+				received = append(received, r.Method+" "+string(b))
+				mu.Unlock()
+				_, _ = io.WriteString(w, "answer to "+string(b))
+			}))
+			var first string
+			for i, body := range tt.bodies {
+				r := httptest.NewRequest(http.MethodPost, "/example.com/api", strings.NewReader(body))
+				r.Header.Set("Content-Type", tt.contentType)
+				w := httptest.NewRecorder()
+				s.ServeHTTP(w, r)
+				if w.Code != tt.wantStatus {
+					t.Fatalf("request %d: status %d, want %d", i, w.Code, tt.wantStatus)
+				}
+				if i == 0 {
+					first = w.Body.String()
+				} else if same := w.Body.String() == first; same != (tt.wantFetches == 1) {
+					t.Errorf("request %d: body %q after %q", i, w.Body, first)
+				}
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if len(received) != tt.wantFetches {
+				t.Fatalf("upstream got %v, want %d requests", received, tt.wantFetches)
+			}
+			// The origin sees the client's body, not the canonical form.
+			for i, got := range received {
+				if want := "POST " + tt.bodies[i]; got != want {
+					t.Errorf("upstream request %d = %q, want %q", i, got, want)
+				}
+			}
+		})
+	}
+}
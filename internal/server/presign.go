@@ -0,0 +1,42 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Presigner is implemented by stores that can hand out direct download URLs.
+// Wrappers that transform bodies (dedup, compression) deliberately don't.
+type Presigner interface {
+	PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error)
+}
+
+// redirectToStorage answers a hit for an object of at least
+// presign_redirect_min_bytes with a redirect to a presigned storage URL, so
+// large bodies don't stream through the proxy. It reports whether it did.
+func (s *Server) redirectToStorage(ctx context.Context, w http.ResponseWriter, r *http.Request, key string, size int64) bool {
+	c := s.conf()
+	if c.PresignRedirectMinBytes <= 0 || size < c.PresignRedirectMinBytes {
+		return false
+	}
+	p := s.Presigner
+	if p == nil {
+		var ok bool
+		if p, ok = s.Store.(Presigner); !ok {
+			return false
+		}
+	}
+	u, err := p.PresignGet(ctx, key, seconds(c.PresignExpiry))
+	if err != nil {
+		log.Printf("presign %s: %v", key, err)
+		return false
+	}
+	status := c.PresignRedirectStatus
+	if status != http.StatusTemporaryRedirect {
+		status = http.StatusFound
+	}
+	http.Redirect(w, r, u, status)
+	return true
+}
@@ -0,0 +1,81 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+// fakePresigner signs URLs on storage.local, or fails with err.
+type fakePresigner struct {
+	err    error
+	expiry time.Duration
+}
+
+func (p *fakePresigner) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	if p.err != nil {
+		return "", p.err
+	}
+	p.expiry = expiry
+	return "https://storage.local/" + key + "?sig", nil
+}
+
+func TestPresignRedirect(t *testing.T) {
+	body := strings.Repeat("x", 100)
+	tests := []struct {
+		name       string
+		minBytes   int64
+		status     int
+		presigner  *fakePresigner
+		wantStatus int
+	}{
+		{"large hit", 50, 0, &fakePresigner{}, http.StatusFound},
+		{"large hit, 307", 50, http.StatusTemporaryRedirect, &fakePresigner{}, http.StatusTemporaryRedirect},
+		{"unsupported status", 50, http.StatusMovedPermanently, &fakePresigner{}, http.StatusFound},
+		{"exactly the threshold", 100, 0, &fakePresigner{}, http.StatusFound},
+		{"small hit", 200, 0, &fakePresigner{}, http.StatusOK},
+		{"disabled", 0, 0, &fakePresigner{}, http.StatusOK},
+		{"no presigner", 50, 0, nil, http.StatusOK},
+		{"presign fails", 50, 0, &fakePresigner{err: errors.New("no credentials")}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "")
+			cfg.PresignRedirectMinBytes = tt.minBytes
+			cfg.PresignRedirectStatus = tt.status
+			cfg.PresignExpiry = 120
+			s, _ := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, body)
+			}))
+			if tt.presigner != nil {
+				s.Presigner = tt.presigner
+			}
+
+			// The miss always streams through the proxy.
+			if w := do(s, http.MethodGet, "/example.com/big.bin"); w.Code != http.StatusOK || w.Body.String() != body {
+				t.Fatalf("miss = %d %q", w.Code, w.Body)
+			}
+			w := do(s, http.MethodGet, "/example.com/big.bin")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("hit status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if w.Body.String() != body {
+					t.Errorf("inline body = %q", w.Body)
+				}
+				return
+			}
+			objKey, _ := entryKeys(s, "example.com", "big.bin")
+			if loc := w.Header().Get("Location"); loc != "https://storage.local/"+objKey+"?sig" {
+				t.Errorf("Location = %q", loc)
+			}
+			if tt.presigner.expiry != 120*time.Second {
+				t.Errorf("expiry = %v, want 2m", tt.presigner.expiry)
+			}
+		})
+	}
+}
@@ -0,0 +1,148 @@
+package server
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// errPurgeLine rejects a purge body line that names no valid route.
+var errPurgeLine = errors.New("want <domain>/<route>")
+
+// purgeFailure is one entry a purge couldn't remove.
+type purgeFailure struct {
+	Key   string `json:"key"`
+	Error string `json:"error"`
+}
+
+// purgeSummary reports a batch purge entry by entry, so a partial failure
+// says exactly what is left behind.
+type purgeSummary struct {
+	Succeeded int            `json:"succeeded"`
+	Failed    int            `json:"failed"`
+	Skipped   int            `json:"skipped"`
+	Failures  []purgeFailure `json:"failures,omitempty"`
+	// Error reports why the purge stopped early, if it did.
+	Error string `json:"error,omitempty"`
+}
+
+func (p *purgeSummary) add(key string, removed bool, err error) {
+	switch {
+	case err != nil:
+		p.Failed++
+		p.Failures = append(p.Failures, purgeFailure{Key: key, Error: err.Error()})
+	case removed:
+		p.Succeeded++
+	default:
+		p.Skipped++
+	}
+}
+
+// purgeEntry removes the entry stored under metaKey: object, variants and
+// segments first, so a failure part way leaves meta the reconciler will
+// prune rather than an object nothing points at. Entries that don't exist,
+// or are being fetched or evicted right now, are skipped (removed false, no
+// error).
+func (s *Server) purgeEntry(ctx context.Context, metaKey string) (bool, error) {
+	objKey, ok := cache.ObjectKeyForMeta(metaKey)
+	if !ok {
+		return false, nil
+	}
+	if found, err := s.Store.HasObject(ctx, metaKey); err != nil || !found {
+		return false, err
+	}
+	if !s.activity.beginEvict(objKey) {
+		return false, nil
+	}
+	defer s.activity.endEvict(objKey)
+	if err := s.removeBody(ctx, objKey); err != nil {
+		return false, err
+	}
+	if err := s.Store.DeleteObject(ctx, metaKey); err != nil {
+		return false, err
+	}
+	s.noteRemoved(metaKey)
+	return true, nil
+}
+
+// purgeRoute removes the entry for a "<domain>/<route>" purge line and all
+// its variants (language, tenant, POST body, ...). The line is resolved the
+// way a request path is: aliases, key domains, slash_mode, trailing_slash
+// and fold_case all apply.
+func (s *Server) purgeRoute(ctx context.Context, sum *purgeSummary, line string) {
+	c := s.conf()
+	domain, route, _, err := parseAndBuildUpstream("/"+line, "", c.Aliases)
+	if err != nil || cache.ValidateRoute(domain) != nil || cache.ValidateRoute(route) != nil {
+		sum.add(line, false, errPurgeLine)
+		return
+	}
+	keyDomain := c.KeyDomain(domain)
+	metaKey := cache.MetaKey(s.cacheVersion(keyDomain), keyDomain, s.keyRouteFor(domain, route), "")
+	removed, err := s.purgeEntry(ctx, metaKey)
+	sum.add(line, removed, err)
+	prefix := strings.TrimSuffix(metaKey, ".json") + "@"
+	if err := s.Store.ListKeys(ctx, prefix, func(metaKey string) error {
+		removed, err := s.purgeEntry(ctx, metaKey)
+		sum.add(metaKey, removed, err)
+		return nil
+	}); err != nil {
+		sum.add(prefix, false, err)
+	}
+}
+
+// handlePurge serves POST /admin/purge. With ?domain= every entry of that
+// domain (under its current cache version) is removed; otherwise the body
+// lists one "<domain>/<route>" per line, each purged with its variants. The
+// response is a purgeSummary: 200 when nothing failed, 207 when some
+// entries did, 400 (with what was done so far) when the body couldn't be
+// read.
+func (s *Server) handlePurge(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	ctx := r.Context()
+	c := s.conf()
+	var sum purgeSummary
+	status := http.StatusOK
+	if domain := r.URL.Query().Get("domain"); domain != "" {
+		keyDomain := c.KeyDomain(domain)
+		prefix := strings.TrimSuffix(cache.MetaKey(s.cacheVersion(keyDomain), keyDomain, "", ""), ".json")
+		err := s.Store.ListKeys(ctx, prefix, func(metaKey string) error {
+			removed, err := s.purgeEntry(ctx, metaKey)
+			sum.add(metaKey, removed, err)
+			return nil
+		})
+		if err != nil {
+			sum.add(prefix, false, err)
+		}
+		log.Printf("admin: purged %s: %d removed, %d failed, %d skipped", domain, sum.Succeeded, sum.Failed, sum.Skipped)
+	} else {
+		sc := bufio.NewScanner(r.Body)
+		for sc.Scan() {
+			line := strings.TrimPrefix(strings.TrimSpace(sc.Text()), "/")
+			if line == "" {
+				continue
+			}
+			s.purgeRoute(ctx, &sum, line)
+		}
+		if err := sc.Err(); err != nil {
+			sum.Error = "reading body: " + err.Error()
+			status = http.StatusBadRequest
+		}
+		log.Printf("admin: purged %d entries, %d failed, %d skipped", sum.Succeeded, sum.Failed, sum.Skipped)
+	}
+	if status == http.StatusOK && sum.Failed > 0 {
+		status = http.StatusMultiStatus
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(sum)
+}
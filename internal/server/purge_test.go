@@ -0,0 +1,189 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// failDeleteStore fails deletes of keys containing any of failing, and
+// listings when failList is set.
+type failDeleteStore struct {
+	*memStore
+	failing  []string
+	failList bool
+}
+
+func (f failDeleteStore) DeleteObject(ctx context.Context, key string) error {
+	for _, s := range f.failing {
+		if strings.Contains(key, s) {
+			return errors.New("storage unavailable")
+		}
+	}
+	return f.memStore.DeleteObject(ctx, key)
+}
+
+func (f failDeleteStore) ListKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	if f.failList {
+		return errors.New("listing failed")
+	}
+	return f.memStore.ListKeys(ctx, prefix, fn)
+}
+
+func TestPurgeSummary(t *testing.T) {
+	type result struct {
+		removed bool
+		err     error
+	}
+	tests := []struct {
+		name    string
+		results []result
+		want    purgeSummary
+	}{
+		{"empty", nil, purgeSummary{}},
+		{"removed", []result{{true, nil}, {true, nil}}, purgeSummary{Succeeded: 2}},
+		{"skipped", []result{{false, nil}}, purgeSummary{Skipped: 1}},
+		{"mixed", []result{{true, nil}, {false, errors.New("boom")}, {false, nil}}, purgeSummary{
+			Succeeded: 1, Failed: 1, Skipped: 1,
+			Failures: []purgeFailure{{Key: "key1", Error: "boom"}},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var sum purgeSummary
+			for i, r := range tt.results {
+				sum.add(fmt.Sprint("key", i), r.removed, r.err)
+			}
+			if fmt.Sprint(sum) != fmt.Sprint(tt.want) {
+				t.Errorf("summary %+v, want %+v", sum, tt.want)
+			}
+		})
+	}
+}
+
+func TestPurge(t *testing.T) {
+	const yaml = `admin_token: secret
+vary_language: true
+domains:
+  ci.example.com:
+    fold_case: true
+`
+	tests := []struct {
+		name         string
+		query        string
+		body         string
+		failing      []string // deletes of keys containing these fail
+		failList     bool
+		wantStatus   int
+		wantSum      purgeSummary // Failures compared by key only
+		wantFailures []string
+		wantLeft     []string // "<domain>/<route>" still cached afterwards
+	}{
+		{"routes", "", "example.com/a.txt\n/example.com/b.txt\n", nil, false,
+			http.StatusOK, purgeSummary{Succeeded: 2}, nil, []string{"example.com/c.txt", "example.com/de.txt", "other.example.com/a.txt"}},
+		// Only the language variants of de.txt are stored, not the plain
+		// entry.
+		{"with variants", "", "example.com/de.txt\n", nil, false,
+			http.StatusOK, purgeSummary{Succeeded: 2, Skipped: 1}, nil, []string{"example.com/a.txt", "example.com/b.txt", "example.com/c.txt", "other.example.com/a.txt"}},
+		{"absent entry skipped", "", "example.com/a.txt\nexample.com/missing.txt\n\n", nil, false,
+			http.StatusOK, purgeSummary{Succeeded: 1, Skipped: 1}, nil, []string{"example.com/b.txt", "example.com/c.txt", "example.com/de.txt", "other.example.com/a.txt"}},
+		{"resolved like a request", "", "ci.example.com/Docs/A.TXT\n", nil, false,
+			http.StatusOK, purgeSummary{Succeeded: 1}, nil, []string{"example.com/a.txt", "example.com/b.txt", "example.com/c.txt", "example.com/de.txt", "other.example.com/a.txt"}},
+		{"bad line", "", "example.com\nexample.com/a.txt\n", nil, false,
+			http.StatusMultiStatus, purgeSummary{Succeeded: 1, Failed: 1}, []string{"example.com"}, []string{"example.com/b.txt", "example.com/c.txt", "example.com/de.txt", "other.example.com/a.txt"}},
+		{"some deletes fail", "", "example.com/a.txt\nexample.com/b.txt\nexample.com/c.txt\n", []string{"b.txt"}, false,
+			http.StatusMultiStatus, purgeSummary{Succeeded: 2, Failed: 1}, []string{"example.com/b.txt"}, []string{"example.com/b.txt", "example.com/de.txt", "other.example.com/a.txt"}},
+		{"variant delete fails", "", "example.com/de.txt\n", []string{"@"}, false,
+			http.StatusMultiStatus, purgeSummary{Failed: 2, Skipped: 1}, []string{"@lang/de", "@lang/fr"}, []string{"example.com/a.txt", "example.com/b.txt", "example.com/c.txt", "example.com/de.txt", "other.example.com/a.txt"}},
+		{"domain", "?domain=example.com", "", nil, false,
+			http.StatusOK, purgeSummary{Succeeded: 5}, nil, []string{"other.example.com/a.txt"}},
+		{"domain, some deletes fail", "?domain=example.com", "", []string{"a.txt", "c.txt"}, false,
+			http.StatusMultiStatus, purgeSummary{Succeeded: 3, Failed: 2}, []string{"a.txt", "c.txt"}, []string{"example.com/a.txt", "example.com/c.txt", "other.example.com/a.txt"}},
+		{"domain, listing fails", "?domain=example.com", "", nil, true,
+			http.StatusMultiStatus, purgeSummary{Failed: 1}, []string{"meta/"}, []string{"example.com/a.txt", "example.com/b.txt", "example.com/c.txt", "example.com/de.txt", "other.example.com/a.txt"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "body")
+			}))
+			for _, p := range []string{"example.com/a.txt", "example.com/b.txt", "example.com/c.txt", "other.example.com/a.txt"} {
+				do(s, http.MethodGet, "/"+p)
+			}
+			// Two language variants of one route.
+			do(s, http.MethodGet, "/example.com/de.txt", "Accept-Language", "de")
+			do(s, http.MethodGet, "/example.com/de.txt", "Accept-Language", "fr")
+			do(s, http.MethodGet, "/ci.example.com/docs/a.txt")
+			s.Store = failDeleteStore{st, tt.failing, tt.failList}
+
+			r := httptest.NewRequest(http.MethodPost, "/admin/purge"+tt.query, strings.NewReader(tt.body))
+			r.Header.Set("Authorization", "Bearer secret")
+			w := httptest.NewRecorder()
+			s.AdminHandler().ServeHTTP(w, r)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			var got purgeSummary
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatalf("body %s: %v", w.Body, err)
+			}
+			if got.Succeeded != tt.wantSum.Succeeded || got.Failed != tt.wantSum.Failed || got.Skipped != tt.wantSum.Skipped {
+				t.Errorf("summary %+v, want %+v", got, tt.wantSum)
+			}
+			if len(got.Failures) != len(tt.wantFailures) {
+				t.Fatalf("failures %+v, want %v", got.Failures, tt.wantFailures)
+			}
+			sort.Slice(got.Failures, func(i, j int) bool { return got.Failures[i].Key < got.Failures[j].Key })
+			for i, f := range got.Failures {
+				if !strings.Contains(f.Key, tt.wantFailures[i]) || f.Error == "" {
+					t.Errorf("failure %d = %+v, want one for %s with its error", i, f, tt.wantFailures[i])
+				}
+			}
+
+			var left []string
+			for _, d := range []string{"example.com", "other.example.com"} {
+				seen := map[string]bool{}
+				for _, route := range domainObjects(st, d) {
+					route, _, _ = strings.Cut(route, "@")
+					if !seen[route] {
+						seen[route] = true
+						left = append(left, d+"/"+route)
+					}
+				}
+			}
+			if want := tt.wantLeft; fmt.Sprint(left) != fmt.Sprint(want) {
+				t.Errorf("left %v, want %v", left, want)
+			}
+		})
+	}
+}
+
+func TestPurgeMethod(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		token      string
+		wantStatus int
+	}{
+		{"post", http.MethodPost, "secret", http.StatusOK},
+		{"get", http.MethodGet, "secret", http.StatusMethodNotAllowed},
+		{"delete", http.MethodDelete, "secret", http.StatusMethodNotAllowed},
+		{"wrong token", http.MethodPost, "guess", http.StatusForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, "admin_token: secret\n"), http.NotFoundHandler())
+			w := do(s.AdminHandler(), tt.method, "/admin/purge", "Authorization", "Bearer "+tt.token)
+			if w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
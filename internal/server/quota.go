@@ -0,0 +1,215 @@
+package server
+
+import (
+	"container/list"
+	"context"
+	"log"
+	"sort"
+	"sync"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// domainQuota orders each domain's cached entries by recency, so
+// max_objects_per_domain can evict the least recently used by count. Entries
+// are tracked by meta key.
+type domainQuota struct {
+	mu      sync.Mutex
+	domains map[string]*list.List // of *quotaEntry, front is most recent
+	entries map[string]*list.Element
+	// seq numbers entries as they are added; pass numbers storage walks
+	// (see walkStart and prune).
+	seq  uint64
+	pass uint64
+}
+
+type quotaEntry struct {
+	metaKey string
+	domain  string
+	added   uint64
+	seen    uint64
+}
+
+// touch marks metaKey as just used. Unknown keys are added only if add is
+// set, so hits on entries outside the index don't grow it.
+func (q *domainQuota) touch(domain, metaKey string, add bool) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e, ok := q.entries[metaKey]; ok {
+		q.domains[domain].MoveToFront(e)
+		return
+	}
+	if add {
+		q.entries[metaKey] = q.list(domain).PushFront(q.newEntry(domain, metaKey))
+	}
+}
+
+// seed adds metaKey, found in storage, as the domain's least recently used
+// entry. Keys already indexed keep their place: they were used since.
+func (q *domainQuota) seed(domain, metaKey string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.entries[metaKey]; !ok {
+		q.entries[metaKey] = q.list(domain).PushBack(q.newEntry(domain, metaKey))
+	}
+}
+
+// list returns domain's recency list, creating it; q.mu must be held.
+func (q *domainQuota) list(domain string) *list.List {
+	if q.domains == nil {
+		q.domains = make(map[string]*list.List)
+		q.entries = make(map[string]*list.Element)
+	}
+	l := q.domains[domain]
+	if l == nil {
+		l = list.New()
+		q.domains[domain] = l
+	}
+	return l
+}
+
+// newEntry numbers a new entry; q.mu must be held.
+func (q *domainQuota) newEntry(domain, metaKey string) *quotaEntry {
+	q.seq++
+	return &quotaEntry{metaKey: metaKey, domain: domain, added: q.seq}
+}
+
+// walkStart begins a walk over storage for see and prune, returning its
+// pass number and the current sequence.
+func (q *domainQuota) walkStart() (pass, since uint64) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	q.pass++
+	return q.pass, q.seq
+}
+
+// see records that pass found metaKey in storage.
+func (q *domainQuota) see(pass uint64, metaKey string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e, ok := q.entries[metaKey]; ok {
+		e.Value.(*quotaEntry).seen = pass
+	}
+}
+
+// prune drops entries a complete walk (pass, begun when the sequence was at
+// since) didn't find, such as ones a bucket lifecycle rule deleted, so they
+// stop counting against the cap. Entries added during the walk are kept. It
+// returns how many were dropped.
+func (q *domainQuota) prune(pass, since uint64) int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	n := 0
+	for metaKey, e := range q.entries {
+		if qe := e.Value.(*quotaEntry); qe.seen != pass && qe.added <= since {
+			q.domains[qe.domain].Remove(e)
+			delete(q.entries, metaKey)
+			n++
+		}
+	}
+	return n
+}
+
+func (q *domainQuota) remove(domain, metaKey string) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if e, ok := q.entries[metaKey]; ok {
+		q.domains[domain].Remove(e)
+		delete(q.entries, metaKey)
+	}
+}
+
+// overflow removes and returns domain's least recently used entries beyond
+// limit.
+func (q *domainQuota) overflow(domain string, limit int) []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	l := q.domains[domain]
+	var out []string
+	for l != nil && l.Len() > limit {
+		e := l.Back()
+		metaKey := l.Remove(e).(*quotaEntry).metaKey
+		delete(q.entries, metaKey)
+		out = append(out, metaKey)
+	}
+	return out
+}
+
+// BuildQuotaIndex seeds the max_objects_per_domain index from storage,
+// ordering existing entries by when they were cached behind any used since
+// startup, and evicts any domain already over its cap.
+func (s *Server) BuildQuotaIndex(ctx context.Context) (int, error) {
+	type entry struct{ metaKey, domain, cachedAt string }
+	var entries []entry
+	err := s.Store.ListKeys(ctx, "meta/", func(metaKey string) error {
+		_, domain, _, ok := cache.ParseMetaKey(metaKey)
+		if !ok {
+			return nil
+		}
+		m, found, err := s.readMetaBulk(ctx, metaKey)
+		if err != nil || !found || m.Neg || !m.HasBody() {
+			return nil
+		}
+		entries = append(entries, entry{metaKey, domain, m.CachedAt})
+		return nil
+	})
+	// Newest first, each pushed behind the last.
+	sort.Slice(entries, func(i, j int) bool { return entries[i].cachedAt > entries[j].cachedAt })
+	domains := make(map[string]bool)
+	for _, e := range entries {
+		s.quota.seed(e.domain, e.metaKey)
+		domains[e.domain] = true
+	}
+	for domain := range domains {
+		s.enforceQuota(ctx, domain)
+	}
+	return len(entries), err
+}
+
+// noteStored adds a just-written entry to the quota index, evicting the
+// domain's least recently used entries if it is now over the cap.
+func (s *Server) noteStored(ctx context.Context, metaKey string) {
+	if s.conf().MaxObjectsPerDomain <= 0 {
+		return
+	}
+	if _, domain, _, ok := cache.ParseMetaKey(metaKey); ok {
+		s.quota.touch(domain, metaKey, true)
+		s.enforceQuota(ctx, domain)
+	}
+}
+
+// noteUsed refreshes the recency of the entry for objKey after a hit.
+func (s *Server) noteUsed(objKey string) {
+	if s.conf().MaxObjectsPerDomain <= 0 {
+		return
+	}
+	metaKey := cache.MetaKeyForObject(objKey)
+	if _, domain, _, ok := cache.ParseMetaKey(metaKey); ok {
+		s.quota.touch(domain, metaKey, false)
+	}
+}
+
+// noteRemoved drops a deleted entry from the quota index.
+func (s *Server) noteRemoved(metaKey string) {
+	if _, domain, _, ok := cache.ParseMetaKey(metaKey); ok {
+		s.quota.remove(domain, metaKey)
+	}
+}
+
+func (s *Server) enforceQuota(ctx context.Context, domain string) {
+	limit := s.conf().MaxObjectsPerDomain
+	if limit <= 0 {
+		return
+	}
+	for _, metaKey := range s.quota.overflow(domain, limit) {
+		objKey, ok := cache.ObjectKeyForMeta(metaKey)
+		if !ok || !s.activity.beginEvict(objKey) {
+			// Being fetched; it will be re-added when written.
+			continue
+		}
+		_ = s.Store.DeleteObject(ctx, metaKey)
+		_ = s.removeBody(ctx, objKey)
+		s.activity.endEvict(objKey)
+		log.Printf("quota: %s over max_objects_per_domain, evicted %s", domain, objKey)
+	}
+}
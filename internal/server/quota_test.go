@@ -0,0 +1,195 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+func TestDomainQuota(t *testing.T) {
+	tests := []struct {
+		name  string
+		ops   []string // "+k" touch and add, "~k" touch only, "s:k" seed, "-k" remove
+		limit int
+		want  []string // evicted, least recent first
+	}{
+		{"oldest evicted", []string{"+a", "+b", "+c"}, 2, []string{"a"}},
+		{"touch refreshes", []string{"+a", "+b", "+c", "~a"}, 2, []string{"b"}},
+		{"touch doesn't add", []string{"+a", "~b", "+c"}, 2, nil},
+		{"seeded behind used", []string{"+a", "s:b", "s:c"}, 1, []string{"c", "b"}},
+		{"seed keeps a used key's place", []string{"+a", "+b", "s:a"}, 1, []string{"a"}},
+		{"removed not counted", []string{"+a", "+b", "+c", "-b"}, 2, nil},
+		{"under the cap", []string{"+a", "+b"}, 5, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var q domainQuota
+			key := func(k string) string { return "meta/example.com/" + k + ".json" }
+			for _, op := range tt.ops {
+				switch {
+				case strings.HasPrefix(op, "s:"):
+					q.seed("example.com", key(op[2:]))
+				case op[0] == '+':
+					q.touch("example.com", key(op[1:]), true)
+				case op[0] == '~':
+					q.touch("example.com", key(op[1:]), false)
+				case op[0] == '-':
+					q.remove("example.com", key(op[1:]))
+				}
+			}
+			var want []string
+			for _, k := range tt.want {
+				want = append(want, key(k))
+			}
+			if got := q.overflow("example.com", tt.limit); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("overflow = %v, want %v", got, want)
+			}
+			if got := q.overflow("other.example.com", 0); len(got) != 0 {
+				t.Errorf("other domain overflowed: %v", got)
+			}
+		})
+	}
+}
+
+// domainObjects lists the routes of domain's cached objects, sorted.
+func domainObjects(st *memStore, domain string) []string {
+	var out []string
+	for _, k := range st.keys("meta/") {
+		if _, d, route, ok := cache.ParseMetaKey(k); ok && d == domain {
+			out = append(out, cache.UnescapeRoute(route))
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+func TestMaxObjectsPerDomain(t *testing.T) {
+	tests := []struct {
+		name     string
+		limit    int
+		requests []string // in order; repeats are hits
+		want     []string // a.example.com routes left
+	}{
+		{"within the cap", 3, []string{"1", "2", "3"}, []string{"1", "2", "3"}},
+		{"least recent evicted", 3, []string{"1", "2", "3", "4", "5"}, []string{"3", "4", "5"}},
+		{"hit keeps an entry", 3, []string{"1", "2", "3", "1", "4", "5"}, []string{"1", "4", "5"}},
+		{"cap of one", 1, []string{"1", "2", "3"}, []string{"3"}},
+		{"unlimited", 0, []string{"1", "2", "3", "4", "5"}, []string{"1", "2", "3", "4", "5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, fmt.Sprintf("max_objects_per_domain: %d\n", tt.limit))
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "body")
+			}))
+			for _, p := range tt.requests {
+				do(s, http.MethodGet, "/a.example.com/"+p)
+				// Another domain's entries count against its own cap only.
+				do(s, http.MethodGet, "/b.example.com/"+p)
+				if n := len(domainObjects(st, "a.example.com")); tt.limit > 0 && n > tt.limit {
+					t.Fatalf("after %s: %d entries over the cap of %d", p, n, tt.limit)
+				}
+			}
+			if got := domainObjects(st, "a.example.com"); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("entries %v, want %v", got, tt.want)
+			}
+			if got := domainObjects(st, "b.example.com"); tt.limit > 0 && len(got) != min(tt.limit, len(tt.want)) {
+				t.Errorf("other domain entries %v", got)
+			}
+			for _, k := range st.keys("objects/") {
+				if _, ok, _ := st.ReadMeta(context.Background(), cache.MetaKeyForObject(k)); !ok {
+					t.Errorf("object %s left without meta", k)
+				}
+			}
+		})
+	}
+}
+
+func TestBuildQuotaIndex(t *testing.T) {
+	tests := []struct {
+		name   string
+		limit  int
+		stored int      // entries cached before the index, oldest first
+		used   []string // stored again before the index is built
+		want   []string
+	}{
+		{"oldest evicted", 2, 4, nil, []string{"2", "3"}},
+		{"used since startup kept", 2, 4, []string{"0"}, []string{"0", "3"}},
+		{"under the cap", 5, 4, nil, []string{"0", "1", "2", "3"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := loadConfig(t, "")
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "body")
+			}))
+			for i := 0; i < tt.stored; i++ {
+				route := fmt.Sprint(i)
+				do(s, http.MethodGet, "/example.com/"+route)
+				_, metaKey := entryKeys(s, "example.com", route)
+				m, _, _ := st.ReadMeta(ctx, metaKey)
+				m.CachedAt = time.Now().Add(time.Duration(i-tt.stored) * time.Minute).UTC().Format(time.RFC3339Nano)
+				_ = st.WriteMeta(ctx, metaKey, m)
+			}
+			cfg.MaxObjectsPerDomain = tt.limit
+			s.SetConfig(cfg)
+			for _, p := range tt.used {
+				_, metaKey := entryKeys(s, "example.com", p)
+				s.noteStored(ctx, metaKey)
+			}
+			n, err := s.BuildQuotaIndex(ctx)
+			if err != nil || n != tt.stored {
+				t.Fatalf("BuildQuotaIndex = %d, %v", n, err)
+			}
+			if got := domainObjects(st, "example.com"); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("entries %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestQuotaPrune(t *testing.T) {
+	tests := []struct {
+		name    string
+		deleted []string // meta removed behind the cache's back
+		want    []string // left after two more entries arrive, cap 3
+	}{
+		{"nothing deleted", nil, []string{"3", "4", "5"}},
+		{"deleted entry stops counting", []string{"3"}, []string{"2", "4", "5"}},
+		{"deleted entries stop counting", []string{"2", "3"}, []string{"1", "4", "5"}},
+		{"all deleted", []string{"1", "2", "3"}, []string{"4", "5"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, st := newTestServer(t, loadConfig(t, "max_objects_per_domain: 3\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "body")
+			}))
+			for _, p := range []string{"1", "2", "3"} {
+				do(s, http.MethodGet, "/example.com/"+p)
+			}
+			for _, p := range tt.deleted {
+				objKey, metaKey := entryKeys(s, "example.com", p)
+				_ = st.DeleteObject(ctx, metaKey)
+				_ = st.DeleteObject(ctx, objKey)
+			}
+			if _, _, err := s.ReconcileOnce(ctx); err != nil {
+				t.Fatal(err)
+			}
+			for _, p := range []string{"4", "5"} {
+				do(s, http.MethodGet, "/example.com/"+p)
+			}
+			if got := domainObjects(st, "example.com"); fmt.Sprint(got) != fmt.Sprint(tt.want) {
+				t.Errorf("entries %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,349 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// parseSingleRange parses "bytes=start-end" with both bounds given. Other
+// forms (suffix, open-ended, multiple ranges) are left to the full path.
+func parseSingleRange(h string) (start, end int64, ok bool) {
+	spec, found := strings.CutPrefix(h, "bytes=")
+	if !found || strings.Contains(spec, ",") {
+		return 0, 0, false
+	}
+	a, b, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+	start, err1 := strconv.ParseInt(a, 10, 64)
+	end, err2 := strconv.ParseInt(b, 10, 64)
+	if err1 != nil || err2 != nil || start < 0 || end < start {
+		return 0, 0, false
+	}
+	return start, end, true
+}
+
+// parseContentRange parses "bytes start-end/total"; total is -1 if unknown.
+func parseContentRange(h string) (start, end, total int64, ok bool) {
+	spec, found := strings.CutPrefix(h, "bytes ")
+	if !found {
+		return 0, 0, 0, false
+	}
+	rng, tot, found := strings.Cut(spec, "/")
+	if !found {
+		return 0, 0, 0, false
+	}
+	a, b, found := strings.Cut(rng, "-")
+	if !found {
+		return 0, 0, 0, false
+	}
+	var err error
+	if start, err = strconv.ParseInt(a, 10, 64); err != nil {
+		return 0, 0, 0, false
+	}
+	if end, err = strconv.ParseInt(b, 10, 64); err != nil || end < start {
+		return 0, 0, 0, false
+	}
+	total = -1
+	if tot != "*" {
+		if total, err = strconv.ParseInt(tot, 10, 64); err != nil {
+			return 0, 0, 0, false
+		}
+	}
+	return start, end, total, true
+}
+
+// covers reports whether segs together cover [start, end].
+func covers(segs []cache.Segment, start, end int64) bool {
+	sorted := append([]cache.Segment(nil), segs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	pos := start
+	for _, sg := range sorted {
+		if sg.Start > pos {
+			break
+		}
+		if sg.End >= pos {
+			pos = sg.End + 1
+		}
+		if pos > end {
+			return true
+		}
+	}
+	return false
+}
+
+// copySegments writes bytes [start, end] to dst from the stored segments,
+// which must cover the range.
+func (s *Server) copySegments(ctx context.Context, dst io.Writer, objKey string, segs []cache.Segment, start, end int64) error {
+	sorted := append([]cache.Segment(nil), segs...)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Start < sorted[j].Start })
+	pos := start
+	for _, sg := range sorted {
+		if pos > end {
+			break
+		}
+		if sg.End < pos || sg.Start > pos {
+			continue
+		}
+		rc, _, _, err := s.Store.GetObject(ctx, cache.SegmentKey(objKey, sg.Start, sg.End))
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(io.Discard, rc, pos-sg.Start); err != nil {
+			rc.Close()
+			return err
+		}
+		n := min(sg.End, end) - pos + 1
+		_, err = io.CopyN(dst, rc, n)
+		rc.Close()
+		if err != nil {
+			return err
+		}
+		pos += n
+	}
+	if pos <= end {
+		return fmt.Errorf("segments of %s don't cover %d-%d", objKey, start, end)
+	}
+	return nil
+}
+
+// serveRange answers a single explicit byte range under range_caching while
+// no full body is cached: from stored segments when they cover it, else by
+// fetching just that range upstream and storing it as a new segment. Once
+// the segments cover the whole object it is stitched together and stored as
+// a regular entry. o carries the request's upstream headers. It returns
+// false to leave the request to the full path.
+func (s *Server) serveRange(ctx context.Context, w http.ResponseWriter, domain, upstreamURL, objKey, metaKey string, start, end int64, o fetchOpts) bool {
+	c := s.conf()
+	meta, ok, _ := s.Store.ReadMeta(ctx, metaKey)
+	if ok && (meta.Neg || meta.HasBody()) {
+		return false
+	}
+	if ok && !cache.IsFresh(meta, int(c.TTLDefault)) {
+		meta, ok = cache.Meta{}, false
+	}
+	if ok && meta.Size > 0 {
+		if start >= meta.Size {
+			return false
+		}
+		end = min(end, meta.Size-1)
+	}
+	if ok && covers(meta.Segments, start, end) {
+		var buf bytes.Buffer
+		if err := s.copySegments(ctx, &buf, objKey, meta.Segments, start, end); err == nil {
+			s.setDecision(w, decisionFreshHit)
+			writePartial(w, meta.ContentType, meta.ETag, meta.LastModified, start, end, meta.Size, buf.Bytes())
+			return true
+		}
+	}
+
+	if s.breakerOpen(domain) > 0 {
+		return false
+	}
+	o.headers = withHeader(o.headers, "Range", fmt.Sprintf("bytes=%d-%d", start, end))
+	fr, err := download(ctx, s.clientFor(domain), upstreamURL, cache.Meta{}, o)
+	s.recordFetch(ctx, domain, fr, err)
+	if err != nil || fr.tooLarge {
+		return false
+	}
+
+	wctx, cancel := s.writeContext(ctx)
+	defer cancel()
+	switch fr.status {
+	case http.StatusOK:
+		// The origin ignored Range; cache the whole thing and slice it.
+		decision := decisionPassThrough
+		if s.storable(fr) {
+			if err := s.persist(wctx, objKey, metaKey, fr); err != nil {
+				log.Printf("cache write failed for %s: %v", objKey, err)
+			} else {
+				decision = decisionMissFetched
+			}
+		}
+		total := int64(len(fr.body))
+		if start >= total {
+			return false
+		}
+		end = min(end, total-1)
+		s.setDecision(w, decision)
+		writePartial(w, fr.contentType, fr.etag, fr.lastModified, start, end, total, fr.body[start:end+1])
+		return true
+	case http.StatusPartialContent:
+	default:
+		return false
+	}
+
+	gs, ge, total, ok := parseContentRange(fr.header.Get("Content-Range"))
+	if !ok || int64(len(fr.body)) != ge-gs+1 {
+		return false
+	}
+	if total < 0 || !s.storable(fr) || s.overSizeLimit(domain, total) {
+		s.setDecision(w, decisionPassThrough)
+		writePartial(w, fr.contentType, fr.etag, fr.lastModified, gs, ge, total, fr.body)
+		return true
+	}
+	if s.storeSegment(wctx, objKey, metaKey, fr, gs, ge, total) {
+		s.setDecision(w, decisionMissFetched)
+	} else {
+		s.setDecision(w, decisionPassThrough)
+	}
+	writePartial(w, fr.contentType, fr.etag, fr.lastModified, gs, ge, total, fr.body)
+	return true
+}
+
+// maxSegments caps the segments kept per object; ranges beyond it are
+// served without being stored.
+const maxSegments = 64
+
+// storeSegment adds bytes [gs, ge] of a total-byte object, fetched in fr, to
+// the entry's segments, merging it with any it overlaps or adjoins. Updates
+// of one key are serialized with each other and with persist, so concurrent
+// ranges can't drop each other's segments. It reports whether the segment
+// was stored.
+func (s *Server) storeSegment(ctx context.Context, objKey, metaKey string, fr fetched, gs, ge, total int64) bool {
+	unlock := s.writeLocks.Lock(objKey)
+	locked := true
+	defer func() {
+		if locked {
+			unlock()
+		}
+	}()
+	meta, ok, _ := s.Store.ReadMeta(ctx, metaKey)
+	if ok && (meta.Neg || meta.HasBody()) {
+		return false
+	}
+	if ok && (meta.ETag != fr.etag || meta.Size != total || !cache.IsFresh(meta, int(s.conf().TTLDefault))) {
+		// A different or expired representation; its segments no longer apply.
+		_ = s.deleteSegments(ctx, objKey)
+		meta.Segments = nil
+	}
+	segs, merged := []cache.Segment{{Start: gs, End: ge}}, []cache.Segment{{Start: gs, End: ge}}
+	lo, hi := gs, ge
+	for _, sg := range meta.Segments {
+		if sg.Start > ge+1 || sg.End < gs-1 {
+			segs = append(segs, sg)
+			continue
+		}
+		merged = append(merged, sg)
+		lo, hi = min(lo, sg.Start), max(hi, sg.End)
+	}
+	if len(segs) > maxSegments {
+		return false
+	}
+	if err := s.Store.PutObject(ctx, cache.SegmentKey(objKey, gs, ge), fr.body, fr.contentType); err != nil {
+		return false
+	}
+	if len(merged) > 1 {
+		var buf bytes.Buffer
+		if err := s.copySegments(ctx, &buf, objKey, merged, lo, hi); err != nil {
+			log.Printf("merge segments of %s: %v", objKey, err)
+			return false
+		}
+		if err := s.Store.PutObject(ctx, cache.SegmentKey(objKey, lo, hi), buf.Bytes(), fr.contentType); err != nil {
+			return false
+		}
+		for _, sg := range merged {
+			if sg.Start != lo || sg.End != hi {
+				_ = s.Store.DeleteObject(ctx, cache.SegmentKey(objKey, sg.Start, sg.End))
+			}
+		}
+		segs[0] = cache.Segment{Start: lo, End: hi}
+	}
+	bodyCached := false
+	meta = cache.Meta{
+		ETag:         fr.etag,
+		LastModified: fr.lastModified,
+		CachedAt:     cache.NowISO(),
+		TTL:          int(s.conf().TTLDefault),
+		Size:         total,
+		ContentType:  fr.contentType,
+		BodyCached:   &bodyCached,
+		Segments:     segs,
+	}
+	if err := s.Store.WriteMeta(ctx, metaKey, meta); err != nil {
+		return false
+	}
+	if covers(meta.Segments, 0, total-1) {
+		// persist takes the write lock itself.
+		locked = false
+		unlock()
+		s.stitch(ctx, objKey, metaKey, meta, fr)
+	}
+	return true
+}
+
+// stitch assembles a fully covered object from its segments and stores it
+// as a regular entry, then drops the segments. On failure the segment entry
+// is left as it is.
+func (s *Server) stitch(ctx context.Context, objKey, metaKey string, meta cache.Meta, last fetched) {
+	var buf bytes.Buffer
+	if err := s.copySegments(ctx, &buf, objKey, meta.Segments, 0, meta.Size-1); err != nil {
+		log.Printf("stitch %s: %v", objKey, err)
+		return
+	}
+	full := last
+	full.status = http.StatusOK
+	full.body = buf.Bytes()
+	full.checksum = ""
+	full.header = last.header.Clone()
+	full.header.Del("Content-Range")
+	full.header.Del("Content-Length")
+	if err := s.persist(ctx, objKey, metaKey, full); err != nil {
+		log.Printf("stitch %s: %v", objKey, err)
+		return
+	}
+	_ = s.deleteSegments(ctx, objKey)
+}
+
+// deleteSegments removes every stored segment of the object at objKey,
+// whether or not its meta still lists them.
+func (s *Server) deleteSegments(ctx context.Context, objKey string) error {
+	prefix := cache.SegmentPrefix(objKey)
+	var keys []string
+	err := s.Store.ListKeys(ctx, prefix, func(key string) error {
+		if _, ok := cache.ParseSegmentKey(prefix, key); ok {
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	for _, key := range keys {
+		if derr := s.Store.DeleteObject(ctx, key); err == nil {
+			err = derr
+		}
+	}
+	return err
+}
+
+// writePartial sends a 206 for bytes [start, end] of a total-byte object
+// (total < 0 if unknown).
+func writePartial(w http.ResponseWriter, contentType, etag, lastModified string, start, end, total int64, body []byte) {
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	size := "*"
+	if total >= 0 {
+		size = strconv.FormatInt(total, 10)
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Accept-Ranges", "bytes")
+	w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%s", start, end, size))
+	if etag != "" {
+		w.Header().Set("ETag", etag)
+	}
+	if lastModified != "" {
+		w.Header().Set("Last-Modified", lastModified)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(http.StatusPartialContent)
+	_, _ = w.Write(body)
+}
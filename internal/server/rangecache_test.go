@@ -0,0 +1,177 @@
+package server
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+func TestRangeCaching(t *testing.T) {
+	body := make([]byte, 100)
+	for i := range body {
+		body[i] = byte('a' + i%26)
+	}
+	type step struct {
+		start, end int64 // -1 for a plain GET
+		fetch      bool
+		// whole: answered with the full body, as cache hits ignore Range.
+		whole bool
+	}
+	tests := []struct {
+		name        string
+		ignoreRange bool
+		steps       []step
+		wantFull    bool // a regular entry is stored by the end
+	}{
+		{"two ranges, then each from cache", false, []step{{0, 9, true, false}, {20, 29, true, false}, {0, 9, false, false}, {22, 25, false, false}}, false},
+		{"combined range after filling the gap", false, []step{{0, 9, true, false}, {20, 29, true, false}, {10, 19, true, false}, {5, 25, false, false}}, false},
+		{"range across a gap", false, []step{{0, 9, true, false}, {20, 29, true, false}, {5, 25, true, false}, {0, 29, false, false}}, false},
+		{"end past the object", false, []step{{90, 150, true, false}, {95, 99, false, false}}, false},
+		{"stitched once covered", false, []step{{0, 49, true, false}, {50, 99, true, false}, {-1, -1, false, true}, {10, 19, false, true}}, true},
+		{"origin ignores Range", true, []step{{0, 9, true, false}, {-1, -1, false, true}, {50, 59, false, true}}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			s, st := newTestServer(t, loadConfig(t, "range_caching: true\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				if tt.ignoreRange {
+					r.Header.Del("Range")
+				}
+				w.Header().Set("ETag", `"v1"`)
+				http.ServeContent(w, r, "", time.Time{}, bytes.NewReader(body))
+			}))
+			for i, sp := range tt.steps {
+				before := fetches.Load()
+				var headers []string
+				if sp.start >= 0 {
+					headers = []string{"Range", fmt.Sprintf("bytes=%d-%d", sp.start, sp.end)}
+				}
+				w := do(s, http.MethodGet, "/example.com/big.bin", headers...)
+				if sp.whole {
+					if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), body) {
+						t.Fatalf("step %d: %v = %d, %d bytes; want the whole body", i, headers, w.Code, w.Body.Len())
+					}
+				} else {
+					end := min(sp.end, int64(len(body))-1)
+					if w.Code != http.StatusPartialContent || !bytes.Equal(w.Body.Bytes(), body[sp.start:end+1]) {
+						t.Fatalf("step %d: range %d-%d = %d %q", i, sp.start, sp.end, w.Code, w.Body)
+					}
+					if want := fmt.Sprintf("bytes %d-%d/%d", sp.start, end, len(body)); w.Header().Get("Content-Range") != want {
+						t.Errorf("step %d: Content-Range %q, want %q", i, w.Header().Get("Content-Range"), want)
+					}
+				}
+				if fetched := fetches.Load() > before; fetched != sp.fetch {
+					t.Errorf("step %d: fetched upstream %v, want %v", i, fetched, sp.fetch)
+				}
+			}
+			objKey, _ := entryKeys(s, "example.com", "big.bin")
+			_, full := st.objects[objKey]
+			if full != tt.wantFull {
+				t.Errorf("full body stored %v, want %v", full, tt.wantFull)
+			}
+			if segs := st.keys("segments/"); full && len(segs) != 0 {
+				t.Errorf("segments left after stitching: %v", segs)
+			}
+		})
+	}
+}
+
+func TestParseRanges(t *testing.T) {
+	tests := []struct {
+		name              string
+		header            string
+		contentRange      bool
+		start, end, total int64
+		ok                bool
+	}{
+		{"range", "bytes=0-9", false, 0, 9, 0, true},
+		{"open-ended range", "bytes=10-", false, 0, 0, 0, false},
+		{"suffix range", "bytes=-10", false, 0, 0, 0, false},
+		{"multiple ranges", "bytes=0-1,5-6", false, 0, 0, 0, false},
+		{"reversed range", "bytes=9-0", false, 0, 0, 0, false},
+		{"content range", "bytes 0-9/100", true, 0, 9, 100, true},
+		{"unknown total", "bytes 10-19/*", true, 10, 19, -1, true},
+		{"bad content range", "bytes 10-5/100", true, 0, 0, 0, false},
+		{"wrong unit", "items 0-9/100", true, 0, 0, 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var start, end, total int64
+			var ok bool
+			if tt.contentRange {
+				start, end, total, ok = parseContentRange(tt.header)
+			} else {
+				start, end, ok = parseSingleRange(tt.header)
+			}
+			if ok != tt.ok || (ok && (start != tt.start || end != tt.end || total != tt.total)) {
+				t.Errorf("parse %q = %d, %d, %d, %v", tt.header, start, end, total, ok)
+			}
+		})
+	}
+}
+
+func TestCovers(t *testing.T) {
+	segs := []cache.Segment{{Start: 20, End: 29}, {Start: 0, End: 9}, {Start: 10, End: 14}}
+	tests := []struct {
+		start, end int64
+		want       bool
+	}{
+		{0, 9, true},
+		{0, 14, true},
+		{5, 12, true},
+		{0, 15, false},
+		{15, 19, false},
+		{21, 29, true},
+		{25, 30, false},
+	}
+	for _, tt := range tests {
+		if got := covers(segs, tt.start, tt.end); got != tt.want {
+			t.Errorf("covers(%d-%d) = %v, want %v", tt.start, tt.end, got, tt.want)
+		}
+	}
+}
+
+func TestUnrequestedPartialContent(t *testing.T) {
+	tests := []struct {
+		name       string
+		yaml       string
+		wantStatus int
+	}{
+		{"relayed", "", http.StatusPartialContent},
+		{"relayed explicitly", "partial_response: relay\n", http.StatusPartialContent},
+		{"refused", "partial_response: error\n", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			s, st := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				// An origin that only ever sends the first 4 bytes.
+				w.Header().Set("Content-Range", "bytes 0-3/100")
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write([]byte("abcd"))
+			}))
+			for i := 0; i < 2; i++ {
+				w := do(s, http.MethodGet, "/example.com/big.bin")
+				if w.Code != tt.wantStatus {
+					t.Fatalf("request %d: status %d, want %d", i, w.Code, tt.wantStatus)
+				}
+				if tt.wantStatus == http.StatusPartialContent && (w.Body.String() != "abcd" || w.Header().Get("Content-Range") != "bytes 0-3/100") {
+					t.Errorf("request %d: relayed %q with Content-Range %q", i, w.Body, w.Header().Get("Content-Range"))
+				}
+			}
+			if keys := st.keys(""); len(keys) != 0 {
+				t.Errorf("partial body stored: %v", keys)
+			}
+			if n := fetches.Load(); n != 2 {
+				t.Errorf("%d upstream fetches, want 2 (nothing cached)", n)
+			}
+		})
+	}
+}
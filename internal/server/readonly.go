@@ -0,0 +1,68 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// readOnly reports whether the proxy is in maintenance mode: the admin
+// override when one is set, else read_only from config. In this mode nothing
+// is fetched from upstream or written to storage.
+func (s *Server) readOnly() bool {
+	if p := s.readOnlyOverride.Load(); p != nil {
+		return *p
+	}
+	return s.conf().ReadOnly
+}
+
+// serveReadOnlyMiss answers a request the cache can't satisfy fresh while
+// read-only: with the stored object however old, when read_only_serve_stale
+// allows it, else with read_only_status.
+func (s *Server) serveReadOnlyMiss(ctx context.Context, w http.ResponseWriter, r *http.Request, objKey string, meta cache.Meta, hasMeta bool) {
+	c := s.conf()
+	if c.ReadOnlyServeStale && hasMeta && !meta.Neg {
+		if ok, _ := s.Store.HasObject(ctx, objKey); ok {
+			s.setDecision(w, decisionReadOnlyStale)
+			if s.serveFromCache(ctx, w, r, objKey, &meta) {
+				return
+			}
+		}
+	}
+	s.setDecision(w, decisionReadOnlyMiss)
+	w.Header().Set("Retry-After", "60")
+	http.Error(w, "cache is read-only for maintenance", c.ReadOnlyStatus)
+}
+
+// handleReadOnly reports the maintenance mode on GET. POST ?enabled=true or
+// false overrides read_only until DELETE hands control back to config; the
+// override isn't persisted across restarts.
+func (s *Server) handleReadOnly(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		on, err := strconv.ParseBool(r.URL.Query().Get("enabled"))
+		if err != nil {
+			http.Error(w, "enabled must be true or false", http.StatusBadRequest)
+			return
+		}
+		s.readOnlyOverride.Store(&on)
+		log.Printf("admin: read-only mode set to %v", on)
+	case http.MethodDelete:
+		s.readOnlyOverride.Store(nil)
+		log.Printf("admin: read-only override cleared (config read_only=%v)", s.conf().ReadOnly)
+	default:
+		w.Header().Set("Allow", "GET, POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		ReadOnly   bool `json:"read_only"`
+		Overridden bool `json:"overridden"`
+	}{s.readOnly(), s.readOnlyOverride.Load() != nil})
+}
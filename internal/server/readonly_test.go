@@ -0,0 +1,89 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestReadOnly(t *testing.T) {
+	tests := []struct {
+		name       string
+		yaml       string
+		override   string // ?enabled= for POST /admin/readonly; "clear" sets then DELETEs one
+		route      string // a.txt is cached, b.txt isn't
+		stale      bool
+		wantStatus int
+		wantBody   string
+		wantFetch  bool
+	}{
+		{"hit", "read_only: true\n", "", "a.txt", false, http.StatusOK, "cached", false},
+		{"miss", "read_only: true\n", "", "b.txt", false, http.StatusServiceUnavailable, "", false},
+		{"miss, custom status", "read_only: true\nread_only_status: 404\n", "", "b.txt", false, http.StatusNotFound, "", false},
+		{"stale served", "read_only: true\n", "", "a.txt", true, http.StatusOK, "cached", false},
+		{"stale refused", "read_only: true\nread_only_serve_stale: false\n", "", "a.txt", true, http.StatusServiceUnavailable, "", false},
+		{"enabled by admin", "", "true", "b.txt", false, http.StatusServiceUnavailable, "", false},
+		{"disabled by admin", "read_only: true\n", "false", "b.txt", false, http.StatusOK, "fresh", true},
+		{"override cleared", "read_only: true\n", "clear", "b.txt", false, http.StatusServiceUnavailable, "", false},
+		{"off", "", "", "b.txt", false, http.StatusOK, "fresh", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var body atomic.Value
+			body.Store("cached")
+			var fetches atomic.Int32
+			cfg := loadConfig(t, "admin_token: secret\n"+tt.yaml)
+			ro := cfg.ReadOnly
+			cfg.ReadOnly = false
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				_, _ = io.WriteString(w, body.Load().(string))
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			if tt.stale {
+				_, metaKey := entryKeys(s, "example.com", "a.txt")
+				m, _, _ := st.ReadMeta(ctx, metaKey)
+				m.CachedAt, m.TTL = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano), 60
+				_ = st.WriteMeta(ctx, metaKey, m)
+			}
+			cfg.ReadOnly = ro
+			s.SetConfig(cfg)
+			switch tt.override {
+			case "":
+			case "clear":
+				do(s.AdminHandler(), http.MethodPost, "/admin/readonly?enabled=false", "Authorization", "Bearer secret")
+				do(s.AdminHandler(), http.MethodDelete, "/admin/readonly", "Authorization", "Bearer secret")
+			default:
+				w := do(s.AdminHandler(), http.MethodPost, "/admin/readonly?enabled="+tt.override, "Authorization", "Bearer secret")
+				if w.Code != http.StatusOK || !strings.Contains(w.Body.String(), `"read_only":`+tt.override) {
+					t.Fatalf("admin readonly: %d %s", w.Code, w.Body)
+				}
+			}
+			body.Store("fresh")
+			fetches.Store(0)
+			keys := len(st.keys(""))
+
+			w := do(s, http.MethodGet, "/example.com/"+tt.route)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantBody != "" && w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+			if tt.wantStatus >= 400 && w.Header().Get("Retry-After") == "" {
+				t.Error("refusal without Retry-After")
+			}
+			if fetched := fetches.Load() > 0; fetched != tt.wantFetch {
+				t.Errorf("fetched upstream %v, want %v", fetched, tt.wantFetch)
+			}
+			if !tt.wantFetch && len(st.keys("")) != keys {
+				t.Errorf("storage written in read-only mode: %v", st.keys(""))
+			}
+		})
+	}
+}
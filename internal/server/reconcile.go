@@ -0,0 +1,110 @@
+package server
+
+import (
+	"context"
+	"log"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// RunReconciler prunes orphaned meta every interval until ctx is done.
+func (s *Server) RunReconciler(ctx context.Context, interval time.Duration) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if s.readOnly() {
+				continue
+			}
+			checked, pruned, err := s.ReconcileOnce(ctx)
+			if err != nil {
+				log.Printf("reconcile: %v (checked %d, pruned %d)", err, checked, pruned)
+				continue
+			}
+			if pruned > 0 {
+				log.Printf("reconcile: checked %d meta, pruned %d orphaned", checked, pruned)
+			}
+		}
+	}
+}
+
+// readMetaBulk is ReadMeta for walks over many keys. Reads share a
+// meta_read_concurrency-sized semaphore across all such walks, whatever their
+// own parallelism, so admin and background jobs can't flood storage.
+func (s *Server) readMetaBulk(ctx context.Context, metaKey string) (cache.Meta, bool, error) {
+	m, found, _, err := s.readMetaTimed(ctx, metaKey)
+	return m, found, err
+}
+
+// readMetaTimed is readMetaBulk that also returns how long storage took to
+// answer, not counting the wait for the semaphore, for sweepPacer.
+func (s *Server) readMetaTimed(ctx context.Context, metaKey string) (cache.Meta, bool, time.Duration, error) {
+	select {
+	case s.metaSem <- struct{}{}:
+	case <-ctx.Done():
+		return cache.Meta{}, false, 0, ctx.Err()
+	}
+	defer func() { <-s.metaSem }()
+	start := time.Now()
+	m, found, err := s.Store.ReadMeta(ctx, metaKey)
+	return m, found, time.Since(start), err
+}
+
+// ReconcileOnce walks all meta and deletes entries whose object no longer
+// exists (e.g. removed by a bucket lifecycle rule). Such meta would otherwise
+// report fresh hits that miss, or revalidate to a 304 with nothing to serve.
+// Negative and body-less entries (cache_head, range segments) have no
+// object and are left alone. The walk is paced by
+// reconcile_rate and sweep_max_latency_ms (see sweepPacer). A complete walk
+// also drops max_objects_per_domain index entries whose meta is gone.
+func (s *Server) ReconcileOnce(ctx context.Context) (checked, pruned int, err error) {
+	pace := s.newSweepPacer("reconcile", s.conf().ReconcileRate)
+	defer pace.stop()
+	pass, since := s.quota.walkStart()
+	err = s.Store.ListKeys(ctx, "meta/", func(metaKey string) error {
+		s.quota.see(pass, metaKey)
+		objKey, ok := cache.ObjectKeyForMeta(metaKey)
+		if !ok {
+			return nil
+		}
+		m, found, latency, err := s.readMetaTimed(ctx, metaKey)
+		if err := pace.wait(ctx, latency); err != nil {
+			return err
+		}
+		if err != nil || !found || m.Neg || !m.HasBody() {
+			return nil
+		}
+		checked++
+		exists, err := s.Store.HasObject(ctx, objKey)
+		if err != nil || exists {
+			return nil
+		}
+		if !s.activity.beginEvict(objKey) {
+			return nil
+		}
+		defer s.activity.endEvict(objKey)
+		// A fetch may have completed between the check and the claim.
+		if exists, err := s.Store.HasObject(ctx, objKey); err != nil || exists {
+			return nil
+		}
+		if err := s.Store.DeleteObject(ctx, metaKey); err != nil {
+			log.Printf("reconcile: delete %s: %v", metaKey, err)
+			return nil
+		}
+		// Variants and segments left behind by the lost object.
+		_ = s.removeBody(ctx, objKey)
+		s.noteRemoved(metaKey)
+		pruned++
+		return nil
+	})
+	if err == nil {
+		if n := s.quota.prune(pass, since); n > 0 {
+			log.Printf("reconcile: dropped %d quota index entries with no meta", n)
+		}
+	}
+	return checked, pruned, err
+}
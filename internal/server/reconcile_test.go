@@ -0,0 +1,51 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestReconcileOrphanedMeta(t *testing.T) {
+	tests := []struct {
+		name       string
+		route      string
+		status     int
+		dropObject bool
+		wantKept   bool
+	}{
+		{"orphaned", "gone.txt", http.StatusOK, true, false},
+		{"intact", "here.txt", http.StatusOK, false, true},
+		{"negative", "missing.txt", http.StatusNotFound, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, st := newTestServer(t, loadConfig(t, ""), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if tt.status != http.StatusOK {
+					http.NotFound(w, r)
+					return
+				}
+				_, _ = io.WriteString(w, "body")
+			}))
+			do(s, http.MethodGet, "/example.com/"+tt.route)
+			objKey, metaKey := entryKeys(s, "example.com", tt.route)
+			if tt.dropObject {
+				// As a bucket lifecycle rule would.
+				_ = st.DeleteObject(ctx, objKey)
+			}
+
+			_, pruned, err := s.ReconcileOnce(ctx)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, kept, _ := st.ReadMeta(ctx, metaKey); kept != tt.wantKept {
+				t.Errorf("meta kept = %v, want %v", kept, tt.wantKept)
+			}
+			if (pruned == 0) != tt.wantKept {
+				t.Errorf("pruned = %d, want kept %v", pruned, tt.wantKept)
+			}
+		})
+	}
+}
@@ -0,0 +1,136 @@
+package server
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// revalQueue is a bounded pool dedicated to background refreshes, kept apart
+// from foreground fetches so a burst of expiring objects can't swamp origins.
+// A key already queued or running is coalesced; jobs beyond the queue length
+// are dropped.
+type revalQueue struct {
+	jobs chan revalJob
+
+	mu      sync.Mutex
+	pending map[string]struct{}
+}
+
+type revalJob struct {
+	key string
+	fn  func(ctx context.Context)
+}
+
+// StartRevalidator starts workers that run queued revalidations until ctx is
+// done. Without it, background revalidation is disabled. Call Drain after
+// cancelling ctx to wait for in-flight jobs.
+func (s *Server) StartRevalidator(ctx context.Context, workers, queue int) {
+	if workers <= 0 {
+		return
+	}
+	if queue < 0 {
+		queue = 0
+	}
+	q := &revalQueue{
+		jobs:    make(chan revalJob, queue),
+		pending: make(map[string]struct{}),
+	}
+	for i := 0; i < workers; i++ {
+		s.bg.Add(1)
+		go func() {
+			defer s.bg.Done()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case j := <-q.jobs:
+					j.fn(ctx)
+					q.done(j.key)
+				}
+			}
+		}()
+	}
+	s.reval.Store(q)
+}
+
+// Drain waits for background workers to exit.
+func (s *Server) Drain() {
+	s.bg.Wait()
+}
+
+// enqueueRevalidation schedules fn under key. It reports false when the pool
+// is disabled or full; a key already pending counts as scheduled.
+func (s *Server) enqueueRevalidation(key string, fn func(ctx context.Context)) bool {
+	q := s.reval.Load()
+	if q == nil || s.readOnly() {
+		return false
+	}
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	if _, ok := q.pending[key]; ok {
+		return true
+	}
+	select {
+	case q.jobs <- revalJob{key: key, fn: fn}:
+		q.pending[key] = struct{}{}
+		return true
+	default:
+		return false
+	}
+}
+
+func (q *revalQueue) done(key string) {
+	q.mu.Lock()
+	delete(q.pending, key)
+	q.mu.Unlock()
+}
+
+// revalidate refreshes a cached entry in the background: a 304 renews
+// CachedAt and a storable, non-empty 2xx replaces the object. Anything else
+// leaves the stale entry for the foreground path to deal with.
+func (s *Server) revalidate(ctx context.Context, domain, upstreamURL, objKey, metaKey string, o fetchOpts) {
+	c := s.conf()
+	_, _, _ = s.sf.Do(objKey+"\x00reval", func() (any, error) {
+		defer s.activity.endFetch(objKey)
+		if s.activity.beginFetch(objKey) {
+			return nil, nil
+		}
+		meta, hasMeta := s.readBodyMeta(ctx, objKey, metaKey)
+		if hasMeta && cache.IsFresh(meta, int(c.TTLDefault)) {
+			return nil, nil
+		}
+		if s.breakerOpen(domain) > 0 {
+			return nil, nil
+		}
+		fr, err := download(ctx, s.clientFor(domain), upstreamURL, meta, o)
+		s.recordFetch(ctx, domain, fr, err)
+		if err != nil {
+			log.Printf("revalidate %s: %v", objKey, err)
+			return nil, nil
+		}
+		wctx, cancel := s.writeContext(ctx)
+		defer cancel()
+		switch {
+		case fr.notModified && hasMeta:
+			meta.Renew(int(c.TTLDefault), c.AdaptiveTTLMax)
+			_ = s.Store.WriteMeta(wctx, metaKey, meta)
+		case fr.status < 200 || fr.status >= 300 || fr.status == http.StatusPartialContent || len(fr.body) == 0 || !s.storable(fr):
+			// Not a replacement; the stale entry stays for the foreground path.
+		case s.unchangedBody(meta, hasMeta, fr):
+			s.renewUnchanged(wctx, metaKey, meta, fr)
+		default:
+			if s.unexpectedType(metaKey, fr) {
+				log.Printf("revalidate %s: unexpected content type %q, keeping cached copy", objKey, fr.contentType)
+				break
+			}
+			if err := s.persist(wctx, objKey, metaKey, fr); err != nil {
+				log.Printf("revalidate %s: %v", objKey, err)
+			}
+		}
+		return nil, nil
+	})
+}
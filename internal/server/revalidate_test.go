@@ -0,0 +1,82 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRevalidationPool(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		queue   int
+	}{
+		{"single worker", 1, 2},
+		{"pool", 3, 5},
+		{"no queue", 2, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, ""), http.NotFoundHandler())
+			ctx, cancel := context.WithCancel(context.Background())
+			s.StartRevalidator(ctx, tt.workers, tt.queue)
+			defer func() { cancel(); s.Drain() }()
+
+			var running, peak, ran atomic.Int32
+			started := make(chan struct{}, 64)
+			release := make(chan struct{})
+			job := func(ctx context.Context) {
+				n := running.Add(1)
+				for p := peak.Load(); n > p && !peak.CompareAndSwap(p, n); p = peak.Load() {
+				}
+				started <- struct{}{}
+				<-release
+				running.Add(-1)
+				ran.Add(1)
+			}
+			enqueue := func(i int) bool { return s.enqueueRevalidation(fmt.Sprint("key", i), job) }
+
+			// Occupy every worker, then fill the queue behind them. Without
+			// a queue a job is only taken by a worker already waiting, so
+			// give them a moment to start.
+			for i := 0; i < tt.workers; i++ {
+				for tries := 0; !enqueue(i); tries++ {
+					if tries == 1000 {
+						t.Fatalf("job %d rejected with idle workers", i)
+					}
+					time.Sleep(time.Millisecond)
+				}
+				<-started
+			}
+			for i := tt.workers; i < tt.workers+tt.queue; i++ {
+				if !enqueue(i) {
+					t.Fatalf("job %d rejected with room in the queue", i)
+				}
+			}
+			if !enqueue(0) {
+				t.Error("a key already pending wasn't coalesced")
+			}
+			if enqueue(tt.workers + tt.queue) {
+				t.Error("job beyond the queue length was accepted")
+			}
+
+			close(release)
+			deadline := time.After(5 * time.Second)
+			for int(ran.Load()) < tt.workers+tt.queue {
+				select {
+				case <-started:
+				case <-deadline:
+					t.Fatalf("%d of %d jobs ran", ran.Load(), tt.workers+tt.queue)
+				case <-time.After(time.Millisecond):
+				}
+			}
+			if p := int(peak.Load()); p > tt.workers {
+				t.Errorf("%d revalidations ran at once, pool size %d", p, tt.workers)
+			}
+		})
+	}
+}
@@ -0,0 +1,121 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"log"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// RunScrubber runs an integrity scrub every interval until ctx is done,
+// checking at most rate objects per second.
+func (s *Server) RunScrubber(ctx context.Context, interval time.Duration, rate int) {
+	t := time.NewTicker(interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-t.C:
+			if s.readOnly() {
+				continue
+			}
+			checked, corrupt, err := s.ScrubOnce(ctx, rate)
+			if err != nil {
+				log.Printf("scrub: %v (checked %d, corrupt %d)", err, checked, corrupt)
+				continue
+			}
+			if corrupt > 0 {
+				log.Printf("scrub: checked %d objects, removed %d corrupt", checked, corrupt)
+			}
+		}
+	}
+}
+
+// ScrubOnce re-reads every object that has a stored checksum and removes
+// entries whose body no longer matches it, copying the bad body to
+// quarantine/<object key> first when scrub_quarantine is set (bodies up to
+// verifyBufferMax; larger ones are hashed as they stream and only logged).
+// A positive rate bounds the
+// objects checked per second to keep storage load down; the walk also honors
+// /admin/sweep and sweep_max_latency_ms (see sweepPacer).
+func (s *Server) ScrubOnce(ctx context.Context, rate int) (checked, corrupt int, err error) {
+	pace := s.newSweepPacer("scrub", rate)
+	defer pace.stop()
+	err = s.Store.ListKeys(ctx, "meta/", func(metaKey string) error {
+		objKey, ok := cache.ObjectKeyForMeta(metaKey)
+		if !ok {
+			return nil
+		}
+		m, found, latency, err := s.readMetaTimed(ctx, metaKey)
+		if err := pace.wait(ctx, latency); err != nil {
+			return err
+		}
+		if err != nil || !found || m.Neg || m.Checksum == "" || !m.HasBody() {
+			return nil
+		}
+		sum, body, ct, err := s.scrubRead(ctx, objKey, s.conf().ScrubQuarantine)
+		if err != nil {
+			return nil
+		}
+		checked++
+		if sum == m.Checksum {
+			return nil
+		}
+		if !s.activity.beginEvict(objKey) {
+			return nil
+		}
+		defer s.activity.endEvict(objKey)
+		// Skip entries rewritten since they were read.
+		if cur, found, _ := s.Store.ReadMeta(ctx, metaKey); !found || cur.Checksum != m.Checksum {
+			return nil
+		}
+		corrupt++
+		log.Printf("scrub: %s checksum mismatch, removing", objKey)
+		if s.conf().ScrubQuarantine {
+			if body != nil {
+				_ = s.Store.PutObject(ctx, "quarantine/"+objKey, body, ct)
+			} else {
+				log.Printf("scrub: %s too large to quarantine", objKey)
+			}
+		}
+		_ = s.Store.DeleteObject(ctx, metaKey)
+		_ = s.removeBody(ctx, objKey)
+		s.noteRemoved(metaKey)
+		if s.Stats != nil {
+			if _, domain, _, ok := cache.ParseMetaKey(metaKey); ok {
+				s.Stats.For(s.metricsLabel(domain)).ScrubCorrupt.Add(1)
+			}
+		}
+		return nil
+	})
+	return checked, corrupt, err
+}
+
+// scrubRead returns the checksum of the object at key, hashed as it
+// streams. With keep, bodies up to verifyBufferMax are also returned for
+// quarantine; larger ones aren't held in memory.
+func (s *Server) scrubRead(ctx context.Context, key string, keep bool) (sum string, body []byte, contentType string, err error) {
+	rc, size, hdrs, err := s.Store.GetObject(ctx, key)
+	if err != nil {
+		return "", nil, "", err
+	}
+	defer rc.Close()
+	c := cache.NewChecksummer()
+	var w io.Writer = c
+	var buf *bytes.Buffer
+	if keep && size <= verifyBufferMax {
+		buf = new(bytes.Buffer)
+		w = io.MultiWriter(c, buf)
+	}
+	if _, err := io.Copy(w, rc); err != nil {
+		return "", nil, "", err
+	}
+	if buf != nil && buf.Len() <= verifyBufferMax {
+		body = buf.Bytes()
+	}
+	return c.Sum(), body, hdrs["Content-Type"], nil
+}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/metrics"
+)
+
+func TestScrub(t *testing.T) {
+	tests := []struct {
+		name           string
+		large          bool // over verifyBufferMax
+		corrupt        bool
+		quarantine     bool
+		rate           int
+		wantCorrupt    int
+		wantQuarantine bool
+		minDuration    time.Duration
+	}{
+		{"intact", false, false, false, 0, 0, false, 0},
+		{"corrupted", false, true, false, 0, 1, false, 0},
+		{"corrupted, quarantined", false, true, true, 0, 1, true, 0},
+		{"large, intact", true, false, true, 0, 0, false, 0},
+		{"large, corrupted", true, true, true, 0, 1, false, 0},
+		{"rate bounded", false, false, false, 20, 0, false, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := loadConfig(t, "")
+			cfg.ScrubQuarantine = tt.quarantine
+			body := "body of /a.txt"
+			if tt.large {
+				body += strings.Repeat(".", verifyBufferMax)
+			}
+			var fetches atomic.Int32
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				if r.URL.Path == "/a.txt" {
+					_, _ = io.WriteString(w, body)
+					return
+				}
+				_, _ = io.WriteString(w, "body of "+r.URL.Path)
+			}))
+			s.Stats = metrics.NewDomainStats(0)
+			do(s, http.MethodGet, "/example.com/a.txt")
+			do(s, http.MethodGet, "/example.com/b.txt")
+			objKey, metaKey := entryKeys(s, "example.com", "a.txt")
+			rotten := []byte("BODY OF /a.txt" + body[len("body of /a.txt"):])
+			if tt.corrupt {
+				// Bit rot: same size, different bytes.
+				_ = st.PutObject(ctx, objKey, rotten, "text/plain")
+			}
+
+			start := time.Now()
+			checked, corrupt, err := s.ScrubOnce(ctx, tt.rate)
+			if err != nil || checked != 2 || corrupt != tt.wantCorrupt {
+				t.Fatalf("ScrubOnce = %d checked, %d corrupt, %v; want 2, %d", checked, corrupt, err, tt.wantCorrupt)
+			}
+			if d := time.Since(start); d < tt.minDuration {
+				t.Errorf("pass took %v, want at least %v", d, tt.minDuration)
+			}
+			_, metaLeft := st.objects[metaKey]
+			_, objLeft := st.objects[objKey]
+			if metaLeft == tt.corrupt || objLeft == tt.corrupt {
+				t.Errorf("after scrub meta present %v, object present %v", metaLeft, objLeft)
+			}
+			q, quarantined := st.objects["quarantine/"+objKey]
+			if quarantined != tt.wantQuarantine || (quarantined && !bytes.Equal(q.data, rotten)) {
+				t.Errorf("quarantined = %v, want %v", quarantined, tt.wantQuarantine)
+			}
+			if n := len(st.keys("quarantine/")); n > 1 {
+				t.Errorf("%d quarantined bodies", n)
+			}
+			if c, _ := s.Stats.Lookup("example.com"); c.ScrubCorrupt.Load() != int64(tt.wantCorrupt) {
+				t.Errorf("scrub_corrupt = %d, want %d", c.ScrubCorrupt.Load(), tt.wantCorrupt)
+			}
+
+			// A removed entry is refetched on the next request.
+			w := do(s, http.MethodGet, "/example.com/a.txt")
+			if w.Body.String() != body {
+				t.Errorf("body after scrub: %d bytes, want %d", w.Body.Len(), len(body))
+			}
+			if want := 2 + int32(tt.wantCorrupt); fetches.Load() != want {
+				t.Errorf("%d upstream fetches, want %d", fetches.Load(), want)
+			}
+		})
+	}
+}
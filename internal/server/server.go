@@ -1,17 +1,25 @@
 package server
 
 import (
+	"bytes"
 	"context"
+	"errors"
 	"io"
+	"log"
 	"net/http"
+	"net/http/httptrace"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"golang.org/x/sync/singleflight"
 
 	"github.com/yourname/raw-cacher-go/internal/cache"
+	"github.com/yourname/raw-cacher-go/internal/config"
 	"github.com/yourname/raw-cacher-go/internal/httpx"
+	"github.com/yourname/raw-cacher-go/internal/metrics"
 )
 
 // Store is the minimal storage interface satisfied by your MinIO store.
@@ -20,213 +28,1184 @@ type Store interface {
 	HasObject(ctx context.Context, key string) (bool, error)
 	GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error)
 	PutObject(ctx context.Context, key string, data []byte, contentType string) error
+	DeleteObject(ctx context.Context, key string) error
+	ListKeys(ctx context.Context, prefix string, fn func(key string) error) error
+	// ObjectETag returns the storage-side ETag of key.
+	ObjectETag(ctx context.Context, key string) (string, bool, error)
 	ReadMeta(ctx context.Context, key string) (cache.Meta, bool, error)
 	WriteMeta(ctx context.Context, key string, m cache.Meta) error
 }
 
 type Server struct {
-	Store          Store
-	Client         *http.Client
-	TTLDefault     int
-	TTL404         int
-	ServeIfPresent bool
-	sf             singleflight.Group
+	Store  Store
+	Client *http.Client
+	// Stats receives per-domain hit/miss counts; nil disables them.
+	Stats *metrics.DomainStats
+	// Loader re-reads configuration for POST /admin/reload; nil disables it.
+	Loader func() (config.Config, error)
+	// Presigner hands out the URLs of presign_redirect_min_bytes redirects;
+	// nil uses Store when it can presign itself.
+	Presigner Presigner
+
+	cfg atomic.Pointer[config.Config]
+	sf  singleflight.Group
+
+	clients sync.Map // httpx.Options -> *http.Client
+
+	versionMu  sync.RWMutex
+	globalBump int
+	versions   map[string]int
+
+	// denyAll is set when a reload fails on the allowlist under
+	// allowlist_fail_mode "closed".
+	denyAll atomic.Bool
+
+	// readOnlyOverride, when set via /admin/readonly, takes precedence over
+	// read_only in config.
+	readOnlyOverride atomic.Pointer[bool]
+
+	// sweepPaused holds background sweeps (reconcile, scrub) between
+	// objects; sweepBackingOff counts sweeps waiting out slow storage.
+	sweepPaused     atomic.Bool
+	sweepBackingOff atomic.Int32
+
+	// fetchSlots limits concurrent upstream fetches (max_upstream_fetches,
+	// max_fetches_per_domain).
+	fetchSlots *fetchLimiter
+
+	// admit filters one-hit wonders out of storage (admit_after); built on
+	// first use.
+	admit     *admission
+	admitOnce sync.Once
+
+	// writeLocks serializes persist per object key.
+	writeLocks keyedMutex
+
+	// activity keeps maintenance deletes off keys being fetched.
+	activity keyActivity
+
+	// cooldown remembers recent fetches for fetch_cooldown_ms.
+	cooldown fetchCooldown
+
+	// certWarned maps a domain to the certificate expiry last logged for
+	// it (upstream_cert_warn_days).
+	certWarned sync.Map
+
+	// breakers fail misses fast for origins that keep failing
+	// (breaker_failures).
+	breakers breakers
+
+	// quota orders entries per domain for max_objects_per_domain.
+	quota domainQuota
+
+	// perClient counts in-flight requests per client address
+	// (max_requests_per_client).
+	perClient clientCounts
+
+	// metaSem bounds meta reads issued by bulk walks; see readMetaBulk.
+	metaSem chan struct{}
+
+	reval atomic.Pointer[revalQueue]
+	bg    sync.WaitGroup // background workers, waited on by Drain
+}
+
+func NewServer(store Store, cfg config.Config) *Server {
+	s := &Server{
+		Store:   store,
+		Client:  httpx.NewUpstreamClient(),
+		metaSem: make(chan struct{}, max(cfg.MetaReadConcurrency, 1)),
+	}
+	if cfg.MaxUpstreamFetches > 0 || cfg.MaxFetchesPerDomain > 0 {
+		s.fetchSlots = newFetchLimiter(cfg.MaxUpstreamFetches, cfg.MaxFetchesPerDomain)
+	}
+	s.cfg.Store(&cfg)
+	return s
+}
+
+// conf returns the current settings snapshot. It is replaced wholesale on
+// reload and must not be modified.
+func (s *Server) conf() *config.Config {
+	return s.cfg.Load()
+}
+
+// SetConfig atomically replaces the settings used by subsequent requests.
+func (s *Server) SetConfig(cfg config.Config) {
+	s.cfg.Store(&cfg)
+}
+
+// clientFor returns the upstream client for domain: Client unless global or
+// per-domain settings need a different transport, in which case one is
+// built once per distinct set of options and reused.
+func (s *Server) clientFor(domain string) *http.Client {
+	return s.client(s.clientOptions(domain))
+}
+
+// downgradeClientFor returns the client to retry with after a TLS handshake
+// failure, or nil unless tls_downgrade is set for domain.
+func (s *Server) downgradeClientFor(domain string) *http.Client {
+	if !s.conf().Domain(domain).TLSDowngrade {
+		return nil
+	}
+	opts, ok := s.clientOptions(domain).Downgrade()
+	if !ok {
+		return nil
+	}
+	return s.client(opts)
+}
+
+func (s *Server) clientOptions(domain string) httpx.Options {
+	c := s.conf()
+	d := c.Domain(domain)
+	// Versions were validated when the config was loaded.
+	minV, _ := httpx.TLSVersion(d.TLSMinVersion)
+	maxV, _ := httpx.TLSVersion(d.TLSMaxVersion)
+	idle, keepAlive := c.UpstreamIdleConnTimeout, c.UpstreamKeepAlive
+	if d.IdleConnTimeout > 0 {
+		idle = d.IdleConnTimeout
+	}
+	if d.KeepAlive > 0 {
+		keepAlive = d.KeepAlive
+	}
+	return httpx.Options{
+		DisableHTTP2: c.DisableHTTP2 || d.DisableHTTP2,
+		ServerName:   d.TLSServerName,
+		MinVersion:   minV,
+		MaxVersion:   maxV,
+
+		IdleConnTimeout: seconds(idle),
+		KeepAlive:       seconds(keepAlive),
+	}
 }
 
-func NewServer(store Store, ttlDefault, ttl404 int, serveIf bool) *Server {
-	return &Server{
-		Store:          store,
-		Client:         httpx.NewUpstreamClient(),
-		TTLDefault:     ttlDefault,
-		TTL404:         ttl404,
-		ServeIfPresent: serveIf,
+func (s *Server) client(opts httpx.Options) *http.Client {
+	if opts == (httpx.Options{}) {
+		return s.Client
+	}
+	if cl, ok := s.clients.Load(opts); ok {
+		return cl.(*http.Client)
 	}
+	cl, _ := s.clients.LoadOrStore(opts, httpx.NewClient(opts))
+	return cl.(*http.Client)
+}
+
+func seconds(n int) time.Duration { return time.Duration(n) * time.Second }
+
+// upstreamTimeout resolves the fetch deadline for domain. With neither a
+// domain nor a global upstream_timeout, httpx.DefaultTimeout applies.
+func (s *Server) upstreamTimeout(domain string) time.Duration {
+	c := s.conf()
+	if d := c.Domain(domain).UpstreamTimeout; d > 0 {
+		return seconds(d)
+	}
+	if c.UpstreamTimeout > 0 {
+		return seconds(c.UpstreamTimeout)
+	}
+	return httpx.DefaultTimeout
+}
+
+// overSizeLimit reports whether a body of size bytes is too large to store for
+// domain (max_object_bytes, overridable per domain).
+func (s *Server) overSizeLimit(domain string, size int64) bool {
+	limit := s.objectLimit(domain)
+	return limit > 0 && size > limit
+}
+
+// objectLimit returns the max_object_bytes in effect for domain (0 = none).
+func (s *Server) objectLimit(domain string) int64 {
+	c := s.conf()
+	if d := c.Domain(domain).MaxObjectBytes; d > 0 {
+		return d
+	}
+	return c.MaxObjectBytes
 }
 
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	ctx := r.Context()
+	c := s.conf()
+	if c.RequestTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, seconds(c.RequestTimeout))
+		defer cancel()
+	}
 
-	domain, route, upstreamURL, err := parseAndBuildUpstream(r.URL.Path, r.URL.RawQuery)
+	if s.handleCORS(w, r) {
+		return
+	}
+
+	domain, route, upstreamURL, err := parseAndBuildUpstream(r.URL.Path, r.URL.RawQuery, c.Aliases)
 	if err != nil {
 		http.Error(w, "path must be /<domain>/<route>", http.StatusBadRequest)
 		return
 	}
 
-	objKey := cache.ObjectKey(domain, route)
-	metaKey := cache.MetaKey(domain, route)
+	if cache.ValidateRoute(domain) != nil || cache.ValidateRoute(route) != nil {
+		http.Error(w, "invalid characters in path", http.StatusBadRequest)
+		return
+	}
+	if !s.domainAllowed(domain) {
+		http.Error(w, "domain not allowed", http.StatusForbidden)
+		return
+	}
+	dw := &decisionWriter{ResponseWriter: w}
+	w = dw
+	defer func() { s.recordDecision(domain, dw.decision, dw.written) }()
+
+	readOnly := s.readOnly()
+
+	if isUpgrade(r) {
+		if readOnly {
+			s.serveReadOnlyMiss(ctx, w, r, "", cache.Meta{}, false)
+			return
+		}
+		s.serveUpgrade(w, r, domain, upstreamURL)
+		return
+	}
+
+	keyRoute := route
+	switch c.SlashMode {
+	case SlashModeOff:
+	case SlashModeAll:
+		route = collapseSlashes(route)
+		keyRoute = route
+		upstreamURL = upstreamURLFor(domain, route, r.URL.RawQuery)
+	default:
+		keyRoute = collapseSlashes(route)
+	}
+
+	if canon := trailingSlash(keyRoute, c.TrailingSlash); canon != keyRoute {
+		if c.TrailingSlashRedirect {
+			loc := "/" + domain + "/" + trailingSlash(route, c.TrailingSlash)
+			if r.URL.RawQuery != "" {
+				loc += "?" + r.URL.RawQuery
+			}
+			http.Redirect(w, r, s.absoluteURL(r, loc), http.StatusMovedPermanently)
+			return
+		}
+		keyRoute = canon
+	}
+	// Rules match the route as requested; only the key is case-folded.
+	ruleRoute := keyRoute
+	// Case-insensitive origins serve /A.TXT and /a.txt alike; key them once
+	// but fetch the path as requested.
+	if c.Domain(domain).FoldCase {
+		keyRoute = strings.ToLower(keyRoute)
+	}
+
+	if c.Immutable(domain, ruleRoute) {
+		dw.cacheControl = "public, max-age=" + strconv.Itoa(c.ImmutableMaxAge) + ", immutable"
+	}
+
+	// Variants of the route (POST body, language, tenant, ...) get their own
+	// entries; they are kept apart from the route so it can't forge one.
+	var variant string
+	opts := s.fetchOpts(domain)
+	opts.route = ruleRoute
+	for k, v := range s.traceHeaders(r) {
+		opts.headers = withHeader(opts.headers, k, v)
+	}
+	if r.Method == http.MethodPost {
+		body, suffix, err := s.postCacheKey(r)
+		if err != nil {
+			http.Error(w, "POST not cacheable: "+err.Error(), http.StatusMethodNotAllowed)
+			return
+		}
+		variant += suffix
+		opts.method = http.MethodPost
+		opts.body = body
+		opts.headers = withHeader(opts.headers, "Content-Type", r.Header.Get("Content-Type"))
+	}
+
+	if c.VaryLanguage {
+		if suffix := languageKeySuffix(r.Header.Get("Accept-Language")); suffix != "" {
+			variant += suffix
+			opts.headers = withHeader(opts.headers, "Accept-Language", r.Header.Get("Accept-Language"))
+		}
+	}
+	if dc := c.Domain(domain); dc.VaryAccept {
+		w.Header().Add("Vary", "Accept")
+		if suffix, mediaType := acceptKeySuffix(r.Header.Get("Accept"), dc.AcceptTypes); suffix != "" {
+			variant += suffix
+			opts.headers = withHeader(opts.headers, "Accept", mediaType)
+		}
+	}
+	if suffix, k, v := s.partitionKey(r); suffix != "" {
+		variant += suffix
+		opts.headers = withHeader(opts.headers, k, v)
+	}
+
+	// Mirrors serving identical content share the canonical domain's
+	// entries; the fetch still goes to the requested domain.
+	keyDomain := c.KeyDomain(domain)
+	version := s.cacheVersion(keyDomain)
+	objKey := cache.ObjectKey(version, keyDomain, keyRoute, variant)
+	metaKey := cache.MetaKey(version, keyDomain, keyRoute, variant)
+
+	// An operator bypass skips every cache lookup and re-populates the entry.
+	bypass := !readOnly && s.bypassRequested(r)
+	sfKey := objKey
+	if bypass {
+		sfKey += "\x00bypass"
+	}
+
+	if r.Method == http.MethodHead && c.CacheHead && !bypass && !readOnly {
+		if s.serveHead(ctx, w, r, domain, upstreamURL, metaKey, opts) {
+			return
+		}
+	}
+
+	if c.RangeCaching && r.Method == http.MethodGet && !bypass && !readOnly {
+		if start, end, ok := parseSingleRange(r.Header.Get("Range")); ok {
+			if s.serveRange(ctx, w, domain, upstreamURL, objKey, metaKey, start, end, opts) {
+				return
+			}
+		}
+	}
 
 	// Fast path: serve from cache if present (optional policy)
-	if s.ServeIfPresent {
+	if c.ServeIf && !bypass {
 		if ok, _ := s.Store.HasObject(ctx, objKey); ok {
-			if s.serveFromCache(ctx, w, objKey) {
+			var fm *cache.Meta
+			if c.StoreHeaders || c.ConditionalOnHit || c.VerifyOnRead || c.DebugHeaders || s.reval.Load() != nil {
+				if m, ok, _ := s.Store.ReadMeta(ctx, metaKey); ok {
+					fm = &m
+				}
+			}
+			// Stale objects are served as-is and refreshed off the request path.
+			if fm != nil && !fm.Neg && !cache.IsFresh(*fm, int(c.TTLDefault)) {
+				s.enqueueRevalidation(objKey, func(ctx context.Context) {
+					s.revalidate(ctx, domain, upstreamURL, objKey, metaKey, opts)
+				})
+			}
+			s.setDecision(w, decisionServeIfPresent)
+			if s.serveFromCache(ctx, w, r, objKey, fm) {
 				return
 			}
 		}
 	}
 
 	// Load metadata and decide based on TTL/negative cache
-	meta, hasMeta, _ := s.Store.ReadMeta(ctx, metaKey)
-	if hasMeta && cache.IsNegativeFresh(meta, s.TTL404) {
-		http.Error(w, "Upstream negative-cached 404", http.StatusNotFound)
+	meta, hasMeta := cache.Meta{}, false
+	if !bypass {
+		meta, hasMeta = s.readBodyMeta(ctx, objKey, metaKey)
+	}
+	if hasMeta && cache.IsNegativeFresh(meta, int(c.TTL404)) {
+		s.setDecision(w, decisionNegativeHit)
+		if s.servePlaceholder(w, domain, route) {
+			return
+		}
+		if meta.Status != 0 && meta.Status != http.StatusNotFound {
+			http.Error(w, "Upstream error (negative-cached)", c.ClientStatus(meta.Status))
+			return
+		}
+		writeNotFound(w, c.ClientStatus(http.StatusNotFound), meta.NegBody, meta.NegContentType, "Upstream negative-cached 404")
 		return
 	}
-	if hasMeta && cache.IsFresh(meta, s.TTLDefault) {
+	if hasMeta && cache.IsFresh(meta, int(c.TTLDefault)) {
 		if ok, _ := s.Store.HasObject(ctx, objKey); ok {
-			if s.serveFromCache(ctx, w, objKey) {
+			s.setDecision(w, decisionFreshHit)
+			if s.serveFromCache(ctx, w, r, objKey, &meta) {
 				return
 			}
 		}
 	}
+	// Within the stale-while-revalidate window, serve the expired object and
+	// refresh it off the request path if the revalidation pool accepts it.
+	if hasMeta && !meta.Neg {
+		if swr, _ := s.staleWindows(meta); cache.IsStaleWithin(meta, int(c.TTLDefault), swr) {
+			if ok, _ := s.Store.HasObject(ctx, objKey); ok && s.enqueueRevalidation(objKey, func(ctx context.Context) {
+				s.revalidate(ctx, domain, upstreamURL, objKey, metaKey, opts)
+			}) {
+				s.setDecision(w, decisionStaleRevalidate)
+				if s.serveFromCache(ctx, w, r, objKey, &meta) {
+					return
+				}
+			}
+		}
+	}
+
+	if readOnly {
+		s.serveReadOnlyMiss(ctx, w, r, objKey, meta, hasMeta)
+		return
+	}
+
+	// With fetch_patience_ms and a stale copy on hand, the fetch is detached
+	// from the request so it can finish in the background if the client is
+	// served stale first.
+	fetchCtx := ctx
+	var patience <-chan time.Time
+	stale := meta
+	if c.FetchPatienceMS > 0 && hasMeta && !meta.Neg {
+		if ok, _ := s.Store.HasObject(ctx, objKey); ok {
+			fetchCtx = context.WithoutCancel(ctx)
+			t := time.NewTimer(time.Duration(c.FetchPatienceMS) * time.Millisecond)
+			defer t.Stop()
+			patience = t.C
+		}
+	}
+
+	admit := bypass || s.admitted(objKey)
+	cooldown := time.Duration(c.FetchCooldownMS) * time.Millisecond
+	// refreshed starts the fetch_cooldown_ms window once the cached entry
+	// has actually been renewed or replaced.
+	refreshed := func() {
+		if cooldown > 0 {
+			s.cooldown.record(objKey, time.Now(), cooldown)
+		}
+	}
 
 	// Consolidate concurrent misses per key
-	v, err, _ := s.sf.Do(objKey, func() (any, error) {
+	fetch := func() (any, error) {
+		ctx := fetchCtx
+		s.activity.beginFetch(objKey)
+		defer s.activity.endFetch(objKey)
 		// Re-check under singleflight
-		meta, hasMeta, _ = s.Store.ReadMeta(ctx, metaKey)
-		if hasMeta && cache.IsNegativeFresh(meta, s.TTL404) {
-			return fetchResult{kind: kindNotFound}, nil
+		if !bypass {
+			meta, hasMeta = s.readBodyMeta(ctx, objKey, metaKey)
+		}
+		if hasMeta && cache.IsNegativeFresh(meta, int(c.TTL404)) {
+			if meta.Status != 0 && meta.Status != http.StatusNotFound {
+				return fetchResult{kind: kindUpstreamError, status: meta.Status, decision: decisionNegativeHit}, nil
+			}
+			return fetchResult{kind: kindNotFound, decision: decisionNegativeHit, body: meta.NegBody, contentType: meta.NegContentType}, nil
+		}
+		if hasMeta && !meta.Neg {
+			ok, err := s.Store.HasObject(ctx, objKey)
+			switch {
+			case ok && cache.IsFresh(meta, int(c.TTLDefault)):
+				return fetchResult{kind: kindServeCache, decision: decisionFreshHit}, nil
+			case ok && !bypass && cooldown > 0 && s.cooldown.active(objKey, time.Now(), cooldown):
+				// Just fetched (e.g. a zero-lifetime entry); serve that
+				// rather than fetch again within fetch_cooldown_ms.
+				return fetchResult{kind: kindServeCache, decision: decisionCooldown}, nil
+			case err == nil && !ok:
+				// Meta whose object is gone (e.g. removed by a lifecycle
+				// rule) must not make the fetch conditional: a 304 would
+				// leave nothing to serve. Refetch in full so persist
+				// replaces the meta.
+				meta, hasMeta = cache.Meta{}, false
+			}
 		}
-		if hasMeta && cache.IsFresh(meta, s.TTLDefault) {
-			if ok, _ := s.Store.HasObject(ctx, objKey); ok {
-				return fetchResult{kind: kindServeCache}, nil
+
+		if left := s.breakerOpen(domain); left > 0 {
+			if s.canServeStaleOnError(ctx, objKey, meta, hasMeta) {
+				return fetchResult{kind: kindServeCache, decision: decisionStaleIfError}, nil
 			}
+			return nil, &errBreakerOpen{domain: domain, retryAfter: left}
 		}
 
-		fr, err := download(ctx, s.Client, upstreamURL, meta)
+		fr, err := download(ctx, s.clientFor(domain), upstreamURL, meta, opts)
+		s.recordFetch(ctx, domain, fr, err)
 		if err != nil {
+			if s.canServeStaleOnError(ctx, objKey, meta, hasMeta) {
+				return fetchResult{kind: kindServeCache, decision: decisionStaleIfError}, nil
+			}
 			return nil, err
 		}
 
+		// Writes outlive the request deadline so a fetched body still lands
+		// in the cache when the client gives up or times out.
+		ctx, cancel := s.writeContext(ctx)
+		defer cancel()
+
 		switch {
 		case fr.notModified && hasMeta:
-			meta.CachedAt = cache.NowISO()
-			_ = s.Store.WriteMeta(ctx, metaKey, meta)
-			return fetchResult{kind: kindServeCache}, nil
+			meta.Renew(int(c.TTLDefault), c.AdaptiveTTLMax)
+			if err := s.Store.WriteMeta(ctx, metaKey, meta); err == nil {
+				refreshed()
+			}
+			return fetchResult{kind: kindServeCache, decision: decisionRevalidated}, nil
 
 		case fr.status == http.StatusNotFound:
-			_ = s.Store.WriteMeta(ctx, metaKey, cache.Meta{
+			neg := cache.Meta{
 				CachedAt: cache.NowISO(),
-				TTL:      s.TTL404,
+				TTL:      c.NegativeTTL(http.StatusNotFound),
 				Neg:      true,
-			})
-			return fetchResult{kind: kindNotFound}, nil
+			}
+			// Oversized bodies are dropped rather than truncated so a hit
+			// never replays a partial payload.
+			if len(fr.body) > 0 && len(fr.body) <= c.NegativeBodyMaxBytes {
+				neg.NegBody = fr.body
+				neg.NegContentType = fr.contentType
+			}
+			if neg.TTL > 0 {
+				_ = s.Store.WriteMeta(ctx, metaKey, neg)
+			}
+			return fetchResult{kind: kindNotFound, decision: decisionMissNotFound, body: neg.NegBody, contentType: neg.NegContentType}, nil
+
+		case fr.status >= 500 && s.canServeStaleOnError(ctx, objKey, meta, hasMeta):
+			return fetchResult{kind: kindServeCache, decision: decisionStaleIfError}, nil
 
 		case fr.status < 200 || fr.status >= 300:
-			return fetchResult{kind: kindUpstreamError, status: fr.status}, nil
+			if ttl := c.NegativeTTL(fr.status); ttl > 0 && fr.status >= 400 {
+				_ = s.Store.WriteMeta(ctx, metaKey, cache.Meta{
+					CachedAt: cache.NowISO(),
+					TTL:      ttl,
+					Neg:      true,
+					Status:   fr.status,
+				})
+			}
+			return fetchResult{kind: kindUpstreamError, status: fr.status, decision: decisionMissError}, nil
+
+		case fr.status == http.StatusOK && len(fr.body) == 0 && s.softEmpty(route, fr.contentType):
+			if c.EmptyBodyNegTTL > 0 {
+				_ = s.Store.WriteMeta(ctx, metaKey, cache.Meta{
+					CachedAt: cache.NowISO(),
+					TTL:      c.EmptyBodyNegTTL,
+					Neg:      true,
+					Status:   http.StatusBadGateway,
+				})
+			}
+			return fetchResult{kind: kindUpstreamError, status: http.StatusBadGateway, decision: decisionMissError}, nil
+
+		case fr.status == http.StatusOK && s.unexpectedType(metaKey, fr):
+			log.Printf("upstream %s: unexpected content type %q, not caching", upstreamURL, fr.contentType)
+			return fetchResult{kind: kindUpstreamError, status: http.StatusBadGateway, decision: decisionMissError}, nil
+
+		case fr.tooLarge:
+			return fetchResult{kind: kindStream, decision: decisionPassThrough}, nil
+
+		case fr.status == http.StatusPartialContent:
+			// A partial body must never be stored as the full object. Only
+			// range_caching issues range requests on purpose; an origin that
+			// answers a plain GET this way is relayed, or refused under
+			// partial_response "error".
+			if c.PartialResponse == PartialResponseError {
+				return fetchResult{kind: kindUpstreamError, status: http.StatusBadGateway, decision: decisionMissError}, nil
+			}
+			return fetchResult{
+				kind:         kindWroteBody,
+				decision:     decisionPassThrough,
+				status:       http.StatusPartialContent,
+				header:       fr.header,
+				body:         fr.body,
+				contentType:  fr.contentType,
+				etag:         fr.etag,
+				lastModified: fr.lastModified,
+			}, nil
+
+		case fr.method == http.MethodHead || !s.storable(fr) || !admit:
+			// A forced upstream HEAD (upstream_method) has no body to store,
+			// and admit_after keeps rarely requested objects out.
+			return fetchResult{
+				kind:         kindWroteBody,
+				decision:     decisionPassThrough,
+				header:       fr.header,
+				body:         fr.body,
+				contentType:  fr.contentType,
+				etag:         fr.etag,
+				lastModified: fr.lastModified,
+			}, nil
+
+		case s.unchangedBody(meta, hasMeta, fr):
+			s.renewUnchanged(ctx, metaKey, meta, fr)
+			refreshed()
+			return fetchResult{kind: kindServeCache, decision: decisionRevalidated}, nil
 
 		default:
-			if err := persist(ctx, s.Store, objKey, metaKey, fr, s.TTLDefault); err != nil {
-				return nil, err
+			decision := fetchDecision(bypass)
+			if err := s.persist(ctx, objKey, metaKey, fr); err != nil {
+				if !c.ServeOnWriteFailure {
+					return nil, err
+				}
+				log.Printf("cache write failed for %s, serving uncached: %v", objKey, err)
+				decision = decisionPassThrough
+			} else {
+				refreshed()
 			}
 			return fetchResult{
 				kind:         kindWroteBody,
+				decision:     decision,
+				header:       fr.header,
 				body:         fr.body,
 				contentType:  fr.contentType,
 				etag:         fr.etag,
 				lastModified: fr.lastModified,
 			}, nil
 		}
-	})
+	}
+	ch := s.sf.DoChan(sfKey, fetch)
 
+	var sr singleflight.Result
+	select {
+	case sr = <-ch:
+	case <-patience:
+		s.setDecision(w, decisionStalePatience)
+		if s.serveFromCache(ctx, w, r, objKey, &stale) {
+			return
+		}
+		sr = <-ch
+	}
+	v, err := sr.Val, sr.Err
 	if err != nil {
+		s.setDecision(w, decisionMissError)
+		if s.servePlaceholder(w, domain, route) {
+			return
+		}
+		if errors.Is(err, context.DeadlineExceeded) {
+			http.Error(w, "upstream timeout", http.StatusGatewayTimeout)
+			return
+		}
+		var open *errBreakerOpen
+		if errors.As(err, &open) {
+			secs := int((open.retryAfter + time.Second - 1) / time.Second)
+			w.Header().Set("Retry-After", strconv.Itoa(secs))
+			http.Error(w, "upstream unavailable: circuit open", http.StatusServiceUnavailable)
+			return
+		}
 		http.Error(w, "upstream error: "+err.Error(), http.StatusBadGateway)
 		return
 	}
 
 	res, _ := v.(fetchResult)
+	s.setDecision(w, res.decision)
 	switch res.kind {
 	case kindServeCache:
-		if s.serveFromCache(ctx, w, objKey) {
+		if s.serveFromCache(ctx, w, r, objKey, &meta) {
 			return
 		}
+		// The copy may have just been dropped (verify_on_read); one more
+		// round fetches it again if so.
+		if sr := <-s.sf.DoChan(sfKey, fetch); sr.Err == nil {
+			switch res, _ := sr.Val.(fetchResult); res.kind {
+			case kindWroteBody:
+				s.setDecision(w, res.decision)
+				s.writeFetched(w, r, res)
+				return
+			case kindStream:
+				s.setDecision(w, res.decision)
+				s.streamFetched(ctx, w, domain, upstreamURL, opts)
+				return
+			}
+		}
 		http.Error(w, "cache read failed", http.StatusInternalServerError)
 
 	case kindNotFound:
-		http.Error(w, "Upstream 404", http.StatusNotFound)
+		if s.servePlaceholder(w, domain, route) {
+			return
+		}
+		writeNotFound(w, c.ClientStatus(http.StatusNotFound), res.body, res.contentType, "Upstream 404")
 
 	case kindUpstreamError:
+		if s.servePlaceholder(w, domain, route) {
+			return
+		}
 		if res.status >= 400 && res.status <= 599 {
-			http.Error(w, "Upstream error", res.status)
+			http.Error(w, "Upstream error", c.ClientStatus(res.status))
 		} else {
 			http.Error(w, "Upstream error", http.StatusBadGateway)
 		}
 
 	case kindWroteBody:
-		ct := res.contentType
+		s.writeFetched(w, r, res)
+
+	case kindStream:
+		s.streamFetched(ctx, w, domain, upstreamURL, opts)
+
+	default:
+		http.Error(w, "unexpected state", http.StatusInternalServerError)
+	}
+}
+
+// writeFetched relays a body fetched from upstream (kindWroteBody).
+func (s *Server) writeFetched(w http.ResponseWriter, r *http.Request, res fetchResult) {
+	if s.conf().ConditionalOnMiss && notModified(r, res.etag, res.lastModified) {
+		writeNotModified(w, res.etag, res.lastModified)
+		return
+	}
+	replayHeaders(w, s.snapshotHeaders(res.header))
+	// As on hits (serveFromCache), so a miss and the hits after it agree.
+	if s.conf().VaryLanguage {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	if lang := res.header.Get("Content-Language"); lang != "" {
+		w.Header().Set("Content-Language", lang)
+	}
+	ct := res.contentType
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", ct)
+	if res.etag != "" {
+		w.Header().Set("ETag", res.etag)
+	}
+	if res.lastModified != "" {
+		w.Header().Set("Last-Modified", res.lastModified)
+	}
+	w.Header().Set("Content-Length", strconv.FormatInt(int64(len(res.body)), 10))
+	status := http.StatusOK
+	if res.status == http.StatusPartialContent {
+		status = res.status
+		w.Header().Set("Content-Range", res.header.Get("Content-Range"))
+	}
+	w.WriteHeader(status)
+	_, _ = w.Write(res.body)
+}
+
+// streamFetched serves a body too large to cache (kindStream) straight from
+// upstream.
+func (s *Server) streamFetched(ctx context.Context, w http.ResponseWriter, domain, upstreamURL string, o fetchOpts) {
+	status, err := s.streamUpstream(ctx, w, s.clientFor(domain), upstreamURL, o)
+	s.recordFetch(ctx, domain, fetched{status: status}, err)
+	if err != nil {
+		http.Error(w, "upstream error: "+err.Error(), http.StatusBadGateway)
+	}
+}
+
+// writeNotFound replays a stored upstream 404 body, or falls back to msg,
+// with status (404 unless remapped by status_map).
+func writeNotFound(w http.ResponseWriter, status int, body []byte, contentType, msg string) {
+	if len(body) == 0 {
+		http.Error(w, msg, status)
+		return
+	}
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	w.WriteHeader(status)
+	_, _ = w.Write(body)
+}
+
+// fetchOpts are the per-domain knobs for an upstream request.
+type fetchOpts struct {
+	// headers are static per-domain request headers (e.g. API keys); they
+	// are sent upstream only, never logged, stored or reflected to clients.
+	headers map[string]string
+	// timeout bounds the whole exchange, including reading the body.
+	timeout time.Duration
+	// bodyIdle aborts a body that stalls for this long between reads.
+	bodyIdle time.Duration
+	// method, if set, overrides the request method (upstream_method).
+	method string
+	// route is the request's route as per-route rules see it: canonical
+	// but not case-folded.
+	route string
+	// maxInflated caps a transparently gunzipped body (0 = no cap).
+	maxInflated int64
+	// maxBody is the largest body of a 2xx GET buffered (max_object_bytes);
+	// larger ones are left unread, to be streamed by a second request. POST
+	// bodies are always read, as a POST can't safely be sent twice (0 = no
+	// cap).
+	maxBody int64
+	// body is sent with the request (POST caching).
+	body []byte
+	// downgrade, if set, retries a failed TLS handshake (tls_downgrade).
+	downgrade *http.Client
+	// strip lists headers removed from the request last (strip_headers).
+	strip []string
+	// slots, if set, gates the fetch on a free slot for domain.
+	slots  *fetchLimiter
+	domain string
+	// inflight, if set, counts the fetch while it runs.
+	inflight *atomic.Int64
+	// contentTypePick chooses among duplicate Content-Types
+	// (duplicate_content_type).
+	contentTypePick string
+	// certSeen, if set, is given the expiry of the upstream's certificate
+	// chain (upstream_cert_warn_days).
+	certSeen func(notAfter time.Time)
+}
+
+// withHeader returns a copy of hdr with k set to v, leaving the shared
+// per-domain map untouched.
+func withHeader(hdr map[string]string, k, v string) map[string]string {
+	out := make(map[string]string, len(hdr)+1)
+	for hk, hv := range hdr {
+		out[hk] = hv
+	}
+	out[k] = v
+	return out
+}
+
+// fetchOpts resolves the upstream request options for domain.
+func (s *Server) fetchOpts(domain string) fetchOpts {
+	c := s.conf()
+	return fetchOpts{
+		headers:  c.Domain(domain).Headers,
+		timeout:  s.upstreamTimeout(domain),
+		bodyIdle: seconds(c.UpstreamBodyIdleTimeout),
+		method:   c.Domain(domain).UpstreamMethod,
+		strip:    c.Domain(domain).StripHeaders,
+
+		downgrade: s.downgradeClientFor(domain),
+
+		maxInflated: c.MaxDecompressedBytes,
+		maxBody:     s.objectLimit(domain),
+
+		slots:  s.fetchSlots,
+		domain: domain,
+
+		inflight: s.inflightCounter(domain),
+
+		contentTypePick: c.DuplicateContentType,
+		certSeen:        s.certWatcher(domain),
+	}
+}
+
+// errBodyIdle reports an upstream body that stopped sending data.
+var errBodyIdle = errors.New("upstream body idle timeout")
+
+// errInflatedTooLarge reports a compressed upstream body that inflated past
+// max_decompressed_bytes.
+var errInflatedTooLarge = errors.New("upstream body exceeds decompression limit")
+
+// download fetches from the upstream URL with conditional headers if available.
+func download(ctx context.Context, client *http.Client, url string, prior cache.Meta, o fetchOpts) (fetched, error) {
+	return fetchUpstream(ctx, client, http.MethodGet, url, prior, o)
+}
+
+// fetchUpstream is download for an arbitrary method; HEAD yields no body.
+// A 2xx GET body over o.maxBody isn't buffered: the result is marked
+// tooLarge instead, without a body.
+func fetchUpstream(ctx context.Context, client *http.Client, method, url string, prior cache.Meta, o fetchOpts) (fetched, error) {
+	if o.method != "" {
+		method = o.method
+	}
+	var fr fetched
+	err := exchange(ctx, client, method, url, prior, o, func(resp *http.Response, br io.Reader) error {
+		fr = fetched{url: url, domain: o.domain, route: o.route, method: method, status: resp.StatusCode, header: resp.Header}
+		if resp.StatusCode == http.StatusNotModified {
+			fr.header, fr.notModified = nil, true
+			return nil
+		}
+		limited := o.maxBody > 0 && method == http.MethodGet && resp.StatusCode >= 200 && resp.StatusCode < 300
+		if limited {
+			if resp.ContentLength > o.maxBody {
+				fr.tooLarge = true
+				return nil
+			}
+			br = io.LimitReader(br, o.maxBody+1)
+		}
+		// Hash exactly the bytes we keep, after the transport has undone any
+		// chunking or compression.
+		sum := cache.NewChecksummer()
+		body, err := io.ReadAll(io.TeeReader(br, sum))
+		if err != nil {
+			return err
+		}
+		if resp.Uncompressed && o.maxInflated > 0 && int64(len(body)) > o.maxInflated {
+			return errInflatedTooLarge
+		}
+		if limited && int64(len(body)) > o.maxBody {
+			fr.tooLarge = true
+			return nil
+		}
+		fr.body, fr.checksum = body, sum.Sum()
+		fr.contentType, fr.etag, fr.lastModified = extractHeaders(resp.Header, body, o.contentTypePick)
+		return nil
+	})
+	if err != nil {
+		return fetched{}, err
+	}
+	return fr, nil
+}
+
+// streamUpstream relays an upstream response to w as it arrives, without
+// buffering or storing it: the path for bodies over max_object_bytes. An
+// error once the body has started aborts the response.
+func (s *Server) streamUpstream(ctx context.Context, w http.ResponseWriter, client *http.Client, url string, o fetchOpts) (status int, err error) {
+	err = exchange(ctx, client, http.MethodGet, url, cache.Meta{}, o, func(resp *http.Response, br io.Reader) error {
+		status = resp.StatusCode
+		replayHeaders(w, s.snapshotHeaders(resp.Header))
+		ct, etag, lm := extractHeaders(resp.Header, nil, o.contentTypePick)
 		if ct == "" {
 			ct = "application/octet-stream"
 		}
 		w.Header().Set("Content-Type", ct)
-		if res.etag != "" {
-			w.Header().Set("ETag", res.etag)
+		if etag != "" {
+			w.Header().Set("ETag", etag)
 		}
-		if res.lastModified != "" {
-			w.Header().Set("Last-Modified", res.lastModified)
+		if lm != "" {
+			w.Header().Set("Last-Modified", lm)
 		}
-		w.Header().Set("Content-Length", strconv.FormatInt(int64(len(res.body)), 10))
-		w.WriteHeader(http.StatusOK)
-		_, _ = w.Write(res.body)
-
-	default:
-		http.Error(w, "unexpected state", http.StatusInternalServerError)
-	}
+		if resp.ContentLength >= 0 {
+			w.Header().Set("Content-Length", strconv.FormatInt(resp.ContentLength, 10))
+		}
+		w.WriteHeader(resp.StatusCode)
+		n, err := s.copyBody(w, br)
+		if err == nil && resp.Uncompressed && o.maxInflated > 0 && n > o.maxInflated {
+			err = errInflatedTooLarge
+		}
+		if err != nil {
+			log.Printf("upstream %s: streaming %s: %v", o.domain, url, err)
+			panic(http.ErrAbortHandler)
+		}
+		return nil
+	})
+	return status, err
 }
 
-// download fetches from the upstream URL with conditional headers if available.
-func download(ctx context.Context, client *http.Client, url string, prior cache.Meta) (fetched, error) {
-	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+// exchange sends one upstream request under o and hands the response to
+// read, with its body bounded by max_decompressed_bytes and
+// upstream_body_idle_timeout. The fetch slot, timeout and connection are
+// held until read returns.
+func exchange(ctx context.Context, client *http.Client, method, url string, prior cache.Meta, o fetchOpts, read func(resp *http.Response, body io.Reader) error) error {
+	// Waiting for a slot doesn't count against the upstream timeout.
+	if o.slots != nil {
+		release, err := o.slots.acquire(ctx, o.domain)
+		if err != nil {
+			return err
+		}
+		defer release()
+	}
+	if o.inflight != nil {
+		o.inflight.Add(1)
+		defer o.inflight.Add(-1)
+	}
+	if o.timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, o.timeout)
+		defer cancel()
+	}
+	if o.method != "" {
+		method = o.method
+	}
+	ctx, cancelIdle := context.WithCancelCause(ctx)
+	defer cancelIdle(nil)
+	var reqBody io.Reader
+	if o.body != nil {
+		reqBody = bytes.NewReader(o.body)
+	}
+	req, _ := http.NewRequestWithContext(ctx, method, url, reqBody)
+	for k, v := range o.headers {
+		req.Header.Set(k, v)
+	}
 	if prior.ETag != "" {
 		req.Header.Set("If-None-Match", prior.ETag)
 	}
 	if prior.LastModified != "" {
 		req.Header.Set("If-Modified-Since", prior.LastModified)
 	}
+	for _, h := range o.strip {
+		if http.CanonicalHeaderKey(h) == "User-Agent" {
+			// An empty value stops the client adding its default.
+			req.Header.Set("User-Agent", "")
+			continue
+		}
+		req.Header.Del(h)
+	}
+
+	var reused bool
+	req = req.WithContext(httptrace.WithClientTrace(ctx, &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) { reused = info.Reused },
+	}))
 
 	_ = time.Now() // placeholder if you want to add timings/metrics later
 	resp, err := client.Do(req)
+	if err != nil && reused && httpx.IsConnReset(err) && ctx.Err() == nil &&
+		(method == http.MethodGet || method == http.MethodHead) {
+		// The origin closed a pooled connection under us; that connection
+		// is discarded, so one retry gets a working one. Only safe methods
+		// are retried: a POST may already have been acted on.
+		log.Printf("upstream %s: reused connection reset (%v), retrying", o.domain, err)
+		resp, err = client.Do(req.Clone(ctx))
+	}
+	if err != nil && o.downgrade != nil && httpx.IsHandshakeError(err) {
+		log.Printf("upstream %s: TLS handshake failed (%v), retrying with an older version", o.domain, err)
+		retry := req.Clone(ctx)
+		if o.body != nil {
+			retry.Body = io.NopCloser(bytes.NewReader(o.body))
+		}
+		resp, err = o.downgrade.Do(retry)
+	}
 	if err != nil {
-		return fetched{}, err
+		return err
 	}
 	defer resp.Body.Close()
-
-	if resp.StatusCode == http.StatusNotModified {
-		return fetched{status: resp.StatusCode, notModified: true}, nil
+	if o.certSeen != nil {
+		if notAfter, ok := certExpiry(resp.TLS); ok {
+			o.certSeen(notAfter)
+		}
 	}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return fetched{}, err
+	var br io.Reader = resp.Body
+	if resp.Uncompressed && o.maxInflated > 0 {
+		// The transport is inflating a gzip body; bound it against bombs.
+		br = io.LimitReader(br, o.maxInflated+1)
 	}
-	ct, etag, lm := extractHeaders(resp.Header)
-
-	return fetched{
-		status:       resp.StatusCode,
-		body:         body,
-		contentType:  ct,
-		etag:         etag,
-		lastModified: lm,
-	}, nil
+	if o.bodyIdle > 0 {
+		ir := newIdleReader(br, o.bodyIdle, func() { cancelIdle(errBodyIdle) })
+		defer ir.stop()
+		br = ir
+	}
+	if err := read(resp, br); err != nil {
+		if errors.Is(context.Cause(ctx), errBodyIdle) {
+			return errBodyIdle
+		}
+		return err
+	}
+	return nil
 }
 
-// persist writes the object and metadata to storage.
-func persist(ctx context.Context, st Store, objKey, metaKey string, fr fetched, ttlDefault int) error {
-	if err := st.PutObject(ctx, objKey, fr.body, fr.contentType); err != nil {
+// persist writes the object and metadata to storage, retrying each write.
+// Writes of one key never overlap, so object and meta always come from the
+// same response; under write_conflict "skip" a write that finds another in
+// progress is dropped instead of queued.
+func (s *Server) persist(ctx context.Context, objKey, metaKey string, fr fetched) error {
+	c := s.conf()
+	if c.WriteConflict == WriteConflictSkip {
+		unlock, ok := s.writeLocks.TryLock(objKey)
+		if !ok {
+			return nil
+		}
+		defer unlock()
+	} else {
+		defer s.writeLocks.Lock(objKey)()
+	}
+	err := s.retryWrite(ctx, func() error {
+		return s.Store.PutObject(ctx, objKey, fr.body, fr.contentType)
+	})
+	if err != nil {
 		return err
 	}
+	ttl, revalidate := s.entryTTL(metaKey, fr)
+	var storeETag string
+	if c.VerifyStoreETag {
+		storeETag, _, _ = s.Store.ObjectETag(ctx, objKey)
+	}
+	s.persistVariants(ctx, objKey, fr)
+	if fr.checksum == "" {
+		fr.checksum = cache.Checksum(fr.body)
+	}
+	bodyCached := true
 	meta := cache.Meta{
 		ETag:         fr.etag,
 		LastModified: fr.lastModified,
 		CachedAt:     cache.NowISO(),
-		TTL:          ttlDefault,
+		TTL:          ttl,
 		Size:         int64(len(fr.body)),
 		Neg:          false,
+		Headers:      s.snapshotHeaders(fr.header),
+		BodyCached:   &bodyCached,
+		StoreETag:    storeETag,
+		Checksum:     fr.checksum,
+
+		ContentLanguage: fr.header.Get("Content-Language"),
+		Revalidate:      revalidate,
+	}
+	if _, _, route, _ := cache.ParseMetaKey(metaKey); cache.LossyRoute(route) {
+		meta.URL = fr.url
+	}
+	if c.HonorCacheControl {
+		cc := cache.ParseCacheControl(strings.Join(fr.header.Values("Cache-Control"), ","))
+		meta.StaleWhileRevalidate = max(cc.StaleWhileRevalidate, 0)
+		meta.StaleIfError = max(cc.StaleIfError, 0)
+	}
+	err = s.retryWrite(ctx, func() error {
+		return s.Store.WriteMeta(ctx, metaKey, meta)
+	})
+	if err == nil {
+		s.noteStored(ctx, metaKey)
+	}
+	return err
+}
+
+// entryTTL returns the TTL to store fr under at metaKey, and whether the
+// entry must be revalidated before every use (a zero lifetime).
+func (s *Server) entryTTL(metaKey string, fr fetched) (ttl int, revalidate bool) {
+	ttl = s.routeTTL(metaKey, fr)
+	if lt, ok := s.lifetime(fr); ok {
+		return lt, lt <= 0
+	}
+	if c := s.conf(); fr.etag == "" && fr.lastModified == "" && int(c.TTLNoValidators) > ttl {
+		// Can't revalidate cheaply, so keep it around longer.
+		ttl = int(c.TTLNoValidators)
+	}
+	return ttl, false
+}
+
+// keyRouteFor returns the route a request for route on domain is keyed
+// under: with slashes collapsed (slash_mode), the trailing slash made
+// canonical, and lowercased for fold_case domains. ServeHTTP applies the
+// same steps inline, since it may redirect or rewrite the upstream path
+// along the way.
+func (s *Server) keyRouteFor(domain, route string) string {
+	c := s.conf()
+	if c.SlashMode != SlashModeOff {
+		route = collapseSlashes(route)
+	}
+	route = trailingSlash(route, c.TrailingSlash)
+	if c.Domain(domain).FoldCase {
+		route = strings.ToLower(route)
+	}
+	return route
+}
+
+// removeBody deletes the object stored at objKey along with its encoded
+// variants and, under range_caching, its range segments. It carries on past
+// failures and returns the first.
+func (s *Server) removeBody(ctx context.Context, objKey string) error {
+	c := s.conf()
+	err := s.Store.DeleteObject(ctx, objKey)
+	for _, enc := range c.CompressVariants {
+		if verr := s.Store.DeleteObject(ctx, cache.VariantKey(objKey, enc)); err == nil {
+			err = verr
+		}
+	}
+	if c.RangeCaching {
+		if serr := s.deleteSegments(ctx, objKey); err == nil {
+			err = serr
+		}
+	}
+	return err
+}
+
+// persistVariants stores (or removes stale) encoded variants of the body.
+// Failures only cost compression on later hits, so they are logged, not returned.
+func (s *Server) persistVariants(ctx context.Context, objKey string, fr fetched) {
+	ok := s.compressible(fr.contentType, len(fr.body))
+	for _, enc := range s.conf().CompressVariants {
+		vkey := cache.VariantKey(objKey, enc)
+		if !ok {
+			_ = s.Store.DeleteObject(ctx, vkey)
+			continue
+		}
+		b, err := encodeVariant(enc, fr.body)
+		if err == nil {
+			err = s.retryWrite(ctx, func() error {
+				return s.Store.PutObject(ctx, vkey, b, fr.contentType)
+			})
+		}
+		if err != nil {
+			log.Printf("variant %s for %s: %v", enc, objKey, err)
+			_ = s.Store.DeleteObject(ctx, vkey)
+		}
 	}
-	return st.WriteMeta(ctx, metaKey, meta)
 }
 
-// parseAndBuildUpstream extracts <domain> and <route> from /<domain>/<route>
-// and builds https://<domain>/<route>?<rawQuery>.
-func parseAndBuildUpstream(path, rawQuery string) (string, string, string, error) {
-	p := strings.TrimPrefix(path, "/")
+// writeContext detaches ctx from its caller's cancellation for cache writes,
+// bounding them by the storage write timeout instead.
+func (s *Server) writeContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	ctx = context.WithoutCancel(ctx)
+	if t := s.conf().StorageWriteTimeout; t > 0 {
+		return context.WithTimeout(ctx, seconds(t))
+	}
+	return ctx, func() {}
+}
+
+// retryWrite runs op up to StorageWriteRetries extra times, doubling the
+// backoff between attempts. It gives up early if ctx is done.
+func (s *Server) retryWrite(ctx context.Context, op func() error) error {
+	c := s.conf()
+	backoff := time.Duration(c.StorageWriteBackoffMS) * time.Millisecond
+	err := op()
+	for i := 0; err != nil && i < c.StorageWriteRetries; i++ {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		err = op()
+	}
+	return err
+}
+
+// parseAndBuildUpstream extracts <domain> and <route> from /<domain>/<route>,
+// after alias expansion, and builds https://<domain>/<route>?<rawQuery>.
+func parseAndBuildUpstream(path, rawQuery string, aliases map[string]string) (string, string, string, error) {
+	p := expandAlias(strings.TrimPrefix(path, "/"), aliases)
 	i := strings.IndexByte(p, '/')
 	if i <= 0 {
 		return "", "", "", http.ErrNotSupported
@@ -234,20 +1213,174 @@ func parseAndBuildUpstream(path, rawQuery string) (string, string, string, error
 	domain := p[:i]
 	route := p[i+1:]
 
+	return domain, route, upstreamURLFor(domain, route, rawQuery), nil
+}
+
+// expandAlias rewrites "<alias>/<rest>" to "<target>/<rest>" when the first
+// segment is a configured alias, so aliased and direct requests share keys.
+func expandAlias(p string, aliases map[string]string) string {
+	if len(aliases) == 0 {
+		return p
+	}
+	name, rest, _ := strings.Cut(p, "/")
+	target, ok := aliases[name]
+	if !ok {
+		return p
+	}
+	return strings.Trim(target, "/") + "/" + rest
+}
+
+// upstreamURLFor builds https://<domain>/<route>?<rawQuery>.
+func upstreamURLFor(domain, route, rawQuery string) string {
 	url := "https://" + strings.TrimRight(domain, "/") + "/" + strings.TrimLeft(route, "/")
 	if rawQuery != "" {
 		url += "?" + rawQuery
 	}
-	return domain, route, url, nil
+	return url
+}
+
+// Slash modes control collapsing of duplicate slashes in routes.
+const (
+	SlashModeKey = "key" // collapse for cache keys only (default)
+	SlashModeAll = "all" // collapse for keys and the upstream URL
+	SlashModeOff = "off" // keep routes verbatim
+)
+
+// WriteConflictSkip drops a persist that finds another in progress for the
+// same key, rather than waiting to overwrite it (write_conflict).
+const WriteConflictSkip = "skip"
+
+// PartialResponseError answers an unrequested upstream 206 with 502 instead
+// of relaying it (partial_response).
+const PartialResponseError = "error"
+
+// Trailing-slash policies canonicalize "/path" and "/path/" to one form.
+const (
+	TrailingSlashStrip  = "strip"
+	TrailingSlashAppend = "append"
+)
+
+// trailingSlash applies policy to a non-empty route; "" leaves it alone.
+func trailingSlash(route, policy string) string {
+	if route == "" {
+		return route
+	}
+	switch policy {
+	case TrailingSlashStrip:
+		if t := strings.TrimRight(route, "/"); t != "" {
+			return t
+		}
+	case TrailingSlashAppend:
+		if !strings.HasSuffix(route, "/") {
+			return route + "/"
+		}
+	}
+	return route
 }
 
-// serveFromCache streams a cached object to the client.
-func (s *Server) serveFromCache(ctx context.Context, w http.ResponseWriter, key string) bool {
+// collapseSlashes replaces runs of '/' with a single '/'.
+func collapseSlashes(route string) string {
+	if !strings.Contains(route, "//") {
+		return route
+	}
+	var b strings.Builder
+	b.Grow(len(route))
+	for i := 0; i < len(route); i++ {
+		if route[i] == '/' && i > 0 && route[i-1] == '/' {
+			continue
+		}
+		b.WriteByte(route[i])
+	}
+	return b.String()
+}
+
+// serveFromCache streams a cached object to the client, preferring a stored
+// encoded variant when the client accepts one. meta, when known, supplies
+// the stored upstream header snapshot.
+func (s *Server) serveFromCache(ctx context.Context, w http.ResponseWriter, r *http.Request, key string, meta *cache.Meta) bool {
 	rc, size, hdrs, err := s.Store.GetObject(ctx, key)
 	if err != nil {
 		return false
 	}
+	lm := hdrs["Last-Modified"]
+	if meta != nil && meta.LastModified != "" {
+		lm = meta.LastModified
+	}
+	if unmodifiedSinceFailed(r, lm) {
+		rc.Close()
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return true
+	}
+	if s.conf().ConditionalOnHit {
+		// Clients may hold the upstream ETag (sent on the miss) or the
+		// storage one (sent on earlier hits); either validates.
+		etag := hdrs["ETag"]
+		if meta != nil && meta.ETag != "" && notModified(r, meta.ETag, lm) {
+			etag = meta.ETag
+		}
+		if notModified(r, etag, lm) {
+			rc.Close()
+			writeNotModified(w, etag, lm)
+			return true
+		}
+	}
+	if s.redirectToStorage(ctx, w, r, key, size) {
+		rc.Close()
+		return true
+	}
+	if c := s.conf(); c.VerifyOnRead && meta != nil && !meta.Neg && meta.HasBody() {
+		vrc, err := verifyCached(rc, size, *meta, func() {
+			if c.IntegrityMismatch == IntegrityMismatchServe {
+				log.Printf("integrity: %s does not match its meta, served anyway", key)
+				return
+			}
+			log.Printf("integrity: %s does not match its meta, served before the check finished; evicting", key)
+			wctx, cancel := s.writeContext(ctx)
+			defer cancel()
+			s.dropCorrupt(wctx, key)
+		})
+		switch {
+		case errors.Is(err, errIntegrity) && c.IntegrityMismatch == IntegrityMismatchServe:
+			log.Printf("integrity: %s does not match its meta, serving anyway", key)
+		case errors.Is(err, errIntegrity) && c.IntegrityMismatch == IntegrityMismatchFail:
+			vrc.Close()
+			log.Printf("integrity: %s does not match its meta", key)
+			http.Error(w, "cached object failed integrity check", http.StatusBadGateway)
+			return true
+		case errors.Is(err, errIntegrity):
+			vrc.Close()
+			log.Printf("integrity: %s does not match its meta, evicting", key)
+			s.dropCorrupt(ctx, key)
+			return false
+		case err != nil:
+			return false
+		}
+		rc = vrc
+	}
+	if s.compressible(hdrs["Content-Type"], int(size)) {
+		w.Header().Add("Vary", "Accept-Encoding")
+		for _, enc := range s.acceptedEncodings(r) {
+			vrc, vsize, vhdrs, err := s.Store.GetObject(ctx, cache.VariantKey(key, enc))
+			if err != nil {
+				continue
+			}
+			rc.Close()
+			rc, size, hdrs = vrc, vsize, vhdrs
+			w.Header().Set("Content-Encoding", enc)
+			break
+		}
+	}
 	defer rc.Close()
+	if s.conf().VaryLanguage {
+		w.Header().Add("Vary", "Accept-Language")
+	}
+	s.setTTLRemaining(w, meta)
+	if meta != nil {
+		replayHeaders(w, meta.Headers)
+		if meta.ContentLanguage != "" {
+			w.Header().Set("Content-Language", meta.ContentLanguage)
+		}
+	}
 	for k, v := range hdrs {
 		if v != "" {
 			w.Header().Set(k, v)
@@ -255,13 +1388,15 @@ func (s *Server) serveFromCache(ctx context.Context, w http.ResponseWriter, key
 	}
 	w.Header().Set("Content-Length", strconv.FormatInt(size, 10))
 	w.WriteHeader(http.StatusOK)
-	_, _ = io.Copy(w, rc)
+	_, _ = s.copyBody(w, rc)
+	s.noteUsed(key)
 	return true
 }
 
-// extractHeaders returns Content-Type, ETag, Last-Modified from response headers.
-func extractHeaders(h http.Header) (contentType, etag, lastModified string) {
-	contentType = h.Get("Content-Type")
+// extractHeaders returns Content-Type, ETag, Last-Modified from response
+// headers. See pickContentType for how the Content-Type is chosen.
+func extractHeaders(h http.Header, body []byte, pick string) (contentType, etag, lastModified string) {
+	contentType = pickContentType(h.Values("Content-Type"), body, pick)
 	etag = h.Get("ETag")
 	lastModified = h.Get("Last-Modified")
 	return
@@ -274,19 +1409,36 @@ const (
 	kindNotFound
 	kindUpstreamError
 	kindWroteBody
+	// kindStream: the body is too large to buffer; each client streams its
+	// own copy from upstream.
+	kindStream
 )
 
 type fetched struct {
+	url          string
+	domain       string
+	method       string
 	status       int
+	header       http.Header
 	notModified  bool
 	body         []byte
 	contentType  string
 	etag         string
 	lastModified string
+	// route is fetchOpts.route, for matching per-route rules.
+	route string
+	// checksum is the Meta.Checksum of body, hashed while it was read;
+	// empty for bodies assembled some other way.
+	checksum string
+	// tooLarge marks a 2xx whose body was over fetchOpts.maxBody and was
+	// left unread.
+	tooLarge bool
 }
 
 type fetchResult struct {
 	kind         fetchKind
+	decision     string
+	header       http.Header
 	status       int
 	body         []byte
 	contentType  string
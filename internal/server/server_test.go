@@ -0,0 +1,1522 @@
+package server
+
+import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"context"
+	"crypto/md5"
+	"crypto/tls"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/http/httptrace"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+	"github.com/yourname/raw-cacher-go/internal/config"
+	"github.com/yourname/raw-cacher-go/internal/httpx"
+)
+
+// memStore is an in-memory Store. Meta is kept as JSON objects next to the
+// bodies, as the MinIO store does.
+type memStore struct {
+	mu      sync.Mutex
+	objects map[string]memObject
+	// puts counts PutObject calls per key.
+	puts map[string]int
+}
+
+type memObject struct {
+	data        []byte
+	contentType string
+}
+
+func newMemStore() *memStore {
+	return &memStore{objects: map[string]memObject{}, puts: map[string]int{}}
+}
+
+func (m *memStore) HasObject(ctx context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.objects[key]
+	return ok, nil
+}
+
+func (m *memStore) GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return nil, 0, nil, os.ErrNotExist
+	}
+	return io.NopCloser(strings.NewReader(string(o.data))), int64(len(o.data)), map[string]string{"Content-Type": o.contentType}, nil
+}
+
+func (m *memStore) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memObject{append([]byte(nil), data...), contentType}
+	m.puts[key]++
+	return nil
+}
+
+func (m *memStore) DeleteObject(ctx context.Context, key string) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	delete(m.objects, key)
+	return nil
+}
+
+func (m *memStore) ListKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	m.mu.Lock()
+	var keys []string
+	for k := range m.objects {
+		if strings.HasPrefix(k, prefix) {
+			keys = append(keys, k)
+		}
+	}
+	m.mu.Unlock()
+	sort.Strings(keys)
+	for _, k := range keys {
+		if err := fn(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *memStore) ObjectETag(ctx context.Context, key string) (string, bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	o, ok := m.objects[key]
+	if !ok {
+		return "", false, nil
+	}
+	sum := md5.Sum(o.data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`, true, nil
+}
+
+func (m *memStore) ReadMeta(ctx context.Context, key string) (cache.Meta, bool, error) {
+	var meta cache.Meta
+	m.mu.Lock()
+	o, ok := m.objects[key]
+	m.mu.Unlock()
+	if !ok {
+		return meta, false, nil
+	}
+	if err := json.Unmarshal(o.data, &meta); err != nil {
+		return cache.Meta{}, false, nil
+	}
+	return meta, true, nil
+}
+
+func (m *memStore) WriteMeta(ctx context.Context, key string, meta cache.Meta) error {
+	b, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.objects[key] = memObject{b, "application/json"}
+	return nil
+}
+
+// keys returns the stored keys with prefix, sorted.
+func (m *memStore) keys(prefix string) []string {
+	var out []string
+	_ = m.ListKeys(context.Background(), prefix, func(k string) error {
+		out = append(out, k)
+		return nil
+	})
+	return out
+}
+
+// entryKeys returns the object and meta keys of the plain entry for route
+// on domain.
+func entryKeys(s *Server, domain, route string) (objKey, metaKey string) {
+	v := s.cacheVersion(domain)
+	return cache.ObjectKey(v, domain, route, ""), cache.MetaKey(v, domain, route, "")
+}
+
+// loadConfig loads settings from yaml (and the defaults) the way the proxy
+// does at startup.
+func loadConfig(t testing.TB, yaml string) config.Config {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.yaml")
+	if err := os.WriteFile(path, []byte(yaml), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RAW_CACHER_CONFIG", path)
+	t.Setenv("MINIO_ENDPOINT", "localhost:9000")
+	t.Setenv("MINIO_ACCESS_KEY", "access")
+	t.Setenv("MINIO_SECRET_KEY", "secret")
+	cfg, err := config.Load()
+	if err != nil {
+		t.Fatalf("config.Load: %v", err)
+	}
+	return cfg
+}
+
+// newTestServer returns a Server over a memStore whose upstream requests,
+// for any domain, are answered by upstream.
+func newTestServer(t testing.TB, cfg config.Config, upstream http.Handler) (*Server, *memStore) {
+	t.Helper()
+	ts := httptest.NewTLSServer(upstream)
+	t.Cleanup(ts.Close)
+	tr := ts.Client().Transport.(*http.Transport).Clone()
+	tr.TLSClientConfig.InsecureSkipVerify = true
+	tr.DialContext = func(ctx context.Context, network, _ string) (net.Conn, error) {
+		return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+	}
+	st := newMemStore()
+	s := NewServer(st, cfg)
+	s.Client = &http.Client{Transport: tr}
+	return s, st
+}
+
+// do sends a request for target through s, with headers given as
+// "Name", "value" pairs.
+func do(s http.Handler, method, target string, headers ...string) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(method, target, nil)
+	for i := 0; i+1 < len(headers); i += 2 {
+		r.Header.Set(headers[i], headers[i+1])
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, r)
+	return w
+}
+
+func TestConditionalOnMiss(t *testing.T) {
+	const etag = `"v1"`
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	tests := []struct {
+		name    string
+		enabled bool
+		header  []string
+		want    int
+	}{
+		{"matching If-None-Match", true, []string{"If-None-Match", etag}, http.StatusNotModified},
+		{"weak If-None-Match", true, []string{"If-None-Match", `W/"v1"`}, http.StatusNotModified},
+		{"other If-None-Match", true, []string{"If-None-Match", `"v0"`}, http.StatusOK},
+		{"matching If-Modified-Since", true, []string{"If-Modified-Since", lastModified}, http.StatusNotModified},
+		{"no validators", true, nil, http.StatusOK},
+		{"disabled", false, []string{"If-None-Match", etag}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "")
+			cfg.ConditionalOnMiss = tt.enabled
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("ETag", etag)
+				w.Header().Set("Last-Modified", lastModified)
+				_, _ = io.WriteString(w, "body")
+			}))
+			w := do(s, http.MethodGet, "/example.com/a.txt", tt.header...)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusNotModified && w.Body.Len() != 0 {
+				t.Errorf("304 has a body: %q", w.Body)
+			}
+			if len(st.keys("")) == 0 {
+				t.Error("miss wasn't stored")
+			}
+		})
+	}
+}
+
+// storageETagStore reports the ETag `"storage"` for every object, as S3
+// reports its own ETag alongside the upstream one kept in meta.
+type storageETagStore struct{ *memStore }
+
+func (s storageETagStore) GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error) {
+	rc, size, hdrs, err := s.memStore.GetObject(ctx, key)
+	if err == nil {
+		hdrs["ETag"] = `"storage"`
+	}
+	return rc, size, hdrs, err
+}
+
+func TestConditionalOnHit(t *testing.T) {
+	const etag = `"v1"`
+	const lastModified = "Mon, 02 Jan 2006 15:04:05 GMT"
+	tests := []struct {
+		name    string
+		enabled bool
+		header  []string
+		want    int
+	}{
+		{"upstream ETag", true, []string{"If-None-Match", etag}, http.StatusNotModified},
+		{"weak upstream ETag", true, []string{"If-None-Match", `W/"v1"`}, http.StatusNotModified},
+		{"storage ETag", true, []string{"If-None-Match", `"storage"`}, http.StatusNotModified},
+		{"other ETag", true, []string{"If-None-Match", `"v0"`}, http.StatusOK},
+		{"If-Modified-Since matches", true, []string{"If-Modified-Since", lastModified}, http.StatusNotModified},
+		{"modified since", true, []string{"If-Modified-Since", "Sun, 01 Jan 2006 15:04:05 GMT"}, http.StatusOK},
+		{"no validators", true, nil, http.StatusOK},
+		{"disabled", false, []string{"If-None-Match", etag}, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "")
+			cfg.ConditionalOnHit = tt.enabled
+			var fetches atomic.Int32
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				w.Header().Set("ETag", etag)
+				w.Header().Set("Last-Modified", lastModified)
+				_, _ = io.WriteString(w, "body")
+			}))
+			s.Store = storageETagStore{st}
+			do(s, http.MethodGet, "/example.com/a.txt")
+			w := do(s, http.MethodGet, "/example.com/a.txt", tt.header...)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusNotModified {
+				if w.Body.Len() != 0 {
+					t.Errorf("304 has a body: %q", w.Body)
+				}
+				if w.Header().Get("ETag") == "" {
+					t.Error("304 without an ETag")
+				}
+			} else if w.Body.String() != "body" {
+				t.Errorf("body = %q", w.Body)
+			}
+			if n := fetches.Load(); n != 1 {
+				t.Errorf("%d upstream fetches, want only the miss", n)
+			}
+		})
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	tests := []struct {
+		name   string
+		yaml   string
+		domain string
+		want   time.Duration
+	}{
+		{"global", "upstream_timeout: 20\n", "example.com", 20 * time.Second},
+		{"domain override", "upstream_timeout: 20\ndomains:\n  slow.example.com:\n    upstream_timeout: 180\n", "slow.example.com", 180 * time.Second},
+		{"other domain", "upstream_timeout: 20\ndomains:\n  slow.example.com:\n    upstream_timeout: 180\n", "example.com", 20 * time.Second},
+		{"zero keeps a default", "upstream_timeout: 0\n", "example.com", httpx.DefaultTimeout},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, tt.yaml), http.NotFoundHandler())
+			if got := s.upstreamTimeout(tt.domain); got != tt.want {
+				t.Errorf("upstreamTimeout(%q) = %v, want %v", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestFetchDeadline(t *testing.T) {
+	tests := []struct {
+		name    string
+		timeout time.Duration
+		wantErr bool
+	}{
+		{"slow origin, long deadline", 5 * time.Second, false},
+		{"fast-fail deadline", 50 * time.Millisecond, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, ""), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(300 * time.Millisecond):
+				case <-r.Context().Done():
+				}
+				_, _ = io.WriteString(w, "late")
+			}))
+			o := s.fetchOpts("example.com")
+			o.timeout = tt.timeout
+			start := time.Now()
+			fr, err := download(context.Background(), s.Client, "https://example.com/a", cache.Meta{}, o)
+			if tt.wantErr {
+				if !errors.Is(err, context.DeadlineExceeded) {
+					t.Fatalf("err = %v, want a deadline error", err)
+				}
+				if d := time.Since(start); d > 250*time.Millisecond {
+					t.Errorf("took %v to time out", d)
+				}
+				return
+			}
+			if err != nil || string(fr.body) != "late" {
+				t.Fatalf("download = %q, %v", fr.body, err)
+			}
+		})
+	}
+}
+
+// flakyStore fails the first fails PutObject calls.
+type flakyStore struct {
+	*memStore
+	fails int
+}
+
+func (f *flakyStore) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	f.mu.Lock()
+	failing := f.fails > 0
+	f.fails--
+	f.mu.Unlock()
+	if failing {
+		return errors.New("storage unavailable")
+	}
+	return f.memStore.PutObject(ctx, key, data, contentType)
+}
+
+func TestStorageWriteRetry(t *testing.T) {
+	tests := []struct {
+		name       string
+		fails      int
+		serve      bool
+		want       int
+		wantStored bool
+	}{
+		{"succeeds on retry", 2, false, http.StatusOK, true},
+		{"exhausted, served uncached", 5, true, http.StatusOK, false},
+		{"exhausted", 5, false, http.StatusBadGateway, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "storage_write_retries: 2\nstorage_write_backoff_ms: 1\n")
+			cfg.ServeOnWriteFailure = tt.serve
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "body")
+			}))
+			s.Store = &flakyStore{memStore: st, fails: tt.fails}
+			w := do(s, http.MethodGet, "/example.com/a.txt")
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusOK && w.Body.String() != "body" {
+				t.Errorf("body = %q", w.Body)
+			}
+			objKey, _ := entryKeys(s, "example.com", "a.txt")
+			if got := st.puts[objKey] > 0; got != tt.wantStored {
+				t.Errorf("stored = %v, want %v", got, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestTTLNoValidators(t *testing.T) {
+	tests := []struct {
+		name   string
+		yaml   string
+		header []string
+		want   int
+	}{
+		{"no validators", "ttl_no_validators: 86400\n", nil, 86400},
+		{"etag", "ttl_no_validators: 86400\n", []string{"ETag", `"v1"`}, 3600},
+		{"last-modified", "ttl_no_validators: 86400\n", []string{"Last-Modified", "Mon, 02 Jan 2006 15:04:05 GMT"}, 3600},
+		{"floor below default", "ttl_no_validators: 60\n", nil, 3600},
+		{"unset", "", nil, 3600},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				for i := 0; i+1 < len(tt.header); i += 2 {
+					w.Header().Set(tt.header[i], tt.header[i+1])
+				}
+				_, _ = io.WriteString(w, "body")
+			}))
+			if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			_, metaKey := entryKeys(s, "example.com", "a.txt")
+			meta, ok, _ := st.ReadMeta(context.Background(), metaKey)
+			if !ok {
+				t.Fatal("no meta stored")
+			}
+			if meta.TTL != tt.want {
+				t.Errorf("TTL = %d, want %d", meta.TTL, tt.want)
+			}
+		})
+	}
+}
+
+// slowStore delays PutObject by delay and fails it if ctx is done by then.
+type slowStore struct {
+	*memStore
+	delay time.Duration
+}
+
+func (s *slowStore) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	time.Sleep(s.delay)
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	return s.memStore.PutObject(ctx, key, data, contentType)
+}
+
+func TestRequestTimeout(t *testing.T) {
+	tests := []struct {
+		name          string
+		upstreamDelay time.Duration
+		writeDelay    time.Duration
+		want          int
+		wantStored    bool
+	}{
+		{"fast", 0, 0, http.StatusOK, true},
+		{"slow upstream", 3 * time.Second, 0, http.StatusGatewayTimeout, false},
+		{"slow write outlives the request", 0, 1200 * time.Millisecond, http.StatusOK, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, "request_timeout: 1\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				select {
+				case <-time.After(tt.upstreamDelay):
+				case <-r.Context().Done():
+					return
+				}
+				_, _ = io.WriteString(w, "body")
+			}))
+			s.Store = &slowStore{memStore: st, delay: tt.writeDelay}
+			start := time.Now()
+			w := do(s, http.MethodGet, "/example.com/a.txt")
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if d := time.Since(start); tt.want == http.StatusGatewayTimeout && d > 2*time.Second {
+				t.Errorf("timed out after %v", d)
+			}
+			objKey, _ := entryKeys(s, "example.com", "a.txt")
+			if got := st.puts[objKey] > 0; got != tt.wantStored {
+				t.Errorf("stored = %v, want %v", got, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestDisableHTTP2Option(t *testing.T) {
+	tests := []struct {
+		name   string
+		yaml   string
+		domain string
+		want   bool
+	}{
+		{"default", "", "example.com", false},
+		{"global", "disable_http2: true\n", "example.com", true},
+		{"domain", "domains:\n  h1.example.com:\n    disable_http2: true\n", "h1.example.com", true},
+		{"other domain", "domains:\n  h1.example.com:\n    disable_http2: true\n", "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, tt.yaml), http.NotFoundHandler())
+			if got := s.clientOptions(tt.domain).DisableHTTP2; got != tt.want {
+				t.Errorf("DisableHTTP2 for %s = %v, want %v", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTLSServerNameOption(t *testing.T) {
+	const yaml = "domains:\n  mirror.example.com:\n    tls_server_name: origin.example.com\n"
+	tests := []struct {
+		domain string
+		want   string
+	}{
+		{"mirror.example.com", "origin.example.com"},
+		{"example.com", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, yaml), http.NotFoundHandler())
+			if got := s.clientOptions(tt.domain).ServerName; got != tt.want {
+				t.Errorf("ServerName for %s = %q, want %q", tt.domain, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestNegativeBody(t *testing.T) {
+	const payload = `{"error":"not_found","id":42}`
+	tests := []struct {
+		name     string
+		max      int
+		wantBody string
+		wantType string
+	}{
+		{"replayed", 1024, payload, "application/json"},
+		{"over the bound", 8, "Upstream negative-cached 404\n", "text/plain; charset=utf-8"},
+		{"disabled", 0, "Upstream negative-cached 404\n", "text/plain; charset=utf-8"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "")
+			cfg.NegativeBodyMaxBytes = tt.max
+			var fetches int
+			s, _ := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches++
+				w.Header().Set("Content-Type", "application/json")
+				w.WriteHeader(http.StatusNotFound)
+				_, _ = io.WriteString(w, payload)
+			}))
+			do(s, http.MethodGet, "/example.com/missing.json")
+			w := do(s, http.MethodGet, "/example.com/missing.json")
+			if fetches != 1 {
+				t.Fatalf("%d upstream fetches, want a negative hit", fetches)
+			}
+			if w.Code != http.StatusNotFound || w.Body.String() != tt.wantBody {
+				t.Errorf("negative hit = %d %q, want 404 %q", w.Code, w.Body, tt.wantBody)
+			}
+			if got := w.Header().Get("Content-Type"); got != tt.wantType {
+				t.Errorf("Content-Type = %q, want %q", got, tt.wantType)
+			}
+		})
+	}
+}
+
+func TestNegativeTTLs(t *testing.T) {
+	const yaml = "ttl_404: 60\nnegative_ttls:\n  503: 5\n  410: 3600\n"
+	tests := []struct {
+		name    string
+		status  int
+		wantNeg bool
+		wantTTL int
+	}{
+		{"transient", http.StatusServiceUnavailable, true, 5},
+		{"not found", http.StatusNotFound, true, 60},
+		{"gone", http.StatusGone, true, 3600},
+		{"unlisted", http.StatusInternalServerError, false, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				http.Error(w, "nope", tt.status)
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			_, metaKey := entryKeys(s, "example.com", "a.txt")
+			meta, ok, _ := st.ReadMeta(context.Background(), metaKey)
+			if neg := ok && meta.Neg; neg != tt.wantNeg {
+				t.Fatalf("negative entry = %v, want %v", neg, tt.wantNeg)
+			}
+			if meta.TTL != tt.wantTTL {
+				t.Errorf("negative TTL = %d, want %d", meta.TTL, tt.wantTTL)
+			}
+		})
+	}
+}
+
+func TestDomainHeaders(t *testing.T) {
+	const yaml = `access_log: true
+store_headers: true
+domains:
+  api.example.com:
+    headers:
+      X-Api-Key: k-123-secret
+      Authorization: Bearer svc-secret
+`
+	tests := []struct {
+		name     string
+		domain   string
+		wantSent bool
+	}{
+		{"configured origin", "api.example.com", true},
+		{"other origin", "example.com", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got http.Header
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				got = r.Header.Clone()
+				mu.Unlock()
+				_, _ = io.WriteString(w, "body")
+			}))
+			var logs strings.Builder
+			prev := log.Writer()
+			log.SetOutput(&logs)
+			defer log.SetOutput(prev)
+
+			h := s.AccessLog(s)
+			w := do(h, http.MethodGet, "/"+tt.domain+"/a.json")
+			hit := do(h, http.MethodGet, "/"+tt.domain+"/a.json")
+
+			mu.Lock()
+			sent := got.Get("X-Api-Key") == "k-123-secret" && got.Get("Authorization") == "Bearer svc-secret"
+			mu.Unlock()
+			if sent != tt.wantSent {
+				t.Errorf("headers sent upstream = %v, want %v", sent, tt.wantSent)
+			}
+			for _, secret := range []string{"k-123-secret", "svc-secret"} {
+				for name, resp := range map[string]*httptest.ResponseRecorder{"miss": w, "hit": hit} {
+					for k, vs := range resp.Header() {
+						if strings.Contains(strings.Join(vs, ","), secret) {
+							t.Errorf("%s response reflects %s in %s", name, secret, k)
+						}
+					}
+				}
+				if strings.Contains(logs.String(), secret) {
+					t.Errorf("%s logged", secret)
+				}
+				for _, k := range st.keys("") {
+					if strings.Contains(string(st.objects[k].data), secret) {
+						t.Errorf("%s stored in %s", secret, k)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestAliases(t *testing.T) {
+	const yaml = "aliases:\n  npm: registry.npmjs.org\n  gh: raw.githubusercontent.com/acme/\n"
+	tests := []struct {
+		name                  string
+		path, query           string
+		wantDomain, wantRoute string
+		wantURL               string
+		direct                string
+	}{
+		{"domain alias", "/npm/react", "", "registry.npmjs.org", "react", "https://registry.npmjs.org/react", "/registry.npmjs.org/react"},
+		{"prefix alias", "/gh/tools/main/x.sh", "v=2", "raw.githubusercontent.com", "acme/tools/main/x.sh", "https://raw.githubusercontent.com/acme/tools/main/x.sh?v=2", "/raw.githubusercontent.com/acme/tools/main/x.sh?v=2"},
+		{"not an alias", "/npmjs.org/react", "", "npmjs.org", "react", "https://npmjs.org/react", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, yaml)
+			domain, route, url, err := parseAndBuildUpstream(tt.path, tt.query, cfg.Aliases)
+			if err != nil || domain != tt.wantDomain || route != tt.wantRoute || url != tt.wantURL {
+				t.Fatalf("parseAndBuildUpstream = %q, %q, %q, %v", domain, route, url, err)
+			}
+			if tt.direct == "" {
+				return
+			}
+
+			// The alias and the direct form share one entry.
+			var fetches atomic.Int32
+			s, _ := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				_, _ = io.WriteString(w, r.URL.RequestURI())
+			}))
+			target := tt.path
+			if tt.query != "" {
+				target += "?" + tt.query
+			}
+			a := do(s, http.MethodGet, target)
+			d := do(s, http.MethodGet, tt.direct)
+			if a.Code != http.StatusOK || a.Body.String() != d.Body.String() {
+				t.Errorf("alias got %d %q, direct %q", a.Code, a.Body, d.Body)
+			}
+			if n := fetches.Load(); n != 1 {
+				t.Errorf("%d upstream fetches, want 1", n)
+			}
+		})
+	}
+}
+
+func TestVerifyStoreETag(t *testing.T) {
+	tests := []struct {
+		name        string
+		verify      bool
+		replace     bool
+		wantFetches int32
+		wantBody    string
+	}{
+		{"untouched", true, false, 1, "origin"},
+		{"replaced out-of-band", true, true, 2, "origin"},
+		{"replaced, check off", false, true, 1, "tampered"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "")
+			cfg.VerifyStoreETag = tt.verify
+			var fetches atomic.Int32
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				_, _ = io.WriteString(w, "origin")
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			if tt.replace {
+				objKey, _ := entryKeys(s, "example.com", "a.txt")
+				_ = st.PutObject(context.Background(), objKey, []byte("tampered"), "text/plain")
+			}
+			w := do(s, http.MethodGet, "/example.com/a.txt")
+			if w.Body.String() != tt.wantBody {
+				t.Errorf("body = %q, want %q", w.Body, tt.wantBody)
+			}
+			if n := fetches.Load(); n != tt.wantFetches {
+				t.Errorf("%d upstream fetches, want %d", n, tt.wantFetches)
+			}
+		})
+	}
+}
+
+func TestInvalidRoute(t *testing.T) {
+	tests := []struct {
+		name   string
+		target string
+		want   int
+	}{
+		{"null byte", "/example.com/a%00b.txt", http.StatusBadRequest},
+		{"newline", "/example.com/a%0Ab.txt", http.StatusBadRequest},
+		{"control char in domain", "/exam%01ple.com/a.txt", http.StatusBadRequest},
+		{"backslash", "/example.com/a%5Cb.txt", http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			s, st := newTestServer(t, loadConfig(t, ""), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				_, _ = io.WriteString(w, "ok")
+			}))
+			if w := do(s, http.MethodGet, tt.target); w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if tt.want == http.StatusBadRequest && (fetches.Load() != 0 || len(st.keys("")) != 0) {
+				t.Errorf("rejected request fetched %d times, stored %v", fetches.Load(), st.keys(""))
+			}
+		})
+	}
+}
+
+func TestDecompressionLimit(t *testing.T) {
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write(bytes.Repeat([]byte{'a'}, 1<<20))
+	_ = zw.Close()
+	tests := []struct {
+		name       string
+		yaml       string
+		wantStatus int // 0: the response is cut off
+		wantStored bool
+	}{
+		{"under the limit", "max_decompressed_bytes: 2097152\n", http.StatusOK, true},
+		{"over the limit", "max_decompressed_bytes: 65536\n", http.StatusBadGateway, false},
+		{"no limit", "max_decompressed_bytes: 0\n", http.StatusOK, true},
+		{"over the limit, streamed", "max_decompressed_bytes: 65536\nmax_object_bytes: 1024\n", 0, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Encoding", "gzip")
+				w.Header().Set("Content-Type", "text/plain")
+				_, _ = w.Write(gz.Bytes())
+			}))
+			srv := httptest.NewServer(s)
+			defer srv.Close()
+			resp, err := http.Get(srv.URL + "/example.com/bomb.txt")
+			var n int64
+			if err == nil {
+				n, err = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+			switch {
+			case tt.wantStatus == 0:
+				if err == nil {
+					t.Errorf("streamed %d bytes without error", n)
+				}
+			case err != nil:
+				t.Fatalf("GET: %v", err)
+			case resp.StatusCode != tt.wantStatus:
+				t.Errorf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			case tt.wantStatus == http.StatusOK && n != 1<<20:
+				t.Errorf("body of %d bytes, want %d", n, 1<<20)
+			}
+			objKey, _ := entryKeys(s, "example.com", "bomb.txt")
+			st.mu.Lock()
+			_, stored := st.objects[objKey]
+			st.mu.Unlock()
+			if stored != tt.wantStored {
+				t.Errorf("stored %v, want %v", stored, tt.wantStored)
+			}
+		})
+	}
+}
+
+func TestMaxObjectBytes(t *testing.T) {
+	const yaml = `debug_headers: true
+max_object_bytes: 64
+domains:
+  releases.example.com:
+    max_object_bytes: 1048576
+  api.example.com:
+    max_object_bytes: 16
+`
+	tests := []struct {
+		name       string
+		domain     string
+		size       int
+		chunked    bool // no Content-Length, so the limit is found reading
+		wantStored bool
+	}{
+		{"api, under its limit", "api.example.com", 16, false, true},
+		{"api, over its limit", "api.example.com", 17, false, false},
+		{"api, over its limit, chunked", "api.example.com", 17, true, false},
+		{"releases, over the global limit", "releases.example.com", 4096, false, true},
+		{"releases, over its limit", "releases.example.com", 1<<20 + 1, false, false},
+		{"releases, over its limit, chunked", "releases.example.com", 1<<20 + 1, true, false},
+		{"global, under", "example.com", 64, false, true},
+		{"global, over", "example.com", 65, true, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			body := bytes.Repeat([]byte{'x'}, tt.size)
+			var fetches atomic.Int32
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				if !tt.chunked {
+					w.Header().Set("Content-Length", fmt.Sprint(len(body)))
+				}
+				_, _ = w.Write(body)
+			}))
+			for i := 0; i < 2; i++ {
+				w := do(s, http.MethodGet, "/"+tt.domain+"/file.bin")
+				if w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), body) {
+					t.Fatalf("request %d: status %d, %d of %d bytes", i, w.Code, w.Body.Len(), len(body))
+				}
+				if d := w.Header().Get("X-Cache-Decision"); !tt.wantStored && d != decisionPassThrough {
+					t.Errorf("request %d: decision %q, want %q", i, d, decisionPassThrough)
+				}
+			}
+			objKey, _ := entryKeys(s, tt.domain, "file.bin")
+			if stored, _ := st.HasObject(context.Background(), objKey); stored != tt.wantStored {
+				t.Errorf("stored %v, want %v", stored, tt.wantStored)
+			}
+			// A stored body is a hit the second time. For one too large,
+			// each request abandons the fetch that finds it so and streams
+			// from a second one.
+			want := int32(1)
+			if !tt.wantStored {
+				want = 4
+			}
+			if n := fetches.Load(); n != want {
+				t.Errorf("%d upstream fetches, want %d", n, want)
+			}
+		})
+	}
+}
+
+func TestFetchPatience(t *testing.T) {
+	tests := []struct {
+		name         string
+		patienceMS   int
+		delay        time.Duration
+		primed       bool
+		wantBody     string
+		wantDecision string
+	}{
+		{"slow origin, stale served", 50, 400 * time.Millisecond, true, "v1", decisionStalePatience},
+		{"fast origin", 200, 0, true, "v2", decisionMissFetched},
+		{"disabled", 0, 100 * time.Millisecond, true, "v2", decisionMissFetched},
+		{"nothing stale to serve", 50, 100 * time.Millisecond, false, "v2", decisionMissFetched},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := loadConfig(t, "debug_headers: true\n")
+			cfg.FetchPatienceMS = tt.patienceMS
+			var version atomic.Int32
+			version.Store(1)
+			var delay atomic.Int64
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				time.Sleep(time.Duration(delay.Load()))
+				_, _ = io.WriteString(w, fmt.Sprintf("v%d", version.Load()))
+			}))
+			objKey, metaKey := entryKeys(s, "example.com", "a.txt")
+			if tt.primed {
+				do(s, http.MethodGet, "/example.com/a.txt")
+				m, _, _ := st.ReadMeta(ctx, metaKey)
+				m.CachedAt = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339Nano)
+				_ = st.WriteMeta(ctx, metaKey, m)
+			}
+			version.Store(2)
+			delay.Store(int64(tt.delay))
+
+			start := time.Now()
+			w := do(s, http.MethodGet, "/example.com/a.txt")
+			took := time.Since(start)
+			if w.Code != http.StatusOK || w.Body.String() != tt.wantBody {
+				t.Fatalf("got %d %q, want %q", w.Code, w.Body, tt.wantBody)
+			}
+			if got := w.Header().Get("X-Cache-Decision"); got != tt.wantDecision {
+				t.Errorf("decision %q, want %q", got, tt.wantDecision)
+			}
+			if tt.wantDecision == decisionStalePatience && took >= tt.delay {
+				t.Errorf("stale copy took %v, as long as the fetch", took)
+			}
+
+			// The fetch completes in the background either way.
+			deadline := time.Now().Add(2 * time.Second)
+			for {
+				st.mu.Lock()
+				body := string(st.objects[objKey].data)
+				st.mu.Unlock()
+				if body == "v2" {
+					break
+				}
+				if time.Now().After(deadline) {
+					t.Fatalf("stored body still %q", body)
+				}
+				time.Sleep(10 * time.Millisecond)
+			}
+		})
+	}
+}
+
+func TestLongRouteKeys(t *testing.T) {
+	tests := []struct {
+		name    string
+		route   string
+		wantURL bool
+	}{
+		{"short", "a.txt", false},
+		{"over the key limit", strings.Repeat("segment/", 200) + "f.txt", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			s, st := newTestServer(t, loadConfig(t, ""), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				_, _ = io.WriteString(w, r.URL.Path)
+			}))
+			for i := 0; i < 2; i++ {
+				if w := do(s, http.MethodGet, "/example.com/"+tt.route); w.Code != http.StatusOK || w.Body.String() != "/"+tt.route {
+					t.Fatalf("request %d: %d %.40q", i, w.Code, w.Body)
+				}
+			}
+			if n := fetches.Load(); n != 1 {
+				t.Errorf("%d upstream fetches, want 1", n)
+			}
+			objKey, metaKey := entryKeys(s, "example.com", tt.route)
+			if len(objKey) > cache.MaxKeyLength || len(metaKey) > cache.MaxKeyLength {
+				t.Errorf("keys of %d and %d bytes", len(objKey), len(metaKey))
+			}
+			m, _, err := st.ReadMeta(context.Background(), metaKey)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := m.URL != ""; got != tt.wantURL {
+				t.Errorf("meta URL %q recorded: %v, want %v", m.URL, got, tt.wantURL)
+			}
+			if tt.wantURL && !strings.HasSuffix(m.URL, "/"+tt.route) {
+				t.Errorf("meta URL = %q", m.URL)
+			}
+		})
+	}
+}
+
+func TestStripHeaders(t *testing.T) {
+	const domains = `vary_language: true
+domains:
+  example.com:
+    headers: {Cookie: "a=1", Referer: "https://ref.example", Authorization: "Bearer t"}
+    strip_headers: [%s]
+  other.example.com:
+    headers: {Cookie: "a=1", Referer: "https://ref.example", Authorization: "Bearer t"}
+`
+	tests := []struct {
+		name    string
+		domain  string
+		strip   string
+		absent  []string
+		present []string
+		wantUA  string // "go" for Go's default
+	}{
+		{"stripped", "example.com", "Cookie, Referer, User-Agent", []string{"Cookie", "Referer"}, []string{"Authorization", "Accept-Language"}, ""},
+		{"case insensitive", "example.com", "cookie, REFERER", []string{"Cookie", "Referer"}, []string{"Authorization"}, "go"},
+		{"client header", "example.com", "Accept-Language", []string{"Accept-Language"}, []string{"Cookie", "Referer"}, "go"},
+		{"other domain", "other.example.com", "Cookie, Referer, User-Agent", nil, []string{"Cookie", "Referer", "Authorization", "Accept-Language"}, "go"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got http.Header
+			s, _ := newTestServer(t, loadConfig(t, fmt.Sprintf(domains, tt.strip)), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				got = r.Header.Clone()
+				mu.Unlock()
+				_, _ = io.WriteString(w, "body")
+			}))
+			if w := do(s, http.MethodGet, "/"+tt.domain+"/a.txt", "Accept-Language", "en"); w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for _, h := range tt.absent {
+				if v, ok := got[h]; ok {
+					t.Errorf("%s sent upstream: %q", h, v)
+				}
+			}
+			for _, h := range tt.present {
+				if got.Get(h) == "" {
+					t.Errorf("%s not sent upstream", h)
+				}
+			}
+			if ua := got.Get("User-Agent"); (tt.wantUA == "go") != strings.HasPrefix(ua, "Go-http-client") {
+				t.Errorf("User-Agent = %q", ua)
+			}
+		})
+	}
+}
+
+func TestTLSDowngrade(t *testing.T) {
+	// The origin aborts any handshake offering TLS 1.3.
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "body")
+	}))
+	ts.TLS = &tls.Config{GetConfigForClient: func(hello *tls.ClientHelloInfo) (*tls.Config, error) {
+		for _, v := range hello.SupportedVersions {
+			if v == tls.VersionTLS13 {
+				return nil, errors.New("no TLS 1.3 here")
+			}
+		}
+		return nil, nil
+	}}
+	ts.Config.ErrorLog = log.New(io.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+	clientFor := func(maxVersion uint16) *http.Client {
+		return &http.Client{Transport: &http.Transport{
+			TLSClientConfig: &tls.Config{InsecureSkipVerify: true, MaxVersion: maxVersion},
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, ts.Listener.Addr().String())
+			},
+		}}
+	}
+
+	tests := []struct {
+		name       string
+		yaml       string
+		wantStatus int
+	}{
+		{"downgraded", "domains:\n  example.com:\n    tls_downgrade: true\n", http.StatusOK},
+		{"no downgrade", "", http.StatusBadGateway},
+		{"1.3 required", "domains:\n  example.com:\n    tls_downgrade: true\n    tls_min_version: \"1.3\"\n", http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, tt.yaml), http.NotFoundHandler())
+			// Stand in for the clients httpx.NewClient would build, which
+			// don't trust the test certificate.
+			opts := s.clientOptions("example.com")
+			s.Client = clientFor(opts.MaxVersion)
+			if opts != (httpx.Options{}) {
+				s.clients.Store(opts, clientFor(opts.MaxVersion))
+			}
+			if down, ok := opts.Downgrade(); ok {
+				s.clients.Store(down, clientFor(down.MaxVersion))
+			}
+			if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", w.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+// failReused is a transport that completes a request on a reused
+// connection and then reports err instead of the response, as if the
+// origin had dropped the pooled connection mid-exchange. It fails once.
+type failReused struct {
+	*http.Transport
+	err    error
+	failed atomic.Bool
+}
+
+func (f *failReused) RoundTrip(r *http.Request) (*http.Response, error) {
+	var reused bool
+	trace := &httptrace.ClientTrace{GotConn: func(info httptrace.GotConnInfo) {
+		reused = info.Reused
+		if t := httptrace.ContextClientTrace(r.Context()); t != nil && t.GotConn != nil {
+			t.GotConn(info)
+		}
+	}}
+	resp, err := f.Transport.RoundTrip(r.WithContext(httptrace.WithClientTrace(r.Context(), trace)))
+	if err != nil || !reused || f.failed.Swap(true) {
+		return resp, err
+	}
+	resp.Body.Close()
+	return nil, f.err
+}
+
+func TestReusedConnReset(t *testing.T) {
+	reset := &net.OpError{Op: "read", Net: "tcp", Err: os.NewSyscallError("read", syscall.ECONNRESET)}
+	pipe := &net.OpError{Op: "write", Net: "tcp", Err: os.NewSyscallError("write", syscall.EPIPE)}
+	tests := []struct {
+		name         string
+		method       string
+		err          error
+		wantErr      bool
+		wantRequests int32 // including the first, which pools the connection
+	}{
+		{"GET reset", http.MethodGet, reset, false, 3},
+		{"HEAD reset", http.MethodHead, reset, false, 3},
+		{"GET broken pipe", http.MethodGet, pipe, false, 3},
+		{"POST reset not retried", http.MethodPost, reset, true, 2},
+		{"EOF not retried", http.MethodGet, io.ErrUnexpectedEOF, true, 2},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var requests atomic.Int32
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				requests.Add(1)
+				_, _ = io.WriteString(w, "ok")
+			}))
+			defer ts.Close()
+			client := &http.Client{Transport: &failReused{Transport: &http.Transport{}, err: tt.err}}
+			defer client.CloseIdleConnections()
+			ctx := context.Background()
+			o := fetchOpts{domain: "example.com"}
+			if tt.method == http.MethodPost {
+				o.body = []byte("q")
+			}
+			if _, err := fetchUpstream(ctx, client, tt.method, ts.URL+"/a.txt", cache.Meta{}, o); err != nil {
+				t.Fatalf("first fetch: %v", err)
+			}
+			fr, err := fetchUpstream(ctx, client, tt.method, ts.URL+"/a.txt", cache.Meta{}, o)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("fetch after reset: err = %v, want error %v", err, tt.wantErr)
+			}
+			if err == nil && fr.status != http.StatusOK {
+				t.Errorf("status %d", fr.status)
+			}
+			if n := requests.Load(); n != tt.wantRequests {
+				t.Errorf("origin saw %d requests, want %d", n, tt.wantRequests)
+			}
+		})
+	}
+}
+
+func TestConnTuningOptions(t *testing.T) {
+	const yaml = "upstream_idle_conn_timeout: 20\nupstream_keepalive: 10\ndomains:\n  flaky.example.com:\n    idle_conn_timeout: 5\n  partial.example.com:\n    keepalive: 3\n"
+	tests := []struct {
+		domain              string
+		wantIdle, wantAlive time.Duration
+	}{
+		{"example.com", 20 * time.Second, 10 * time.Second},
+		{"flaky.example.com", 5 * time.Second, 10 * time.Second},
+		{"partial.example.com", 20 * time.Second, 3 * time.Second},
+	}
+	for _, tt := range tests {
+		t.Run(tt.domain, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, yaml), http.NotFoundHandler())
+			o := s.clientOptions(tt.domain)
+			if o.IdleConnTimeout != tt.wantIdle || o.KeepAlive != tt.wantAlive {
+				t.Errorf("idle %v, keep-alive %v; want %v, %v", o.IdleConnTimeout, o.KeepAlive, tt.wantIdle, tt.wantAlive)
+			}
+		})
+	}
+}
+
+func TestKeyDomains(t *testing.T) {
+	const yaml = "key_domains:\n  cdn1.example.com: cdn.example.com\n  CDN2.example.com: CDN.example.com\n"
+	tests := []struct {
+		name        string
+		first, then string
+		wantHosts   []string // upstream requests, in order
+	}{
+		{"aliases share", "cdn1.example.com", "cdn2.example.com", []string{"cdn1.example.com"}},
+		{"alias and canonical", "cdn2.example.com", "cdn.example.com", []string{"cdn2.example.com"}},
+		{"canonical first", "cdn.example.com", "cdn1.example.com", []string{"cdn.example.com"}},
+		{"unrelated domain", "cdn1.example.com", "other.example.com", []string{"cdn1.example.com", "other.example.com"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var hosts []string
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				hosts = append(hosts, r.Host)
+				mu.Unlock()
+				_, _ = io.WriteString(w, "from "+r.Host)
+			}))
+			do(s, http.MethodGet, "/"+tt.first+"/lib.js")
+			w := do(s, http.MethodGet, "/"+tt.then+"/lib.js")
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if fmt.Sprint(hosts) != fmt.Sprint(tt.wantHosts) {
+				t.Errorf("upstream saw %v, want %v", hosts, tt.wantHosts)
+			}
+			if want := "from " + tt.wantHosts[len(tt.wantHosts)-1]; w.Body.String() != want {
+				t.Errorf("body %q, want %q", w.Body, want)
+			}
+			if len(tt.wantHosts) == 1 {
+				objKey, _ := entryKeys(s, "cdn.example.com", "lib.js")
+				if ok, _ := st.HasObject(context.Background(), objKey); !ok {
+					t.Errorf("nothing stored under the canonical domain: %v", st.keys("objects/"))
+				}
+			}
+		})
+	}
+}
+
+func TestStatusMap(t *testing.T) {
+	const yaml = "status_map: {403: 404, 404: 410}\nnegative_ttls: {403: 60}\n"
+	tests := []struct {
+		name     string
+		upstream int
+		want     int
+		wantNeg  bool
+	}{
+		{"403 as 404", http.StatusForbidden, http.StatusNotFound, true},
+		{"404 as 410", http.StatusNotFound, http.StatusGone, true},
+		{"unmapped", http.StatusBadGateway, http.StatusBadGateway, false},
+		{"success untouched", http.StatusOK, http.StatusOK, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.upstream)
+				_, _ = io.WriteString(w, "body")
+			}))
+			// The miss, then the (negative) hit, both remapped.
+			for i := 0; i < 2; i++ {
+				if w := do(s, http.MethodGet, "/example.com/a.txt"); w.Code != tt.want {
+					t.Errorf("request %d: status %d, want %d", i, w.Code, tt.want)
+				}
+			}
+			// What is cached keeps the upstream status.
+			_, metaKey := entryKeys(s, "example.com", "a.txt")
+			m, ok, _ := st.ReadMeta(context.Background(), metaKey)
+			if neg := ok && m.Neg; neg != tt.wantNeg {
+				t.Fatalf("negative entry = %v, want %v", neg, tt.wantNeg)
+			}
+			if status := cmp.Or(m.Status, http.StatusNotFound); tt.wantNeg && status != tt.upstream {
+				t.Errorf("cached status %d, want %d", status, tt.upstream)
+			}
+		})
+	}
+}
+
+func TestStreamedChecksum(t *testing.T) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 4096)
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	_, _ = zw.Write(body)
+	_ = zw.Close()
+	tests := []struct {
+		name       string
+		chunked    bool
+		gzipped    bool
+		corrupt    bool // the stored object is altered behind the cache's back
+		wantStatus int
+	}{
+		{"content length", false, false, false, http.StatusOK},
+		{"chunked", true, false, false, http.StatusOK},
+		{"gzip", false, true, false, http.StatusOK},
+		{"chunked gzip", true, true, false, http.StatusOK},
+		{"altered since", true, false, true, http.StatusBadGateway},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			cfg := loadConfig(t, "debug_headers: true\nverify_on_read: true\nintegrity_mismatch: fail\n")
+			s, st := newTestServer(t, cfg, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				out := body
+				if tt.gzipped {
+					out = gz.Bytes()
+					w.Header().Set("Content-Encoding", "gzip")
+				}
+				if !tt.chunked {
+					w.Header().Set("Content-Length", fmt.Sprint(len(out)))
+					_, _ = w.Write(out)
+					return
+				}
+				for len(out) > 0 {
+					n := min(len(out), 1000)
+					_, _ = w.Write(out[:n])
+					w.(http.Flusher).Flush()
+					out = out[n:]
+				}
+			}))
+			if w := do(s, http.MethodGet, "/example.com/a.bin"); w.Code != http.StatusOK || !bytes.Equal(w.Body.Bytes(), body) {
+				t.Fatalf("miss: status %d, %d bytes", w.Code, w.Body.Len())
+			}
+			objKey, metaKey := entryKeys(s, "example.com", "a.bin")
+			m, _, _ := st.ReadMeta(ctx, metaKey)
+			if m.Checksum != cache.Checksum(body) {
+				t.Fatalf("stored checksum %s, want that of the decoded body", m.Checksum)
+			}
+			if tt.corrupt {
+				st.mu.Lock()
+				o := st.objects[objKey]
+				o.data = append([]byte("X"), o.data[1:]...)
+				st.objects[objKey] = o
+				st.mu.Unlock()
+			}
+			w := do(s, http.MethodGet, "/example.com/a.bin")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("hit: status %d, want %d", w.Code, tt.wantStatus)
+			}
+			if tt.wantStatus == http.StatusOK {
+				if d := w.Header().Get("X-Cache-Decision"); d != decisionFreshHit || !bytes.Equal(w.Body.Bytes(), body) {
+					t.Errorf("hit: decision %q, %d bytes", d, w.Body.Len())
+				}
+			}
+		})
+	}
+}
+
+func TestFoldCase(t *testing.T) {
+	const yaml = `ttl_default: 3600
+ttl_rules:
+  - match: '^ci\.example\.com/Docs/'
+    ttl: 60
+domains:
+  ci.example.com:
+    fold_case: true
+`
+	type req struct {
+		path      string
+		wantFetch bool
+		wantTTL   int // of the entry afterwards
+	}
+	tests := []struct {
+		name     string
+		requests []req
+	}{
+		{"case variants share an entry", []req{
+			{"/ci.example.com/Dir/File.TXT", true, 3600},
+			{"/ci.example.com/dir/file.txt", false, 3600},
+			{"/ci.example.com/DIR/FILE.txt", false, 3600},
+		}},
+		{"different paths stay apart", []req{
+			{"/ci.example.com/Dir/File.TXT", true, 3600},
+			{"/ci.example.com/Dir/Other.TXT", true, 3600},
+		}},
+		{"other domain keeps case", []req{
+			{"/example.com/Dir/File.TXT", true, 3600},
+			{"/example.com/dir/file.txt", true, 3600},
+		}},
+		{"rules match the route as requested", []req{
+			{"/ci.example.com/Docs/Guide.html", true, 60},
+			{"/ci.example.com/docs/guide.html", false, 60},
+		}},
+		{"rules miss a differently cased request", []req{
+			{"/ci.example.com/docs/guide.html", true, 3600},
+			{"/ci.example.com/Docs/Guide.html", false, 3600},
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var paths []string
+			var mu sync.Mutex
+			s, st := newTestServer(t, loadConfig(t, yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				paths = append(paths, r.URL.Path)
+				mu.Unlock()
+				_, _ = io.WriteString(w, "body of "+r.URL.Path)
+			}))
+			first := map[string]string{} // folded key route -> body first served
+			for i, rq := range tt.requests {
+				mu.Lock()
+				before := len(paths)
+				mu.Unlock()
+				w := do(s, http.MethodGet, rq.path)
+				domain, route, _ := strings.Cut(strings.TrimPrefix(rq.path, "/"), "/")
+				keyRoute := route
+				if domain == "ci.example.com" {
+					keyRoute = strings.ToLower(route)
+				}
+				if want, ok := first[domain+"/"+keyRoute]; ok && w.Body.String() != want {
+					t.Errorf("request %d: body %q, want %q", i, w.Body, want)
+				}
+				first[domain+"/"+keyRoute] = w.Body.String()
+				mu.Lock()
+				fetched := len(paths) > before
+				if fetched && paths[len(paths)-1] != "/"+route {
+					t.Errorf("request %d: upstream saw %q, want the path as requested", i, paths[len(paths)-1])
+				}
+				mu.Unlock()
+				if fetched != rq.wantFetch {
+					t.Errorf("request %d (%s): fetched %v, want %v", i, rq.path, fetched, rq.wantFetch)
+				}
+				_, metaKey := entryKeys(s, domain, keyRoute)
+				if m, ok, _ := st.ReadMeta(context.Background(), metaKey); !ok || m.TTL != rq.wantTTL {
+					t.Errorf("request %d: entry TTL %d (found %v), want %d", i, m.TTL, ok, rq.wantTTL)
+				}
+			}
+		})
+	}
+}
+
+func TestMetaWithoutObject(t *testing.T) {
+	tests := []struct {
+		name         string
+		dropObject   bool
+		expire       bool
+		wantCond     bool // upstream saw a conditional request
+		wantDecision string
+		wantBody     string
+		wantFetches  int32
+	}{
+		{"fresh meta, object gone", true, false, false, decisionMissFetched, "v2", 2},
+		{"expired meta, object gone", true, true, false, decisionMissFetched, "v2", 2},
+		{"expired meta, object kept", false, true, true, decisionRevalidated, "v1", 2},
+		{"fresh, intact", false, false, false, decisionFreshHit, "v1", 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			var fetches atomic.Int32
+			var cond atomic.Bool
+			var body atomic.Value
+			body.Store("v1")
+			s, st := newTestServer(t, loadConfig(t, "debug_headers: true\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				w.Header().Set("ETag", `"v1"`)
+				if r.Header.Get("If-None-Match") != "" {
+					cond.Store(true)
+					w.WriteHeader(http.StatusNotModified)
+					return
+				}
+				_, _ = io.WriteString(w, body.Load().(string))
+			}))
+			do(s, http.MethodGet, "/example.com/a.txt")
+			objKey, metaKey := entryKeys(s, "example.com", "a.txt")
+			if tt.dropObject {
+				_ = st.DeleteObject(ctx, objKey)
+			}
+			if tt.expire {
+				m, _, _ := st.ReadMeta(ctx, metaKey)
+				m.CachedAt = time.Now().Add(-2 * time.Hour).UTC().Format(time.RFC3339Nano)
+				_ = st.WriteMeta(ctx, metaKey, m)
+			}
+			body.Store("v2")
+
+			w := do(s, http.MethodGet, "/example.com/a.txt")
+			if w.Code != http.StatusOK || w.Body.String() != tt.wantBody {
+				t.Fatalf("got %d %q, want %q", w.Code, w.Body, tt.wantBody)
+			}
+			if got := w.Header().Get("X-Cache-Decision"); got != tt.wantDecision {
+				t.Errorf("decision %q, want %q", got, tt.wantDecision)
+			}
+			if cond.Load() != tt.wantCond {
+				t.Errorf("conditional request sent: %v, want %v", cond.Load(), tt.wantCond)
+			}
+			if n := fetches.Load(); n != tt.wantFetches {
+				t.Errorf("%d upstream requests, want %d", n, tt.wantFetches)
+			}
+			// Meta and object agree again.
+			m, _, _ := st.ReadMeta(ctx, metaKey)
+			st.mu.Lock()
+			stored := st.objects[objKey].data
+			st.mu.Unlock()
+			if m.Checksum != cache.Checksum(stored) || string(stored) != tt.wantBody {
+				t.Errorf("object %q with meta checksum %s", stored, m.Checksum)
+			}
+		})
+	}
+}
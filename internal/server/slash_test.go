@@ -0,0 +1,99 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSlashModes(t *testing.T) {
+	tests := []struct {
+		name         string
+		mode         string
+		path         string
+		wantUpstream string
+		wantRoute    string
+	}{
+		{"key, internal", "key", "/example.com/a//b", "/a//b", "a/b"},
+		// Leading slashes never reach the upstream URL, whatever the mode.
+		{"key, leading", "key", "/example.com//a/b", "/a/b", "a/b"},
+		{"key, trailing", "key", "/example.com/a/b//", "/a/b//", "a/b/"},
+		{"all, internal", "all", "/example.com/a///b", "/a/b", "a/b"},
+		{"all, leading", "all", "/example.com//a/b", "/a/b", "a/b"},
+		{"all, trailing", "all", "/example.com/a/b//", "/a/b/", "a/b/"},
+		{"off", "off", "/example.com/a//b", "/a//b", "a//b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var upstreamPath string
+			s, st := newTestServer(t, loadConfig(t, "slash_mode: "+tt.mode+"\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				upstreamPath = r.URL.Path
+				_, _ = io.WriteString(w, "body")
+			}))
+			if w := do(s, http.MethodGet, tt.path); w.Code != http.StatusOK {
+				t.Fatalf("status = %d", w.Code)
+			}
+			if upstreamPath != tt.wantUpstream {
+				t.Errorf("upstream path = %q, want %q", upstreamPath, tt.wantUpstream)
+			}
+			objKey, _ := entryKeys(s, "example.com", tt.wantRoute)
+			if _, ok := st.objects[objKey]; !ok {
+				t.Errorf("no entry at %s; have %s", objKey, strings.Join(st.keys(""), ", "))
+			}
+		})
+	}
+}
+
+func TestTrailingSlash(t *testing.T) {
+	tests := []struct {
+		name         string
+		yaml         string
+		path         string
+		want         int
+		wantLocation string
+		wantRoute    string
+	}{
+		{"strip, normalized", "trailing_slash: strip\n", "/example.com/dir/", http.StatusOK, "", "dir"},
+		{"append, normalized", "trailing_slash: append\n", "/example.com/dir", http.StatusOK, "", "dir/"},
+		{"strip, redirect", "trailing_slash: strip\ntrailing_slash_redirect: true\n", "/example.com/dir/?v=1", http.StatusMovedPermanently, "http://proxy.local/example.com/dir?v=1", ""},
+		{"append, redirect", "trailing_slash: append\ntrailing_slash_redirect: true\n", "/example.com/dir", http.StatusMovedPermanently, "http://proxy.local/example.com/dir/", ""},
+		{"append, redirect, already canonical", "trailing_slash: append\ntrailing_slash_redirect: true\n", "/example.com/dir/", http.StatusOK, "", "dir/"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var fetches atomic.Int32
+			s, st := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fetches.Add(1)
+				_, _ = io.WriteString(w, "body")
+			}))
+			w := do(s, http.MethodGet, "http://proxy.local"+tt.path)
+			if w.Code != tt.want {
+				t.Fatalf("status = %d, want %d", w.Code, tt.want)
+			}
+			if got := w.Header().Get("Location"); got != tt.wantLocation {
+				t.Errorf("Location = %q, want %q", got, tt.wantLocation)
+			}
+			if tt.wantRoute == "" {
+				if n := fetches.Load(); n != 0 {
+					t.Errorf("redirect fetched upstream %d times", n)
+				}
+				return
+			}
+			objKey, _ := entryKeys(s, "example.com", tt.wantRoute)
+			if _, ok := st.objects[objKey]; !ok {
+				t.Errorf("no entry at %s; have %s", objKey, strings.Join(st.keys(""), ", "))
+			}
+			// Both spellings share the entry.
+			other := strings.TrimSuffix(tt.path, "/")
+			if other == tt.path {
+				other += "/"
+			}
+			do(s, http.MethodGet, "http://proxy.local"+other)
+			if n := fetches.Load(); n != 1 {
+				t.Errorf("%d upstream fetches for %s and %s, want 1", n, tt.path, other)
+			}
+		})
+	}
+}
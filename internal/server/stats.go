@@ -0,0 +1,147 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/metrics"
+)
+
+// decisionWriter remembers the cache decision taken for a request so it can
+// be counted once the response is done.
+type decisionWriter struct {
+	http.ResponseWriter
+	decision string
+	// cacheControl, if set, replaces Cache-Control on successful responses
+	// served from or stored in the cache (immutable routes), unless they
+	// already forbid shared caching.
+	cacheControl string
+	wroteHeader  bool
+	// written counts body bytes sent to the client.
+	written int64
+}
+
+func (d *decisionWriter) WriteHeader(code int) {
+	if !d.wroteHeader {
+		d.wroteHeader = true
+		if d.cacheControl != "" && (code == http.StatusOK || code == http.StatusPartialContent || code == http.StatusNotModified) &&
+			cachedDecision(d.decision) && !privateCacheControl(d.Header().Get("Cache-Control")) {
+			d.Header().Set("Cache-Control", d.cacheControl)
+		}
+	}
+	d.ResponseWriter.WriteHeader(code)
+}
+
+func (d *decisionWriter) Write(b []byte) (int, error) {
+	if !d.wroteHeader {
+		d.WriteHeader(http.StatusOK)
+	}
+	n, err := d.ResponseWriter.Write(b)
+	d.written += int64(n)
+	return n, err
+}
+
+// cachedDecision reports whether a response under decision comes from, or
+// was just stored in, the cache. Pass-through and error responses aren't.
+func cachedDecision(decision string) bool {
+	switch decision {
+	case decisionFreshHit, decisionServeIfPresent, decisionRevalidated,
+		decisionStaleRevalidate, decisionStaleIfError, decisionStalePatience,
+		decisionCooldown, decisionReadOnlyStale, decisionMissFetched, decisionBypass:
+		return true
+	}
+	return false
+}
+
+// privateCacheControl reports whether cc keeps a response out of shared
+// caches.
+func privateCacheControl(cc string) bool {
+	for _, d := range strings.Split(cc, ",") {
+		name, _, _ := strings.Cut(strings.TrimSpace(d), "=")
+		if strings.EqualFold(name, "no-store") || strings.EqualFold(name, "private") {
+			return true
+		}
+	}
+	return false
+}
+
+// Unwrap lets http.ResponseController reach Flush/Hijack on the real writer.
+func (d *decisionWriter) Unwrap() http.ResponseWriter { return d.ResponseWriter }
+
+// metricsLabel buckets domain for per-domain metrics: under an allowlist,
+// by the matching entry (so wildcard subdomains share a series), otherwise
+// by the domain itself, capped by metrics_max_domains.
+func (s *Server) metricsLabel(domain string) string {
+	if e, _ := s.allowlistMatch(domain); e != "" {
+		return e
+	}
+	return strings.ToLower(domain)
+}
+
+// recordDecision counts the final decision and bytes served for domain.
+func (s *Server) recordDecision(domain, decision string, written int64) {
+	if s.Stats == nil || decision == "" {
+		return
+	}
+	c := s.Stats.For(s.metricsLabel(domain))
+	c.BytesServed.Add(written)
+	switch decision {
+	case decisionNegativeHit:
+		c.NegativeHits.Add(1)
+	case decisionFreshHit, decisionServeIfPresent, decisionRevalidated,
+		decisionStaleRevalidate, decisionStaleIfError, decisionStalePatience,
+		decisionCooldown, decisionReadOnlyStale:
+		c.Hits.Add(1)
+	default:
+		c.Misses.Add(1)
+	}
+}
+
+// inflightCounter returns the in-flight fetch gauge for domain, or nil
+// without stats.
+func (s *Server) inflightCounter(domain string) *atomic.Int64 {
+	if s.Stats == nil {
+		return nil
+	}
+	return &s.Stats.For(s.metricsLabel(domain)).InFlight
+}
+
+// handleDomainStats serves GET /admin/stats/<domain>: a snapshot of the
+// domain's counters, keyed like /metrics (see metricsLabel).
+func (s *Server) handleDomainStats(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.Header().Set("Allow", http.MethodGet)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	domain := strings.TrimPrefix(r.URL.Path, "/admin/stats/")
+	if domain == "" || strings.Contains(domain, "/") {
+		http.Error(w, "path must be /admin/stats/<domain>", http.StatusBadRequest)
+		return
+	}
+	if s.Stats == nil {
+		http.Error(w, "stats disabled", http.StatusNotImplemented)
+		return
+	}
+	label := s.metricsLabel(domain)
+	c, ok := s.Stats.Lookup(label)
+	if !ok {
+		http.Error(w, "no stats for domain", http.StatusNotFound)
+		return
+	}
+	breaker, left := "closed", s.breakerOpen(domain)
+	if left > 0 {
+		breaker = "open"
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Domain string `json:"domain"`
+		metrics.Snapshot
+		Breaker string `json:"breaker"`
+		// BreakerRetryAfter is how many seconds an open breaker has left.
+		BreakerRetryAfter int `json:"breaker_retry_after,omitempty"`
+	}{label, c.Snapshot(), breaker, int((left + time.Second - 1) / time.Second)})
+}
@@ -0,0 +1,259 @@
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/yourname/raw-cacher-go/internal/metrics"
+)
+
+func TestDomainCounters(t *testing.T) {
+	type counts struct{ hits, misses, neg int64 }
+	tests := []struct {
+		name     string
+		yaml     string
+		max      int
+		requests []string
+		want     map[string]counts
+	}{
+		{
+			"hits and misses", "", 0,
+			[]string{"a.example.com/x", "a.example.com/x", "a.example.com/y", "b.example.com/missing", "b.example.com/missing"},
+			map[string]counts{"a.example.com": {1, 2, 0}, "b.example.com": {0, 1, 1}},
+		},
+		{
+			"bucketed by allowlist entry", "allowed_domains: [\"*.example.com\"]\n", 0,
+			[]string{"a.example.com/x", "b.example.com/x", "b.example.com/x"},
+			map[string]counts{"*.example.com": {1, 2, 0}},
+		},
+		{
+			"cardinality cap", "", 1,
+			[]string{"a.example.com/x", "b.example.com/x", "c.example.com/x", "c.example.com/x"},
+			map[string]counts{"a.example.com": {0, 1, 0}, metrics.OtherDomain: {1, 2, 0}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if strings.HasPrefix(r.URL.Path, "/missing") {
+					http.NotFound(w, r)
+					return
+				}
+				_, _ = io.WriteString(w, "body")
+			}))
+			s.Stats = metrics.NewDomainStats(tt.max)
+			for _, p := range tt.requests {
+				do(s, http.MethodGet, "/"+p)
+			}
+			for label, want := range tt.want {
+				c, ok := s.Stats.Lookup(label)
+				if !ok {
+					t.Errorf("no counters for %s", label)
+					continue
+				}
+				if got := (counts{c.Hits.Load(), c.Misses.Load(), c.NegativeHits.Load()}); got != want {
+					t.Errorf("%s: hits/misses/negative = %v, want %v", label, got, want)
+				}
+			}
+
+			w := do(s.Stats.Handler(), http.MethodGet, "/metrics")
+			for label, want := range tt.want {
+				line := `rawcacher_cache_hits_total{domain="` + label + `"} ` + strconv.FormatInt(want.hits, 10)
+				if !strings.Contains(w.Body.String(), line+"\n") {
+					t.Errorf("/metrics lacks %q", line)
+				}
+			}
+		})
+	}
+}
+
+func TestRecordDecision(t *testing.T) {
+	type counts struct{ hits, misses, neg int64 }
+	tests := []struct {
+		decision string
+		want     counts
+	}{
+		{decisionFreshHit, counts{1, 0, 0}},
+		{decisionRevalidated, counts{1, 0, 0}},
+		{decisionStaleIfError, counts{1, 0, 0}},
+		{decisionStalePatience, counts{1, 0, 0}},
+		{decisionReadOnlyStale, counts{1, 0, 0}},
+		{decisionCooldown, counts{1, 0, 0}},
+		{decisionNegativeHit, counts{0, 0, 1}},
+		{decisionMissFetched, counts{0, 1, 0}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.decision, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, ""), http.NotFoundHandler())
+			s.Stats = metrics.NewDomainStats(0)
+			s.recordDecision("example.com", tt.decision, 4)
+			c, ok := s.Stats.Lookup("example.com")
+			if !ok {
+				t.Fatal("no counters for example.com")
+			}
+			if got := (counts{c.Hits.Load(), c.Misses.Load(), c.NegativeHits.Load()}); got != tt.want {
+				t.Errorf("hits/misses/negative = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDomainStatsEndpoint(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		path        string
+		token       string
+		requests    []string
+		wantStatus  int
+		wantSnap    metrics.Snapshot
+		wantBreaker string
+	}{
+		{"snapshot", http.MethodGet, "/admin/stats/a.example.com", "secret",
+			[]string{"a.example.com/x", "a.example.com/x", "a.example.com/missing", "a.example.com/missing", "b.example.com/x"},
+			http.StatusOK, metrics.Snapshot{Hits: 1, Misses: 2, NegativeHits: 1}, "closed"},
+		{"breaker open", http.MethodGet, "/admin/stats/a.example.com", "secret",
+			[]string{"a.example.com/fail"}, http.StatusOK, metrics.Snapshot{Misses: 1}, "open"},
+		{"no token", http.MethodGet, "/admin/stats/a.example.com", "", []string{"a.example.com/x"}, http.StatusForbidden, metrics.Snapshot{}, ""},
+		{"unknown domain", http.MethodGet, "/admin/stats/c.example.com", "secret", []string{"a.example.com/x"}, http.StatusNotFound, metrics.Snapshot{}, ""},
+		{"no domain", http.MethodGet, "/admin/stats/", "secret", nil, http.StatusBadRequest, metrics.Snapshot{}, ""},
+		{"nested path", http.MethodGet, "/admin/stats/a.example.com/x", "secret", nil, http.StatusBadRequest, metrics.Snapshot{}, ""},
+		{"wrong method", http.MethodPost, "/admin/stats/a.example.com", "secret", nil, http.StatusMethodNotAllowed, metrics.Snapshot{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, "admin_token: secret\nbreaker_failures: 1\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				switch r.URL.Path {
+				case "/missing":
+					http.NotFound(w, r)
+				case "/fail":
+					http.Error(w, "down", http.StatusServiceUnavailable)
+				default:
+					_, _ = io.WriteString(w, "body")
+				}
+			}))
+			s.Stats = metrics.NewDomainStats(0)
+			want := tt.wantSnap
+			for _, p := range tt.requests {
+				w := do(s, http.MethodGet, "/"+p)
+				if strings.HasPrefix(p, "a.example.com/") {
+					want.BytesServed += int64(w.Body.Len())
+				}
+			}
+			var headers []string
+			if tt.token != "" {
+				headers = []string{"Authorization", "Bearer " + tt.token}
+			}
+			w := do(s.AdminHandler(), tt.method, tt.path, headers...)
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if w.Code != http.StatusOK {
+				return
+			}
+			var got struct {
+				Domain string `json:"domain"`
+				metrics.Snapshot
+				Breaker           string `json:"breaker"`
+				BreakerRetryAfter int    `json:"breaker_retry_after"`
+			}
+			if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+			if got.Domain != "a.example.com" || got.Snapshot != want {
+				t.Errorf("%s: %+v, want %+v", got.Domain, got.Snapshot, want)
+			}
+			if got.Breaker != tt.wantBreaker || (got.Breaker == "open") != (got.BreakerRetryAfter > 0) {
+				t.Errorf("breaker %q, retry after %d; want %q", got.Breaker, got.BreakerRetryAfter, tt.wantBreaker)
+			}
+		})
+	}
+}
+
+// TestDomainStatsConcurrent reads /admin/stats/<domain> while requests for
+// that domain and another run; run it with -race. Every snapshot must lie
+// between the previous one and the final totals.
+func TestDomainStatsConcurrent(t *testing.T) {
+	tests := []struct {
+		name    string
+		workers int
+		each    int
+	}{
+		{"few workers", 2, 50},
+		{"many workers", 16, 20},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, "admin_token: secret\n"), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "body")
+			}))
+			s.Stats = metrics.NewDomainStats(0)
+			admin := s.AdminHandler()
+			// Prime both, so every concurrent request is a hit.
+			do(s, http.MethodGet, "/a.example.com/x")
+			do(s, http.MethodGet, "/b.example.com/x")
+
+			var wg sync.WaitGroup
+			for i := 0; i < tt.workers; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for j := 0; j < tt.each; j++ {
+						do(s, http.MethodGet, "/a.example.com/x")
+						do(s, http.MethodGet, "/b.example.com/x")
+					}
+				}()
+			}
+			done := make(chan struct{})
+			var readerErr error
+			var reads int
+			go func() {
+				defer close(done)
+				var prev metrics.Snapshot
+				for {
+					w := do(admin, http.MethodGet, "/admin/stats/a.example.com", "Authorization", "Bearer secret")
+					var snap metrics.Snapshot
+					if err := json.Unmarshal(w.Body.Bytes(), &snap); err != nil || w.Code != http.StatusOK {
+						readerErr = fmt.Errorf("status %d, %v", w.Code, err)
+						return
+					}
+					reads++
+					if snap.Hits < prev.Hits || snap.BytesServed < prev.BytesServed || snap.Misses != 1 {
+						readerErr = fmt.Errorf("snapshot %+v after %+v", snap, prev)
+						return
+					}
+					prev = snap
+					if snap.Hits == int64(tt.workers*tt.each) {
+						return
+					}
+				}
+			}()
+			wg.Wait()
+			<-done
+			if readerErr != nil {
+				t.Fatal(readerErr)
+			}
+			if reads == 0 {
+				t.Fatal("no snapshots read")
+			}
+			total := int64(tt.workers * tt.each)
+			for domain, want := range map[string]metrics.Snapshot{
+				"a.example.com": {Hits: total, Misses: 1, BytesServed: 4 * (total + 1)},
+				"b.example.com": {Hits: total, Misses: 1, BytesServed: 4 * (total + 1)},
+			} {
+				w := do(admin, http.MethodGet, "/admin/stats/"+domain, "Authorization", "Bearer secret")
+				var snap metrics.Snapshot
+				_ = json.Unmarshal(w.Body.Bytes(), &snap)
+				if snap != want {
+					t.Errorf("%s: %+v, want %+v", domain, snap, want)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// Bounds of the pause a sweep takes while storage is slow.
+const (
+	sweepBackoffMin = time.Second
+	sweepBackoffMax = 30 * time.Second
+)
+
+// sweepPacer paces a background walk over the bucket (reconcile, scrub) so
+// it doesn't compete with serving: at most rate objects per second, nothing
+// while paused through /admin/sweep, and a growing pause whenever a storage
+// read takes longer than sweep_max_latency_ms, until reads are fast again.
+type sweepPacer struct {
+	s       *Server
+	name    string
+	tick    *time.Ticker
+	backoff time.Duration
+}
+
+func (s *Server) newSweepPacer(name string, rate int) *sweepPacer {
+	p := &sweepPacer{s: s, name: name}
+	if rate > 0 {
+		p.tick = time.NewTicker(time.Second / time.Duration(rate))
+	}
+	return p
+}
+
+func (p *sweepPacer) stop() {
+	if p.tick != nil {
+		p.tick.Stop()
+	}
+	if p.backoff > 0 {
+		p.s.sweepBackingOff.Add(-1)
+	}
+}
+
+// wait blocks until the walk may touch its next object. latency is how long
+// the walk's last storage read took.
+func (p *sweepPacer) wait(ctx context.Context, latency time.Duration) error {
+	for p.s.sweepPaused.Load() {
+		if err := sleepCtx(ctx, time.Second); err != nil {
+			return err
+		}
+	}
+	if limit := p.s.conf().SweepMaxLatencyMS; limit > 0 && latency > time.Duration(limit)*time.Millisecond {
+		if p.backoff == 0 {
+			p.backoff = sweepBackoffMin
+			p.s.sweepBackingOff.Add(1)
+			log.Printf("%s: storage read took %v, backing off", p.name, latency.Round(time.Millisecond))
+		} else {
+			p.backoff = min(p.backoff*2, sweepBackoffMax)
+		}
+		if err := sleepCtx(ctx, p.backoff); err != nil {
+			return err
+		}
+	} else if p.backoff > 0 {
+		p.backoff = 0
+		p.s.sweepBackingOff.Add(-1)
+		log.Printf("%s: storage latency recovered, resuming", p.name)
+	}
+	if p.tick == nil {
+		return ctx.Err()
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-p.tick.C:
+		return nil
+	}
+}
+
+func sleepCtx(ctx context.Context, d time.Duration) error {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-t.C:
+		return nil
+	}
+}
+
+// handleSweep reports on GET whether background sweeps are paused or backing
+// off; POST ?paused=true or false pauses or resumes them. The switch isn't
+// persisted across restarts.
+func (s *Server) handleSweep(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+	case http.MethodPost:
+		on, err := strconv.ParseBool(r.URL.Query().Get("paused"))
+		if err != nil {
+			http.Error(w, "paused must be true or false", http.StatusBadRequest)
+			return
+		}
+		s.sweepPaused.Store(on)
+		log.Printf("admin: background sweeps paused=%v", on)
+	default:
+		w.Header().Set("Allow", "GET, POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(struct {
+		Paused     bool `json:"paused"`
+		BackingOff bool `json:"backing_off"`
+	}{s.sweepPaused.Load(), s.sweepBackingOff.Load() > 0})
+}
@@ -0,0 +1,159 @@
+package server
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// slowMetaStore delays every meta read, as an overloaded bucket would.
+type slowMetaStore struct {
+	*memStore
+	delay time.Duration
+}
+
+func (s slowMetaStore) ReadMeta(ctx context.Context, key string) (cache.Meta, bool, error) {
+	time.Sleep(s.delay)
+	return s.memStore.ReadMeta(ctx, key)
+}
+
+func TestSweepPacer(t *testing.T) {
+	const limit = 10 * time.Millisecond
+	tests := []struct {
+		name          string
+		latencies     []time.Duration // of successive reads
+		wantThrottled []bool          // wait didn't return within the deadline
+		wantBacking   bool            // still backing off afterwards
+	}{
+		{"fast reads", []time.Duration{time.Millisecond, time.Millisecond}, []bool{false, false}, false},
+		{"slow read", []time.Duration{50 * time.Millisecond}, []bool{true}, true},
+		{"recovered", []time.Duration{50 * time.Millisecond, time.Millisecond}, []bool{true, false}, false},
+		{"still slow", []time.Duration{50 * time.Millisecond, 50 * time.Millisecond}, []bool{true, true}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, fmt.Sprintf("sweep_max_latency_ms: %d\n", limit/time.Millisecond))
+			s, _ := newTestServer(t, cfg, http.NotFoundHandler())
+			p := s.newSweepPacer("test", 0)
+			for i, latency := range tt.latencies {
+				ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+				err := p.wait(ctx, latency)
+				cancel()
+				if throttled := err != nil; throttled != tt.wantThrottled[i] {
+					t.Errorf("read %d (%v): throttled %v, want %v", i, latency, throttled, tt.wantThrottled[i])
+				}
+			}
+			if backing := s.sweepBackingOff.Load() > 0; backing != tt.wantBacking {
+				t.Errorf("backing off %v, want %v", backing, tt.wantBacking)
+			}
+			p.stop()
+			if n := s.sweepBackingOff.Load(); n != 0 {
+				t.Errorf("%d sweeps backing off after stop", n)
+			}
+		})
+	}
+}
+
+func TestSweepThrottle(t *testing.T) {
+	tests := []struct {
+		name      string
+		yaml      string
+		delay     time.Duration // per meta read
+		paused    bool
+		wantDone  bool          // the walk finishes within the deadline
+		wantSlow  time.Duration // and takes at least this long
+		wantAdmin string        // /admin/sweep while it is held back
+	}{
+		{"unthrottled", "", 0, false, true, 0, ""},
+		{"rate limited", "reconcile_rate: 50\n", 0, false, true, 80 * time.Millisecond, ""},
+		{"slow storage backs off", "sweep_max_latency_ms: 5\n", 20 * time.Millisecond, false, false, 0, `"paused":false,"backing_off":true`},
+		{"slow storage under the threshold", "sweep_max_latency_ms: 500\n", 20 * time.Millisecond, false, true, 0, ""},
+		{"paused", "", 0, true, false, 0, `"paused":true,"backing_off":false`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, st := newTestServer(t, loadConfig(t, "admin_token: secret\n"+tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, "body")
+			}))
+			for i := 0; i < 5; i++ {
+				do(s, http.MethodGet, fmt.Sprintf("/example.com/%d.txt", i))
+			}
+			s.Store = slowMetaStore{st, tt.delay}
+			admin := func(method, target string) string {
+				return do(s.AdminHandler(), method, target, "Authorization", "Bearer secret").Body.String()
+			}
+			if tt.paused {
+				admin(http.MethodPost, "/admin/sweep?paused=true")
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+			defer cancel()
+			type result struct {
+				checked int
+				err     error
+			}
+			done := make(chan result, 1)
+			start := time.Now()
+			go func() {
+				checked, _, err := s.ReconcileOnce(ctx)
+				done <- result{checked, err}
+			}()
+			time.Sleep(100 * time.Millisecond)
+			if got := admin(http.MethodGet, "/admin/sweep"); !strings.Contains(got, tt.wantAdmin) {
+				t.Errorf("/admin/sweep = %s, want %s", got, tt.wantAdmin)
+			}
+			res := <-done
+			elapsed := time.Since(start)
+			if finished := res.err == nil; finished != tt.wantDone {
+				t.Fatalf("finished %v (checked %d, %v), want %v", finished, res.checked, res.err, tt.wantDone)
+			}
+			if !tt.wantDone {
+				if !errors.Is(res.err, context.DeadlineExceeded) || res.checked >= 5 {
+					t.Errorf("checked %d, %v; want the walk held back", res.checked, res.err)
+				}
+				return
+			}
+			if res.checked != 5 || elapsed < tt.wantSlow {
+				t.Errorf("checked %d in %v, want 5 in at least %v", res.checked, elapsed, tt.wantSlow)
+			}
+		})
+	}
+}
+
+func TestSweepAdmin(t *testing.T) {
+	tests := []struct {
+		name       string
+		method     string
+		query      string
+		wantStatus int
+		wantPaused bool
+	}{
+		{"status", http.MethodGet, "", http.StatusOK, false},
+		{"pause", http.MethodPost, "?paused=true", http.StatusOK, true},
+		{"resume", http.MethodPost, "?paused=false", http.StatusOK, false},
+		{"bad value", http.MethodPost, "?paused=maybe", http.StatusBadRequest, false},
+		{"wrong method", http.MethodDelete, "", http.StatusMethodNotAllowed, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, _ := newTestServer(t, loadConfig(t, "admin_token: secret\n"), http.NotFoundHandler())
+			w := do(s.AdminHandler(), tt.method, "/admin/sweep"+tt.query, "Authorization", "Bearer secret")
+			if w.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", w.Code, tt.wantStatus, w.Body)
+			}
+			if s.sweepPaused.Load() != tt.wantPaused {
+				t.Errorf("paused %v, want %v", s.sweepPaused.Load(), tt.wantPaused)
+			}
+			if w.Code == http.StatusOK && !strings.Contains(w.Body.String(), fmt.Sprintf(`"paused":%v`, tt.wantPaused)) {
+				t.Errorf("body %s", w.Body)
+			}
+		})
+	}
+}
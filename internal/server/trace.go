@@ -0,0 +1,45 @@
+package server
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+)
+
+// traceHeaders returns the trace_headers to send upstream for r: the
+// client's values, and for a missing traceparent or X-Request-Id a freshly
+// generated one so the origin's logs can still be correlated with ours.
+func (s *Server) traceHeaders(r *http.Request) map[string]string {
+	names := s.conf().TraceHeaders
+	if len(names) == 0 {
+		return nil
+	}
+	out := make(map[string]string, len(names))
+	for _, name := range names {
+		v := r.Header.Get(name)
+		if v == "" {
+			v = generateTraceHeader(http.CanonicalHeaderKey(name))
+		}
+		if v != "" {
+			out[name] = v
+		}
+	}
+	return out
+}
+
+func generateTraceHeader(name string) string {
+	switch name {
+	case "Traceparent":
+		// W3C Trace Context: version-traceid-parentid-flags.
+		return "00-" + randomHex(16) + "-" + randomHex(8) + "-01"
+	case "X-Request-Id":
+		return randomHex(16)
+	}
+	return ""
+}
+
+func randomHex(n int) string {
+	b := make([]byte, n)
+	_, _ = rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,71 @@
+package server
+
+import (
+	"io"
+	"net/http"
+	"regexp"
+	"sync"
+	"testing"
+)
+
+func TestTraceHeaders(t *testing.T) {
+	const yaml = "trace_headers: [traceparent, X-Request-Id, X-B3-TraceId]\n"
+	const parent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	traceparent := regexp.MustCompile(`^00-[0-9a-f]{32}-[0-9a-f]{16}-01$`)
+	requestID := regexp.MustCompile(`^[0-9a-f]{32}$`)
+	tests := []struct {
+		name    string
+		yaml    string
+		client  []string
+		want    map[string]*regexp.Regexp // nil value: absent
+		wantRaw map[string]string
+	}{
+		{"forwarded", yaml, []string{"Traceparent", parent, "X-Request-Id", "req-1", "X-B3-TraceId", "abc"}, nil,
+			map[string]string{"Traceparent": parent, "X-Request-Id": "req-1", "X-B3-Traceid": "abc"}},
+		{"generated", yaml, nil,
+			map[string]*regexp.Regexp{"Traceparent": traceparent, "X-Request-Id": requestID, "X-B3-Traceid": nil}, nil},
+		{"not configured", "", []string{"Traceparent", parent, "X-Request-Id", "req-1"},
+			map[string]*regexp.Regexp{"Traceparent": nil, "X-Request-Id": nil}, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var mu sync.Mutex
+			var got http.Header
+			s, _ := newTestServer(t, loadConfig(t, tt.yaml), http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				mu.Lock()
+				got = r.Header.Clone()
+				mu.Unlock()
+				_, _ = io.WriteString(w, "body")
+			}))
+			if w := do(s, http.MethodGet, "/example.com/a.txt", tt.client...); w.Code != http.StatusOK {
+				t.Fatalf("status %d", w.Code)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			for h, v := range tt.wantRaw {
+				if got.Get(h) != v {
+					t.Errorf("%s = %q, want %q", h, got.Get(h), v)
+				}
+			}
+			for h, re := range tt.want {
+				switch v := got.Get(h); {
+				case re == nil && v != "":
+					t.Errorf("%s sent upstream: %q", h, v)
+				case re != nil && !re.MatchString(v):
+					t.Errorf("%s = %q, want %s", h, v, re)
+				}
+			}
+		})
+	}
+}
+
+func TestGeneratedTraceHeadersDiffer(t *testing.T) {
+	tests := []struct{ name string }{{"Traceparent"}, {"X-Request-Id"}}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if a, b := generateTraceHeader(tt.name), generateTraceHeader(tt.name); a == "" || a == b {
+				t.Errorf("generated %q then %q", a, b)
+			}
+		})
+	}
+}
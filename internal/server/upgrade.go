@@ -0,0 +1,46 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+)
+
+// isUpgrade reports whether r asks to switch protocols (e.g. WebSocket).
+// Such requests can't be cached and must never reach the download path.
+func isUpgrade(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, v := range r.Header.Values("Connection") {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// serveUpgrade either rejects an upgrade request or, when proxy_upgrades is
+// set, tunnels it to the upstream unmodified.
+func (s *Server) serveUpgrade(w http.ResponseWriter, r *http.Request, domain, upstreamURL string) {
+	if !s.conf().ProxyUpgrades {
+		http.Error(w, "protocol upgrades are not supported", http.StatusNotImplemented)
+		return
+	}
+	target, err := url.Parse(upstreamURL)
+	if err != nil {
+		http.Error(w, "bad upstream url", http.StatusBadRequest)
+		return
+	}
+	rp := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			pr.Out.URL = target
+			pr.Out.Host = target.Host
+		},
+		Transport: s.clientFor(domain).Transport,
+	}
+	rp.ServeHTTP(w, r)
+}
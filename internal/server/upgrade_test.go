@@ -0,0 +1,73 @@
+package server
+
+import (
+	"bufio"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+// echoUpgrade accepts any upgrade and echoes what the client sends.
+func echoUpgrade(w http.ResponseWriter, r *http.Request) {
+	if r.Header.Get("Upgrade") != "websocket" {
+		http.Error(w, "upgrade expected", http.StatusBadRequest)
+		return
+	}
+	conn, brw, err := http.NewResponseController(w).Hijack()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	_, _ = io.WriteString(conn, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+	_, _ = io.Copy(conn, brw)
+}
+
+func TestUpgrade(t *testing.T) {
+	tests := []struct {
+		name       string
+		proxy      bool
+		wantStatus int
+	}{
+		{"rejected", false, http.StatusNotImplemented},
+		{"tunneled", true, http.StatusSwitchingProtocols},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := loadConfig(t, "")
+			cfg.ProxyUpgrades = tt.proxy
+			s, st := newTestServer(t, cfg, http.HandlerFunc(echoUpgrade))
+			proxy := httptest.NewServer(s)
+			defer proxy.Close()
+
+			conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer conn.Close()
+			_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+			_, _ = io.WriteString(conn, "GET /example.com/socket HTTP/1.1\r\nHost: proxy\r\nConnection: Upgrade\r\nUpgrade: websocket\r\n\r\n")
+			br := bufio.NewReader(conn)
+			resp, err := http.ReadResponse(br, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.wantStatus {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.wantStatus)
+			}
+			if keys := st.keys(""); len(keys) != 0 {
+				t.Errorf("upgrade request stored %v", keys)
+			}
+			if !tt.proxy {
+				return
+			}
+			_, _ = io.WriteString(conn, "ping")
+			got := make([]byte, 4)
+			if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+				t.Errorf("tunnel echoed %q, %v", got, err)
+			}
+		})
+	}
+}
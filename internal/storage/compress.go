@@ -0,0 +1,302 @@
+package storage
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// compressedContentType prefixes the stored content type of a compressed
+// object; the original type and size travel as parameters.
+const compressedContentType = "application/vnd.raw-cacher.compressed+"
+
+// Compressor is a compression algorithm used at rest.
+type Compressor interface {
+	Name() string
+	Compress(data []byte) ([]byte, error)
+	Decompress(r io.Reader) (io.ReadCloser, error)
+}
+
+// NewCompressor returns the compressor for algo ("gzip" or "zstd"). A level
+// of 0 selects the algorithm's default.
+func NewCompressor(algo string, level int) (Compressor, error) {
+	switch algo {
+	case "gzip":
+		if level == 0 {
+			level = gzip.DefaultCompression
+		}
+		if level < gzip.HuffmanOnly || level > gzip.BestCompression {
+			return nil, fmt.Errorf("gzip: invalid level %d", level)
+		}
+		return gzipCompressor{level: level}, nil
+	case "zstd":
+		lvl := zstd.SpeedDefault
+		if level != 0 {
+			lvl = zstd.EncoderLevelFromZstd(level)
+		}
+		enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(lvl))
+		if err != nil {
+			return nil, err
+		}
+		return zstdCompressor{enc: enc}, nil
+	}
+	return nil, fmt.Errorf("unsupported compression %q", algo)
+}
+
+// DictKey is the storage key of the zstd dictionary with the given ID.
+// Dictionaries are never overwritten or removed, so objects compressed with
+// one stay readable after the configured dictionary changes.
+func DictKey(id string) string { return "dictionaries/zstd/" + id }
+
+// DictID identifies a dictionary by a hash of its contents, so any change to
+// the dictionary file is a new version.
+func DictID(dict []byte) string {
+	sum := sha256.Sum256(dict)
+	return hex.EncodeToString(sum[:8])
+}
+
+// NewZstdDictCompressor returns a zstd compressor using dict, e.g. one
+// trained with "zstd --train" on sample objects. A level of 0 selects the
+// default.
+func NewZstdDictCompressor(dict []byte, level int) (Compressor, error) {
+	lvl := zstd.SpeedDefault
+	if level != 0 {
+		lvl = zstd.EncoderLevelFromZstd(level)
+	}
+	enc, err := zstd.NewWriter(nil, zstd.WithEncoderLevel(lvl), zstd.WithEncoderDictRaw(0, dict))
+	if err != nil {
+		return nil, err
+	}
+	return zstdCompressor{enc: enc, dict: dict, dictID: DictID(dict)}, nil
+}
+
+type gzipCompressor struct{ level int }
+
+func (gzipCompressor) Name() string { return "gzip" }
+
+func (g gzipCompressor) Compress(data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw, err := gzip.NewWriterLevel(&buf, g.level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := zw.Write(data); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (gzipCompressor) Decompress(r io.Reader) (io.ReadCloser, error) {
+	return gzip.NewReader(r)
+}
+
+// zstdCompressor shares one encoder; EncodeAll is safe for concurrent use.
+// With a dictionary, dictID is recorded on every object it compresses.
+type zstdCompressor struct {
+	enc    *zstd.Encoder
+	dict   []byte
+	dictID string
+}
+
+func (zstdCompressor) Name() string { return "zstd" }
+
+func (z zstdCompressor) Compress(data []byte) ([]byte, error) {
+	return z.enc.EncodeAll(data, nil), nil
+}
+
+func (z zstdCompressor) Decompress(r io.Reader) (io.ReadCloser, error) {
+	opts := []zstd.DOption{zstd.WithDecoderConcurrency(1)}
+	if z.dict != nil {
+		opts = append(opts, zstd.WithDecoderDictRaw(0, z.dict))
+	}
+	dec, err := zstd.NewReader(r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return dec.IOReadCloser(), nil
+}
+
+// CompressStore compresses object bodies before handing them to the wrapped
+// Backend and transparently decompresses them on read. Bodies that don't
+// shrink are stored as-is, and objects written before compression was
+// enabled are still readable. Meta is left uncompressed.
+type CompressStore struct {
+	Backend
+	c Compressor
+	// MaxDecompressed aborts reads that inflate past this many bytes, so a
+	// corrupt or malicious object can't expand without bound. Zero disables
+	// the limit.
+	MaxDecompressed int64
+
+	// dicts caches zstd dictionaries read back from DictKey, by ID.
+	dicts sync.Map // string -> Compressor
+}
+
+// ErrDecompressedTooLarge is returned by reads exceeding MaxDecompressed.
+var ErrDecompressedTooLarge = errors.New("decompressed size limit exceeded")
+
+func NewCompressStore(b Backend, c Compressor) *CompressStore {
+	return &CompressStore{Backend: b, c: c}
+}
+
+func (s *CompressStore) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	if len(data) == 0 {
+		return s.Backend.PutObject(ctx, key, data, contentType)
+	}
+	z, err := s.c.Compress(data)
+	if err != nil || len(z) >= len(data) {
+		return s.Backend.PutObject(ctx, key, data, contentType)
+	}
+	params := map[string]string{
+		"type": contentType,
+		"size": strconv.Itoa(len(data)),
+	}
+	if z, ok := s.c.(zstdCompressor); ok && z.dictID != "" {
+		params["dict"] = z.dictID
+	}
+	ct := mime.FormatMediaType(compressedContentType+s.c.Name(), params)
+	return s.Backend.PutObject(ctx, key, z, ct)
+}
+
+func (s *CompressStore) GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error) {
+	rc, size, hdrs, err := s.Backend.GetObject(ctx, key)
+	if err != nil || !strings.HasPrefix(hdrs["Content-Type"], compressedContentType) {
+		return rc, size, hdrs, err
+	}
+	mt, params, err := mime.ParseMediaType(hdrs["Content-Type"])
+	if err != nil {
+		rc.Close()
+		return nil, 0, nil, fmt.Errorf("%s: %w", key, err)
+	}
+	c := s.c
+	if id := params["dict"]; id != "" {
+		if c, err = s.dict(ctx, id); err != nil {
+			rc.Close()
+			return nil, 0, nil, fmt.Errorf("%s: dictionary %s: %w", key, id, err)
+		}
+	} else if algo := strings.TrimPrefix(mt, compressedContentType); algo != c.Name() || isDict(c) {
+		// Written under a different setting; decode with that algorithm.
+		if c, err = NewCompressor(algo, 0); err != nil {
+			rc.Close()
+			return nil, 0, nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return decompressed(key, rc, c, params, hdrs, s.MaxDecompressed)
+}
+
+// StoreDict saves the configured dictionary under DictKey unless a copy is
+// already there, so objects compressed with it can be read by any instance
+// and after the dictionary is replaced.
+func (s *CompressStore) StoreDict(ctx context.Context) error {
+	z, ok := s.c.(zstdCompressor)
+	if !ok || z.dictID == "" {
+		return nil
+	}
+	s.dicts.Store(z.dictID, s.c)
+	key := DictKey(z.dictID)
+	if ok, err := s.Backend.HasObject(ctx, key); err != nil || ok {
+		return err
+	}
+	return s.Backend.PutObject(ctx, key, z.dict, "application/octet-stream")
+}
+
+// dict returns a decompressor for the dictionary with the given ID.
+func (s *CompressStore) dict(ctx context.Context, id string) (Compressor, error) {
+	if c, ok := s.dicts.Load(id); ok {
+		return c.(Compressor), nil
+	}
+	rc, _, _, err := s.Backend.GetObject(ctx, DictKey(id))
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	dict, err := io.ReadAll(rc)
+	if err != nil {
+		return nil, err
+	}
+	if DictID(dict) != id {
+		return nil, errors.New("stored dictionary doesn't match its ID")
+	}
+	c := zstdCompressor{dict: dict, dictID: id}
+	s.dicts.Store(id, c)
+	return c, nil
+}
+
+func isDict(c Compressor) bool {
+	z, ok := c.(zstdCompressor)
+	return ok && z.dictID != ""
+}
+
+func decompressed(key string, rc io.ReadCloser, c Compressor, params, hdrs map[string]string, limit int64) (io.ReadCloser, int64, map[string]string, error) {
+	size, err := strconv.ParseInt(params["size"], 10, 64)
+	if err != nil {
+		rc.Close()
+		return nil, 0, nil, fmt.Errorf("%s: bad size: %w", key, err)
+	}
+	if limit > 0 && size > limit {
+		rc.Close()
+		return nil, 0, nil, fmt.Errorf("%s: %w", key, ErrDecompressedTooLarge)
+	}
+	zr, err := c.Decompress(rc)
+	if err != nil {
+		rc.Close()
+		return nil, 0, nil, fmt.Errorf("%s: %w", key, err)
+	}
+	out := make(map[string]string, len(hdrs))
+	for k, v := range hdrs {
+		out[k] = v
+	}
+	out["Content-Type"] = params["type"]
+	// Never inflate past the recorded size, whatever the stream claims.
+	max := size
+	if limit > 0 {
+		max = min(max, limit)
+	}
+	return readCloser{Reader: &capReader{r: zr, n: max}, close: func() error {
+		zr.Close()
+		return rc.Close()
+	}}, size, out, nil
+}
+
+type readCloser struct {
+	io.Reader
+	close func() error
+}
+
+func (r readCloser) Close() error { return r.close() }
+
+// capReader fails with ErrDecompressedTooLarge once more than n bytes are
+// available, unlike io.LimitReader which would silently truncate.
+type capReader struct {
+	r io.Reader
+	n int64
+}
+
+func (c *capReader) Read(p []byte) (int, error) {
+	if c.n < 0 {
+		return 0, ErrDecompressedTooLarge
+	}
+	if int64(len(p)) > c.n+1 {
+		p = p[:c.n+1]
+	}
+	n, err := c.r.Read(p)
+	c.n -= int64(n)
+	if c.n < 0 {
+		return n + int(c.n), ErrDecompressedTooLarge
+	}
+	return n, err
+}
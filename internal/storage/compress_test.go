@@ -0,0 +1,347 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"mime"
+	"strings"
+	"testing"
+)
+
+// jsonCorpus returns a deterministic JSON document of roughly n bytes,
+// shaped like a typical API listing.
+func jsonCorpus(n int) []byte {
+	type item struct {
+		ID      int      `json:"id"`
+		Name    string   `json:"name"`
+		Owner   string   `json:"owner"`
+		Tags    []string `json:"tags"`
+		Stars   int      `json:"stars"`
+		Updated string   `json:"updated_at"`
+	}
+	r := rand.New(rand.NewPCG(1, 2))
+	words := []string{"cache", "proxy", "minio", "edge", "raw", "static", "asset", "mirror", "cdn", "origin"}
+	var items []item
+	for size := 0; size < n; size += 150 {
+		i := len(items)
+		items = append(items, item{
+			ID:      i,
+			Name:    words[r.IntN(len(words))] + "-" + words[r.IntN(len(words))],
+			Owner:   fmt.Sprintf("user%d", r.IntN(500)),
+			Tags:    []string{words[r.IntN(len(words))], words[r.IntN(len(words))]},
+			Stars:   r.IntN(100000),
+			Updated: fmt.Sprintf("2024-%02d-%02dT%02d:00:00Z", 1+r.IntN(12), 1+r.IntN(28), r.IntN(24)),
+		})
+	}
+	b, _ := json.Marshal(items)
+	return b
+}
+
+func TestCompressStore(t *testing.T) {
+	corpus := jsonCorpus(64 << 10)
+	random := make([]byte, 4096)
+	r := rand.New(rand.NewPCG(3, 4))
+	for i := range random {
+		random[i] = byte(r.Uint32())
+	}
+	tests := []struct {
+		name           string
+		algo           string
+		level          int
+		body           []byte
+		wantCompressed bool
+	}{
+		{"gzip default", "gzip", 0, corpus, true},
+		{"gzip best", "gzip", 9, corpus, true},
+		{"zstd default", "zstd", 0, corpus, true},
+		{"zstd fastest", "zstd", 1, corpus, true},
+		{"zstd best", "zstd", 19, corpus, true},
+		{"incompressible", "zstd", 0, random, false},
+		{"empty", "gzip", 0, []byte{}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, f := newTestStore(t)
+			c, err := NewCompressor(tt.algo, tt.level)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cs := NewCompressStore(s, c)
+			const key = "objects/data.json"
+			if err := cs.PutObject(ctx, key, tt.body, "application/json"); err != nil {
+				t.Fatal(err)
+			}
+			stored, _ := f.object("cache", key)
+			if compressed := len(stored) < len(tt.body); compressed != tt.wantCompressed {
+				t.Errorf("stored %d bytes of %d, want compressed %v", len(stored), len(tt.body), tt.wantCompressed)
+			}
+
+			rc, size, hdrs, err := cs.GetObject(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(got, tt.body) {
+				t.Fatalf("round trip: %d bytes, %v; want %d bytes intact", len(got), err, len(tt.body))
+			}
+			if size != int64(len(tt.body)) || hdrs["Content-Type"] != "application/json" {
+				t.Errorf("size %d, Content-Type %q", size, hdrs["Content-Type"])
+			}
+		})
+	}
+}
+
+func TestCompressStoreSettingsChange(t *testing.T) {
+	corpus := jsonCorpus(16 << 10)
+	tests := []struct {
+		name        string
+		write, read string
+	}{
+		{"gzip then zstd", "gzip", "zstd"},
+		{"zstd then gzip", "zstd", "gzip"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, _ := newTestStore(t)
+			wc, _ := NewCompressor(tt.write, 0)
+			rc, _ := NewCompressor(tt.read, 0)
+			if err := NewCompressStore(s, wc).PutObject(ctx, "objects/a", corpus, "application/json"); err != nil {
+				t.Fatal(err)
+			}
+			body, _, _, err := NewCompressStore(s, rc).GetObject(ctx, "objects/a")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer body.Close()
+			if got, _ := io.ReadAll(body); !bytes.Equal(got, corpus) {
+				t.Error("body written under the old setting doesn't round-trip")
+			}
+		})
+	}
+}
+
+func TestCompressStoreDict(t *testing.T) {
+	v1, v2 := jsonCorpus(8<<10), jsonCorpus(12 << 10)[4<<10:]
+	body := jsonCorpus(600)
+	tests := []struct {
+		name        string
+		write, read []byte // dictionaries; nil is plain zstd
+		tamper      bool   // the stored dictionary no longer matches its ID
+		drop        bool   // the stored dictionary is gone
+		wantErr     bool
+	}{
+		{"same dictionary", v1, v1, false, false, false},
+		{"after a version bump", v1, v2, false, false, false},
+		{"dictionary dropped", v1, nil, false, false, false},
+		{"dictionary added", nil, v2, false, false, false},
+		{"stored dictionary missing", v1, v2, false, true, true},
+		{"stored dictionary altered", v1, v2, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, f := newTestStore(t)
+			store := func(dict []byte) *CompressStore {
+				c, err := NewCompressor("zstd", 0)
+				if dict != nil {
+					c, err = NewZstdDictCompressor(dict, 0)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				cs := NewCompressStore(s, c)
+				if err := cs.StoreDict(ctx); err != nil {
+					t.Fatal(err)
+				}
+				return cs
+			}
+			if err := store(tt.write).PutObject(ctx, "objects/a.json", body, "application/json"); err != nil {
+				t.Fatal(err)
+			}
+			if tt.write != nil {
+				key := DictKey(DictID(tt.write))
+				if stored, ok := f.object("cache", key); !ok || !bytes.Equal(stored, tt.write) {
+					t.Fatalf("dictionary not stored under %s", key)
+				}
+				switch {
+				case tt.drop:
+					_ = s.DeleteObject(ctx, key)
+				case tt.tamper:
+					f.put("cache", key, v2)
+				}
+			}
+
+			rc, size, _, err := store(tt.read).GetObject(ctx, "objects/a.json")
+			if tt.wantErr {
+				if err == nil {
+					rc.Close()
+					t.Fatal("read succeeded without the original dictionary")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, err := io.ReadAll(rc)
+			rc.Close()
+			if err != nil || !bytes.Equal(got, body) || size != int64(len(body)) {
+				t.Errorf("round trip: %d of %d bytes, %v", len(got), len(body), err)
+			}
+		})
+	}
+}
+
+func TestDictCompression(t *testing.T) {
+	dict := jsonCorpus(8 << 10)
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"small object", jsonCorpus(600)},
+		{"medium object", jsonCorpus(2 << 10)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			plain, _ := NewCompressor("zstd", 0)
+			withDict, err := NewZstdDictCompressor(dict, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			a, _ := plain.Compress(tt.body)
+			b, _ := withDict.Compress(tt.body)
+			if len(b) >= len(a) {
+				t.Errorf("%d bytes with the dictionary, %d without", len(b), len(a))
+			}
+		})
+	}
+}
+
+func TestStoreDictOnce(t *testing.T) {
+	tests := []struct {
+		name     string
+		dict     []byte
+		wantPuts int
+	}{
+		{"dictionary", jsonCorpus(4 << 10), 1},
+		{"no dictionary", nil, 0},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, f := newTestStore(t)
+			c, _ := NewCompressor("zstd", 0)
+			if tt.dict != nil {
+				c, _ = NewZstdDictCompressor(tt.dict, 0)
+			}
+			puts := f.count("PUT")
+			for i := 0; i < 3; i++ {
+				if err := NewCompressStore(s, c).StoreDict(ctx); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if n := f.count("PUT") - puts; n != tt.wantPuts {
+				t.Errorf("%d PUTs, want %d", n, tt.wantPuts)
+			}
+		})
+	}
+}
+
+func TestCompressStoreLimit(t *testing.T) {
+	bomb := []byte(strings.Repeat("a", 1<<20))
+	tests := []struct {
+		name    string
+		algo    string
+		limit   int64
+		size    string // overrides the recorded size, as a corrupt object might
+		wantErr bool
+	}{
+		{"zstd over the limit", "zstd", 1 << 10, "", true},
+		{"gzip over the limit", "gzip", 1 << 10, "", true},
+		{"under the limit", "zstd", 2 << 20, "", false},
+		{"no limit", "gzip", 0, "", false},
+		{"recorded size understated", "zstd", 2 << 20, "1024", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, _ := newTestStore(t)
+			c, err := NewCompressor(tt.algo, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+			cs := NewCompressStore(s, c)
+			cs.MaxDecompressed = tt.limit
+			if tt.size == "" {
+				err = cs.PutObject(ctx, "objects/bomb", bomb, "text/plain")
+			} else {
+				z, _ := c.Compress(bomb)
+				ct := mime.FormatMediaType(compressedContentType+c.Name(), map[string]string{"type": "text/plain", "size": tt.size})
+				err = s.PutObject(ctx, "objects/bomb", z, ct)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []byte
+			rc, _, _, err := cs.GetObject(ctx, "objects/bomb")
+			if err == nil {
+				got, err = io.ReadAll(rc)
+				rc.Close()
+			}
+			if tt.wantErr {
+				if !errors.Is(err, ErrDecompressedTooLarge) {
+					t.Errorf("err = %v, want ErrDecompressedTooLarge", err)
+				}
+				return
+			}
+			if err != nil || !bytes.Equal(got, bomb) {
+				t.Errorf("read %d bytes, %v", len(got), err)
+			}
+		})
+	}
+}
+
+// BenchmarkCompressor compares the algorithms at rest on a JSON corpus.
+func BenchmarkCompressor(b *testing.B) {
+	corpus := jsonCorpus(1 << 20)
+	for _, cfg := range []struct {
+		algo  string
+		level int
+	}{{"gzip", 1}, {"gzip", 0}, {"gzip", 9}, {"zstd", 1}, {"zstd", 0}, {"zstd", 19}} {
+		c, err := NewCompressor(cfg.algo, cfg.level)
+		if err != nil {
+			b.Fatal(err)
+		}
+		z, _ := c.Compress(corpus)
+		ratio := float64(len(corpus)) / float64(len(z))
+		b.Run(fmt.Sprintf("%s-%d/compress", cfg.algo, cfg.level), func(b *testing.B) {
+			b.SetBytes(int64(len(corpus)))
+			for i := 0; i < b.N; i++ {
+				if _, err := c.Compress(corpus); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(ratio, "ratio")
+		})
+		b.Run(fmt.Sprintf("%s-%d/decompress", cfg.algo, cfg.level), func(b *testing.B) {
+			b.SetBytes(int64(len(corpus)))
+			for i := 0; i < b.N; i++ {
+				rc, err := c.Decompress(bytes.NewReader(z))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := io.Copy(io.Discard, rc); err != nil {
+					b.Fatal(err)
+				}
+				rc.Close()
+			}
+		})
+	}
+}
@@ -0,0 +1,205 @@
+package storage
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// Backend is the set of operations the proxy needs from a store. *Store
+// implements it, and wrappers such as DedupStore compose it.
+type Backend interface {
+	HasObject(ctx context.Context, key string) (bool, error)
+	GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error)
+	PutObject(ctx context.Context, key string, data []byte, contentType string) error
+	DeleteObject(ctx context.Context, key string) error
+	ListKeys(ctx context.Context, prefix string, fn func(key string) error) error
+	// ObjectETag returns the storage-side ETag of key.
+	ObjectETag(ctx context.Context, key string) (string, bool, error)
+	ReadMeta(ctx context.Context, key string) (cache.Meta, bool, error)
+	WriteMeta(ctx context.Context, key string, m cache.Meta) error
+}
+
+// pointerContentType marks an object whose body is a blobPointer.
+const pointerContentType = "application/vnd.raw-cacher.pointer+json"
+
+type blobPointer struct {
+	Blob        string `json:"blob"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+// DedupStore stores bodies content-addressed under blobs/<sha256> and writes
+// small pointer objects at the requested keys, so identical content fetched
+// from different URLs is stored once. References are tracked as empty
+// marker objects under refs/<sha256>/, and a blob is removed when its last
+// reference goes away. Adding and releasing references to one blob are
+// serialized within the process, so a release can't delete a blob that a
+// concurrent put has just decided to reuse.
+type DedupStore struct {
+	Backend
+
+	mu    sync.Mutex
+	locks map[string]*blobLock
+}
+
+type blobLock struct {
+	mu   sync.Mutex
+	refs int
+}
+
+// lock blocks until blob sum is free and returns its unlock func.
+func (d *DedupStore) lock(sum string) func() {
+	d.mu.Lock()
+	if d.locks == nil {
+		d.locks = make(map[string]*blobLock)
+	}
+	l := d.locks[sum]
+	if l == nil {
+		l = &blobLock{}
+		d.locks[sum] = l
+	}
+	l.refs++
+	d.mu.Unlock()
+	l.mu.Lock()
+	return func() {
+		l.mu.Unlock()
+		d.mu.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(d.locks, sum)
+		}
+		d.mu.Unlock()
+	}
+}
+
+func NewDedupStore(b Backend) *DedupStore {
+	return &DedupStore{Backend: b}
+}
+
+func blobKey(sum string) string { return "blobs/" + sum }
+
+func refKey(sum, key string) string {
+	h := sha256.Sum256([]byte(key))
+	return "refs/" + sum + "/" + hex.EncodeToString(h[:])
+}
+
+func (d *DedupStore) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	h := sha256.Sum256(data)
+	sum := hex.EncodeToString(h[:])
+	old, _ := d.readPointer(ctx, key)
+	if err := d.addRef(ctx, sum, key, data, contentType); err != nil {
+		return err
+	}
+	b, err := json.Marshal(blobPointer{Blob: sum, ContentType: contentType})
+	if err != nil {
+		return err
+	}
+	if err := d.Backend.PutObject(ctx, key, b, pointerContentType); err != nil {
+		return err
+	}
+	if old != nil && old.Blob != sum {
+		return d.release(ctx, old.Blob, key)
+	}
+	return nil
+}
+
+// addRef records key's reference to blob sum, storing the blob first if
+// it isn't there yet.
+func (d *DedupStore) addRef(ctx context.Context, sum, key string, data []byte, contentType string) error {
+	defer d.lock(sum)()
+	if ok, err := d.Backend.HasObject(ctx, blobKey(sum)); err != nil {
+		return err
+	} else if !ok {
+		if err := d.Backend.PutObject(ctx, blobKey(sum), data, contentType); err != nil {
+			return err
+		}
+	}
+	return d.Backend.PutObject(ctx, refKey(sum, key), nil, "")
+}
+
+func (d *DedupStore) GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error) {
+	rc, size, hdrs, err := d.Backend.GetObject(ctx, key)
+	if err != nil || hdrs["Content-Type"] != pointerContentType {
+		return rc, size, hdrs, err
+	}
+	p, err := decodePointer(rc)
+	rc.Close()
+	if err != nil {
+		return nil, 0, nil, fmt.Errorf("pointer %s: %w", key, err)
+	}
+	rc, size, hdrs, err = d.Backend.GetObject(ctx, blobKey(p.Blob))
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if p.ContentType != "" {
+		hdrs["Content-Type"] = p.ContentType
+	}
+	return rc, size, hdrs, nil
+}
+
+func (d *DedupStore) DeleteObject(ctx context.Context, key string) error {
+	p, err := d.readPointer(ctx, key)
+	if err != nil {
+		return err
+	}
+	if err := d.Backend.DeleteObject(ctx, key); err != nil {
+		return err
+	}
+	if p == nil {
+		return nil
+	}
+	return d.release(ctx, p.Blob, key)
+}
+
+// release drops key's reference to blob sum and deletes the blob once no
+// references remain.
+func (d *DedupStore) release(ctx context.Context, sum, key string) error {
+	defer d.lock(sum)()
+	if err := d.Backend.DeleteObject(ctx, refKey(sum, key)); err != nil {
+		return err
+	}
+	errReferenced := errors.New("referenced")
+	err := d.Backend.ListKeys(ctx, "refs/"+sum+"/", func(string) error { return errReferenced })
+	if errors.Is(err, errReferenced) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return d.Backend.DeleteObject(ctx, blobKey(sum))
+}
+
+// readPointer returns the pointer stored at key, or nil if key is absent or
+// holds a plain (pre-dedup) object.
+func (d *DedupStore) readPointer(ctx context.Context, key string) (*blobPointer, error) {
+	if ok, err := d.Backend.HasObject(ctx, key); err != nil || !ok {
+		return nil, err
+	}
+	rc, _, hdrs, err := d.Backend.GetObject(ctx, key)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	if hdrs["Content-Type"] != pointerContentType {
+		return nil, nil
+	}
+	return decodePointer(rc)
+}
+
+func decodePointer(r io.Reader) (*blobPointer, error) {
+	var p blobPointer
+	if err := json.NewDecoder(io.LimitReader(r, 4<<10)).Decode(&p); err != nil {
+		return nil, err
+	}
+	if len(p.Blob) != sha256.Size*2 || strings.Trim(p.Blob, "0123456789abcdef") != "" {
+		return nil, fmt.Errorf("invalid blob reference %q", p.Blob)
+	}
+	return &p, nil
+}
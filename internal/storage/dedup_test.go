@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"testing"
+)
+
+func TestDedupStore(t *testing.T) {
+	type put struct{ key, body string }
+	tests := []struct {
+		name      string
+		puts      []put
+		deletes   []string
+		wantBlobs int
+	}{
+		{"identical bodies share a blob", []put{{"objects/a", "same"}, {"objects/b", "same"}}, nil, 1},
+		{"different bodies", []put{{"objects/a", "one"}, {"objects/b", "two"}}, nil, 2},
+		{"shared blob outlives one reference", []put{{"objects/a", "same"}, {"objects/b", "same"}}, []string{"objects/a"}, 1},
+		{"last reference removes the blob", []put{{"objects/a", "same"}, {"objects/b", "same"}}, []string{"objects/a", "objects/b"}, 0},
+		{"overwrite releases the old blob", []put{{"objects/a", "old"}, {"objects/a", "new"}}, nil, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, _ := newTestStore(t)
+			d := NewDedupStore(s)
+			want := map[string]string{}
+			for _, p := range tt.puts {
+				if err := d.PutObject(ctx, p.key, []byte(p.body), "text/plain"); err != nil {
+					t.Fatal(err)
+				}
+				want[p.key] = p.body
+			}
+			for _, k := range tt.deletes {
+				if err := d.DeleteObject(ctx, k); err != nil {
+					t.Fatal(err)
+				}
+				delete(want, k)
+			}
+
+			blobs := 0
+			if err := s.ListKeys(ctx, "blobs/", func(string) error { blobs++; return nil }); err != nil {
+				t.Fatal(err)
+			}
+			if blobs != tt.wantBlobs {
+				t.Errorf("blobs = %d, want %d", blobs, tt.wantBlobs)
+			}
+			for k, body := range want {
+				rc, _, hdrs, err := d.GetObject(ctx, k)
+				if err != nil {
+					t.Fatalf("GetObject(%s): %v", k, err)
+				}
+				got, _ := io.ReadAll(rc)
+				rc.Close()
+				if string(got) != body || hdrs["Content-Type"] != "text/plain" {
+					t.Errorf("GetObject(%s) = %q (%s), want %q", k, got, hdrs["Content-Type"], body)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,232 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// FSStore is a Backend on the local filesystem. Each object is one file,
+// named by the hash of its key so arbitrary keys map to safe paths, that
+// starts with a JSON header line carrying the key and content type.
+type FSStore struct {
+	root string
+
+	// MetaMaxBytes caps the size of a meta object; anything larger is read
+	// as absent. Zero means cache.DefaultMetaMaxBytes.
+	MetaMaxBytes int64
+}
+
+type fsHeader struct {
+	Key         string `json:"key"`
+	ContentType string `json:"content_type,omitempty"`
+}
+
+func NewFSStore(root string) (*FSStore, error) {
+	if err := os.MkdirAll(root, 0o755); err != nil {
+		return nil, err
+	}
+	return &FSStore{root: root}, nil
+}
+
+func (f *FSStore) path(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	h := hex.EncodeToString(sum[:])
+	return filepath.Join(f.root, h[:2], h)
+}
+
+func (f *FSStore) HasObject(ctx context.Context, key string) (bool, error) {
+	_, err := os.Stat(f.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// open returns the file positioned after its header, and the body size.
+func (f *FSStore) open(key string) (*os.File, *bufio.Reader, fsHeader, int64, error) {
+	fh, err := os.Open(f.path(key))
+	if err != nil {
+		return nil, nil, fsHeader{}, 0, err
+	}
+	st, err := fh.Stat()
+	if err != nil {
+		fh.Close()
+		return nil, nil, fsHeader{}, 0, err
+	}
+	br := bufio.NewReader(fh)
+	line, err := br.ReadBytes('\n')
+	var hdr fsHeader
+	if err == nil {
+		err = json.Unmarshal(line, &hdr)
+	}
+	if err != nil {
+		fh.Close()
+		return nil, nil, fsHeader{}, 0, err
+	}
+	return fh, br, hdr, st.Size() - int64(len(line)), nil
+}
+
+func (f *FSStore) GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error) {
+	fh, br, hdr, size, err := f.open(key)
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	st, _ := fh.Stat()
+	h := map[string]string{
+		"Content-Type":  hdr.ContentType,
+		"ETag":          fsETag(st),
+		"Last-Modified": st.ModTime().UTC().Format(time.RFC1123),
+	}
+	return readCloser{Reader: br, close: fh.Close}, size, h, nil
+}
+
+func fsETag(st os.FileInfo) string {
+	return `"` + strconv.FormatInt(st.ModTime().UnixNano(), 36) + "-" + strconv.FormatInt(st.Size(), 36) + `"`
+}
+
+// PutObject writes via a temporary file and rename so readers never see a
+// partial object.
+func (f *FSStore) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	_, commit, discard, err := f.stage(key, bytes.NewReader(data), contentType)
+	if err != nil {
+		return err
+	}
+	if err := commit(); err != nil {
+		discard()
+		return err
+	}
+	return nil
+}
+
+// stage copies an object body from r into a temporary file beside key's
+// path and returns the body size. commit moves the file into place; discard
+// removes it if it wasn't. On error nothing is left behind.
+func (f *FSStore) stage(key string, r io.Reader, contentType string) (n int64, commit func() error, discard func(), err error) {
+	p := f.path(key)
+	if err := os.MkdirAll(filepath.Dir(p), 0o755); err != nil {
+		return 0, nil, nil, err
+	}
+	line, err := json.Marshal(fsHeader{Key: key, ContentType: contentType})
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(p), ".tmp-*")
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	discard = func() { _ = os.Remove(tmp.Name()) }
+	if _, err := tmp.Write(append(line, '\n')); err != nil {
+		tmp.Close()
+		discard()
+		return 0, nil, nil, err
+	}
+	if n, err = io.Copy(tmp, r); err != nil {
+		tmp.Close()
+		discard()
+		return 0, nil, nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		discard()
+		return 0, nil, nil, err
+	}
+	return n, func() error { return os.Rename(tmp.Name(), p) }, discard, nil
+}
+
+func (f *FSStore) DeleteObject(ctx context.Context, key string) error {
+	err := os.Remove(f.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// ListKeys walks every stored object, reading each header; it is meant for
+// startup scans, not the request path.
+func (f *FSStore) ListKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	return f.walk(ctx, func(key string, _ fs.FileInfo) error {
+		if strings.HasPrefix(key, prefix) {
+			return fn(key)
+		}
+		return nil
+	})
+}
+
+func (f *FSStore) walk(ctx context.Context, fn func(key string, st fs.FileInfo) error) error {
+	return filepath.WalkDir(f.root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || strings.HasPrefix(d.Name(), ".tmp-") {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		fh, err := os.Open(p)
+		if err != nil {
+			return nil
+		}
+		line, _ := bufio.NewReader(fh).ReadBytes('\n')
+		st, _ := fh.Stat()
+		fh.Close()
+		var hdr fsHeader
+		if json.Unmarshal(line, &hdr) != nil || hdr.Key == "" || st == nil {
+			return nil
+		}
+		return fn(hdr.Key, st)
+	})
+}
+
+func (f *FSStore) ObjectETag(ctx context.Context, key string) (string, bool, error) {
+	st, err := os.Stat(f.path(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return "", false, nil
+	}
+	if err != nil {
+		return "", false, err
+	}
+	return fsETag(st), true, nil
+}
+
+func (f *FSStore) ReadMeta(ctx context.Context, key string) (cache.Meta, bool, error) {
+	var m cache.Meta
+	fh, br, _, _, err := f.open(key)
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, false, nil
+	}
+	if err != nil {
+		return m, false, err
+	}
+	defer fh.Close()
+	limit := f.MetaMaxBytes
+	if limit <= 0 {
+		limit = cache.DefaultMetaMaxBytes
+	}
+	b, err := io.ReadAll(io.LimitReader(br, limit+1))
+	if err != nil {
+		return m, false, err
+	}
+	if int64(len(b)) > limit || json.Unmarshal(b, &m) != nil {
+		return cache.Meta{}, false, nil
+	}
+	return m, true, nil
+}
+
+func (f *FSStore) WriteMeta(ctx context.Context, key string, m cache.Meta) error {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	return f.PutObject(ctx, key, b, "application/json")
+}
@@ -0,0 +1,45 @@
+package storage
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+func TestFSStoreMetaMaxBytes(t *testing.T) {
+	small := cache.Meta{CachedAt: cache.NowISO(), TTL: 60}
+	large := cache.Meta{CachedAt: cache.NowISO(), Headers: map[string][]string{"X-Pad": {strings.Repeat("x", 200)}}}
+	tests := []struct {
+		name   string
+		limit  int64
+		meta   cache.Meta
+		wantOK bool
+	}{
+		{"default limit", 0, large, true},
+		{"within the limit", 128, small, true},
+		{"over the limit", 128, large, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			f, err := NewFSStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.MetaMaxBytes = tt.limit
+			const key = "v1/example.com/a.txt.json"
+			if err := f.WriteMeta(ctx, key, tt.meta); err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := f.ReadMeta(ctx, key)
+			if err != nil || ok != tt.wantOK {
+				t.Fatalf("ReadMeta = ok %v, err %v; want ok %v", ok, err, tt.wantOK)
+			}
+			if ok && got.CachedAt != tt.meta.CachedAt {
+				t.Errorf("ReadMeta = %+v, want %+v", got, tt.meta)
+			}
+		})
+	}
+}
@@ -0,0 +1,209 @@
+package storage
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// HotIndexKey holds the keys resident in a HotStore at shutdown, most
+// recently used first, for warming the next process.
+const HotIndexKey = "hotcache/index.json"
+
+// HotStore keeps recently read small object bodies in memory, evicting the
+// least recently used once their total size passes MaxBytes. Writes and
+// deletes through it invalidate the entry, including one being filled by a
+// concurrent read; changes made to the backend directly are not seen until
+// the entry is evicted.
+type HotStore struct {
+	Backend
+	// MaxBytes bounds the total size of cached bodies.
+	MaxBytes int64
+	// MaxObject is the largest body that is cached.
+	MaxObject int64
+
+	mu    sync.Mutex
+	lru   *list.List // of *hotEntry, front is most recent
+	items map[string]*list.Element
+	size  int64
+	// fills tracks backend reads in flight per key. A write or delete of the
+	// key meanwhile bumps its generation, so the read's body isn't cached.
+	fills map[string]*hotFill
+}
+
+type hotFill struct {
+	gen  uint64
+	refs int
+}
+
+type hotEntry struct {
+	key  string
+	data []byte
+	hdrs map[string]string
+}
+
+func NewHotStore(b Backend, maxBytes, maxObject int64) *HotStore {
+	return &HotStore{
+		Backend:   b,
+		MaxBytes:  maxBytes,
+		MaxObject: maxObject,
+		lru:       list.New(),
+		items:     make(map[string]*list.Element),
+		fills:     make(map[string]*hotFill),
+	}
+}
+
+func (h *HotStore) HasObject(ctx context.Context, key string) (bool, error) {
+	h.mu.Lock()
+	_, ok := h.items[key]
+	h.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	return h.Backend.HasObject(ctx, key)
+}
+
+func (h *HotStore) GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error) {
+	h.mu.Lock()
+	if el, ok := h.items[key]; ok {
+		h.lru.MoveToFront(el)
+		e := el.Value.(*hotEntry)
+		h.mu.Unlock()
+		return io.NopCloser(bytes.NewReader(e.data)), int64(len(e.data)), e.hdrs, nil
+	}
+	f := h.fills[key]
+	if f == nil {
+		f = &hotFill{}
+		h.fills[key] = f
+	}
+	f.refs++
+	gen := f.gen
+	h.mu.Unlock()
+
+	rc, size, hdrs, err := h.Backend.GetObject(ctx, key)
+	if err != nil || size > h.MaxObject || size > h.MaxBytes {
+		h.add(key, f, gen, nil, nil)
+		return rc, size, hdrs, err
+	}
+	data, err := io.ReadAll(io.LimitReader(rc, h.MaxObject+1))
+	rc.Close()
+	if err != nil || int64(len(data)) != size {
+		h.add(key, f, gen, nil, nil)
+	} else {
+		h.add(key, f, gen, data, hdrs)
+	}
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	return io.NopCloser(bytes.NewReader(data)), int64(len(data)), hdrs, nil
+}
+
+// PutObject and DeleteObject invalidate key both before and after the
+// backend call, so a read that overlaps the write never caches what it
+// replaced.
+func (h *HotStore) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	h.remove(key)
+	defer h.remove(key)
+	return h.Backend.PutObject(ctx, key, data, contentType)
+}
+
+func (h *HotStore) DeleteObject(ctx context.Context, key string) error {
+	h.remove(key)
+	defer h.remove(key)
+	return h.Backend.DeleteObject(ctx, key)
+}
+
+// add ends the read of key registered as f and caches data, unless it is nil
+// or key was written since the read began (generation gen).
+func (h *HotStore) add(key string, f *hotFill, gen uint64, data []byte, hdrs map[string]string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if f.refs--; f.refs == 0 {
+		delete(h.fills, key)
+	}
+	if data == nil || f.gen != gen {
+		return
+	}
+	if el, ok := h.items[key]; ok {
+		h.drop(el)
+	}
+	h.items[key] = h.lru.PushFront(&hotEntry{key: key, data: data, hdrs: hdrs})
+	h.size += int64(len(data))
+	for h.size > h.MaxBytes {
+		h.drop(h.lru.Back())
+	}
+}
+
+func (h *HotStore) remove(key string) {
+	h.mu.Lock()
+	if f := h.fills[key]; f != nil {
+		f.gen++
+	}
+	if el, ok := h.items[key]; ok {
+		h.drop(el)
+	}
+	h.mu.Unlock()
+}
+
+// drop unlinks el; h.mu must be held.
+func (h *HotStore) drop(el *list.Element) {
+	e := h.lru.Remove(el).(*hotEntry)
+	delete(h.items, e.key)
+	h.size -= int64(len(e.data))
+}
+
+// Keys returns the resident keys, most recently used first.
+func (h *HotStore) Keys() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, h.lru.Len())
+	for el := h.lru.Front(); el != nil; el = el.Next() {
+		keys = append(keys, el.Value.(*hotEntry).key)
+	}
+	return keys
+}
+
+// SaveIndex writes the resident keys to HotIndexKey.
+func (h *HotStore) SaveIndex(ctx context.Context) (int, error) {
+	keys := h.Keys()
+	b, err := json.Marshal(keys)
+	if err != nil {
+		return 0, err
+	}
+	return len(keys), h.Backend.PutObject(ctx, HotIndexKey, b, "application/json")
+}
+
+// Warm reads HotIndexKey and loads the listed objects, stopping early when
+// ctx is done. Keys are loaded least recently used first so the recency
+// order survives the restart; ones that no longer exist are skipped.
+func (h *HotStore) Warm(ctx context.Context) (int, error) {
+	if ok, err := h.Backend.HasObject(ctx, HotIndexKey); err != nil || !ok {
+		return 0, err
+	}
+	rc, _, _, err := h.Backend.GetObject(ctx, HotIndexKey)
+	if err != nil {
+		return 0, err
+	}
+	var keys []string
+	err = json.NewDecoder(rc).Decode(&keys)
+	rc.Close()
+	if err != nil {
+		return 0, err
+	}
+	loaded := 0
+	for i := len(keys) - 1; i >= 0; i-- {
+		if ctx.Err() != nil {
+			return loaded, ctx.Err()
+		}
+		rc, _, _, err := h.GetObject(ctx, keys[i])
+		if err != nil {
+			continue
+		}
+		rc.Close()
+		loaded++
+	}
+	return loaded, nil
+}
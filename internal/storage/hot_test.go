@@ -0,0 +1,86 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"testing"
+)
+
+func TestHotStoreWarm(t *testing.T) {
+	tests := []struct {
+		name       string
+		reads      []string // before the restart
+		deleted    []string // removed from storage while down
+		maxBytes   int64    // of the restarted cache
+		noIndex    bool
+		canceled   bool // warm-up stopped before it starts
+		wantLoaded int
+		wantKeys   []string // resident after warming, most recent first
+	}{
+		{"round trip", []string{"a", "b", "c", "a"}, nil, 1 << 20, false, false, 3, []string{"a", "c", "b"}},
+		{"deleted since", []string{"a", "b", "c"}, []string{"b"}, 1 << 20, false, false, 2, []string{"c", "a"}},
+		{"smaller cache keeps the most recent", []string{"a", "b", "c"}, nil, 20, false, false, 3, []string{"c", "b"}},
+		{"no index", []string{"a"}, nil, 1 << 20, true, false, 0, []string{}},
+		{"canceled", []string{"a", "b"}, nil, 1 << 20, false, true, 0, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, f := newTestStore(t)
+			for _, k := range []string{"a", "b", "c"} {
+				f.put("cache", "objects/"+k, []byte("body of "+k))
+			}
+			before := NewHotStore(s, 1<<20, 1<<10)
+			for _, k := range tt.reads {
+				rc, _, _, err := before.GetObject(ctx, "objects/"+k)
+				if err != nil {
+					t.Fatal(err)
+				}
+				rc.Close()
+			}
+			if !tt.noIndex {
+				if n, err := before.SaveIndex(ctx); err != nil || n != len(before.Keys()) {
+					t.Fatalf("SaveIndex = %d, %v", n, err)
+				}
+			}
+			for _, k := range tt.deleted {
+				_ = s.DeleteObject(ctx, "objects/"+k)
+			}
+
+			after := NewHotStore(s, tt.maxBytes, 1<<10)
+			wctx, cancel := context.WithCancel(ctx)
+			if tt.canceled {
+				cancel()
+			}
+			n, err := after.Warm(wctx)
+			cancel()
+			if (err != nil) != tt.canceled || n != tt.wantLoaded {
+				t.Fatalf("Warm = %d, %v; want %d", n, err, tt.wantLoaded)
+			}
+			want := make([]string, len(tt.wantKeys))
+			for i, k := range tt.wantKeys {
+				want[i] = "objects/" + k
+			}
+			if got := after.Keys(); fmt.Sprint(got) != fmt.Sprint(want) {
+				t.Errorf("resident %v, want %v", got, want)
+			}
+			// Warmed objects are served without going back to storage.
+			gets := f.count("GET")
+			for _, k := range tt.wantKeys {
+				rc, _, _, err := after.GetObject(ctx, "objects/"+k)
+				if err != nil {
+					t.Fatal(err)
+				}
+				b, _ := io.ReadAll(rc)
+				rc.Close()
+				if string(b) != "body of "+k {
+					t.Errorf("%s = %q", k, b)
+				}
+			}
+			if n := f.count("GET") - gets; n != 0 {
+				t.Errorf("%d storage reads for warmed objects", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"sync/atomic"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// ReplicatedStore sends writes, deletes and listings to a read-write primary
+// and serves reads from read-only replicas, falling through to the primary
+// when a replica misses or fails (e.g. because it lags behind).
+type ReplicatedStore struct {
+	Backend // primary
+
+	replicas []Backend
+	// RoundRobin spreads reads by starting each at the next replica instead
+	// of always trying them in order.
+	RoundRobin bool
+	next       atomic.Uint64
+}
+
+func NewReplicatedStore(primary Backend, replicas ...Backend) *ReplicatedStore {
+	return &ReplicatedStore{Backend: primary, replicas: replicas}
+}
+
+// readOrder returns the replicas to try for one read.
+func (r *ReplicatedStore) readOrder() []Backend {
+	n := len(r.replicas)
+	if !r.RoundRobin || n < 2 {
+		return r.replicas
+	}
+	start := int(r.next.Add(1) % uint64(n))
+	out := make([]Backend, 0, n)
+	out = append(out, r.replicas[start:]...)
+	return append(out, r.replicas[:start]...)
+}
+
+func (r *ReplicatedStore) HasObject(ctx context.Context, key string) (bool, error) {
+	for _, b := range r.readOrder() {
+		if ok, err := b.HasObject(ctx, key); err == nil && ok {
+			return true, nil
+		}
+	}
+	return r.Backend.HasObject(ctx, key)
+}
+
+func (r *ReplicatedStore) GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error) {
+	for _, b := range r.readOrder() {
+		if rc, size, h, err := b.GetObject(ctx, key); err == nil {
+			return rc, size, h, nil
+		}
+	}
+	return r.Backend.GetObject(ctx, key)
+}
+
+func (r *ReplicatedStore) ReadMeta(ctx context.Context, key string) (cache.Meta, bool, error) {
+	for _, b := range r.readOrder() {
+		if m, ok, err := b.ReadMeta(ctx, key); err == nil && ok {
+			return m, true, nil
+		}
+	}
+	return r.Backend.ReadMeta(ctx, key)
+}
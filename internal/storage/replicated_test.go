@@ -0,0 +1,71 @@
+package storage
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"testing"
+)
+
+func TestReplicatedStore(t *testing.T) {
+	tests := []struct {
+		name        string
+		onReplica   bool
+		replicaDown bool
+		wantFrom    string
+	}{
+		{"replica hit", true, false, "replica"},
+		{"lagging replica", false, false, "primary"},
+		{"replica down", true, true, "primary"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			primary, pf := newTestStore(t)
+			replica, rf := newTestStore(t)
+			r := NewReplicatedStore(primary, replica)
+			const key = "objects/a.txt"
+			pf.put("cache", key, []byte("primary"))
+			if tt.onReplica {
+				rf.put("cache", key, []byte("replica"))
+			}
+			if tt.replicaDown {
+				rf.setFail(func(*http.Request) (string, int) { return "AccessDenied", http.StatusForbidden })
+			}
+
+			if ok, err := r.HasObject(ctx, key); !ok || err != nil {
+				t.Fatalf("HasObject = %v, %v", ok, err)
+			}
+			rc, _, _, err := r.GetObject(ctx, key)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, _ := io.ReadAll(rc)
+			rc.Close()
+			if string(got) != tt.wantFrom {
+				t.Errorf("read from %s, want %s", got, tt.wantFrom)
+			}
+
+			// Writes and deletes go to the primary only.
+			rf.setFail(nil)
+			if err := r.PutObject(ctx, "objects/new.txt", []byte("new"), "text/plain"); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := pf.object("cache", "objects/new.txt"); !ok {
+				t.Error("write missing from the primary")
+			}
+			if _, ok := rf.object("cache", "objects/new.txt"); ok {
+				t.Error("write reached the replica")
+			}
+			if err := r.DeleteObject(ctx, key); err != nil {
+				t.Fatal(err)
+			}
+			if _, ok := pf.object("cache", key); ok {
+				t.Error("delete didn't reach the primary")
+			}
+			if _, ok := rf.object("cache", key); ok != tt.onReplica {
+				t.Error("delete reached the replica")
+			}
+		})
+	}
+}
@@ -0,0 +1,313 @@
+package storage
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeS3 is an in-memory stand-in for the parts of the S3 API the MinIO
+// client uses here: bucket existence and creation, object put, get, stat,
+// delete and V2 listing. Buckets are addressed path-style.
+type fakeS3 struct {
+	mu      sync.Mutex
+	buckets map[string]map[string]*fakeObject
+	// fail, if set, is consulted first for every request; a non-empty code
+	// is answered as an S3 error with status.
+	fail func(r *http.Request) (code string, status int)
+	// etag, if set, replaces the MD5 ETag of uploaded bodies (e.g. to mimic
+	// SSE-KMS).
+	etag func(key string, body []byte) string
+	// mangle, if set, alters uploaded bodies before they are stored, as a
+	// faulty disk or proxy would.
+	mangle func(key string, body []byte) []byte
+	// requests counts requests by method.
+	requests map[string]int
+}
+
+type fakeObject struct {
+	body     []byte
+	etag     string
+	header   http.Header
+	modified time.Time
+}
+
+// newFakeS3 starts an empty fakeS3 and returns it with its endpoint.
+func newFakeS3(t *testing.T) (*fakeS3, string) {
+	t.Helper()
+	f := &fakeS3{buckets: map[string]map[string]*fakeObject{}, requests: map[string]int{}}
+	srv := httptest.NewServer(f)
+	t.Cleanup(srv.Close)
+	return f, srv.URL
+}
+
+// newTestStore returns a Store on a fresh fakeS3 with an empty bucket.
+func newTestStore(t *testing.T) (*Store, *fakeS3) {
+	t.Helper()
+	f, endpoint := newFakeS3(t)
+	s, err := NewStore(context.Background(), endpoint, "access", "secret", "cache")
+	if err != nil {
+		t.Fatalf("NewStore: %v", err)
+	}
+	return s, f
+}
+
+// object returns the stored body of key, if any.
+func (f *fakeS3) object(bucket, key string) ([]byte, bool) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	o, ok := f.buckets[bucket][key]
+	if !ok {
+		return nil, false
+	}
+	return o.body, true
+}
+
+// put stores body under key directly, bypassing the client.
+func (f *fakeS3) put(bucket, key string, body []byte) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	sum := md5.Sum(body)
+	f.buckets[bucket][key] = &fakeObject{body: body, etag: `"` + hex.EncodeToString(sum[:]) + `"`, header: http.Header{}, modified: time.Now()}
+}
+
+// dropBucket deletes bucket and everything in it.
+func (f *fakeS3) dropBucket(bucket string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.buckets, bucket)
+}
+
+// setFail installs (or, with nil, removes) the fail hook.
+func (f *fakeS3) setFail(fail func(r *http.Request) (code string, status int)) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.fail = fail
+}
+
+func (f *fakeS3) count(method string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.requests[method]
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	f.mu.Lock()
+	f.requests[r.Method]++
+	fail := f.fail
+	f.mu.Unlock()
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if fail != nil {
+		if code, status := fail(r); code != "" {
+			s3Error(w, r, status, code, bucket, key)
+			return
+		}
+	}
+	q := r.URL.Query()
+	if key == "" {
+		f.serveBucket(w, r, bucket, q)
+		return
+	}
+	f.mu.Lock()
+	objects, ok := f.buckets[bucket]
+	f.mu.Unlock()
+	if !ok {
+		s3Error(w, r, http.StatusNotFound, "NoSuchBucket", bucket, key)
+		return
+	}
+	switch r.Method {
+	case http.MethodPut:
+		if src := r.Header.Get("X-Amz-Copy-Source"); src != "" {
+			f.copyObject(w, r, bucket, key, src)
+			return
+		}
+		body, err := readUpload(r)
+		if err != nil {
+			s3Error(w, r, http.StatusBadRequest, "IncompleteBody", bucket, key)
+			return
+		}
+		if f.mangle != nil {
+			body = f.mangle(key, body)
+		}
+		sum := md5.Sum(body)
+		etag := `"` + hex.EncodeToString(sum[:]) + `"`
+		if f.etag != nil {
+			etag = `"` + f.etag(key, body) + `"`
+		}
+		h := http.Header{}
+		for k, v := range r.Header {
+			if strings.HasPrefix(k, "X-Amz-Meta-") || k == "Content-Type" || k == "Content-Encoding" {
+				h[k] = v
+			}
+		}
+		f.mu.Lock()
+		objects[key] = &fakeObject{body: body, etag: etag, header: h, modified: time.Now()}
+		f.mu.Unlock()
+		w.Header().Set("ETag", etag)
+	case http.MethodGet, http.MethodHead:
+		f.mu.Lock()
+		o, ok := objects[key]
+		f.mu.Unlock()
+		if !ok {
+			s3Error(w, r, http.StatusNotFound, "NoSuchKey", bucket, key)
+			return
+		}
+		for k, v := range o.header {
+			w.Header()[k] = v
+		}
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", "binary/octet-stream")
+		}
+		w.Header().Set("ETag", o.etag)
+		http.ServeContent(w, r, key, o.modified, bytes.NewReader(o.body))
+	case http.MethodDelete:
+		f.mu.Lock()
+		delete(objects, key)
+		f.mu.Unlock()
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+// copyObject serves a server-side copy into bucket/key from src
+// ("<bucket>/<key>", URL-escaped), honoring x-amz-copy-source-if-match.
+func (f *fakeS3) copyObject(w http.ResponseWriter, r *http.Request, bucket, key, src string) {
+	src, _ = url.PathUnescape(strings.TrimPrefix(src, "/"))
+	srcBucket, srcKey, _ := strings.Cut(src, "/")
+	f.mu.Lock()
+	o, ok := f.buckets[srcBucket][srcKey]
+	f.mu.Unlock()
+	if !ok {
+		s3Error(w, r, http.StatusNotFound, "NoSuchKey", srcBucket, srcKey)
+		return
+	}
+	if m := r.Header.Get("X-Amz-Copy-Source-If-Match"); m != "" && strings.Trim(m, `"`) != strings.Trim(o.etag, `"`) {
+		s3Error(w, r, http.StatusPreconditionFailed, "PreconditionFailed", srcBucket, srcKey)
+		return
+	}
+	cp := &fakeObject{body: bytes.Clone(o.body), etag: o.etag, header: o.header.Clone(), modified: time.Now()}
+	f.mu.Lock()
+	f.buckets[bucket][key] = cp
+	f.mu.Unlock()
+	w.Header().Set("Content-Type", "application/xml")
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><CopyObjectResult><LastModified>%s</LastModified><ETag>%s</ETag></CopyObjectResult>`,
+		cp.modified.UTC().Format(time.RFC3339), cp.etag)
+}
+
+func (f *fakeS3) serveBucket(w http.ResponseWriter, r *http.Request, bucket string, q map[string][]string) {
+	f.mu.Lock()
+	objects, exists := f.buckets[bucket]
+	f.mu.Unlock()
+	switch {
+	case r.Method == http.MethodPut:
+		f.mu.Lock()
+		if f.buckets[bucket] == nil {
+			f.buckets[bucket] = map[string]*fakeObject{}
+		}
+		f.mu.Unlock()
+	case !exists:
+		s3Error(w, r, http.StatusNotFound, "NoSuchBucket", bucket, "")
+	case r.Method == http.MethodHead:
+	case has(q, "location"):
+		w.Header().Set("Content-Type", "application/xml")
+		fmt.Fprint(w, `<?xml version="1.0" encoding="UTF-8"?><LocationConstraint xmlns="http://s3.amazonaws.com/doc/2006-03-01/"></LocationConstraint>`)
+	case r.Method == http.MethodGet:
+		prefix := first(q, "prefix")
+		type content struct {
+			Key          string
+			LastModified string
+			ETag         string
+			Size         int64
+			StorageClass string
+		}
+		var out struct {
+			XMLName     xml.Name `xml:"ListBucketResult"`
+			Name        string
+			Prefix      string
+			KeyCount    int
+			MaxKeys     int
+			IsTruncated bool
+			Contents    []content
+		}
+		out.Name, out.Prefix, out.MaxKeys = bucket, prefix, 1000
+		f.mu.Lock()
+		for k, o := range objects {
+			if strings.HasPrefix(k, prefix) {
+				out.Contents = append(out.Contents, content{k, o.modified.UTC().Format(time.RFC3339), o.etag, int64(len(o.body)), "STANDARD"})
+			}
+		}
+		f.mu.Unlock()
+		sort.Slice(out.Contents, func(i, j int) bool { return out.Contents[i].Key < out.Contents[j].Key })
+		out.KeyCount = len(out.Contents)
+		w.Header().Set("Content-Type", "application/xml")
+		_ = xml.NewEncoder(w).Encode(out)
+	}
+}
+
+func has(q map[string][]string, k string) bool { _, ok := q[k]; return ok }
+
+func first(q map[string][]string, k string) string {
+	if v := q[k]; len(v) > 0 {
+		return v[0]
+	}
+	return ""
+}
+
+// readUpload returns an upload's body, undoing aws-chunked encoding, which
+// the client uses for signed uploads over plain HTTP.
+func readUpload(r *http.Request) ([]byte, error) {
+	if r.Header.Get("X-Amz-Decoded-Content-Length") == "" {
+		return io.ReadAll(r.Body)
+	}
+	var out []byte
+	br := bufio.NewReader(r.Body)
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		sizeHex, _, _ := strings.Cut(strings.TrimSpace(line), ";")
+		n, err := strconv.ParseInt(sizeHex, 16, 64)
+		if err != nil {
+			return nil, err
+		}
+		if n == 0 {
+			return out, nil
+		}
+		chunk := make([]byte, n)
+		if _, err := io.ReadFull(br, chunk); err != nil {
+			return nil, err
+		}
+		out = append(out, chunk...)
+		if _, err := br.Discard(2); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func s3Error(w http.ResponseWriter, r *http.Request, status int, code, bucket, key string) {
+	w.Header().Set("Content-Type", "application/xml")
+	// As MinIO does, since HEAD responses carry no error body.
+	w.Header().Set("x-minio-error-code", code)
+	w.WriteHeader(status)
+	if r.Method == http.MethodHead {
+		return
+	}
+	fmt.Fprintf(w, `<?xml version="1.0" encoding="UTF-8"?><Error><Code>%s</Code><Message>%s</Message><BucketName>%s</BucketName><Key>%s</Key></Error>`,
+		code, code, bucket, key)
+}
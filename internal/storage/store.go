@@ -3,10 +3,18 @@ package storage
 import (
 	"bytes"
 	"context"
+	"crypto/md5"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/minio/minio-go/v7/pkg/credentials"
 	"io"
+	"log"
+	"math/rand/v2"
+	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/minio/minio-go/v7"
@@ -25,6 +33,10 @@ func NewStore(ctx context.Context, endpoint, access, secret, bucket string) (*St
 	cl, err := minio.New(endpoint, &minio.Options{
 		Creds:  credentials.NewStaticV4(access, secret, ""),
 		Secure: secure,
+		// The client's own retries would absorb SlowDown with a fixed
+		// policy (and lose PUT bodies on retry); throttled applies the
+		// configured one instead.
+		MaxRetries: 1,
 	})
 	if err != nil {
 		return nil, err
@@ -42,16 +54,175 @@ func NewStore(ctx context.Context, endpoint, access, secret, bucket string) (*St
 	return s, nil
 }
 
+// Connect calls NewStore up to attempts times, sleeping a jittered,
+// doubling backoff (capped at 30s) between failures, so the proxy waits for
+// storage that is still starting instead of crash-looping.
+func Connect(ctx context.Context, endpoint, access, secret, bucket string, attempts int, backoff time.Duration) (*Store, error) {
+	if attempts < 1 {
+		attempts = 1
+	}
+	var err error
+	for i := 1; ; i++ {
+		var s *Store
+		if s, err = NewStore(ctx, endpoint, access, secret, bucket); err == nil {
+			return s, nil
+		}
+		if i >= attempts {
+			return nil, err
+		}
+		// Up to 50% jitter either way (backoff/2 to backoff*3/2) keeps
+		// replicas from hammering storage in lockstep. backoff must be
+		// positive; config rejects anything else.
+		d := backoff/2 + time.Duration(rand.Int64N(int64(backoff)+1))
+		log.Printf("storage: attempt %d/%d failed: %v (retrying in %s)", i, attempts, err, d.Round(time.Millisecond))
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(d):
+		}
+		if backoff *= 2; backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+	}
+}
+
 type Store struct {
 	client *minio.Client
 	bucket string
+
+	// MetaMaxBytes caps the size of a meta object; anything larger is treated
+	// as corrupt. Zero means cache.DefaultMetaMaxBytes.
+	MetaMaxBytes int64
+	// QuarantineMeta moves corrupt meta objects under quarantine/ instead of
+	// leaving them in place to be overwritten by the next fetch.
+	QuarantineMeta bool
+	// RecreateBucket recreates the bucket when it disappears at runtime;
+	// otherwise operations fail with ErrBucketMissing.
+	RecreateBucket bool
+	// SlowDownRetries/SlowDownBackoff retry operations that storage
+	// throttled (SlowDown, 503), doubling the backoff between attempts.
+	SlowDownRetries int
+	SlowDownBackoff time.Duration
+
+	// verifyWrites is set by EnableWriteVerification.
+	verifyWrites bool
+
+	recreateMu sync.Mutex
+}
+
+// ErrWriteCorrupt reports an upload whose ETag shows storage kept different
+// bytes than were sent.
+var ErrWriteCorrupt = errors.New("stored object does not match the body written")
+
+// writeProbeKey is written once at startup to learn whether the bucket's
+// ETags are the MD5 of the body.
+const writeProbeKey = "probes/verify-writes"
+
+// EnableWriteVerification makes PutObject compare the ETag of each upload
+// with the MD5 of the bytes sent, hashed as they stream, and delete the
+// object on a mismatch. A probe object is written first: where ETags aren't
+// body MD5s (SSE-KMS or SSE-C encryption, some gateways) verification
+// stays off and false is returned.
+func (s *Store) EnableWriteVerification(ctx context.Context) (bool, error) {
+	probe := []byte("raw-cacher write verification probe\n")
+	info, err := s.client.PutObject(ctx, s.bucket, writeProbeKey, bytes.NewReader(probe), int64(len(probe)), minio.PutObjectOptions{})
+	if err != nil {
+		return false, err
+	}
+	_ = s.client.RemoveObject(ctx, s.bucket, writeProbeKey, minio.RemoveObjectOptions{})
+	sum := md5.Sum(probe)
+	if !strings.EqualFold(strings.Trim(info.ETag, `"`), hex.EncodeToString(sum[:])) {
+		return false, nil
+	}
+	s.verifyWrites = true
+	return true, nil
+}
+
+// etagMismatch reports whether etag is a plain MD5 ETag that differs from
+// sum. Multipart ETags ("<md5>-<parts>") can't be compared and pass.
+func etagMismatch(etag string, sum []byte) bool {
+	etag = strings.Trim(etag, `"`)
+	if _, err := hex.DecodeString(etag); err != nil || len(etag) != 2*md5.Size {
+		return false
+	}
+	return !strings.EqualFold(etag, hex.EncodeToString(sum))
+}
+
+// isSlowDown reports whether err is storage asking clients to back off.
+func isSlowDown(err error) bool {
+	if err == nil {
+		return false
+	}
+	resp := minio.ToErrorResponse(err)
+	switch resp.Code {
+	case "SlowDown", "SlowDownRead", "SlowDownWrite":
+		return true
+	}
+	return resp.StatusCode == http.StatusServiceUnavailable
+}
+
+// throttled runs op, retrying it while storage answers SlowDown. It gives
+// up early if ctx is done.
+func (s *Store) throttled(ctx context.Context, op func() error) error {
+	backoff := s.SlowDownBackoff
+	err := op()
+	for i := 0; isSlowDown(err) && i < s.SlowDownRetries; i++ {
+		select {
+		case <-ctx.Done():
+			return err
+		case <-time.After(backoff):
+		}
+		backoff *= 2
+		err = op()
+	}
+	return err
+}
+
+// ErrBucketMissing is returned when the bucket was deleted while running
+// and is not being recreated.
+var ErrBucketMissing = errors.New("storage bucket missing")
+
+func isNoSuchBucket(err error) bool {
+	return err != nil && minio.ToErrorResponse(err).Code == "NoSuchBucket"
+}
+
+// bucketMissing handles a NoSuchBucket error. With RecreateBucket it makes
+// the bucket again, as NewStore does at boot, and reports that the
+// operation may be retried; otherwise, or if that fails, it returns an
+// error wrapping ErrBucketMissing.
+func (s *Store) bucketMissing(ctx context.Context) (retry bool, err error) {
+	if !s.RecreateBucket {
+		log.Printf("storage: BUCKET %s IS MISSING", s.bucket)
+		return false, fmt.Errorf("%w: %s", ErrBucketMissing, s.bucket)
+	}
+	s.recreateMu.Lock()
+	defer s.recreateMu.Unlock()
+	exists, err := s.client.BucketExists(ctx, s.bucket)
+	if err == nil && !exists {
+		if err = s.client.MakeBucket(ctx, s.bucket, minio.MakeBucketOptions{}); err == nil {
+			log.Printf("storage: bucket %s was missing, recreated it", s.bucket)
+		}
+	}
+	if err != nil {
+		log.Printf("storage: BUCKET %s IS MISSING, recreate failed: %v", s.bucket, err)
+		return false, fmt.Errorf("%w: %s: %v", ErrBucketMissing, s.bucket, err)
+	}
+	return true, nil
 }
 
 func (s *Store) HasObject(ctx context.Context, key string) (bool, error) {
-	_, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	err := s.throttled(ctx, func() error {
+		_, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+		return err
+	})
 	if err != nil {
+		if isNoSuchBucket(err) {
+			// A recreated bucket is empty.
+			_, err := s.bucketMissing(ctx)
+			return false, err
+		}
 		resp := minio.ToErrorResponse(err)
-		if resp.Code == "NoSuchKey" || resp.Code == "NoSuchBucket" || resp.StatusCode == 404 {
+		if resp.Code == "NoSuchKey" || resp.StatusCode == 404 {
 			return false, nil
 		}
 		return false, err
@@ -59,9 +230,71 @@ func (s *Store) HasObject(ctx context.Context, key string) (bool, error) {
 	return true, nil
 }
 
+// ObjectETag returns the ETag MinIO computed for key; ok is false if the
+// object doesn't exist.
+func (s *Store) ObjectETag(ctx context.Context, key string) (string, bool, error) {
+	var st minio.ObjectInfo
+	err := s.throttled(ctx, func() (err error) {
+		st, err = s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+		return err
+	})
+	if err != nil {
+		if isNoSuchBucket(err) {
+			_, err := s.bucketMissing(ctx)
+			return "", false, err
+		}
+		resp := minio.ToErrorResponse(err)
+		if resp.Code == "NoSuchKey" || resp.StatusCode == 404 {
+			return "", false, nil
+		}
+		return "", false, err
+	}
+	return st.ETag, true, nil
+}
+
+// PresignGet returns a time-limited URL clients can use to download key
+// straight from MinIO.
+func (s *Store) PresignGet(ctx context.Context, key string, expiry time.Duration) (string, error) {
+	u, err := s.client.PresignedGetObject(ctx, s.bucket, key, expiry, nil)
+	if err != nil {
+		return "", err
+	}
+	return u.String(), nil
+}
+
+// PresignerOf returns the Store behind b that can presign downloads for it:
+// b itself, or the primary under wrappers that store bodies unchanged
+// (replicas, the disk tier, the hot cache). Wrappers that transform bodies
+// (compression, dedup) have none, since a presigned URL would bypass them.
+func PresignerOf(b Backend) (*Store, bool) {
+	for {
+		switch v := b.(type) {
+		case *Store:
+			return v, true
+		case *ReplicatedStore:
+			b = v.Backend
+		case *TieredStore:
+			b = v.Backend
+		case *HotStore:
+			b = v.Backend
+		default:
+			return nil, false
+		}
+	}
+}
+
 func (s *Store) GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error) {
-	st, err := s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+	var st minio.ObjectInfo
+	err := s.throttled(ctx, func() (err error) {
+		st, err = s.client.StatObject(ctx, s.bucket, key, minio.StatObjectOptions{})
+		return err
+	})
 	if err != nil {
+		if isNoSuchBucket(err) {
+			if _, berr := s.bucketMissing(ctx); berr != nil {
+				err = berr
+			}
+		}
 		return nil, 0, nil, err
 	}
 	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
@@ -83,39 +316,154 @@ func (s *Store) PutObject(ctx context.Context, key string, data []byte, contentT
 	if contentType != "" {
 		opts.ContentType = contentType
 	}
-	_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(data), int64(len(data)), opts)
+	put := func() error {
+		h := md5.New()
+		info, err := s.client.PutObject(ctx, s.bucket, key, io.TeeReader(bytes.NewReader(data), h), int64(len(data)), opts)
+		if err != nil || !s.verifyWrites || !etagMismatch(info.ETag, h.Sum(nil)) {
+			return err
+		}
+		_ = s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+		return fmt.Errorf("%w: %s", ErrWriteCorrupt, key)
+	}
+	err := s.throttled(ctx, put)
+	if isNoSuchBucket(err) {
+		var retry bool
+		if retry, err = s.bucketMissing(ctx); retry {
+			err = s.throttled(ctx, put)
+		}
+	}
+	return err
+}
+
+func (s *Store) DeleteObject(ctx context.Context, key string) error {
+	err := s.throttled(ctx, func() error {
+		return s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{})
+	})
+	if isNoSuchBucket(err) {
+		_, err = s.bucketMissing(ctx)
+		return err
+	}
+	if err != nil {
+		resp := minio.ToErrorResponse(err)
+		if resp.Code == "NoSuchKey" || resp.StatusCode == 404 {
+			return nil
+		}
+	}
 	return err
 }
 
+// ListKeys calls fn for every key under prefix, stopping at the first error.
+func (s *Store) ListKeys(ctx context.Context, prefix string, fn func(key string) error) error {
+	for obj := range s.client.ListObjects(ctx, s.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if obj.Err != nil {
+			if isNoSuchBucket(obj.Err) {
+				_, err := s.bucketMissing(ctx)
+				return err
+			}
+			return obj.Err
+		}
+		if err := fn(obj.Key); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func (s *Store) ReadMeta(ctx context.Context, key string) (cache.Meta, bool, error) {
 	var m cache.Meta
-	obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+	limit := s.MetaMaxBytes
+	if limit <= 0 {
+		limit = cache.DefaultMetaMaxBytes
+	}
+	var b []byte
+	var etag string
+	var getErr error
+	err := s.throttled(ctx, func() error {
+		obj, err := s.client.GetObject(ctx, s.bucket, key, minio.GetObjectOptions{})
+		if getErr = err; err != nil {
+			return err
+		}
+		defer obj.Close()
+		if b, err = io.ReadAll(io.LimitReader(obj, limit+1)); err != nil {
+			return err
+		}
+		// The first read cached the object info, so Stat costs no request.
+		if info, err := obj.Stat(); err == nil {
+			etag = info.ETag
+		}
+		return nil
+	})
+	if getErr != nil {
+		resp := minio.ToErrorResponse(getErr)
+		if resp.Code == "NoSuchKey" || resp.StatusCode == 404 {
+			return m, false, nil
+		}
+		return m, false, getErr
+	}
 	if err != nil {
+		if isNoSuchBucket(err) {
+			_, err := s.bucketMissing(ctx)
+			return m, false, err
+		}
 		resp := minio.ToErrorResponse(err)
 		if resp.Code == "NoSuchKey" || resp.StatusCode == 404 {
 			return m, false, nil
 		}
 		return m, false, err
 	}
-	defer obj.Close()
-	b, err := io.ReadAll(obj)
-	if err != nil {
-		return m, false, err
+	if int64(len(b)) > limit {
+		s.corruptMeta(ctx, key, etag, fmt.Errorf("exceeds %d bytes", limit))
+		return cache.Meta{}, false, nil
 	}
 	if err := json.Unmarshal(b, &m); err != nil {
-		return m, false, nil
+		s.corruptMeta(ctx, key, etag, err)
+		return cache.Meta{}, false, nil
 	}
 	return m, true, nil
 }
 
+// corruptMeta logs an unreadable meta object and, if enabled, quarantines it.
+// Callers treat the entry as absent so the next fetch rewrites it.
+//
+// The quarantine is a server-side copy of the object as read (matched by
+// etag), since ReadMeta only holds a truncated prefix of oversized meta; the
+// original is removed only once the copy has succeeded.
+func (s *Store) corruptMeta(ctx context.Context, key, etag string, cause error) {
+	log.Printf("storage: corrupt meta %s: %v", key, cause)
+	if !s.QuarantineMeta {
+		return
+	}
+	qkey := "quarantine/" + key
+	dst := minio.CopyDestOptions{Bucket: s.bucket, Object: qkey}
+	src := minio.CopySrcOptions{Bucket: s.bucket, Object: key, MatchETag: etag}
+	if _, err := s.client.CopyObject(ctx, dst, src); err != nil {
+		log.Printf("storage: quarantine %s: %v", key, err)
+		return
+	}
+	if err := s.client.RemoveObject(ctx, s.bucket, key, minio.RemoveObjectOptions{}); err != nil {
+		log.Printf("storage: remove corrupt meta %s: %v", key, err)
+		return
+	}
+	log.Printf("storage: quarantined corrupt meta %s -> %s", key, qkey)
+}
+
 func (s *Store) WriteMeta(ctx context.Context, key string, m cache.Meta) error {
 	b, err := json.Marshal(m)
 	if err != nil {
 		return err
 	}
-	_, err = s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(b), int64(len(b)), minio.PutObjectOptions{
-		ContentType: "application/json",
-	})
+	opts := minio.PutObjectOptions{ContentType: "application/json"}
+	put := func() error {
+		_, err := s.client.PutObject(ctx, s.bucket, key, bytes.NewReader(b), int64(len(b)), opts)
+		return err
+	}
+	err = s.throttled(ctx, put)
+	if isNoSuchBucket(err) {
+		var retry bool
+		if retry, err = s.bucketMissing(ctx); retry {
+			err = s.throttled(ctx, put)
+		}
+	}
 	return err
 }
 
@@ -0,0 +1,407 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"crypto/md5"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/yourname/raw-cacher-go/internal/cache"
+)
+
+// captureLog redirects the standard logger for the rest of the test.
+func captureLog(t *testing.T) *bytes.Buffer {
+	t.Helper()
+	var buf bytes.Buffer
+	prev := log.Writer()
+	log.SetOutput(&buf)
+	t.Cleanup(func() { log.SetOutput(prev) })
+	return &buf
+}
+
+func TestReadMetaCorrupt(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       []byte
+		quarantine bool
+		copyFails  bool
+	}{
+		{"not json", []byte("{not json"), false, false},
+		{"oversized", []byte(`{"cached_at":"` + strings.Repeat("x", 200) + `"}`), false, false},
+		{"not json, quarantined", []byte("\x00\x01garbage"), true, false},
+		{"oversized, quarantined", []byte(`{"cached_at":"` + strings.Repeat("x", 200) + `"}`), true, false},
+		{"quarantine copy fails", []byte("{not json"), true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, f := newTestStore(t)
+			s.MetaMaxBytes = 128
+			s.QuarantineMeta = tt.quarantine
+			logs := captureLog(t)
+			const key = "v1/example.com/a.txt.json"
+			f.put("cache", key, tt.body)
+			if tt.copyFails {
+				f.setFail(func(r *http.Request) (string, int) {
+					if r.Header.Get("X-Amz-Copy-Source") != "" {
+						return "AccessDenied", http.StatusForbidden
+					}
+					return "", 0
+				})
+			}
+
+			if _, ok, err := s.ReadMeta(ctx, key); ok || err != nil {
+				t.Fatalf("ReadMeta = ok %v, err %v; want absent", ok, err)
+			}
+			if !strings.Contains(logs.String(), "corrupt meta "+key) {
+				t.Errorf("corrupt meta not logged: %q", logs.String())
+			}
+			wantQuarantined := tt.quarantine && !tt.copyFails
+			q, quarantined := f.object("cache", "quarantine/"+key)
+			if quarantined != wantQuarantined {
+				t.Errorf("quarantined = %v, want %v", quarantined, wantQuarantined)
+			}
+			if quarantined && !bytes.Equal(q, tt.body) {
+				t.Errorf("quarantined body = %q, want %q", q, tt.body)
+			}
+			// The original goes only once its copy is safely in quarantine.
+			if orig, ok := f.object("cache", key); ok == wantQuarantined || (ok && !bytes.Equal(orig, tt.body)) {
+				t.Errorf("original = %q, present %v; want present %v", orig, ok, !wantQuarantined)
+			}
+			f.setFail(nil)
+
+			// The refetch that follows replaces it.
+			want := cache.Meta{CachedAt: cache.NowISO(), TTL: 60}
+			if err := s.WriteMeta(ctx, key, want); err != nil {
+				t.Fatal(err)
+			}
+			got, ok, err := s.ReadMeta(ctx, key)
+			if err != nil || !ok || got.CachedAt != want.CachedAt || got.TTL != want.TTL {
+				t.Errorf("after rewrite ReadMeta = %+v, %v, %v", got, ok, err)
+			}
+		})
+	}
+}
+
+func TestConnectRetries(t *testing.T) {
+	tests := []struct {
+		name      string
+		fails     int
+		attempts  int
+		wantErr   bool
+		wantTries int
+	}{
+		{"up at once", 0, 3, false, 1},
+		{"up after two failures", 2, 3, false, 3},
+		{"never up in time", 5, 3, true, 3},
+		{"at least one attempt", 1, 0, true, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f, endpoint := newFakeS3(t)
+			captureLog(t)
+			var checks atomic.Int32
+			f.setFail(func(r *http.Request) (string, int) {
+				// Each attempt starts by looking up the bucket's location.
+				if !r.URL.Query().Has("location") {
+					return "", 0
+				}
+				if int(checks.Add(1)) <= tt.fails {
+					return "InvalidAccessKeyId", http.StatusForbidden
+				}
+				return "", 0
+			})
+			s, err := Connect(context.Background(), endpoint, "access", "secret", "cache", tt.attempts, time.Millisecond)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("Connect err = %v, want error %v", err, tt.wantErr)
+			}
+			if n := int(checks.Load()); n != tt.wantTries {
+				t.Errorf("%d attempts, want %d", n, tt.wantTries)
+			}
+			if err == nil {
+				if ok, err := s.client.BucketExists(context.Background(), "cache"); err != nil || !ok {
+					t.Errorf("bucket exists = %v, %v", ok, err)
+				}
+			}
+		})
+	}
+}
+
+func TestPresignerOf(t *testing.T) {
+	ctx := context.Background()
+	s, _ := newTestStore(t)
+	disk, err := NewFSStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	tiered, err := NewTieredStore(ctx, s, disk, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	zstd, err := NewCompressor("zstd", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		b    Backend
+		want bool
+	}{
+		{"store", s, true},
+		{"replicated", NewReplicatedStore(s, disk), true},
+		{"tiered", tiered, true},
+		{"hot over replicated", NewHotStore(NewReplicatedStore(s), 1<<20, 1<<10), true},
+		{"dedup", NewDedupStore(s), false},
+		{"compressed", NewCompressStore(s, zstd), false},
+		{"hot over dedup", NewHotStore(NewDedupStore(s), 1<<20, 1<<10), false},
+		{"disk only", disk, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, ok := PresignerOf(tt.b)
+			if ok != tt.want || (ok && got != s) {
+				t.Fatalf("PresignerOf = %p, %v; want store %v", got, ok, tt.want)
+			}
+			if !ok {
+				return
+			}
+			u, err := got.PresignGet(ctx, "v1/example.com/a.txt", time.Minute)
+			if err != nil || !strings.Contains(u, "/cache/v1/example.com/a.txt?") || !strings.Contains(u, "X-Amz-Expires=60") {
+				t.Errorf("PresignGet = %q, %v", u, err)
+			}
+		})
+	}
+}
+
+func TestBucketMissing(t *testing.T) {
+	ops := []struct {
+		name string
+		op   func(ctx context.Context, s *Store) error
+		// stored is the key the operation leaves behind once the bucket is
+		// recreated, if any.
+		stored string
+	}{
+		{"HasObject", func(ctx context.Context, s *Store) error { _, err := s.HasObject(ctx, "a"); return err }, ""},
+		{"ObjectETag", func(ctx context.Context, s *Store) error { _, _, err := s.ObjectETag(ctx, "a"); return err }, ""},
+		{"ReadMeta", func(ctx context.Context, s *Store) error { _, _, err := s.ReadMeta(ctx, "a.json"); return err }, ""},
+		{"DeleteObject", func(ctx context.Context, s *Store) error { return s.DeleteObject(ctx, "a") }, ""},
+		{"ListKeys", func(ctx context.Context, s *Store) error {
+			return s.ListKeys(ctx, "", func(string) error { return nil })
+		}, ""},
+		{"PutObject", func(ctx context.Context, s *Store) error { return s.PutObject(ctx, "a", []byte("body"), "text/plain") }, "a"},
+		{"WriteMeta", func(ctx context.Context, s *Store) error { return s.WriteMeta(ctx, "a.json", cache.Meta{TTL: 60}) }, "a.json"},
+	}
+	for _, op := range ops {
+		for _, recreate := range []bool{false, true} {
+			t.Run(fmt.Sprintf("%s/recreate=%v", op.name, recreate), func(t *testing.T) {
+				ctx := context.Background()
+				s, f := newTestStore(t)
+				s.RecreateBucket = recreate
+				logs := captureLog(t)
+				f.put("cache", "a", []byte("old"))
+				f.dropBucket("cache")
+
+				err := op.op(ctx, s)
+				if got := errors.Is(err, ErrBucketMissing); got == recreate {
+					t.Fatalf("err = %v, want ErrBucketMissing %v", err, !recreate)
+				}
+				if recreate && err != nil {
+					t.Fatalf("err = %v after recreating", err)
+				}
+				if !recreate && !strings.Contains(logs.String(), "BUCKET cache IS MISSING") {
+					t.Errorf("missing bucket not logged: %q", logs.String())
+				}
+				f.mu.Lock()
+				_, exists := f.buckets["cache"]
+				f.mu.Unlock()
+				if exists != recreate {
+					t.Errorf("bucket exists = %v, want %v", exists, recreate)
+				}
+				// /healthz reports down until the bucket is back.
+				if err := s.Ping(ctx); (err == nil) != recreate {
+					t.Errorf("Ping = %v with recreate %v", err, recreate)
+				}
+				// A write is retried into the new bucket; nothing old survives.
+				if _, ok := f.object("cache", op.stored); recreate && op.stored != "" && !ok {
+					t.Errorf("%s not written after recreating", op.stored)
+				}
+				if _, ok := f.object("cache", "a"); ok && op.stored != "a" {
+					t.Error("old object survived")
+				}
+			})
+		}
+	}
+}
+
+func TestSlowDown(t *testing.T) {
+	tests := []struct {
+		name      string
+		code      string
+		status    int
+		fails     int
+		retries   int
+		wantErr   bool
+		wantPuts  int
+		wantSleep time.Duration // at least, from the doubling backoff
+		deadline  time.Duration // on the context, if set; backoff is then an hour
+	}{
+		{"recovers", "SlowDown", http.StatusServiceUnavailable, 2, 3, false, 3, 30 * time.Millisecond, 0},
+		{"plain 503", "ServiceUnavailable", http.StatusServiceUnavailable, 1, 3, false, 2, 10 * time.Millisecond, 0},
+		{"gives up", "SlowDown", http.StatusServiceUnavailable, 5, 2, true, 3, 30 * time.Millisecond, 0},
+		{"retries off", "SlowDown", http.StatusServiceUnavailable, 1, 0, true, 1, 0, 0},
+		{"other errors not retried", "AccessDenied", http.StatusForbidden, 1, 3, true, 1, 0, 0},
+		{"context ends during backoff", "SlowDown", http.StatusServiceUnavailable, 5, 3, true, 1, 0, 50 * time.Millisecond},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, f := newTestStore(t)
+			s.SlowDownRetries = tt.retries
+			s.SlowDownBackoff = 10 * time.Millisecond
+			ctx := context.Background()
+			if tt.deadline > 0 {
+				s.SlowDownBackoff = time.Hour
+				var cancel context.CancelFunc
+				ctx, cancel = context.WithTimeout(ctx, tt.deadline)
+				defer cancel()
+			}
+			var puts atomic.Int32
+			f.setFail(func(r *http.Request) (string, int) {
+				if r.Method == http.MethodPut && int(puts.Add(1)) <= tt.fails {
+					return tt.code, tt.status
+				}
+				return "", 0
+			})
+			start := time.Now()
+			err := s.PutObject(ctx, "k", []byte("body"), "text/plain")
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("PutObject err = %v, want error %v", err, tt.wantErr)
+			}
+			if n := int(puts.Load()); n != tt.wantPuts {
+				t.Errorf("%d PUT attempts, want %d", n, tt.wantPuts)
+			}
+			if took := time.Since(start); took < tt.wantSleep || (tt.deadline > 0 && took > time.Second) {
+				t.Errorf("took %v, want at least %v of backoff", took, tt.wantSleep)
+			}
+			if b, ok := f.object("cache", "k"); ok != !tt.wantErr || (ok && string(b) != "body") {
+				t.Errorf("stored %q, %v", b, ok)
+			}
+		})
+	}
+}
+
+func TestEtagMismatch(t *testing.T) {
+	sum := md5.Sum([]byte("body"))
+	hexSum := hex.EncodeToString(sum[:])
+	other := md5.Sum([]byte("other"))
+	tests := []struct {
+		name string
+		etag string
+		want bool
+	}{
+		{"matching", hexSum, false},
+		{"matching, quoted", `"` + hexSum + `"`, false},
+		{"matching, upper case", strings.ToUpper(hexSum), false},
+		{"different", hex.EncodeToString(other[:]), true},
+		{"different, quoted", `"` + hex.EncodeToString(other[:]) + `"`, true},
+		{"multipart", hexSum[:30] + "ab-3", false},
+		{"not hex", strings.Repeat("z", 32), false},
+		{"wrong length", hexSum[:16], false},
+		{"empty", "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := etagMismatch(tt.etag, sum[:]); got != tt.want {
+				t.Errorf("etagMismatch(%q) = %v, want %v", tt.etag, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnableWriteVerification(t *testing.T) {
+	tests := []struct {
+		name    string
+		etag    func(key string, body []byte) string
+		fail    bool
+		want    bool
+		wantErr bool
+	}{
+		{"MD5 ETags", nil, false, true, false},
+		// SSE-KMS ETags look like MD5s but aren't the body's.
+		{"encrypted bucket", func(string, []byte) string { return strings.Repeat("0f", 16) }, false, false, false},
+		{"opaque ETags", func(string, []byte) string { return "v1" }, false, false, false},
+		{"probe fails", nil, true, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s, f := newTestStore(t)
+			f.etag = tt.etag
+			if tt.fail {
+				f.setFail(func(r *http.Request) (string, int) {
+					if r.Method == http.MethodPut {
+						return "AccessDenied", http.StatusForbidden
+					}
+					return "", 0
+				})
+			}
+			on, err := s.EnableWriteVerification(context.Background())
+			if on != tt.want || (err != nil) != tt.wantErr {
+				t.Fatalf("EnableWriteVerification = %v, %v; want %v, error %v", on, err, tt.want, tt.wantErr)
+			}
+			if s.verifyWrites != tt.want {
+				t.Errorf("verifyWrites = %v, want %v", s.verifyWrites, tt.want)
+			}
+			if _, ok := f.object("cache", writeProbeKey); ok {
+				t.Error("probe object left behind")
+			}
+		})
+	}
+}
+
+func TestVerifyWrites(t *testing.T) {
+	flip := func(_ string, body []byte) []byte {
+		out := bytes.Clone(body)
+		out[0] ^= 1
+		return out
+	}
+	tests := []struct {
+		name       string
+		verify     bool
+		mangle     func(key string, body []byte) []byte
+		etag       func(key string, body []byte) string
+		wantErr    bool
+		wantStored string // "" for nothing left behind
+	}{
+		{"intact", true, nil, nil, false, "body"},
+		{"corrupted", true, flip, nil, true, ""},
+		{"corrupted, unverified", false, flip, nil, false, "cody"},
+		{"corrupted, multipart ETag", true, flip, func(string, []byte) string { return strings.Repeat("ab", 16) + "-2" }, false, "cody"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, f := newTestStore(t)
+			if tt.verify {
+				if on, err := s.EnableWriteVerification(ctx); !on || err != nil {
+					t.Fatalf("EnableWriteVerification = %v, %v", on, err)
+				}
+			}
+			f.mangle, f.etag = tt.mangle, tt.etag
+			err := s.PutObject(ctx, "objects/k", []byte("body"), "text/plain")
+			if errors.Is(err, ErrWriteCorrupt) != tt.wantErr || (!tt.wantErr && err != nil) {
+				t.Fatalf("PutObject err = %v, want write corruption %v", err, tt.wantErr)
+			}
+			b, ok := f.object("cache", "objects/k")
+			if got := string(b); ok != (tt.wantStored != "") || got != tt.wantStored {
+				t.Errorf("stored %q (%v), want %q", got, ok, tt.wantStored)
+			}
+		})
+	}
+}
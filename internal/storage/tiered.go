@@ -0,0 +1,257 @@
+package storage
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"io/fs"
+	"log"
+	"sort"
+	"sync"
+)
+
+// TieredStore puts a local disk tier in front of a Backend. Object reads
+// try the disk first; a disk miss streams the object to disk and serves it
+// from there, so promoting a large object doesn't hold it in memory. Writes
+// go to the backend and then the disk (write-through), and the least
+// recently used objects are demoted (removed from disk) once the tier
+// exceeds MaxBytes. Meta and listings always go to the backend, which stays
+// authoritative; the disk only holds copies.
+type TieredStore struct {
+	Backend
+	disk *FSStore
+	// MaxBytes bounds the bodies held on disk.
+	MaxBytes int64
+
+	mu    sync.Mutex
+	lru   *list.List // of *tierEntry, front is most recent
+	items map[string]*list.Element
+	size  int64
+	// fills tracks promotions in flight per key. A write or delete of the
+	// key meanwhile bumps its generation, so the promoted copy is dropped.
+	fills map[string]*tierFill
+}
+
+type tierFill struct {
+	gen  uint64
+	refs int
+}
+
+type tierEntry struct {
+	key  string
+	size int64
+}
+
+// NewTieredStore indexes what disk already holds, oldest first, so a
+// restart keeps the warm tier, then trims it to maxBytes.
+func NewTieredStore(ctx context.Context, b Backend, disk *FSStore, maxBytes int64) (*TieredStore, error) {
+	t := &TieredStore{
+		Backend:  b,
+		disk:     disk,
+		MaxBytes: maxBytes,
+		lru:      list.New(),
+		items:    make(map[string]*list.Element),
+		fills:    make(map[string]*tierFill),
+	}
+	var found []struct {
+		tierEntry
+		mod int64
+	}
+	err := disk.walk(ctx, func(key string, st fs.FileInfo) error {
+		found = append(found, struct {
+			tierEntry
+			mod int64
+		}{tierEntry{key, st.Size()}, st.ModTime().UnixNano()})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(found, func(i, j int) bool { return found[i].mod < found[j].mod })
+	for _, e := range found {
+		t.track(ctx, e.key, e.size)
+	}
+	return t, nil
+}
+
+func (t *TieredStore) HasObject(ctx context.Context, key string) (bool, error) {
+	t.mu.Lock()
+	_, ok := t.items[key]
+	t.mu.Unlock()
+	if ok {
+		return true, nil
+	}
+	return t.Backend.HasObject(ctx, key)
+}
+
+func (t *TieredStore) GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error) {
+	t.mu.Lock()
+	el, ok := t.items[key]
+	if ok {
+		t.lru.MoveToFront(el)
+	}
+	t.mu.Unlock()
+	if ok {
+		if rc, size, h, err := t.disk.GetObject(ctx, key); err == nil {
+			return rc, size, h, nil
+		}
+		t.forget(key)
+	}
+
+	// Register the fill before reading, so a write that lands while the
+	// read is in flight invalidates it.
+	f, gen := t.beginFill(key)
+	rc, size, h, err := t.Backend.GetObject(ctx, key)
+	if err != nil || size > t.MaxBytes {
+		t.endFill(key, f)
+		return rc, size, h, err
+	}
+	n, commit, discard, err := t.disk.stage(key, rc, h["Content-Type"])
+	rc.Close()
+	if err == nil && n != size {
+		discard()
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil {
+		t.endFill(key, f)
+		log.Printf("disk tier: promote %s: %v", key, err)
+		return t.Backend.GetObject(ctx, key)
+	}
+	if !t.commitFill(ctx, key, f, gen, n, commit, discard) {
+		return t.Backend.GetObject(ctx, key)
+	}
+	if rc, size, h, err := t.disk.GetObject(ctx, key); err == nil {
+		return rc, size, h, nil
+	}
+	return t.Backend.GetObject(ctx, key)
+}
+
+// PutObject and DeleteObject invalidate promotions of key both before and
+// after the backend call, so a read that overlaps the write never leaves
+// what it replaced on disk.
+func (t *TieredStore) PutObject(ctx context.Context, key string, data []byte, contentType string) error {
+	t.invalidate(key)
+	err := t.Backend.PutObject(ctx, key, data, contentType)
+	t.invalidate(key)
+	if err != nil {
+		return err
+	}
+	t.promote(ctx, key, data, contentType)
+	return nil
+}
+
+func (t *TieredStore) DeleteObject(ctx context.Context, key string) error {
+	t.evict(ctx, key)
+	defer t.evict(ctx, key)
+	return t.Backend.DeleteObject(ctx, key)
+}
+
+// evict invalidates promotions of key in flight and drops its disk copy.
+func (t *TieredStore) evict(ctx context.Context, key string) {
+	t.invalidate(key)
+	t.forget(key)
+	_ = t.disk.DeleteObject(ctx, key)
+}
+
+// beginFill registers a promotion of key and returns its generation.
+func (t *TieredStore) beginFill(key string) (*tierFill, uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	f := t.fills[key]
+	if f == nil {
+		f = &tierFill{}
+		t.fills[key] = f
+	}
+	f.refs++
+	return f, f.gen
+}
+
+// endFill unregisters a promotion; t.mu must not be held.
+func (t *TieredStore) endFill(key string, f *tierFill) {
+	t.mu.Lock()
+	t.unrefFill(key, f)
+	t.mu.Unlock()
+}
+
+// unrefFill drops a reference to f; t.mu must be held.
+func (t *TieredStore) unrefFill(key string, f *tierFill) {
+	if f.refs--; f.refs == 0 {
+		delete(t.fills, key)
+	}
+}
+
+// commitFill moves a staged promotion of key into place unless key was
+// written or deleted since it began, and reports whether it did.
+func (t *TieredStore) commitFill(ctx context.Context, key string, f *tierFill, gen uint64, size int64, commit func() error, discard func()) bool {
+	t.mu.Lock()
+	t.unrefFill(key, f)
+	if f.gen != gen {
+		t.mu.Unlock()
+		discard()
+		return false
+	}
+	err := commit()
+	t.mu.Unlock()
+	if err != nil {
+		discard()
+		log.Printf("disk tier: promote %s: %v", key, err)
+		return false
+	}
+	t.track(ctx, key, size)
+	return true
+}
+
+// invalidate marks promotions of key in flight as stale.
+func (t *TieredStore) invalidate(key string) {
+	t.mu.Lock()
+	if f := t.fills[key]; f != nil {
+		f.gen++
+	}
+	t.mu.Unlock()
+}
+
+// promote copies an object to disk. Failures only cost a later disk hit.
+func (t *TieredStore) promote(ctx context.Context, key string, data []byte, contentType string) {
+	if int64(len(data)) > t.MaxBytes {
+		t.forget(key)
+		_ = t.disk.DeleteObject(ctx, key)
+		return
+	}
+	if err := t.disk.PutObject(ctx, key, data, contentType); err != nil {
+		log.Printf("disk tier: write %s: %v", key, err)
+		t.forget(key)
+		return
+	}
+	t.track(ctx, key, int64(len(data)))
+}
+
+// track records key as most recently used and demotes the coldest objects
+// until the tier fits MaxBytes.
+func (t *TieredStore) track(ctx context.Context, key string, size int64) {
+	var demote []string
+	t.mu.Lock()
+	if el, ok := t.items[key]; ok {
+		t.size -= t.lru.Remove(el).(*tierEntry).size
+	}
+	t.items[key] = t.lru.PushFront(&tierEntry{key: key, size: size})
+	t.size += size
+	for t.size > t.MaxBytes && t.lru.Len() > 1 {
+		e := t.lru.Remove(t.lru.Back()).(*tierEntry)
+		delete(t.items, e.key)
+		t.size -= e.size
+		demote = append(demote, e.key)
+	}
+	t.mu.Unlock()
+	for _, k := range demote {
+		_ = t.disk.DeleteObject(ctx, k)
+	}
+}
+
+func (t *TieredStore) forget(key string) {
+	t.mu.Lock()
+	if el, ok := t.items[key]; ok {
+		t.size -= t.lru.Remove(el).(*tierEntry).size
+		delete(t.items, key)
+	}
+	t.mu.Unlock()
+}
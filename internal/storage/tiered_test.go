@@ -0,0 +1,237 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"sort"
+	"testing"
+)
+
+func TestTieredStore(t *testing.T) {
+	tests := []struct {
+		name     string
+		maxBytes int64
+		seeded   []string // in MinIO only
+		written  []string // through the tier
+		deleted  []string
+		restart  bool // reopen the tier on the same disk before reading
+		reads    []string
+		wantGets int      // MinIO object reads during reads
+		wantDisk []string // on disk afterwards
+	}{
+		{"disk hit", 1 << 20, nil, []string{"a"}, nil, false, []string{"a", "a"}, 0, []string{"a"}},
+		{"disk miss promotes", 1 << 20, []string{"a"}, nil, nil, false, []string{"a", "a"}, 1, []string{"a"}},
+		{"too large for the tier", 5, []string{"a"}, nil, nil, false, []string{"a", "a"}, 2, []string{}},
+		{"coldest demoted", 20, nil, []string{"a", "b", "c"}, nil, false, []string{"c"}, 0, []string{"b", "c"}},
+		{"read refreshes recency", 20, []string{"a", "b"}, nil, nil, false, []string{"a", "b", "a", "c"}, 3, []string{"a", "c"}},
+		{"delete drops the copy", 1 << 20, nil, []string{"a"}, []string{"a"}, false, nil, 0, []string{}},
+		{"restart keeps the tier", 1 << 20, nil, []string{"a", "b"}, nil, true, []string{"a", "b"}, 0, []string{"a", "b"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, f := newTestStore(t)
+			disk, err := NewFSStore(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			tier, err := NewTieredStore(ctx, s, disk, tt.maxBytes)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, k := range []string{"a", "b", "c"} {
+				f.put("cache", "objects/"+k, []byte("body of "+k))
+			}
+			for _, k := range tt.written {
+				if err := tier.PutObject(ctx, "objects/"+k, []byte("body of "+k), "text/plain"); err != nil {
+					t.Fatal(err)
+				}
+			}
+			for _, k := range tt.deleted {
+				if err := tier.DeleteObject(ctx, "objects/"+k); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if tt.restart {
+				if tier, err = NewTieredStore(ctx, s, disk, tt.maxBytes); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			gets := f.count("GET")
+			for _, k := range tt.reads {
+				rc, _, h, err := tier.GetObject(ctx, "objects/"+k)
+				if err != nil {
+					t.Fatalf("GetObject(%s): %v", k, err)
+				}
+				b, _ := io.ReadAll(rc)
+				rc.Close()
+				if string(b) != "body of "+k {
+					t.Errorf("%s = %q", k, b)
+				}
+				if h["Content-Type"] == "" {
+					t.Errorf("%s served without a content type", k)
+				}
+			}
+			if n := f.count("GET") - gets; n != tt.wantGets {
+				t.Errorf("%d MinIO reads, want %d", n, tt.wantGets)
+			}
+			onDisk := []string{}
+			_ = disk.ListKeys(ctx, "objects/", func(key string) error {
+				onDisk = append(onDisk, key[len("objects/"):])
+				return nil
+			})
+			sort.Strings(onDisk)
+			if fmt.Sprint(onDisk) != fmt.Sprint(tt.wantDisk) {
+				t.Errorf("on disk %v, want %v", onDisk, tt.wantDisk)
+			}
+			// MinIO stays authoritative.
+			for _, k := range tt.written {
+				if _, ok := f.object("cache", "objects/"+k); ok == contains(tt.deleted, k) {
+					t.Errorf("%s in MinIO: %v", k, ok)
+				}
+			}
+		})
+	}
+}
+
+// TestTieredFillOvertaken checks a promotion racing a write of the same key
+// leaves the newer body on disk, not the promoted one.
+func TestTieredFillOvertaken(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    bool
+		wantBody string
+	}{
+		{"overtaken by a write", true, "new"},
+		{"uncontested", false, "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, f := newTestStore(t)
+			disk, _ := NewFSStore(t.TempDir())
+			tier, err := NewTieredStore(ctx, s, disk, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.put("cache", "k", []byte("old"))
+			rc, size, h, _ := s.GetObject(ctx, "k")
+			fill, gen := tier.beginFill("k")
+			n, commit, discard, err := disk.stage("k", rc, h["Content-Type"])
+			rc.Close()
+			if err != nil || n != size {
+				t.Fatalf("stage = %d, %v", n, err)
+			}
+			if tt.write {
+				_ = tier.PutObject(ctx, "k", []byte("new"), "text/plain")
+			}
+			if got := tier.commitFill(ctx, "k", fill, gen, n, commit, discard); got == tt.write {
+				t.Errorf("commitFill = %v", got)
+			}
+			rc, _, _, err = disk.GetObject(ctx, "k")
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(rc)
+			rc.Close()
+			if string(b) != tt.wantBody {
+				t.Errorf("disk holds %q, want %q", b, tt.wantBody)
+			}
+			if len(tier.fills) != 0 {
+				t.Errorf("%d fills left registered", len(tier.fills))
+			}
+		})
+	}
+}
+
+// midReadBackend runs onGet once, after its first GetObject has read the
+// object and before the caller gets it.
+type midReadBackend struct {
+	Backend
+	onGet func()
+}
+
+func (b *midReadBackend) GetObject(ctx context.Context, key string) (io.ReadCloser, int64, map[string]string, error) {
+	rc, size, h, err := b.Backend.GetObject(ctx, key)
+	if err != nil {
+		return rc, size, h, err
+	}
+	body, err := io.ReadAll(rc)
+	rc.Close()
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	if b.onGet != nil {
+		fn := b.onGet
+		b.onGet = nil
+		fn()
+	}
+	return io.NopCloser(bytes.NewReader(body)), size, h, nil
+}
+
+// TestTieredWriteDuringPromotion interleaves a write with a disk-miss
+// promotion through GetObject: the body it read must not end up on disk.
+func TestTieredWriteDuringPromotion(t *testing.T) {
+	tests := []struct {
+		name     string
+		write    func(ctx context.Context, tier *TieredStore) error
+		wantDisk string // "" for no copy
+	}{
+		{"put", func(ctx context.Context, tier *TieredStore) error {
+			return tier.PutObject(ctx, "k", []byte("new"), "text/plain")
+		}, "new"},
+		{"delete", func(ctx context.Context, tier *TieredStore) error {
+			return tier.DeleteObject(ctx, "k")
+		}, ""},
+		{"no write", nil, "old"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx := context.Background()
+			s, f := newTestStore(t)
+			disk, _ := NewFSStore(t.TempDir())
+			b := &midReadBackend{Backend: s}
+			tier, err := NewTieredStore(ctx, b, disk, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.put("cache", "k", []byte("old"))
+			if tt.write != nil {
+				b.onGet = func() {
+					if err := tt.write(ctx, tier); err != nil {
+						t.Errorf("write: %v", err)
+					}
+				}
+			}
+			// After a delete the read itself may fail; only the disk matters.
+			if rc, _, _, err := tier.GetObject(ctx, "k"); err == nil {
+				rc.Close()
+			}
+
+			got := ""
+			if rc, _, _, err := disk.GetObject(ctx, "k"); err == nil {
+				body, _ := io.ReadAll(rc)
+				rc.Close()
+				got = string(body)
+			}
+			if got != tt.wantDisk {
+				t.Errorf("disk holds %q, want %q", got, tt.wantDisk)
+			}
+			if len(tier.fills) != 0 {
+				t.Errorf("%d fills left registered", len(tier.fills))
+			}
+		})
+	}
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}